@@ -0,0 +1,21 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// Appeal 被禁用用户提交的申诉
+type Appeal struct {
+	ID     uint `gorm:"primary_key"`
+	UserID uint `gorm:"index"`
+	// Token 登录时发放，凭此提交申诉
+	Token       string `gorm:"unique_index"`
+	Message     string `gorm:"type:text"`
+	CreatedAt   time.Time
+	SubmittedAt *time.Time
+}
+
+// Submitted 是否已提交
+func (a *Appeal) Submitted() bool {
+	return a.SubmittedAt != nil
+}
@@ -0,0 +1,13 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// ClientAuthFailure 令牌端点客户端认证失败记录
+type ClientAuthFailure struct {
+	ID        uint   `gorm:"primary_key"`
+	ClientID  string `gorm:"index"`
+	IP        string
+	CreatedAt time.Time `gorm:"index"`
+}
@@ -0,0 +1,14 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// ClientRegistration 动态注册（RFC 7591）的应用，注册访问令牌只保存哈希，用于之后读取、更新、删除注册信息（RFC 7592）
+type ClientRegistration struct {
+	ClientID  string `gorm:"primary_key"`
+	TokenHash string `gorm:"unique_index"`
+	IP        string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
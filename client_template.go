@@ -0,0 +1,79 @@
+package ucenter
+
+// ClientTemplate 应用模板，创建应用时预填并限制授权类型、scope、令牌有效期、PKCE 及 PAR
+type ClientTemplate struct {
+	Name                 string   `mapstructure:"name"`                       //显示名称
+	GrantTypes           []string `mapstructure:"grant_types"`                //允许的授权类型
+	ResponseTypes        []string `mapstructure:"response_types"`             //允许的输出类型
+	DefaultScope         string   `mapstructure:"default_scope"`              //默认 scope，空格分隔
+	MaxScope             string   `mapstructure:"max_scope"`                  //可申请的最大 scope，空格分隔
+	AuthMethod           string   `mapstructure:"token_endpoint_auth_method"` //令牌端点认证方式，none 为公开客户端
+	AccessTokenLifespan  int      `mapstructure:"access_token_lifespan"`      //访问令牌有效期（分钟），0 使用系统默认
+	RefreshTokenLifespan int      `mapstructure:"refresh_token_lifespan"`     //刷新令牌有效期（小时），0 不限制
+	RequirePKCE          bool     `mapstructure:"require_pkce"`               //授权码流程必须使用 PKCE
+	RequirePAR           bool     `mapstructure:"require_par"`                //授权请求必须先提交到 PAR 端点
+	Machine              bool     `mapstructure:"machine"`                    //机器应用，可使用 client_credentials，scope 由 RAM 策略限制，不能是公开客户端
+}
+
+// DefaultClientTemplates 未配置 client_templates 时使用的内置模板
+var DefaultClientTemplates = map[string]ClientTemplate{
+	"web": {
+		Name:                 "网站应用",
+		GrantTypes:           []string{"authorization_code", "refresh_token"},
+		ResponseTypes:        []string{"code"},
+		DefaultScope:         "profile openid",
+		MaxScope:             "profile openid",
+		AuthMethod:           "client_secret_basic",
+		AccessTokenLifespan:  60,
+		RefreshTokenLifespan: 24 * 30,
+	},
+	"spa": {
+		Name:                "单页应用",
+		GrantTypes:          []string{"authorization_code"},
+		ResponseTypes:       []string{"code"},
+		DefaultScope:        "profile openid",
+		MaxScope:            "profile openid",
+		AuthMethod:          "none",
+		AccessTokenLifespan: 15,
+		RequirePKCE:         true,
+	},
+	"native": {
+		Name:                 "客户端应用",
+		GrantTypes:           []string{"authorization_code", "refresh_token"},
+		ResponseTypes:        []string{"code"},
+		DefaultScope:         "profile openid",
+		MaxScope:             "profile openid",
+		AuthMethod:           "none",
+		AccessTokenLifespan:  30,
+		RefreshTokenLifespan: 24 * 90,
+		RequirePKCE:          true,
+	},
+	"device": {
+		Name:                 "设备应用",
+		GrantTypes:           []string{"urn:ietf:params:oauth:grant-type:device_code", "refresh_token"},
+		DefaultScope:         "profile openid",
+		MaxScope:             "profile openid",
+		AuthMethod:           "none",
+		AccessTokenLifespan:  30,
+		RefreshTokenLifespan: 24 * 90,
+	},
+	"miniprogram": {
+		Name:                 "微信小程序",
+		GrantTypes:           []string{"urn:ucenter:params:oauth:grant-type:wechat-mini-program", "refresh_token"},
+		DefaultScope:         "profile openid",
+		MaxScope:             "profile openid",
+		AuthMethod:           "none",
+		AccessTokenLifespan:  30,
+		RefreshTokenLifespan: 24 * 30,
+	},
+	"service": {
+		Name:                "服务端应用",
+		GrantTypes:          []string{"client_credentials"},
+		ResponseTypes:       []string{"token"},
+		DefaultScope:        "",
+		MaxScope:            "",
+		AuthMethod:          "client_secret_basic",
+		AccessTokenLifespan: 60,
+		Machine:             true,
+	},
+}
@@ -1,9 +1,53 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	"github.com/naiba/ucenter/engine"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		// ucenter upgrade 升级数据库
+		case "upgrade":
+			err = engine.Upgrade(os.Stdout)
+		// ucenter backup <文件> 生成加密备份
+		case "backup":
+			if len(os.Args) != 3 {
+				err = fmt.Errorf("用法: %s backup <文件>", os.Args[0])
+			} else {
+				err = engine.Backup(os.Stdout, os.Args[2])
+			}
+		// ucenter restore [-force] [-dry-run] <文件> 从备份恢复
+		case "restore":
+			fs := flag.NewFlagSet("restore", flag.ExitOnError)
+			force := fs.Bool("force", false, "覆盖已有数据")
+			dryRun := fs.Bool("dry-run", false, "只列出将被覆盖的内容，不做修改")
+			fs.Parse(os.Args[2:])
+			if fs.NArg() != 1 {
+				err = fmt.Errorf("用法: %s restore [-force] [-dry-run] <文件>", os.Args[0])
+			} else {
+				err = engine.Restore(os.Stdout, fs.Arg(0), *force, *dryRun)
+			}
+		// ucenter check [-repair] 检查孤立记录
+		case "check":
+			fs := flag.NewFlagSet("check", flag.ExitOnError)
+			repair := fs.Bool("repair", false, "删除孤立记录")
+			fs.Parse(os.Args[2:])
+			err = engine.Check(os.Stdout, *repair)
+		default:
+			engine.ServWeb()
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	engine.ServWeb()
 }
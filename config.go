@@ -2,12 +2,188 @@ package ucenter
 
 // Config 配置文件
 type Config struct {
-	AuthCookieName  string `mapstructure:"auth_cookie_name"` //Web验证用的Cookie名称
-	ReCaptchaSecret string `mapstructure:"recaptcha_secret"` //ReCaptcha密钥
-	DBDSN           string `mapstructure:"dbdsn"`            //Mysql链接字符串 "root@tcp(localhost:3306)/ucenter?parseTime=True&loc=Asia%2FShanghai"
-	Domain          string //系统域名
-	DebugAble       bool   `mapstructure:"debug"`        //开启调试
-	SysName         string `mapstructure:"sysname"`      //系统名称
-	PrivateKeyByte  string `mapstructure:"privatekey"`   //系统私钥
-	WebProtocol     string `mapstructure:"web_protocol"` //http or https
+	AuthCookieName string `mapstructure:"auth_cookie_name"` //Web验证用的Cookie名称
+	DBDSN          string `mapstructure:"dbdsn"`            //Mysql链接字符串 "root@tcp(localhost:3306)/ucenter?parseTime=True&loc=Asia%2FShanghai"
+	Domain         string //系统域名
+	DebugAble      bool   `mapstructure:"debug"`         //开启调试
+	SysName        string `mapstructure:"sysname"`       //系统名称
+	PrivateKeyByte string `mapstructure:"privatekey"`    //系统私钥
+	WebProtocol    string `mapstructure:"web_protocol"`  //http or https
+	IDFormat       string `mapstructure:"id_format"`     //新用户及应用对外 ID 的格式：serial（自增）、uuid、ulid
+	PairwiseSalt   string `mapstructure:"pairwise_salt"` //派生 pairwise sub 的盐，为空不支持 pairwise，设置后不能更改
+	HMACSecret     string `mapstructure:"hmac_secret"`   //签名授权码、访问令牌及刷新令牌的密钥，至少 32 字节，更改后已签发的令牌失效
+
+	CaptchaProvider     string   `mapstructure:"captcha_provider"`      //人机验证：recaptcha、hcaptcha、turnstile、image
+	CaptchaSiteKey      string   `mapstructure:"captcha_site_key"`      //人机验证站点密钥
+	CaptchaSecret       string   `mapstructure:"captcha_secret"`        //人机验证服务端密钥
+	CaptchaMode         string   `mapstructure:"captcha_mode"`          //always 总是验证；adaptive 仅在登录失败较多或来自标记网段时验证
+	CaptchaFreeAttempts int      `mapstructure:"captcha_free_attempts"` //自适应模式下，IP 与账户合计登录失败多少次后需要验证
+	CaptchaFlaggedIPs   []string `mapstructure:"captcha_flagged_ips"`   //自适应模式下总是需要验证的 IP 或 CIDR
+
+	PasswordHasher string `mapstructure:"password_hasher"` //密码哈希算法：bcrypt、argon2id
+	BcryptCost     int    `mapstructure:"bcrypt_cost"`     //bcrypt 成本
+	Argon2Time     uint32 `mapstructure:"argon2_time"`     //Argon2id 迭代次数
+	Argon2Memory   uint32 `mapstructure:"argon2_memory"`   //Argon2id 内存（KiB）
+	Argon2Threads  uint8  `mapstructure:"argon2_threads"`  //Argon2id 并行度
+
+	PasswordHashTarget int `mapstructure:"password_hash_target"` //启动时自动调优哈希参数的目标耗时（毫秒），在以上参数的基础上提高 bcrypt 成本或 Argon2id 迭代次数，0 为不调优
+
+	PasswordMinLength        int  `mapstructure:"password_min_length"`        //密码最短长度
+	PasswordMinClasses       int  `mapstructure:"password_min_classes"`       //密码至少包含几类字符（大写、小写、数字、符号）
+	PasswordDisallowIdentity bool `mapstructure:"password_disallow_identity"` //密码不能包含用户名或邮箱
+	PasswordMaxAge           int  `mapstructure:"password_max_age"`           //密码有效期（天），0 为不过期
+	PasswordHistory          int  `mapstructure:"password_history"`           //不能使用最近几次用过的密码，0 为不限制
+
+	LoginURL        string `mapstructure:"login_url"`         //外部登录界面地址，为空使用内置界面
+	ConsentURL      string `mapstructure:"consent_url"`       //外部授权界面地址，为空使用内置界面
+	ChallengeAPIKey string `mapstructure:"challenge_api_key"` //外部登录、授权界面调用 API 的密钥
+
+	ConsentRememberDays    int  `mapstructure:"consent_remember_days"`    //授权页「记住」选项的天数
+	ConsentRememberForever bool `mapstructure:"consent_remember_forever"` //授权页允许一直记住，申请敏感 scope 时始终不允许
+
+	ReturnURLAllowHosts []string `mapstructure:"return_url_allow_hosts"` //return_url 允许跳转的外部域名，支持 *.example.com
+
+	AuthorizeRequireState bool `mapstructure:"authorize_require_state"` //公开客户端的授权请求必须携带 state
+	AuthorizeRequireNonce bool `mapstructure:"authorize_require_nonce"` //OpenID Connect 授权请求必须携带 nonce
+
+	LoginMaxFailures   int  `mapstructure:"login_max_failures"`   //登录失败多少次后锁定
+	LoginFailureWindow int  `mapstructure:"login_failure_window"` //登录失败计数窗口（分钟）
+	LoginPrivacy       bool `mapstructure:"login_privacy"`        //隐私模式：登录、注册不透露用户名或邮箱是否存在
+
+	EmailChangeTTL int `mapstructure:"email_change_ttl"` //修改邮箱的确认链接有效期（小时）
+
+	SecurityAlertCooldown  int            `mapstructure:"security_alert_cooldown"`  //同类安全提醒邮件的最短间隔（分钟），期间的事件合并为一封摘要
+	SecurityAlertCooldowns map[string]int `mapstructure:"security_alert_cooldowns"` //按事件类型覆盖间隔（login_failure、new_device），0 为每次都发送，负数为不发送
+
+	EmailOTPTTL            int  `mapstructure:"email_otp_ttl"`             //邮箱验证码有效期（分钟）
+	EmailOTPMaxAttempts    int  `mapstructure:"email_otp_max_attempts"`    //邮箱验证码最多尝试次数，超过后需重新登录
+	EmailOTPResendInterval int  `mapstructure:"email_otp_resend_interval"` //重新发送邮箱验证码的间隔（秒）
+	MFAAdminStrong         bool `mapstructure:"mfa_admin_strong"`          //管理员级角色只能使用通行密钥登录（初始值，之后在管理中心修改）
+	MFATrustDays           int  `mapstructure:"mfa_trust_days"`            //通过二次验证后可信任该设备的天数，0 为不允许
+	MFARecoveryCodes       int  `mapstructure:"mfa_recovery_codes"`        //每次生成的恢复码个数
+
+	QRLoginTTL int `mapstructure:"qr_login_ttl"` //扫码登录二维码的有效期（秒）
+
+	SudoTTL      int `mapstructure:"sudo_ttl"`       //重新验证身份后可进行敏感操作的时长（分钟）
+	AdminSudoTTL int `mapstructure:"admin_sudo_ttl"` //重新验证身份后可进行管理操作的时长（分钟）
+
+	ClientSecretMinEntropy  int `mapstructure:"client_secret_min_entropy"`  //自定义客户端密钥的最低熵（比特）
+	ClientAuthMaxFailures   int `mapstructure:"client_auth_max_failures"`   //客户端认证失败多少次后限流
+	ClientAuthFailureWindow int `mapstructure:"client_auth_failure_window"` //客户端认证失败计数窗口（分钟）
+
+	ClientTemplates map[string]ClientTemplate `mapstructure:"client_templates"` //应用模板（web、spa、native、service），为空使用内置模板
+
+	AccessTokenLifespan   int `mapstructure:"access_token_lifespan"`   //访问令牌默认有效期（分钟），应用可单独设置
+	RefreshTokenLifespan  int `mapstructure:"refresh_token_lifespan"`  //刷新令牌默认有效期（小时），0 不限制
+	IDTokenLifespan       int `mapstructure:"id_token_lifespan"`       //ID Token 默认有效期（分钟）
+	AuthorizeCodeLifespan int `mapstructure:"authorize_code_lifespan"` //授权码默认有效期（分钟）
+
+	IdentityProviders map[string]IdentityProvider `mapstructure:"identity_providers"` //可关联的外部身份提供方，键为提供方标识
+
+	WechatMiniPrograms map[string]WechatMiniProgram `mapstructure:"wechat_mini_programs"` //微信小程序登录，键为小程序对应的应用 ID
+
+	FeatureFlags map[string]FeatureFlag `mapstructure:"feature_flags"` //功能开关的初始值（enabled、percentage、users），之后在管理中心调整
+
+	GeoIPDB         string   `mapstructure:"geoip_db"`         //GeoIP 数据库路径，国家库或城市库（城市库可显示到城市）
+	SignupCountries []string `mapstructure:"signup_countries"` //允许注册的国家代码，为空不限制
+	LoginCountries  []string `mapstructure:"login_countries"`  //允许登录的国家代码，为空不限制
+	GeoIPExemptIPs  []string `mapstructure:"geoip_exempt_ips"` //不受地区限制的 IP 或 CIDR
+
+	SMTPHost     string `mapstructure:"smtp_host"`     //SMTP 服务器
+	SMTPPort     int    `mapstructure:"smtp_port"`     //SMTP 端口
+	SMTPUsername string `mapstructure:"smtp_username"` //SMTP 用户名
+	SMTPPassword string `mapstructure:"smtp_password"` //SMTP 密码
+	MailFrom     string `mapstructure:"mail_from"`     //发件人地址
+
+	StaleAccountMonths    int `mapstructure:"stale_account_months"`     //多少个月未登录视为长期未使用，0 为关闭
+	StaleAccountGraceDays int `mapstructure:"stale_account_grace_days"` //提醒后多少天停用
+
+	DataExportTTL int `mapstructure:"data_export_ttl"` //数据导出归档保留时间（小时）
+
+	MetricsAllowIPs []string `mapstructure:"metrics_allow_ips"` //可访问 /metrics 的 IP 或 CIDR，如 Prometheus 所在网段，本机总是允许
+
+	SLOTokenErrorRate  float64 `mapstructure:"slo_token_error_rate"`  //告警规则：令牌签发错误率上限
+	SLOLoginP95        float64 `mapstructure:"slo_login_p95"`         //告警规则：登录 p95 耗时上限（秒）
+	SLOMailFailureRate float64 `mapstructure:"slo_mail_failure_rate"` //告警规则：邮件投递失败率上限
+
+	PIIEncryption bool   `mapstructure:"pii_encryption"` //加密保存邮箱等敏感字段，开启后不可关闭
+	KMSProvider   string `mapstructure:"kms_provider"`   //密钥管理服务，内置 local
+	KMSMasterKey  string `mapstructure:"kms_master_key"` //local 的主密钥（base64，至少 32 字节）
+
+	TLSCert        string `mapstructure:"tls_cert"`         //HTTPS 证书，为空使用 HTTP
+	TLSKey         string `mapstructure:"tls_key"`          //HTTPS 私钥
+	TLSClientCA    string `mapstructure:"tls_client_ca"`    //校验 mTLS 客户端证书的 CA
+	MTLSCertHeader string `mapstructure:"mtls_cert_header"` //由反向代理终止 TLS 时，传递客户端证书（URL 编码的 PEM）的请求头
+
+	TrustedProxies []string `mapstructure:"trusted_proxies"` //受信任的反向代理 IP 或 CIDR，只采信它们添加的请求头
+
+	GrantPlugins []string `mapstructure:"grant_plugins"` //自定义授权类型的 Go plugin 路径
+
+	SignupInviteOnly bool `mapstructure:"signup_invite_only"` //注册需要邀请码
+	InviteQuota      int  `mapstructure:"invite_quota"`       //普通用户可生成的邀请码数量
+	SignupApproval   bool `mapstructure:"signup_approval"`    //新注册用户需管理员审核
+
+	SignupClosed       bool     `mapstructure:"signup_closed"`        //关闭注册（初始值，之后在管理中心修改）
+	SignupAllowDomains []string `mapstructure:"signup_allow_domains"` //允许注册的邮箱域名（初始值）
+	SignupBlockDomains []string `mapstructure:"signup_block_domains"` //禁止注册的邮箱域名（初始值）
+
+	SignupAPIClients     []string `mapstructure:"signup_api_clients"`      //可通过 API 代用户注册的第一方应用 ID，应用还需拥有 signup scope
+	SignupAPIIPLimit     int      `mapstructure:"signup_api_ip_limit"`     //注册 API 每个 IP 每小时最多请求次数
+	SignupAPIClientLimit int      `mapstructure:"signup_api_client_limit"` //注册 API 每个应用每小时最多注册成功的用户数
+
+	UploadScanner      string `mapstructure:"upload_scanner"`        //上传文件安全扫描：clamd、icap、http，为空不扫描
+	UploadScannerAddr  string `mapstructure:"upload_scanner_addr"`   //扫描服务地址：clamd 为 tcp://host:3310 或 unix:///path，icap 为 icap://host:1344/service，http 为接收文件的 URL
+	UploadScanFailOpen bool   `mapstructure:"upload_scan_fail_open"` //扫描服务不可用时仍允许上传，默认拒绝
+	UploadScanTimeout  int    `mapstructure:"upload_scan_timeout"`   //单次扫描超时（秒）
+
+	AuditChain          bool   `mapstructure:"audit_chain"`           //审计日志哈希链：每条记录包含上一条的哈希，数据表只允许追加
+	AuditAnchorInterval int    `mapstructure:"audit_anchor_interval"` //哈希链锚点间隔（小时），0 不生成
+	AuditAnchorWebhook  string `mapstructure:"audit_anchor_webhook"`  //锚点生成后 POST 到该地址留存，为空仅保存在数据库
+
+	SigningKeyAlg          string `mapstructure:"signing_key_alg"`           //新签名密钥的算法：RS256、ES256
+	SigningKeyRotationDays int    `mapstructure:"signing_key_rotation_days"` //签名密钥轮换周期（天），0 不轮换
+
+	ClientSecretGraceHours int `mapstructure:"client_secret_grace_hours"` //轮换应用密钥后旧密钥继续有效的时长（小时）
+
+	TokenLeeway int    `mapstructure:"token_leeway"` //校验令牌、DPoP 证明的 exp、iat、nbf 时允许的时钟偏差（秒）
+	NTPServer   string `mapstructure:"ntp_server"`   //管理中心检查本机时钟偏差使用的 NTP 服务器，为空只与数据库比较
+
+	Registration              bool     `mapstructure:"registration"`                //开放动态注册应用（RFC 7591/7592）
+	RegistrationInitialToken  string   `mapstructure:"registration_initial_token"`  //注册时须携带的初始访问令牌，为空允许匿名注册
+	RegistrationGrantTypes    []string `mapstructure:"registration_grant_types"`    //动态注册的应用可使用的授权类型
+	RegistrationRedirectHosts []string `mapstructure:"registration_redirect_hosts"` //允许的跳转链接域名，支持 *.example.com，为空不限制（本机回环地址除外）
+	RegistrationApproval      bool     `mapstructure:"registration_approval"`       //动态注册的应用需管理员在应用管理中启用后才能使用
+
+	DeviceCodeTTL      int `mapstructure:"device_code_ttl"`      //设备授权的验证码有效期（分钟）
+	DeviceCodeInterval int `mapstructure:"device_code_interval"` //设备轮询令牌端点的最短间隔（秒）
+	PARLifespan        int `mapstructure:"par_lifespan"`         //PAR 签发的 request_uri 有效期（秒）
+
+	IPReputation          string   `mapstructure:"ip_reputation"`            //登录、注册来源 IP 信誉查询：file、abuseipdb、http，为空不查询
+	IPReputationAddr      string   `mapstructure:"ip_reputation_addr"`       //file 为黑名单文件路径（每行一个 IP 或 CIDR），abuseipdb 可留空，http 为含 {ip} 的查询地址
+	IPReputationKey       string   `mapstructure:"ip_reputation_key"`        //信誉服务的 API Key
+	IPReputationTimeout   int      `mapstructure:"ip_reputation_timeout"`    //单次查询超时（秒），超时视为无记录
+	IPReputationCacheTTL  int      `mapstructure:"ip_reputation_cache_ttl"`  //查询结果缓存时间（分钟）
+	IPReputationBlock     int      `mapstructure:"ip_reputation_block"`      //评分（0-100）达到该值拒绝登录、注册，0 不拒绝
+	IPReputationChallenge int      `mapstructure:"ip_reputation_challenge"`  //评分达到该值时自适应模式下要求人机验证，0 不要求
+	IPReputationFlag      int      `mapstructure:"ip_reputation_flag"`       //评分达到该值记入审计日志，0 不记录
+	IPReputationExemptIPs []string `mapstructure:"ip_reputation_exempt_ips"` //不查询信誉的 IP 或网段，如办公网出口
+
+	BackupKey string `mapstructure:"backup_key"` //备份加密密钥（base64，至少 32 字节），为空时由 kms_master_key 派生
+
+	IPv6PrefixLength int `mapstructure:"ipv6_prefix_length"` //按 IP 限流、锁定时 IPv6 地址按该长度的前缀合并计数
+
+	UserSearchRateLimit int `mapstructure:"user_search_rate_limit"` //每个用户每分钟最多搜索用户的次数
+
+	Reports            []string `mapstructure:"reports"`              //定期报告的内容：new_users、dormant_accounts、idle_clients、key_expirations，为空不生成
+	ReportIntervalDays int      `mapstructure:"report_interval_days"` //报告周期（天）
+	ReportInactiveDays int      `mapstructure:"report_inactive_days"` //多少天未登录的账户、未签发令牌的应用列入报告
+	ReportRecipients   []string `mapstructure:"report_recipients"`    //报告收件人，为空发送给全部管理员
+	ReportWebhook      string   `mapstructure:"report_webhook"`       //报告生成后以 JSON POST 到该地址，为空不推送
+
+	CustomScopes map[string]CustomScope `mapstructure:"custom_scopes"` //自定义 scope 及其 claims
+}
+
+// Issuer OpenID Connect 签发方，ID Token 的 iss 与发现文档的 issuer 均以此为准
+func Issuer() string {
+	return C.WebProtocol + "://" + C.Domain
 }
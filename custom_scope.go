@@ -0,0 +1,34 @@
+package ucenter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CustomScopeSources 自定义 claim 可用的取值来源，以 = 开头的为固定值
+var CustomScopeSources = map[string]string{
+	"roles":      "用户在 defaultDomain 中的 RAM 角色",
+	"bio":        "简介",
+	"created_at": "注册时间",
+}
+
+// CustomScope 自定义 scope，授权后用户信息端点返回对应的 claims
+type CustomScope struct {
+	Description string            `mapstructure:"description"` //授权页展示的说明
+	Claims      map[string]string `mapstructure:"claims"`      //claim 名称与取值来源：roles、bio、created_at，或以 = 开头的固定值
+}
+
+// registerCustomScopes 将自定义 scope 加入可以使用的 scope 列表
+func registerCustomScopes() {
+	for name, s := range C.CustomScopes {
+		if _, ok := Scopes[name]; ok {
+			panic(fmt.Errorf("自定义 scope %s 与内置 scope 重名", name))
+		}
+		for claim, source := range s.Claims {
+			if _, ok := CustomScopeSources[source]; !ok && !strings.HasPrefix(source, "=") {
+				panic(fmt.Errorf("自定义 scope %s 的 claim %s 取值来源 %s 不存在", name, claim, source))
+			}
+		}
+		Scopes[name] = s.Description
+	}
+}
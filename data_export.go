@@ -0,0 +1,35 @@
+package ucenter
+
+import (
+	"time"
+)
+
+const (
+	// ExportPending 导出等待生成
+	ExportPending = 0
+	// ExportReady 导出已生成，可以下载
+	ExportReady = 1
+	// ExportFailed 导出生成失败
+	ExportFailed = -1
+)
+
+// DataExport 用户数据导出请求
+type DataExport struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"index"`
+	Token     string `gorm:"unique_index"`
+	Status    int    `gorm:"index"`
+	Error     string
+	CreatedAt time.Time
+	ReadyAt   *time.Time
+}
+
+// Path 导出归档的储存路径
+func (e *DataExport) Path() string {
+	return "data/export/" + e.Token + ".zip"
+}
+
+// Expired 导出归档是否已过保留期
+func (e *DataExport) Expired() bool {
+	return e.ReadyAt != nil && time.Since(*e.ReadyAt) > time.Hour*time.Duration(C.DataExportTTL)
+}
@@ -0,0 +1,11 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// DPoPProof 已使用过的 DPoP 证明，防止重放
+type DPoPProof struct {
+	JTI       string    `gorm:"primary_key"`
+	ExpiresAt time.Time `gorm:"index"`
+}
@@ -0,0 +1,27 @@
+package ucenter
+
+import (
+	"time"
+
+	"github.com/naiba/ucenter/pkg/pii"
+)
+
+// EmailChange 等待新旧邮箱确认的邮箱修改，每个用户同时只有一个
+type EmailChange struct {
+	ID       uint       `gorm:"primary_key"`
+	UserID   uint       `gorm:"unique_index"`
+	OldEmail pii.String `gorm:"type:text"`
+	NewEmail pii.String `gorm:"type:text"`
+	// OldToken、NewToken 分别发送到旧邮箱、新邮箱的确认链接
+	OldToken       string `gorm:"unique_index"`
+	NewToken       string `gorm:"unique_index"`
+	OldConfirmedAt *time.Time
+	NewConfirmedAt *time.Time
+	ExpiresAt      time.Time
+	CreatedAt      time.Time
+}
+
+// Confirmed 新旧邮箱是否都已确认
+func (e *EmailChange) Confirmed() bool {
+	return e.OldConfirmedAt != nil && e.NewConfirmedAt != nil
+}
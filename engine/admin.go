@@ -1,13 +1,16 @@
 package engine
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/biezhi/gorm-paginator/pagination"
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	"github.com/naiba/ucenter"
 	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/iplist"
 	"github.com/naiba/ucenter/pkg/nbgin"
 )
 
@@ -22,7 +25,71 @@ func appStatus(c *gin.Context) {
 	err := c.ShouldBind(&asf)
 	if err == nil {
 		var clientOrigin storage.FositeClient
-		err = ucenter.DB.Model(storage.FositeClient{}).Where("id = ?", asf.ID).Find(&clientOrigin).Error
+		err = ucenter.DB.Where("client_id = ?", asf.ID).First(&clientOrigin).Error
+		if err == nil && isDryRun(c) {
+			// 禁用后已签发的令牌与用户授权保留，但应用无法再换取令牌
+			d := newDryRunImpact()
+			d.addClient(clientOrigin.ClientID)
+			if err = d.countRows("authorizations", ucenter.UserAuthorized{}, "client_id = ?", clientOrigin.ClientID); err == nil {
+				err = d.countTokens("client_id", clientOrigin.ClientID)
+			}
+			if err == nil {
+				writeDryRun(c, d)
+				return
+			}
+		}
+		if err == nil {
+			err = ucenter.DB.Model(&clientOrigin).UpdateColumn("status", asf.Status).Error
+		}
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+	}
+}
+
+// appFirstParty 标记或取消标记第一方应用，第一方应用跳过用户同意
+func appFirstParty(c *gin.Context) {
+	type firstPartyForm struct {
+		ID         string `form:"id" binding:"required,min=1"`
+		FirstParty bool   `form:"first_party"`
+	}
+
+	var ff firstPartyForm
+	err := c.ShouldBind(&ff)
+	if err == nil {
+		var client storage.FositeClient
+		err = ucenter.DB.Where("client_id = ?", ff.ID).First(&client).Error
+		if err == nil {
+			err = ucenter.DB.Model(&client).UpdateColumn("first_party", ff.FirstParty).Error
+		}
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+	}
+}
+
+// appNetwork 设置保密客户端可以调用令牌、内省及吊销端点的来源网络，留空不限制
+func appNetwork(c *gin.Context) {
+	type networkForm struct {
+		ID         string `form:"id" binding:"required,min=1"`
+		AllowedIPs string `form:"allowed_ips"`
+	}
+
+	var nf networkForm
+	var client storage.FositeClient
+	var list []string
+	err := c.ShouldBind(&nf)
+	if err == nil {
+		list, err = iplist.Parse(nf.AllowedIPs)
+	}
+	if err == nil {
+		err = ucenter.DB.Where("client_id = ?", nf.ID).First(&client).Error
+	}
+	if err == nil && client.IsPublic() && len(list) > 0 {
+		err = errors.New("公开客户端没有凭证，不能限定来源网络")
+	}
+	if err == nil {
+		err = ucenter.DB.Model(&client).UpdateColumn("allowed_ips", pq.StringArray(list)).Error
 	}
 	if err != nil {
 		c.AbortWithError(http.StatusForbidden, err)
@@ -40,6 +107,10 @@ func adminIndex(c *gin.Context) {
 		"login":  loginCount,
 		"client": clientCount,
 		"auth":   authCount,
+		// 密码哈希参数及重新哈希进度
+		"passwordHash": passwordHashStatus(),
+		// 本机时钟与数据库、NTP 服务器的偏差
+		"clock": clockStatus(),
 	}))
 }
 
@@ -56,7 +127,27 @@ func adminUsers(c *gin.Context) {
 	}, &users)
 
 	c.HTML(http.StatusOK, "admin/users", nbgin.Data(c, gin.H{
-		"users": paginator,
+		"users":   paginator,
+		"admins":  adminUserIDs(),
+		"appeals": submittedAppeals(),
+	}))
+}
+
+func adminUser(c *gin.Context) {
+	var u ucenter.User
+	if err := findUserBySubject(c.Param("id"), &u); err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	var logins []ucenter.Login
+	ucenter.DB.Where("user_id = ?", u.ID).Order("last_seen_at desc").Find(&logins)
+	var identities []ucenter.Identity
+	ucenter.DB.Where("user_id = ?", u.ID).Order("id").Find(&identities)
+	c.HTML(http.StatusOK, "admin/user", nbgin.Data(c, gin.H{
+		"user":       u,
+		"logins":     logins,
+		"identities": identities,
+		"admin":      adminUserIDs()[u.ID],
 	}))
 }
 
@@ -76,3 +167,93 @@ func adminApps(c *gin.Context) {
 		"apps": paginator,
 	}))
 }
+
+func adminLocks(c *gin.Context) {
+	locks, err := lockedLogins()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.HTML(http.StatusOK, "admin/locks", nbgin.Data(c, gin.H{
+		"locks": locks,
+	}))
+}
+
+func unlockLogin(c *gin.Context) {
+	type unlockForm struct {
+		Field string `form:"field" binding:"required,oneof=username ip"`
+		Value string `form:"value" binding:"required,min=1"`
+	}
+
+	var uf unlockForm
+	// 验证用户输入
+	err := c.ShouldBind(&uf)
+	if err == nil {
+		err = ucenter.DB.Delete(ucenter.LoginAttempt{}, uf.Field+" = ?", uf.Value).Error
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+	}
+}
+
+func adminStale(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "15"))
+	var users []ucenter.User
+	paginator := pagination.Pagging(&pagination.Param{
+		DB:      ucenter.DB.Where("status = 0 AND stale_warned_at IS NOT NULL"),
+		Page:    page,
+		Limit:   limit,
+		OrderBy: []string{"stale_warned_at asc"},
+		ShowSQL: true,
+	}, &users)
+
+	c.HTML(http.StatusOK, "admin/stale", nbgin.Data(c, gin.H{
+		"users": paginator,
+		"grace": staleGracePeriod(),
+	}))
+}
+
+func adminPending(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "15"))
+	var users []ucenter.User
+	paginator := pagination.Pagging(&pagination.Param{
+		DB:      ucenter.DB.Where("status = ?", ucenter.StatusPending),
+		Page:    page,
+		Limit:   limit,
+		OrderBy: []string{"id asc"},
+		ShowSQL: true,
+	}, &users)
+
+	c.HTML(http.StatusOK, "admin/pending", nbgin.Data(c, gin.H{
+		"users": paginator,
+	}))
+}
+
+func reviewUser(c *gin.Context) {
+	type reviewForm struct {
+		ID      uint `form:"id" binding:"required,min=1"`
+		Approve bool `form:"approve"`
+	}
+
+	var rf reviewForm
+	if err := c.ShouldBind(&rf); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	var u ucenter.User
+	if ucenter.DB.First(&u, "id = ? AND status = ?", rf.ID, ucenter.StatusPending).Error != nil {
+		c.String(http.StatusNotFound, "该用户不在审核队列中")
+		return
+	}
+	var err error
+	if rf.Approve {
+		err = ucenter.DB.Model(&u).Update("status", 0).Error
+	} else {
+		err = deleteUser(u.ID)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiVersionKey 协商出的 API 版本在请求上下文中的键
+const apiVersionKey = "api_version"
+
+// apiVersion 对外 API 的一个版本
+type apiVersion struct {
+	name string
+	// deprecated 宣布弃用的时间，为空表示仍受支持
+	deprecated *time.Time
+	// sunset 停止服务的时间，之后返回 410
+	sunset *time.Time
+	// link 迁移说明
+	link string
+}
+
+// apiVersions 所有已发布的 API 版本。不兼容的修改发布为新版本，旧版本先标记弃用、
+// 设定停止服务时间，到期后再删除对应的处理函数，不能直接修改已发布版本的行为
+var apiVersions = []apiVersion{
+	{name: "v1"},
+}
+
+// apiDefaultVersion 路径及请求头都未指定版本时使用的版本，保持为最早的受支持版本
+const apiDefaultVersion = "v1"
+
+var acceptVersion = regexp.MustCompile(`application/vnd\.ucenter\.(v[0-9]+)\+json`)
+
+func findAPIVersion(name string) *apiVersion {
+	for i := range apiVersions {
+		if apiVersions[i].name == name {
+			return &apiVersions[i]
+		}
+	}
+	return nil
+}
+
+// negotiateAPIVersion 依次按 API-Version 请求头、Accept 中的媒体类型协商版本
+func negotiateAPIVersion(c *gin.Context) string {
+	if v := c.GetHeader("API-Version"); v != "" {
+		return v
+	}
+	if m := acceptVersion.FindStringSubmatch(c.GetHeader("Accept")); m != nil {
+		return m[1]
+	}
+	return apiDefaultVersion
+}
+
+// apiVersionMiddleware 确定请求的 API 版本并输出弃用信息；fixed 为路径中指定的版本，为空时协商
+func apiVersionMiddleware(fixed string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := fixed
+		if name == "" {
+			name = negotiateAPIVersion(c)
+		}
+		v := findAPIVersion(name)
+		if v == nil {
+			var supported []string
+			for _, v := range apiVersions {
+				if v.sunset == nil || time.Now().Before(*v.sunset) {
+					supported = append(supported, v.name)
+				}
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error":     "不支持的 API 版本：" + name,
+				"supported": supported,
+			})
+			return
+		}
+		c.Header("API-Version", v.name)
+		c.Header("Vary", "API-Version, Accept")
+		if v.deprecated != nil {
+			c.Header("Deprecation", fmt.Sprintf("@%d", v.deprecated.Unix()))
+		}
+		if v.sunset != nil {
+			c.Header("Sunset", v.sunset.UTC().Format(http.TimeFormat))
+		}
+		if v.link != "" {
+			c.Header("Link", "<"+v.link+`>; rel="deprecation"`)
+		}
+		if v.sunset != nil && time.Now().After(*v.sunset) {
+			c.AbortWithStatusJSON(http.StatusGone, gin.H{
+				"error": "API 版本 " + v.name + " 已停止服务",
+			})
+			return
+		}
+		c.Set(apiVersionKey, v.name)
+	}
+}
+
+// versioned 按请求的 API 版本分派处理函数，同一接口可同时提供多个版本；
+// 没有为该版本单独实现时沿用更早版本的处理函数
+func versioned(handlers map[string]gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.MustGet(apiVersionKey).(string)
+		var handler gin.HandlerFunc
+		for _, v := range apiVersions {
+			if h, ok := handlers[v.name]; ok {
+				handler = h
+			}
+			if v.name == name {
+				break
+			}
+		}
+		if handler == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": "API 版本 " + name + " 不提供该接口",
+			})
+			return
+		}
+		handler(c)
+	}
+}
+
+// registerAPI 注册对外 API，各版本共用同一组路由，由 versioned 分派到对应版本的实现
+func registerAPI(api *gin.RouterGroup) {
+	api.GET("/signup", versioned(map[string]gin.HandlerFunc{"v1": signupAPIRequirements}))
+	api.POST("/signup", versioned(map[string]gin.HandlerFunc{"v1": signupAPI}))
+}
@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/biezhi/gorm-paginator/pagination"
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// audit 记录安全事件，写入失败不影响请求本身
+func audit(c *gin.Context, actor uint, event, target, detail string) {
+	entry := ucenter.AuditLog{
+		ActorID: actor,
+		Event:   event,
+		Target:  target,
+		IP:      clientIP(c),
+		UA:      c.Request.UserAgent(),
+		Detail:  detail,
+	}
+	var err error
+	if ucenter.C.AuditChain {
+		err = appendAuditChain(&entry)
+	} else {
+		err = ucenter.DB.Create(&entry).Error
+	}
+	if err != nil {
+		log.Println("audit:", event, err)
+	}
+}
+
+// auditCurrent 以当前登录用户的身份记录安全事件
+func auditCurrent(c *gin.Context, event, target, detail string) {
+	var actor uint
+	if u, ok := c.Get(ucenter.AuthUser); ok {
+		actor = u.(*ucenter.User).ID
+	}
+	audit(c, actor, event, target, detail)
+}
+
+func userTarget(uid uint) string {
+	return fmt.Sprintf("user:%d", uid)
+}
+
+func clientTarget(id string) string {
+	return "client:" + id
+}
+
+// auditAdmin 记录管理中心里执行成功的变更操作
+func auditAdmin(c *gin.Context) {
+	c.Next()
+	if c.Request.Method == http.MethodGet || c.Writer.Status() >= http.StatusBadRequest || len(c.Errors) > 0 || isDryRun(c) {
+		return
+	}
+	form := url.Values{}
+	for k, v := range c.Request.PostForm {
+		if k != "_csrf" {
+			form[k] = v
+		}
+	}
+	auditCurrent(c, ucenter.AuditAdminAction, c.Request.Method+" "+c.Request.URL.Path, form.Encode())
+}
+
+// auditActors 日志中出现的操作人
+func auditActors(logs []ucenter.AuditLog) map[uint]string {
+	var ids []uint
+	for _, l := range logs {
+		if l.ActorID != 0 {
+			ids = append(ids, l.ActorID)
+		}
+	}
+	names := make(map[uint]string)
+	if len(ids) == 0 {
+		return names
+	}
+	var users []ucenter.User
+	ucenter.DB.Select("id, username").Where("id IN (?)", ids).Find(&users)
+	for _, u := range users {
+		names[u.ID] = u.Username
+	}
+	return names
+}
+
+func adminAudit(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "30"))
+	db := ucenter.DB
+	if event := c.Query("event"); event != "" {
+		db = db.Where("event = ?", event)
+	}
+	if actor := c.Query("actor"); actor != "" {
+		db = db.Where("actor_id = ?", actor)
+	}
+	if target := c.Query("target"); target != "" {
+		db = db.Where("target = ?", target)
+	}
+	var logs []ucenter.AuditLog
+	paginator := pagination.Pagging(&pagination.Param{
+		DB:      db,
+		Page:    page,
+		Limit:   limit,
+		OrderBy: []string{"id desc"},
+		ShowSQL: true,
+	}, &logs)
+
+	c.HTML(http.StatusOK, "admin/audit", nbgin.Data(c, gin.H{
+		"logs":   paginator,
+		"actors": auditActors(logs),
+		"events": ucenter.AuditEvents,
+		"chain":  ucenter.C.AuditChain,
+		"query": gin.H{
+			"event":  c.Query("event"),
+			"actor":  c.Query("actor"),
+			"target": c.Query("target"),
+		},
+	}))
+}
+
+// activity 用户最近的账户活动，包括本人的操作及针对本账户的操作
+func activity(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var logs []ucenter.AuditLog
+	if err := ucenter.DB.Where("actor_id = ? OR target = ?", u.ID, userTarget(u.ID)).
+		Order("id desc").Limit(50).Find(&logs).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.HTML(http.StatusOK, "user/activity", nbgin.Data(c, gin.H{
+		"logs":   logs,
+		"actors": auditActors(logs),
+	}))
+}
@@ -1,9 +1,11 @@
 package engine
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/naiba/ucenter/pkg/nbgin"
 
@@ -44,6 +46,11 @@ func authorizeMiddleware(c *gin.Context) {
 		if ucenter.DB.Preload("User").Where("token = ?", tk).First(&loginClient).Error == nil {
 			authorizedUser = &loginClient.User
 			c.Set(ucenter.AuthType, ucenter.AuthTypeCookie)
+			c.Set(ucenter.AuthLogin, &loginClient)
+			touchLogin(&loginClient, clientIP(c))
+		} else {
+			// 终端已在别处下线，同步浏览器状态供应用的 check_session_iframe 感知
+			setBrowserState(c, "")
 		}
 	}
 
@@ -56,16 +63,20 @@ func authorizeMiddleware(c *gin.Context) {
 				"title": "权限不足",
 				"msg":   "您的权限不足以访问此页面哟",
 			})
+			c.Abort()
+			return
 		}
 	}
 
 	if authorizedUser != nil {
-		if authorizedUser.Status == ucenter.StatusSuspended {
+		liftExpiredSuspension(authorizedUser)
+		if authorizedUser.Blocked() {
 			nbgin.SetCookie(c, -1, ucenter.C.AuthCookieName, "")
+			setBrowserState(c, "")
 			c.HTML(http.StatusForbidden, "page/info", gin.H{
 				"icon":  "shield alternate",
 				"title": "禁止通行",
-				"msg":   "您的账户已被禁用，具体原因请联系管理员。",
+				"msg":   suspendedMessage(authorizedUser),
 			})
 			c.Abort()
 			return
@@ -73,3 +84,76 @@ func authorizeMiddleware(c *gin.Context) {
 		c.Set(ucenter.AuthUser, authorizedUser)
 	}
 }
+
+// liftExpiredSuspension 临时禁用到期后自动解除
+func liftExpiredSuspension(u *ucenter.User) {
+	if !u.SuspensionExpired() {
+		return
+	}
+	if ucenter.DB.Model(u).Select("status", "suspended_until", "suspend_reason", "suspended_by").Updates(map[string]interface{}{
+		"status":          0,
+		"suspended_until": nil,
+		"suspend_reason":  "",
+		"suspended_by":    0,
+	}).Error == nil {
+		u.Status = 0
+		u.SuspendedUntil = nil
+		u.SuspendReason = ""
+		u.SuspendedBy = 0
+	}
+}
+
+// suspendedMessage 账户禁用提示
+func suspendedMessage(u *ucenter.User) string {
+	if u.Status == ucenter.StatusDeactivated {
+		return "您的账户因长期未登录已停用，请联系管理员恢复。"
+	}
+	if u.Status == ucenter.StatusPending {
+		return "您的账户正在等待管理员审核，审核通过后即可登录。"
+	}
+	if u.Status == ucenter.StatusUnconfirmed {
+		return "请先打开发送到注册邮箱的确认链接，确认后即可登录。使用密码登录会重新发送确认邮件。"
+	}
+	reason := "具体原因请联系管理员。"
+	if u.SuspendReason != "" {
+		reason = "原因：" + u.SuspendReason
+	}
+	if u.SuspendedUntil == nil {
+		return "您的账户已被禁用，" + reason
+	}
+	return fmt.Sprintf("您的账户已被临时禁用，将于 %s 后自动解除。%s", humanDuration(time.Until(*u.SuspendedUntil)), reason)
+}
+
+// humanDuration 可读的时间长度
+func humanDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "1 分钟"
+	}
+	days := d / (time.Hour * 24)
+	hours := (d % (time.Hour * 24)) / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	var s string
+	if days > 0 {
+		s += fmt.Sprintf("%d 天 ", days)
+	}
+	if hours > 0 {
+		s += fmt.Sprintf("%d 小时 ", hours)
+	}
+	if minutes > 0 {
+		s += fmt.Sprintf("%d 分钟", minutes)
+	}
+	return strings.TrimSpace(s)
+}
+
+// touchLogin 更新终端最近活动，每 5 分钟最多写一次库
+func touchLogin(l *ucenter.Login, ip string) {
+	if time.Since(l.LastSeenAt) < time.Minute*5 && l.IP == ip {
+		return
+	}
+	l.LastSeenAt = time.Now()
+	l.IP = ip
+	ucenter.DB.Model(ucenter.Login{}).Where("token = ?", l.Token).Updates(map[string]interface{}{
+		"last_seen_at": l.LastSeenAt,
+		"ip":           l.IP,
+	})
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/mail"
+)
+
+// saveUserAvatar 以内容哈希命名保存头像，返回需要在入库后删除的旧文件
+func saveUserAvatar(u *ucenter.User, f io.ReadSeeker) (string, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+	var old string
+	if u.Avatar {
+		old = "data" + u.AvatarURL()
+	}
+	u.Avatar = true
+	u.AvatarHash = fmt.Sprintf("%x", h.Sum(nil))[:16]
+	out, err := os.Create("data" + u.AvatarURL())
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, f); err != nil {
+		return "", err
+	}
+	if old == "data"+u.AvatarURL() {
+		old = ""
+	}
+	return old, nil
+}
+
+// avatarPicture 头像的完整地址，用于 picture claim
+func avatarPicture(u *ucenter.User) string {
+	return mail.SiteURL(u.AvatarURL())
+}
+
+// profileClaims profile scope 对应的用户资料 claims
+func profileClaims(u *ucenter.User) map[string]interface{} {
+	return map[string]interface{}{
+		"preferred_username": u.Username,
+		"picture":            avatarPicture(u),
+	}
+}
@@ -0,0 +1,397 @@
+package engine
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/backup"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/kms"
+)
+
+// backupFormat 备份文件格式版本，格式不兼容时递增
+const backupFormat = 1
+
+const (
+	backupUploadDir  = "data/upload"
+	backupConfigFile = "data/config.yaml"
+)
+
+// backupManifest 备份清单，位于备份的第一项
+type backupManifest struct {
+	Format    int       `json:"format"`
+	CreatedAt time.Time `json:"created_at"`
+	// Migrations 备份时已执行的数据迁移，恢复时据此判断备份是否来自更新的版本
+	Migrations []string `json:"migrations"`
+	// SigningKeys 备份时未过期的签名密钥，恢复后逐一核对
+	SigningKeys []string `json:"signing_keys"`
+}
+
+// backupKey 备份加密密钥，优先使用 backup_key，否则由 kms 派生
+func backupKey() ([]byte, error) {
+	if ucenter.C.BackupKey != "" {
+		l, err := kms.NewLocal(ucenter.C.BackupKey)
+		if err != nil {
+			return nil, err
+		}
+		return l.DataKey("backup")
+	}
+	if ucenter.C.KMSMasterKey == "" {
+		return nil, errors.New("未配置 backup_key 或 kms_master_key，无法加密备份")
+	}
+	p, err := kms.New(ucenter.C.KMSProvider, ucenter.C.KMSMasterKey)
+	if err != nil {
+		return nil, err
+	}
+	return p.DataKey("backup")
+}
+
+func tarFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func tarJSON(tw *tar.Writer, name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+func queryStrings(tx *sql.Tx, query string) ([]string, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// dumpSnapshot 在可重复读事务中导出快照并交给 pg_dump，令牌、吊销记录与签名密钥处于同一时间点
+func dumpSnapshot(dump string, m *backupManifest) error {
+	tx, err := ucenter.DB.DB().BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	// 只读事务，pg_dump 结束后回滚即可
+	defer tx.Rollback()
+	var snapshot string
+	if err := tx.QueryRow("SELECT pg_export_snapshot()").Scan(&snapshot); err != nil {
+		return err
+	}
+	if m.Migrations, err = queryStrings(tx, "SELECT id FROM schema_migrations ORDER BY id"); err != nil {
+		return err
+	}
+	if m.SigningKeys, err = queryStrings(tx, "SELECT kid FROM signing_keys WHERE expires_at IS NULL OR expires_at > now() ORDER BY id"); err != nil {
+		return err
+	}
+	cmd := exec.Command("pg_dump", "--format=custom", "--no-owner", "--snapshot="+snapshot, "--file="+dump, "--dbname="+ucenter.C.DBDSN)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_dump 失败: %s", err)
+	}
+	return nil
+}
+
+// Backup 生成加密的备份：数据库快照、上传文件及配置文件，结果写入 w
+func Backup(w io.Writer, path string) error {
+	key, err := backupKey()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(path), ".ucenter-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	m := backupManifest{Format: backupFormat, CreatedAt: time.Now()}
+	dump := filepath.Join(tmp, "database.dump")
+	if err := dumpSnapshot(dump, &m); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "数据库：已导出，%d 项数据迁移，%d 把签名密钥\n", len(m.Migrations), len(m.SigningKeys))
+
+	out := filepath.Join(tmp, "backup")
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc, err := backup.NewWriter(f, key)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(enc)
+	tw := tar.NewWriter(gz)
+	if err := tarJSON(tw, "manifest.json", m); err != nil {
+		return err
+	}
+	if err := tarFile(tw, "database.dump", dump); err != nil {
+		return err
+	}
+	if err := tarFile(tw, "config.yaml", backupConfigFile); err != nil {
+		return err
+	}
+	var files int
+	err = filepath.Walk(backupUploadDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(backupUploadDir, p)
+		if err != nil {
+			return err
+		}
+		files++
+		return tarFile(tw, "upload/"+filepath.ToSlash(rel), p)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Fprintf(w, "上传文件：%d 个\n", files)
+	for _, c := range []io.Closer{tw, gz, enc, f} {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(out, path); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "备份完成：", path)
+	return nil
+}
+
+// checkBackupManifest 校验备份格式，备份中有本版本未知的数据迁移说明来自更新的版本
+func checkBackupManifest(m *backupManifest) error {
+	if m.Format != backupFormat {
+		return fmt.Errorf("不支持的备份格式 %d，当前版本支持 %d", m.Format, backupFormat)
+	}
+	known := make(map[string]bool)
+	for _, dm := range dataMigrations {
+		known[dm.id] = true
+	}
+	for _, id := range m.Migrations {
+		if !known[id] {
+			return fmt.Errorf("备份来自更新的版本（数据迁移 %s 未知），请使用不低于备份时的版本恢复", id)
+		}
+	}
+	return nil
+}
+
+// restoreTarget 上传文件的恢复位置，拒绝跳出上传目录的路径
+func restoreTarget(name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(name, "upload/")))
+	if rel == "." || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("备份中的文件路径不合法: %s", name)
+	}
+	return filepath.Join(backupUploadDir, rel), nil
+}
+
+func restoreFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Restore 从备份恢复数据库与上传文件，force 为 false 时只能恢复到没有用户的空数据库，结果写入 w。
+// dryRun 为 true 时只校验备份并列出将被覆盖的内容，不做任何修改
+func Restore(w io.Writer, path string, force, dryRun bool) error {
+	var users int
+	if err := ucenter.DB.Model(ucenter.User{}).Count(&users).Error; err != nil {
+		return err
+	}
+	if users > 0 && !force && !dryRun {
+		return fmt.Errorf("数据库中已有 %d 个用户，确认覆盖请加 -force", users)
+	}
+	key, err := backupKey()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec, err := backup.NewReader(f, key)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(dec)
+	if err != nil {
+		return backup.ErrCorrupted
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "manifest.json" {
+		return errors.New("备份中缺少清单")
+	}
+	var m backupManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return err
+	}
+	if err := checkBackupManifest(&m); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "备份时间：%s\n", m.CreatedAt.Format("2006-01-02 15:04:05"))
+	if dryRun {
+		return restoreDryRun(w, tr, &m, users)
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(path), ".ucenter-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	dump := filepath.Join(tmp, "database.dump")
+	var files int
+	var restored bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case hdr.Name == "database.dump":
+			if err := restoreFile(dump, tr); err != nil {
+				return err
+			}
+			cmd := exec.Command("pg_restore", "--clean", "--if-exists", "--no-owner", "--single-transaction", "--exit-on-error", "--dbname="+ucenter.C.DBDSN, dump)
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("pg_restore 失败: %s", err)
+			}
+			restored = true
+			fmt.Fprintln(w, "数据库：已恢复")
+		case hdr.Name == "config.yaml":
+			// 不覆盖当前配置，由运维人员比对后决定是否替换
+			if err := restoreFile(backupConfigFile+".restored", tr); err != nil {
+				return err
+			}
+			fmt.Fprintln(w, "配置文件：已保存为", backupConfigFile+".restored")
+		case strings.HasPrefix(hdr.Name, "upload/"):
+			target, err := restoreTarget(hdr.Name)
+			if err != nil {
+				return err
+			}
+			if err := restoreFile(target, tr); err != nil {
+				return err
+			}
+			files++
+		}
+	}
+	if !restored {
+		return errors.New("备份中缺少数据库")
+	}
+	fmt.Fprintf(w, "上传文件：%d 个\n", files)
+
+	var count int
+	if len(m.SigningKeys) > 0 {
+		if err := ucenter.DB.Model(ucenter.SigningKey{}).Where("kid IN (?)", m.SigningKeys).Count(&count).Error; err != nil {
+			return err
+		}
+	}
+	if count != len(m.SigningKeys) {
+		return fmt.Errorf("签名密钥不完整：备份中有 %d 把，恢复后只找到 %d 把", len(m.SigningKeys), count)
+	}
+	fmt.Fprintf(w, "签名密钥：%d 把，已核对\n", count)
+	pending, err := pendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		fmt.Fprintf(w, "有 %d 项数据迁移未执行，请运行 ucenter upgrade\n", len(pending))
+	}
+	fmt.Fprintln(w, "恢复完成")
+	return nil
+}
+
+// restoreDryRun 读完备份中的条目，列出恢复时将被覆盖或写入的内容
+func restoreDryRun(w io.Writer, tr *tar.Reader, m *backupManifest, users int) error {
+	var files int
+	var database bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case hdr.Name == "database.dump":
+			database = true
+		case hdr.Name == "config.yaml":
+			fmt.Fprintln(w, "配置文件：将保存为", backupConfigFile+".restored")
+		case strings.HasPrefix(hdr.Name, "upload/"):
+			if _, err := restoreTarget(hdr.Name); err != nil {
+				return err
+			}
+			files++
+		}
+	}
+	if !database {
+		return errors.New("备份中缺少数据库")
+	}
+	var clients, logins int
+	ucenter.DB.Model(storage.FositeClient{}).Count(&clients)
+	ucenter.DB.Model(ucenter.Login{}).Count(&logins)
+	fmt.Fprintf(w, "数据库：将被覆盖，当前有 %d 个用户、%d 个应用、%d 个登录终端\n", users, clients, logins)
+	fmt.Fprintf(w, "上传文件：将写入 %d 个\n", files)
+	fmt.Fprintf(w, "签名密钥：备份中有 %d 把\n", len(m.SigningKeys))
+	if users > 0 {
+		fmt.Fprintln(w, "数据库中已有用户，实际恢复时需加 -force")
+	}
+	fmt.Fprintln(w, "预演完成，未做任何修改")
+	return nil
+}
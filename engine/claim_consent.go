@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+)
+
+// claimLabels 同意页中内置 claim 的名称
+var claimLabels = map[string]string{
+	"preferred_username": "用户名",
+	"picture":            "头像",
+	"updated_at":         "资料更新时间",
+	"email":              "邮箱地址",
+	"phone_number":       "手机号码",
+}
+
+// consentClaim 同意页中可单独授权的 claim
+type consentClaim struct {
+	Name      string
+	Label     string
+	Essential bool
+	Checked   bool
+}
+
+// requestedClaim OpenID Connect claims 参数中的单个 claim
+type requestedClaim struct {
+	Essential bool          `json:"essential"`
+	Value     interface{}   `json:"value"`
+	Values    []interface{} `json:"values"`
+}
+
+// claimsRequest OpenID Connect Core 5.5 的 claims 参数，分别申请 ID Token 与用户信息端点返回的 claims
+type claimsRequest struct {
+	UserInfo map[string]*requestedClaim `json:"userinfo"`
+	IDToken  map[string]*requestedClaim `json:"id_token"`
+}
+
+// scopeClaimNames scope 包含的 claims
+func scopeClaimNames(scope string) []string {
+	switch scope {
+	case "profile":
+		return []string{"preferred_username", "picture", "updated_at"}
+	case "email":
+		return []string{"email"}
+	case "phone":
+		return []string{"phone_number"}
+	}
+	s, ok := ucenter.C.CustomScopes[scope]
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(s.Claims))
+	for claim := range s.Claims {
+		names = append(names, claim)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// claimLabel claim 在同意页中的名称，自定义 claim 使用取值来源的说明
+func claimLabel(scope, claim string) string {
+	if label, ok := claimLabels[claim]; ok {
+		return label
+	}
+	if label, ok := ucenter.CustomScopeSources[ucenter.C.CustomScopes[scope].Claims[claim]]; ok {
+		return label
+	}
+	return claim
+}
+
+// parseClaimsRequest 解析授权请求的 claims 参数，未携带时返回空的请求
+func parseClaimsRequest(ar fosite.AuthorizeRequester) (*claimsRequest, error) {
+	req := new(claimsRequest)
+	raw := ar.GetRequestForm().Get("claims")
+	if raw == "" {
+		return req, nil
+	}
+	if err := json.Unmarshal([]byte(raw), req); err != nil {
+		return nil, fosite.ErrInvalidRequest.WithHint("The claims parameter must be a JSON object.")
+	}
+	return req, nil
+}
+
+// essential 应用标记为必需的 claims，ID Token 与用户信息端点中的同等对待
+func (r *claimsRequest) essential() map[string]bool {
+	essential := make(map[string]bool)
+	for _, claims := range []map[string]*requestedClaim{r.UserInfo, r.IDToken} {
+		for name, claim := range claims {
+			if claim != nil && claim.Essential {
+				essential[name] = true
+			}
+		}
+	}
+	return essential
+}
+
+// checkSubject claims 参数指定了 sub 时必须是当前用户，否则不能签发 ID Token
+func (r *claimsRequest) checkSubject(sub string) error {
+	for _, claims := range []map[string]*requestedClaim{r.UserInfo, r.IDToken} {
+		claim := claims["sub"]
+		if claim == nil {
+			continue
+		}
+		match := claim.Value == nil || claim.Value == sub
+		if len(claim.Values) > 0 {
+			match = false
+			for _, v := range claim.Values {
+				match = match || v == sub
+			}
+		}
+		if !match {
+			return fosite.ErrAccessDenied.WithHint("The requested subject does not match the authenticated user.")
+		}
+	}
+	return nil
+}
+
+// idTokenClaims ID Token 中的用户资料：profile scope 的 claims，以及 claims 参数为 ID Token 申请、在已授权 scope 内的 claims
+func (r *claimsRequest) idTokenClaims(u *ucenter.User, granted fosite.Arguments, withheld []string) map[string]interface{} {
+	claims := make(map[string]interface{})
+	if granted.Has("profile") {
+		claims = profileClaims(u)
+	}
+	if len(r.IDToken) > 0 {
+		available := scopeClaims(u, granted)
+		for name := range r.IDToken {
+			if v, ok := available[name]; ok {
+				claims[name] = v
+			}
+		}
+	}
+	return withholdClaims(claims, withheld)
+}
+
+// withholdsEssential 用户此前拒绝提供了应用标记为必需的 claim，需要重新征得同意
+func withholdsEssential(withheld []string, essential map[string]bool) bool {
+	for _, claim := range withheld {
+		if essential[claim] {
+			return true
+		}
+	}
+	return false
+}
+
+// consentClaims 同意页中各 scope 下可单独授权的 claims，只有一个 claim 的 scope 按 scope 授权
+func consentClaims(scopes fosite.Arguments, essential map[string]bool, withheld []string) map[string][]consentClaim {
+	isWithheld := make(map[string]bool)
+	for _, claim := range withheld {
+		isWithheld[claim] = true
+	}
+	res := make(map[string][]consentClaim)
+	for _, scope := range scopes {
+		names := scopeClaimNames(scope)
+		if len(names) < 2 {
+			continue
+		}
+		for _, name := range names {
+			res[scope] = append(res[scope], consentClaim{
+				Name:      name,
+				Label:     claimLabel(scope, name),
+				Essential: essential[name],
+				Checked:   essential[name] || !isWithheld[name],
+			})
+		}
+	}
+	return res
+}
+
+// withheldFromForm 同意页中未勾选的 claims，未授权的 scope 不记录
+func withheldFromForm(c *gin.Context, perms map[string]bool) []string {
+	var withheld []string
+	for scope, granted := range perms {
+		names := scopeClaimNames(scope)
+		if !granted || len(names) < 2 {
+			continue
+		}
+		for _, name := range names {
+			if c.PostForm("claim:"+name) != "on" {
+				withheld = append(withheld, name)
+			}
+		}
+	}
+	sort.Strings(withheld)
+	return withheld
+}
+
+// withholdClaims 删除用户拒绝提供的 claims
+func withholdClaims(claims map[string]interface{}, withheld []string) map[string]interface{} {
+	for _, claim := range withheld {
+		delete(claims, claim)
+	}
+	return claims
+}
+
+// authorizedWithheld 用户对应用拒绝提供的 claims
+func authorizedWithheld(userID uint, clientID string) []string {
+	var ua ucenter.UserAuthorized
+	if ucenter.DB.First(&ua, "user_id = ? AND client_id = ?", userID, clientID).Error != nil {
+		return nil
+	}
+	return ua.WithheldClaims
+}
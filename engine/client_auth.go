@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naiba/ucenter"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+func clientAuthFailureWindow() time.Duration {
+	return time.Minute * time.Duration(ucenter.C.ClientAuthFailureWindow)
+}
+
+// requestClientID 令牌端点请求中声明的 client_id，与 fosite 一样对 Basic 认证中的 ID 做 URL 解码
+func requestClientID(c *gin.Context) string {
+	clientID, _, ok := c.Request.BasicAuth()
+	if !ok {
+		return c.PostForm("client_id")
+	}
+	if id, err := url.QueryUnescape(clientID); err == nil {
+		return id
+	}
+	return clientID
+}
+
+// clientAuthLockedFor 客户端还需限流多久，0 表示未限流
+func clientAuthLockedFor(clientID string) time.Duration {
+	max := ucenter.C.ClientAuthMaxFailures
+	if max <= 0 || clientID == "" {
+		return 0
+	}
+	var failures []ucenter.ClientAuthFailure
+	ucenter.DB.Where("client_id = ? AND created_at > ?", clientID, time.Now().Add(-clientAuthFailureWindow())).
+		Order("created_at desc").Limit(max).Find(&failures)
+	if len(failures) < max {
+		return 0
+	}
+	return time.Until(failures[max-1].CreatedAt.Add(clientAuthFailureWindow()))
+}
+
+// clientAuthLocked 认证失败过多的客户端暂时拒绝，已返回 429 时为 true
+func clientAuthLocked(c *gin.Context, clientID string) bool {
+	d := clientAuthLockedFor(clientID)
+	if d <= 0 {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(d/time.Second)+1))
+	writeOAuthError(c, &fosite.RFC6749Error{
+		Name:        fosite.ErrInvalidClient.Name,
+		Description: "Too many failed client authentication attempts, try again later.",
+		Code:        http.StatusTooManyRequests,
+	})
+	return true
+}
+
+// writeOAuthError 以 RFC 6749 的格式返回错误，用于 fosite 未提供写出方法的端点
+func writeOAuthError(c *gin.Context, err error) {
+	e := fosite.ErrorToRFC6749Error(err)
+	c.JSON(e.Code, gin.H{"error": e.Name, "error_description": e.Description})
+}
+
+// recordClientAuthFailure 记录一次客户端认证失败
+func recordClientAuthFailure(clientID, ip string) {
+	if clientID == "" {
+		return
+	}
+	ucenter.DB.Delete(ucenter.ClientAuthFailure{}, "created_at < ?", time.Now().Add(-clientAuthFailureWindow()))
+	ucenter.DB.Create(&ucenter.ClientAuthFailure{
+		ClientID: clientID,
+		IP:       ip,
+	})
+}
+
+// isInvalidClient 是否为客户端认证失败
+func isInvalidClient(err error) bool {
+	e, ok := errors.Cause(err).(*fosite.RFC6749Error)
+	return ok && e.Name == fosite.ErrInvalidClient.Name
+}
+
+// clientAuthError 客户端认证失败的说明
+func clientAuthError(err error) string {
+	e, ok := errors.Cause(err).(*fosite.RFC6749Error)
+	if !ok {
+		return err.Error()
+	}
+	if e.Hint != "" {
+		return e.Description + " " + e.Hint
+	}
+	return e.Description
+}
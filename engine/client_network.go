@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/iplist"
+)
+
+// clientNetworkDenied 应用限定了来源网络时，拒绝从其他网络使用其凭证调用令牌、内省及吊销端点，
+// 拒绝时已写入响应。不计入认证失败次数，以免外部请求借此锁定应用。无法确认应用的限制时一律拒绝
+func clientNetworkDenied(c *gin.Context, clientID string) bool {
+	if clientID == "" {
+		return false
+	}
+	var client storage.FositeClient
+	err := ucenter.DB.Select("allowed_ips").Where("client_id = ?", clientID).First(&client).Error
+	if err == gorm.ErrRecordNotFound {
+		// 应用不存在，交由客户端认证拒绝
+		return false
+	}
+	if err != nil {
+		log.Printf("client network %s: %s", clientID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":             fosite.ErrServerError.Name,
+			"error_description": "The client network restriction could not be verified, try again later.",
+		})
+		return true
+	}
+	if len(client.AllowedIPs) == 0 {
+		return false
+	}
+	ip := clientIP(c)
+	if iplist.Contains(ip, client.AllowedIPs) {
+		return false
+	}
+	clientIPDenied.WithLabelValues(clientID).Inc()
+	audit(c, 0, ucenter.AuditClientIPDenied, clientTarget(clientID), c.Request.URL.Path)
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error":             fosite.ErrInvalidClient.Name,
+		"error_description": "The client is not allowed to authenticate from this network.",
+	})
+	return true
+}
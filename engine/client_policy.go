@@ -0,0 +1,36 @@
+package engine
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/clientpolicy"
+)
+
+// clientPolicyDenied 已注册的应用授权策略不允许该用户授权此应用时展示原因，拒绝时已写入响应
+func clientPolicyDenied(c *gin.Context, user *ucenter.User, ar fosite.AuthorizeRequester) bool {
+	reason, err := clientpolicy.Check(clientpolicy.Request{
+		UserID:   user.ID,
+		ClientID: ar.GetClient().GetID(),
+		Scopes:   ar.GetRequestedScopes(),
+	})
+	if err == nil && reason == "" {
+		return false
+	}
+	if err != nil {
+		log.Printf("应用授权策略检查失败 %s: %s", ar.GetClient().GetID(), err)
+		if reason == "" {
+			reason = "暂时无法确认您能否使用该应用，请稍后再试"
+		}
+	}
+	c.HTML(http.StatusForbidden, "page/info", gin.H{
+		"icon":  "ban",
+		"title": "无法授权该应用",
+		"msg":   reason,
+	})
+	return true
+}
@@ -0,0 +1,42 @@
+package engine
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+)
+
+// allowedScopes 去掉应用授权范围之外的 scope
+func allowedScopes(client fosite.Client, scopes fosite.Arguments) fosite.Arguments {
+	allowed := fosite.Arguments{}
+	for _, scope := range scopes {
+		if fosite.HierarchicScopeStrategy(client.GetScopes(), scope) {
+			allowed = append(allowed, scope)
+		}
+	}
+	return allowed
+}
+
+// narrowRequestScope 应用选择收窄授权范围时，在 fosite 校验之前去掉授权请求中范围之外的 scope，
+// 否则由 fosite 以 invalid_scope 拒绝
+func narrowRequestScope(c *gin.Context) {
+	client, err := oauth2store.GetClient(c, c.Query("client_id"))
+	if err != nil {
+		return
+	}
+	cli, ok := client.(*storage.FositeClient)
+	if !ok || !cli.NarrowScope {
+		return
+	}
+	scope := strings.Join(allowedScopes(cli, strings.Fields(c.Query("scope"))), " ")
+	q := c.Request.URL.Query()
+	q.Set("scope", scope)
+	c.Request.URL.RawQuery = q.Encode()
+	// 表单可能已被中间件解析
+	if c.Request.Form != nil {
+		c.Request.Form.Set("scope", scope)
+	}
+}
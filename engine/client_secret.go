@@ -0,0 +1,42 @@
+package engine
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+// clientSecretGrace 轮换密钥时旧密钥的宽限期
+func clientSecretGrace() time.Duration {
+	return time.Hour * time.Duration(ucenter.C.ClientSecretGraceHours)
+}
+
+// rotateClientSecret 生成新密钥并返回明文。grace 大于 0 时当前密钥在宽限期内仍然有效，
+// 否则立即失效。宽限期内再次轮换时，更早的旧密钥随即失效
+func rotateClientSecret(client *storage.FositeClient, grace time.Duration) (string, error) {
+	secret, err := password.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	client.RotatedSecret = ""
+	client.RotatedSecretExpiresAt = nil
+	if grace > 0 && client.Secret != "" {
+		expires := time.Now().Add(grace)
+		client.RotatedSecret = client.Secret
+		client.RotatedSecretExpiresAt = &expires
+	}
+	client.Secret = string(b)
+	return secret, ucenter.DB.Model(client).Updates(map[string]interface{}{
+		"secret":                    client.Secret,
+		"rotated_secret":            client.RotatedSecret,
+		"rotated_secret_expires_at": client.RotatedSecretExpiresAt,
+	}).Error
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+)
+
+// applyClientTemplate 按模板预填新应用的授权类型、认证方式、令牌有效期、PKCE 及 PAR
+func applyClientTemplate(client *storage.FositeClient, name string, tpl ucenter.ClientTemplate) {
+	client.Template = name
+	client.GrantTypes = tpl.GrantTypes
+	client.ResponseTypes = tpl.ResponseTypes
+	client.Scope = tpl.DefaultScope
+	client.TokenEndpointAuthMethod = tpl.AuthMethod
+	client.AccessTokenLifespan = tpl.AccessTokenLifespan
+	client.RefreshTokenLifespan = tpl.RefreshTokenLifespan
+	client.RequirePKCE = tpl.RequirePKCE
+	client.RequirePushedAuthorizationRequests = tpl.RequirePAR
+	client.Machine = tpl.Machine
+}
+
+// checkTemplateScope scope 是否在应用模板允许的范围内，未使用模板的旧应用及机器应用（由 RAM 策略限制）不限制
+func checkTemplateScope(client *storage.FositeClient, scope string) error {
+	tpl, ok := ucenter.C.ClientTemplates[client.Template]
+	if !ok || client.Machine {
+		return nil
+	}
+	max := fosite.Arguments(strings.Fields(tpl.MaxScope))
+	for _, s := range strings.Fields(scope) {
+		if !max.Has(s) {
+			return fmt.Errorf("%s 类型的应用不能申请 %s", tpl.Name, s)
+		}
+	}
+	return nil
+}
+
+// isFirstParty 是否为管理员标记的第一方应用
+func isFirstParty(client fosite.Client) bool {
+	cli, ok := client.(*storage.FositeClient)
+	return ok && cli.FirstParty
+}
+
+// checkClientActive 禁用或待审核的应用不能发起授权、换取令牌
+func checkClientActive(client fosite.Client) error {
+	if cli, ok := client.(*storage.FositeClient); ok && cli.Status == storage.StatusOauthClientSuspended {
+		return fosite.ErrUnauthorizedClient.WithHint("This client is suspended or awaiting approval.")
+	}
+	return nil
+}
+
+// checkClientPKCE 应用要求 PKCE 时，授权请求必须携带 S256 的 code_challenge
+func checkClientPKCE(ar fosite.AuthorizeRequester) error {
+	client, ok := ar.GetClient().(*storage.FositeClient)
+	if !ok || !client.RequirePKCE || !ar.GetResponseTypes().Has("code") {
+		return nil
+	}
+	form := ar.GetRequestForm()
+	if form.Get("code_challenge") == "" || form.Get("code_challenge_method") != "S256" {
+		return fosite.ErrInvalidRequest.WithHint("This client must use PKCE with the S256 code challenge method.")
+	}
+	return nil
+}
+
+// applyClientLifespans 按应用设置覆盖令牌有效期，未设置的使用全局默认值
+func applyClientLifespans(ar fosite.AccessRequester) {
+	client, ok := ar.GetClient().(*storage.FositeClient)
+	if !ok {
+		return
+	}
+	if client.AccessTokenLifespan > 0 {
+		ar.GetSession().SetExpiresAt(fosite.AccessToken, time.Now().UTC().Add(time.Minute*time.Duration(client.AccessTokenLifespan)).Round(time.Second))
+	}
+	// 刷新令牌沿用首次签发时的有效期，轮换不会延长
+	refresh := client.RefreshTokenLifespan
+	if refresh == 0 {
+		refresh = ucenter.C.RefreshTokenLifespan
+	}
+	if refresh > 0 && ar.GetSession().GetExpiresAt(fosite.RefreshToken).IsZero() {
+		ar.GetSession().SetExpiresAt(fosite.RefreshToken, time.Now().UTC().Add(time.Hour*time.Duration(refresh)).Round(time.Second))
+	}
+}
+
+// setIDTokenExpiry 按应用设置 ID Token 的有效期，由 clientIDTokenStrategy 在每次签发前调用
+func setIDTokenExpiry(client fosite.Client, session fosite.Session) {
+	cli, ok := client.(*storage.FositeClient)
+	s, ok2 := session.(*storage.FositeSession)
+	if !ok || !ok2 || cli.IDTokenLifespan <= 0 {
+		return
+	}
+	s.IDTokenClaims().ExpiresAt = time.Now().UTC().Add(time.Minute * time.Duration(cli.IDTokenLifespan)).Round(time.Second)
+}
@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	jwt2 "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+)
+
+// ntpEpochOffset NTP 纪元（1900 年）与 Unix 纪元相差的秒数
+const ntpEpochOffset = 2208988800
+
+// tokenLeeway 校验 exp、iat、nbf 时允许的时钟偏差
+func tokenLeeway() time.Duration {
+	return time.Second * time.Duration(ucenter.C.TokenLeeway)
+}
+
+// numericClaim 读取 NumericDate 类型的 claim
+func numericClaim(claims jwt2.MapClaims, name string) (int64, bool) {
+	switch v := claims[name].(type) {
+	case float64:
+		return int64(v), true
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// verifyTimeClaims 按 token_leeway 校验 exp、iat、nbf。fosite 会对解码结果再次调用 Claims.Valid()，
+// 因此在容差内通过的值按当前时间改写，避免再次校验时失败
+func verifyTimeClaims(claims jwt2.MapClaims) error {
+	now := time.Now().Unix()
+	leeway := int64(ucenter.C.TokenLeeway)
+	ve := new(jwt2.ValidationError)
+	if exp, ok := numericClaim(claims, "exp"); ok {
+		if exp < now-leeway {
+			ve.Inner = errors.New("Token is expired")
+			ve.Errors |= jwt2.ValidationErrorExpired
+		} else if exp < now {
+			claims["exp"] = float64(now + leeway)
+		}
+	}
+	if iat, ok := numericClaim(claims, "iat"); ok {
+		if iat > now+leeway {
+			ve.Inner = errors.New("Token used before issued")
+			ve.Errors |= jwt2.ValidationErrorIssuedAt
+		} else if iat > now {
+			claims["iat"] = float64(now)
+		}
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok {
+		if nbf > now+leeway {
+			ve.Inner = errors.New("Token is not valid yet")
+			ve.Errors |= jwt2.ValidationErrorNotValidYet
+		} else if nbf > now {
+			claims["nbf"] = float64(now)
+		}
+	}
+	if ve.Errors != 0 {
+		return ve
+	}
+	return nil
+}
+
+// dbClockOffset 本机时钟与数据库的偏差，正数表示本机偏快
+func dbClockOffset() (time.Duration, error) {
+	var dbNow time.Time
+	start := time.Now()
+	if err := ucenter.DB.Raw("SELECT clock_timestamp()").Row().Scan(&dbNow); err != nil {
+		return 0, err
+	}
+	mid := start.Add(time.Since(start) / 2)
+	return mid.Sub(dbNow), nil
+}
+
+// ntpTime 解析 NTP 时间戳
+func ntpTime(b []byte) time.Time {
+	sec := int64(binary.BigEndian.Uint32(b[:4]))
+	frac := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(sec-ntpEpochOffset, frac*1e9>>32)
+}
+
+// ntpClockOffset 以 SNTP（RFC 4330）查询本机时钟与 NTP 服务器的偏差，正数表示本机偏快
+func ntpClockOffset(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, time.Second*2)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 2))
+
+	req := make([]byte, 48)
+	// LI = 0，版本 3，客户端模式
+	req[0] = 0x1b
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	t4 := time.Now()
+	if n < 48 || resp[1] == 0 {
+		return 0, errors.New("NTP 服务器响应无效")
+	}
+	t2 := ntpTime(resp[32:40])
+	t3 := ntpTime(resp[40:48])
+	return -(t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+// clockStatus 管理中心展示的时钟偏差，超过容差的一半时提示
+func clockStatus() gin.H {
+	threshold := tokenLeeway() / 2
+	if threshold < time.Second {
+		threshold = time.Second
+	}
+	status := gin.H{"leeway": ucenter.C.TokenLeeway}
+	var errs []string
+	drift := false
+	if d, err := dbClockOffset(); err != nil {
+		errs = append(errs, fmt.Sprintf("读取数据库时间失败：%s", err))
+	} else {
+		status["db"] = d.Round(time.Millisecond).String()
+		drift = drift || d > threshold || d < -threshold
+	}
+	if ucenter.C.NTPServer != "" {
+		status["server"] = ucenter.C.NTPServer
+		if d, err := ntpClockOffset(ucenter.C.NTPServer); err != nil {
+			errs = append(errs, fmt.Sprintf("查询 NTP 服务器失败：%s", err))
+		} else {
+			status["ntp"] = d.Round(time.Millisecond).String()
+			drift = drift || d > threshold || d < -threshold
+		}
+	}
+	status["errors"] = errs
+	status["drift"] = drift
+	return status
+}
@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// connectedApp 用户已授权的应用，来自授权记录及有效的令牌
+type connectedApp struct {
+	Client       storage.FositeClient
+	Scopes       []ucenter.Scope
+	AuthorizedAt *time.Time
+	FirstUsedAt  *time.Time
+	LastUsedAt   *time.Time
+	// Authorized 授权记录，只有令牌时为空
+	Authorized *ucenter.UserAuthorized
+}
+
+func connectedApps(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	grants, err := oauth2store.(*storage.FositeStore).ClientGrants(u.StrID())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	var authorized []ucenter.UserAuthorized
+	ucenter.DB.Where("user_id = ?", u.ID).Find(&authorized)
+
+	registered := registeredScopes()
+	apps := make(map[string]*connectedApp)
+	app := func(clientID string) *connectedApp {
+		if a, ok := apps[clientID]; ok {
+			return a
+		}
+		a := new(connectedApp)
+		if ucenter.DB.Where("client_id = ?", clientID).First(&a.Client).Error != nil {
+			a.Client.ClientID = clientID
+			a.Client.Name = clientID
+		}
+		apps[clientID] = a
+		return a
+	}
+	scopeOf := func(name string) ucenter.Scope {
+		if s, ok := registered[name]; ok {
+			return s
+		}
+		return ucenter.Scope{Name: name, DisplayName: name, Icon: "key"}
+	}
+	for i := range authorized {
+		a := app(authorized[i].ClientID)
+		a.AuthorizedAt = &authorized[i].UpdatedAt
+		a.Authorized = &authorized[i]
+		for _, scope := range authorized[i].Scope {
+			if authorized[i].Permission[scope] {
+				a.Scopes = append(a.Scopes, scopeOf(scope))
+			}
+		}
+	}
+	for id, g := range grants {
+		a := app(id)
+		first, last := g.FirstUsedAt, g.LastUsedAt
+		a.FirstUsedAt, a.LastUsedAt = &first, &last
+		// 没有授权记录的令牌（如旧版本签发）按令牌的 scope 展示
+		if a.AuthorizedAt == nil {
+			for _, scope := range g.Scopes {
+				a.Scopes = append(a.Scopes, scopeOf(scope))
+			}
+		}
+	}
+
+	list := make([]*connectedApp, 0, len(apps))
+	for _, a := range apps {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return lastActive(list[i]).After(lastActive(list[j]))
+	})
+	c.HTML(http.StatusOK, "user/connected", nbgin.Data(c, gin.H{
+		"apps": list,
+	}))
+}
+
+// lastActive 应用最近一次授权或使用的时间
+func lastActive(a *connectedApp) time.Time {
+	var t time.Time
+	if a.AuthorizedAt != nil {
+		t = *a.AuthorizedAt
+	}
+	if a.LastUsedAt != nil && a.LastUsedAt.After(t) {
+		t = *a.LastUsedAt
+	}
+	return t
+}
+
+// revokeConnectedApp 撤销对应用的全部授权，应用持有的令牌立即失效
+func revokeConnectedApp(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	clientID := c.Param("id")
+	if err := oauth2store.(*storage.FositeStore).RevokeClientTokens(u.StrID(), clientID); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err := ucenter.DB.Delete(ucenter.UserAuthorized{}, "user_id = ? AND client_id = ?", u.ID, clientID).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditTokenRevoke, clientTarget(clientID), "撤销应用授权")
+}
+
+// revokeConnectedScope 撤销对应用授予的单个 scope，含该 scope 的令牌立即失效，应用再次申请时需重新同意
+func revokeConnectedScope(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	clientID, scope := c.Param("id"), c.Param("scope")
+	if scope == "openid" {
+		c.String(http.StatusForbidden, "openid 为必选授权，请撤销整个应用的授权")
+		return
+	}
+	var ua ucenter.UserAuthorized
+	if err := ucenter.DB.First(&ua, "user_id = ? AND client_id = ?", u.ID, clientID).Error; err == nil {
+		scopes := fosite.Arguments{}
+		for _, s := range ua.Scope {
+			if s != scope {
+				scopes = append(scopes, s)
+			}
+		}
+		delete(ua.Permission, scope)
+		raw, _ := json.Marshal(ua.Permission)
+		if err := ucenter.DB.Model(ucenter.UserAuthorized{}).Where("user_id = ? AND client_id = ?", u.ID, clientID).UpdateColumns(map[string]interface{}{
+			"scope":          pq.StringArray(scopes),
+			"permission_raw": string(raw),
+			"updated_at":     time.Now(),
+		}).Error; err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := oauth2store.(*storage.FositeStore).RevokeClientScopeTokens(u.StrID(), clientID, scope); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditTokenRevoke, clientTarget(clientID), "撤销授权范围 "+scope)
+}
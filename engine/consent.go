@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// challengeAPIAuth 外部登录、授权界面调用的 API 使用密钥鉴权
+func challengeAPIAuth(c *gin.Context) {
+	key := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if ucenter.C.ChallengeAPIKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(ucenter.C.ChallengeAPIKey)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+}
+
+// withQuery 为站内链接追加参数，返回完整地址
+func withQuery(requestURL, key, value string) string {
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	u.Scheme = ucenter.C.WebProtocol
+	u.Host = ucenter.C.Domain
+	return u.String()
+}
+
+// redirectToConsentUI 创建授权挑战并跳转到外部授权界面
+func redirectToConsentUI(c *gin.Context, user *ucenter.User, ar fosite.AuthorizeRequester) {
+	cc, err := oauth2store.(*storage.FositeStore).CreateConsentChallenge(ar.GetClient().GetID(), user.StrID(), c.Request.RequestURI, ar.GetRequestedScopes())
+	if err != nil {
+		oauth2provider.WriteAuthorizeError(c.Writer, ar, err)
+		return
+	}
+	u, err := url.Parse(ucenter.C.ConsentURL)
+	if err != nil {
+		oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrServerError)
+		return
+	}
+	q := u.Query()
+	q.Set("consent_challenge", cc.ID)
+	u.RawQuery = q.Encode()
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, u.String())
+}
+
+// consumeConsentVerifier 取回外部授权界面的处理结果
+func consumeConsentVerifier(verifier string, user *ucenter.User, ar fosite.AuthorizeRequester) (map[string]bool, error) {
+	cc, err := oauth2store.(*storage.FositeStore).ConsumeConsentVerifier(verifier)
+	if err != nil {
+		return nil, err
+	}
+	if cc.Subject != user.StrID() || cc.ClientID != ar.GetClient().GetID() {
+		return nil, fosite.ErrRequestForbidden.WithHint("The consent verifier does not belong to this request.")
+	}
+	if cc.Status != storage.ConsentAccepted {
+		return nil, fosite.ErrAccessDenied
+	}
+	perms := make(map[string]bool)
+	for _, scope := range ar.GetRequestedScopes() {
+		perms[scope] = fosite.Arguments(cc.GrantedScopes).Has(scope)
+	}
+	return perms, nil
+}
+
+func consentChallenge(c *gin.Context) {
+	cc, err := oauth2store.(*storage.FositeStore).GetConsentChallenge(c.Query("challenge"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	client, err := oauth2store.GetClient(nil, cc.ClientID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	var user ucenter.User
+	if err := ucenter.DB.First(&user, "id = ?", cc.Subject).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	type scope struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+		Description string `json:"description"`
+		Icon        string `json:"icon"`
+		Sensitive   bool   `json:"sensitive"`
+	}
+	registered := registeredScopes()
+	var scopes []scope
+	for _, s := range cc.RequestedScopes {
+		r := registered[s]
+		scopes = append(scopes, scope{Name: s, DisplayName: r.DisplayName, Description: r.Description, Icon: r.Icon, Sensitive: r.Sensitive})
+	}
+	fc := client.(*storage.FositeClient)
+	c.JSON(http.StatusOK, gin.H{
+		"challenge": cc.ID,
+		"client": gin.H{
+			"client_id":   fc.ClientID,
+			"client_name": fc.Name,
+			"client_uri":  fc.ClientURI,
+			"logo_uri":    fc.LogoURI,
+		},
+		"subject": cc.Subject,
+		"user": gin.H{
+			"username": user.Username,
+			"avatar":   user.Avatar,
+			"picture":  avatarPicture(&user),
+		},
+		"requested_scope": scopes,
+		"expires_at":      cc.ExpiresAt,
+	})
+}
+
+func acceptConsent(c *gin.Context) {
+	type acceptForm struct {
+		GrantScope []string `json:"grant_scope"`
+	}
+	var af acceptForm
+	if err := c.ShouldBindJSON(&af); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cc, err := oauth2store.(*storage.FositeStore).AcceptConsentChallenge(c.Query("challenge"), af.GrantScope)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"redirect_to": withQuery(cc.RequestURL, "consent_verifier", cc.Verifier),
+	})
+}
+
+func rejectConsent(c *gin.Context) {
+	cc, err := oauth2store.(*storage.FositeStore).RejectConsentChallenge(c.Query("challenge"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"redirect_to": withQuery(cc.RequestURL, "consent_verifier", cc.Verifier),
+	})
+}
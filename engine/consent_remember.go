@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+)
+
+// 授权页上用户选择的记住期限
+const (
+	consentRememberOnce    = "once"
+	consentRememberDays    = "days"
+	consentRememberForever = "forever"
+)
+
+// consentRememberForeverAllowed 申请了敏感 scope 时不允许一直记住用户的同意
+func consentRememberForeverAllowed(requested fosite.Arguments, scopes map[string]ucenter.Scope) bool {
+	if !ucenter.C.ConsentRememberForever {
+		return false
+	}
+	for _, scope := range requested {
+		if scopes[scope].Sensitive {
+			return false
+		}
+	}
+	return true
+}
+
+// consentRememberUntil 按授权页的选择计算同意记住到何时，nil 为一直记住。
+// 仅本次时记为当前时间，授权仍保留在已授权应用中，下次授权需要重新同意；
+// 未选择或选择了不允许的期限时按天数记住
+func consentRememberUntil(c *gin.Context, foreverAllowed bool) *time.Time {
+	now := time.Now()
+	switch c.PostForm("remember") {
+	case consentRememberOnce:
+		return &now
+	case consentRememberForever:
+		if foreverAllowed {
+			return nil
+		}
+	}
+	until := now.AddDate(0, 0, ucenter.C.ConsentRememberDays)
+	return &until
+}
@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// csrfHeader 通过 Ajax 提交 CSRF Token 的请求头
+const csrfHeader = "X-CSRF-Token"
+
+// csrfExempt 使用其他方式认证、不经浏览器会话的路由前缀
+var csrfExempt = []string{
+	"/oauth2/token",
+	"/oauth2/revoke",
+	"/oauth2/introspect",
+	"/oauth2/register",
+	"/oauth2/device_authorization",
+	"/oauth2/par",
+	"/oauth2/consent",
+	"/oauth2/login",
+	"/oauth2/logout",
+	"/api/",
+}
+
+// csrfMiddleware 为每个浏览器会话下发 CSRF Token，并校验所有修改数据的请求
+func csrfMiddleware(c *gin.Context) {
+	token, err := c.Cookie(ucenter.CSRFCookieName)
+	if err != nil || token == "" {
+		if token, err = newCSRFToken(c); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	c.Set(ucenter.CSRFToken, token)
+
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return
+	}
+	path := c.MustGet(ucenter.RequestRouter).(string)
+	for _, prefix := range csrfExempt {
+		if strings.HasPrefix(path, prefix) {
+			return
+		}
+	}
+	if !validCSRF(c) {
+		if c.GetHeader(csrfHeader) != "" || c.GetHeader("X-Requested-With") != "" {
+			c.String(http.StatusForbidden, "页面已过期，请刷新后重试")
+		} else {
+			c.HTML(http.StatusForbidden, "page/info", gin.H{
+				"icon":  "shield alternate",
+				"title": "请求已失效",
+				"msg":   "页面已过期，请返回刷新后重试",
+			})
+		}
+		c.Abort()
+	}
+}
+
+// newCSRFToken 生成新的 CSRF Token 并写入 Cookie，登录后调用以避免会话固定
+func newCSRFToken(c *gin.Context) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	nbgin.SetCookie(c, 0, ucenter.CSRFCookieName, token)
+	c.Set(ucenter.CSRFToken, token)
+	return token, nil
+}
+
+// validCSRF 请求头、表单或 URL 中的 Token 是否与会话一致
+func validCSRF(c *gin.Context) bool {
+	expected, _ := c.Get(ucenter.CSRFToken)
+	token := c.GetHeader(csrfHeader)
+	if token == "" {
+		token = c.PostForm("_csrf")
+	}
+	if token == "" {
+		token = c.Query("_csrf")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected.(string))) == 1
+}
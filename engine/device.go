@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/mail"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+func devices(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var logins []ucenter.Login
+	ucenter.DB.Where("user_id = ?", u.ID).Order("last_seen_at desc").Find(&logins)
+	var clients = make(map[string][]storage.FositeClient)
+	for i := 0; i < len(logins); i++ {
+		clients[logins[i].PublicID()] = loginClients(logins[i].Token)
+	}
+	var trusted []ucenter.TrustedDevice
+	ucenter.DB.Where("user_id = ? AND expires_at > ?", u.ID, time.Now()).Order("last_used_at desc").Find(&trusted)
+	c.HTML(http.StatusOK, "user/devices", nbgin.Data(c, gin.H{
+		"logins":  logins,
+		"clients": clients,
+		"trusted": trusted,
+		"current": c.MustGet(ucenter.AuthLogin).(*ucenter.Login).PublicID(),
+	}))
+}
+
+func revokeDevice(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var logins []ucenter.Login
+	ucenter.DB.Where("user_id = ?", u.ID).Find(&logins)
+	for i := 0; i < len(logins); i++ {
+		if logins[i].PublicID() == c.Param("id") {
+			backchannelLogout(u.ID, logins[i].Token)
+			if err := ucenter.DB.Delete(&logins[i]).Error; err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			ucenter.DB.Delete(ucenter.LoginClient{}, "login_token = ?", logins[i].Token)
+			untrustLogins(logins[i].Token)
+			auditCurrent(c, ucenter.AuditSessionRevoke, userTarget(u.ID), logins[i].Name+" "+logins[i].IP)
+			return
+		}
+	}
+	c.AbortWithStatus(http.StatusNotFound)
+}
+
+func revokeAllDevices(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	backchannelLogout(u.ID, userLoginTokens(u.ID)...)
+	if err := ucenter.DB.Delete(ucenter.Login{}, "user_id = ?", u.ID).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ucenter.DB.Delete(ucenter.TrustedDevice{}, "user_id = ?", u.ID)
+	auditCurrent(c, ucenter.AuditSessionRevoke, userTarget(u.ID), "全部设备")
+	nbgin.SetCookie(c, -1, ucenter.C.AuthCookieName, "")
+	setBrowserState(c, "")
+}
+
+// checkNewDevice 记录登录设备，首次出现的设备发送提醒邮件
+func checkNewDevice(u *ucenter.User, l *ucenter.Login, rawUA string) {
+	// IPv6 按前缀计算，同一网段内轮换的临时地址不算新设备
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256([]byte(rawUA+"|"+ipKey(l.IP))))
+	var known, total int
+	ucenter.DB.Model(ucenter.KnownDevice{}).Where("user_id = ? AND fingerprint = ?", u.ID, fingerprint).Count(&known)
+	if known > 0 {
+		return
+	}
+	ucenter.DB.Model(ucenter.KnownDevice{}).Where("user_id = ?", u.ID).Count(&total)
+	revokeToken, err := password.GenerateSecret()
+	if err != nil {
+		log.Printf("known device %s: %s", u.StrID(), err)
+		return
+	}
+	device := ucenter.KnownDevice{
+		UserID:      u.ID,
+		Fingerprint: fingerprint,
+		LoginToken:  l.Token,
+		RevokeToken: revokeToken,
+	}
+	if err := ucenter.DB.Create(&device).Error; err != nil {
+		log.Printf("known device %s: %s", u.StrID(), err)
+		return
+	}
+	// 首次登录不算新设备
+	if total == 0 || u.Email == "" || !mail.Enabled() {
+		return
+	}
+	location := l.Location
+	if location == "" {
+		location = "未知"
+	}
+	notifySecurity(u, ucenter.AlertNewDevice, fmt.Sprintf("您的账户在新设备上登录。\n设备：%s\nIP：%s\n位置：%s\n如果这不是您本人的操作，请点击以下链接下线该设备并尽快修改密码：\n%s",
+		l.Name, l.IP, location, mail.SiteURL("/device/reject/"+device.RevokeToken)))
+}
+
+// rejectDevice 新设备提醒邮件中的“不是我本人”
+func rejectDevice(c *gin.Context) {
+	var device ucenter.KnownDevice
+	if ucenter.DB.First(&device, "revoke_token = ?", c.Param("token")).Error != nil {
+		c.HTML(http.StatusNotFound, "page/info", gin.H{
+			"icon":  "unlink",
+			"title": "链接无效",
+			"msg":   "链接已失效或该设备已被下线",
+		})
+		return
+	}
+	endLogin(device.UserID, device.LoginToken)
+	untrustLogins(device.LoginToken)
+	ucenter.DB.Delete(&device)
+	c.HTML(http.StatusOK, "page/info", gin.H{
+		"icon":  "shield alternate",
+		"title": "设备已下线",
+		"msg":   "该设备的登录已失效，请尽快登录并修改密码。",
+	})
+}
+
+// recordLoginClient 记录终端登录过的应用
+func recordLoginClient(l *ucenter.Login, clientID string) {
+	var lc ucenter.LoginClient
+	if err := ucenter.DB.Where(ucenter.LoginClient{LoginToken: l.Token, ClientID: clientID}).
+		Assign(ucenter.LoginClient{UpdatedAt: time.Now()}).FirstOrCreate(&lc).Error; err != nil {
+		log.Printf("login client %s: %s", clientID, err)
+	}
+}
+
+// loginClients 终端登录过的应用，退出登录时将一同通知
+func loginClients(token string) []storage.FositeClient {
+	var clients []storage.FositeClient
+	ucenter.DB.Joins("JOIN login_clients ON login_clients.client_id = fosite_clients.client_id").
+		Where("login_clients.login_token = ?", token).Find(&clients)
+	return clients
+}
+
+// loginClientGCJob 清理已失效终端的应用记录
+func loginClientGCJob() error {
+	return ucenter.DB.Exec("DELETE FROM login_clients WHERE login_token NOT IN (SELECT token FROM logins)").Error
+}
@@ -0,0 +1,343 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/pkg/errors"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+	"github.com/naiba/ucenter/pkg/usercode"
+)
+
+// deviceCodeGrantType 设备授权（RFC 8628）的 grant_type
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// 设备轮询令牌端点时的错误（RFC 8628 第 3.5 节）
+var (
+	errAuthorizationPending = &fosite.RFC6749Error{
+		Name:        "authorization_pending",
+		Description: "The user has not yet completed the authorization.",
+		Code:        http.StatusBadRequest,
+	}
+	errSlowDown = &fosite.RFC6749Error{
+		Name:        "slow_down",
+		Description: "The device is polling too frequently, increase the interval by 5 seconds.",
+		Code:        http.StatusBadRequest,
+	}
+	errExpiredToken = &fosite.RFC6749Error{
+		Name:        "expired_token",
+		Description: "The device code has expired, restart the device authorization.",
+		Code:        http.StatusBadRequest,
+	}
+)
+
+// deviceCodeHandler 令牌端点处理设备码换取令牌
+type deviceCodeHandler struct {
+	*oauth2.HandleHelper
+	RefreshTokenStrategy oauth2.RefreshTokenStrategy
+	RefreshTokenStorage  oauth2.RefreshTokenStorage
+	IDTokenStrategy      openid.OpenIDConnectTokenStrategy
+	store                *storage.FositeStore
+}
+
+func deviceCodeGrantFactory(config *compose.Config, store interface{}, strategy interface{}) interface{} {
+	return &deviceCodeHandler{
+		HandleHelper: &oauth2.HandleHelper{
+			AccessTokenStrategy: strategy.(oauth2.AccessTokenStrategy),
+			AccessTokenStorage:  store.(oauth2.AccessTokenStorage),
+			AccessTokenLifespan: config.GetAccessTokenLifespan(),
+		},
+		RefreshTokenStrategy: strategy.(oauth2.RefreshTokenStrategy),
+		RefreshTokenStorage:  store.(oauth2.RefreshTokenStorage),
+		IDTokenStrategy:      strategy.(openid.OpenIDConnectTokenStrategy),
+		store:                store.(*storage.FositeStore),
+	}
+}
+
+func deviceCodeInterval() time.Duration {
+	return time.Second * time.Duration(ucenter.C.DeviceCodeInterval)
+}
+
+// HandleTokenEndpointRequest 校验设备码，用户确认后还原确认时的 Session 及授予的 scope
+func (h *deviceCodeHandler) HandleTokenEndpointRequest(ctx context.Context, requester fosite.AccessRequester) error {
+	if !requester.GetGrantTypes().Exact(deviceCodeGrantType) {
+		return errors.WithStack(fosite.ErrUnknownRequest)
+	}
+	if !requester.GetClient().GetGrantTypes().Has(deviceCodeGrantType) {
+		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHint("The client is not allowed to use the device code grant."))
+	}
+	dc, err := h.store.GetDeviceCodeSession(requester.GetRequestForm().Get("device_code"))
+	if err != nil || dc.ClientID != requester.GetClient().GetID() {
+		return errors.WithStack(fosite.ErrInvalidGrant.WithHint("The device code is invalid."))
+	}
+	if time.Now().After(dc.ExpiresAt) {
+		return errors.WithStack(errExpiredToken)
+	}
+	tooFast := dc.LastPolledAt != nil && time.Since(*dc.LastPolledAt) < deviceCodeInterval()
+	if err := h.store.TouchDeviceCode(dc); err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+	switch dc.Status {
+	case storage.DeviceCodePending:
+		if tooFast {
+			return errors.WithStack(errSlowDown)
+		}
+		return errors.WithStack(errAuthorizationPending)
+	case storage.DeviceCodeDenied:
+		return errors.WithStack(fosite.ErrAccessDenied.WithHint("The user denied the authorization request."))
+	case storage.DeviceCodeApproved:
+	default:
+		return errors.WithStack(fosite.ErrInvalidGrant.WithHint("The device code has already been used."))
+	}
+	if err := h.store.ConsumeDeviceCode(dc); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(dc.Session, requester.GetSession()); err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+	requester.SetID(dc.RequestID)
+	requester.SetRequestedScopes(fosite.Arguments(dc.Scopes))
+	for _, scope := range dc.GrantedScope {
+		requester.GrantScope(scope)
+	}
+	if requester.GetSession().GetExpiresAt(fosite.AccessToken).IsZero() {
+		requester.GetSession().SetExpiresAt(fosite.AccessToken, time.Now().UTC().Add(h.AccessTokenLifespan))
+	}
+	return nil
+}
+
+// PopulateTokenEndpointResponse 签发访问令牌，应用可使用 refresh_token 时签发刷新令牌，授予 openid 时签发 ID Token
+func (h *deviceCodeHandler) PopulateTokenEndpointResponse(ctx context.Context, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
+	if !requester.GetGrantTypes().Exact(deviceCodeGrantType) {
+		return errors.WithStack(fosite.ErrUnknownRequest)
+	}
+	if err := h.IssueAccessToken(ctx, requester, responder); err != nil {
+		return err
+	}
+	if requester.GetClient().GetGrantTypes().Has("refresh_token") {
+		refresh, signature, err := h.RefreshTokenStrategy.GenerateRefreshToken(ctx, requester)
+		if err != nil {
+			return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+		}
+		if err := h.RefreshTokenStorage.CreateRefreshTokenSession(ctx, signature, requester.Sanitize([]string{})); err != nil {
+			return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+		}
+		responder.SetExtra("refresh_token", refresh)
+	}
+	if requester.GetGrantedScopes().Has("openid") {
+		token, err := h.IDTokenStrategy.GenerateIDToken(ctx, requester)
+		if err != nil {
+			return err
+		}
+		responder.SetExtra("id_token", token)
+	}
+	return nil
+}
+
+// deviceAuthorization 设备授权端点，为电视、命令行等输入不便的设备签发设备码与用户验证码
+func deviceAuthorization(c *gin.Context) {
+	clientID := requestClientID(c)
+	if clientAuthLocked(c, clientID) {
+		return
+	}
+	ctx, err := mtlsClientAuth(c, c)
+	if err != nil {
+		recordClientAuthFailure(clientID, clientIP(c))
+		writeOAuthError(c, err)
+		return
+	}
+	client, err := oauth2provider.(*fosite.Fosite).AuthenticateClient(ctx, c.Request, c.Request.PostForm)
+	if err != nil {
+		recordClientAuthFailure(clientID, clientIP(c))
+		writeOAuthError(c, err)
+		return
+	}
+	if err := checkClientActive(client); err != nil {
+		writeOAuthError(c, err)
+		return
+	}
+	if !client.GetGrantTypes().Has(deviceCodeGrantType) {
+		writeOAuthError(c, fosite.ErrUnauthorizedClient.WithHint("The client is not allowed to use the device code grant."))
+		return
+	}
+	scopes := fosite.Arguments(strings.Fields(c.PostForm("scope")))
+	if cli, ok := client.(*storage.FositeClient); ok && cli.NarrowScope {
+		scopes = allowedScopes(cli, scopes)
+	}
+	registered := registeredScopes()
+	for _, scope := range scopes {
+		if _, ok := registered[scope]; !ok || !fosite.HierarchicScopeStrategy(client.GetScopes(), scope) {
+			writeOAuthError(c, fosite.ErrInvalidScope.WithHint("The client is not allowed to request scope "+scope+"."))
+			return
+		}
+	}
+
+	deviceCode, err := password.GenerateSecret()
+	if err != nil {
+		writeOAuthError(c, err)
+		return
+	}
+	dc := &storage.DeviceCode{
+		RequestID: fosite.NewRequest().GetID(),
+		ClientID:  client.GetID(),
+		Scopes:    pq.StringArray(scopes),
+		Status:    storage.DeviceCodePending,
+		ExpiresAt: time.Now().Add(time.Minute * time.Duration(ucenter.C.DeviceCodeTTL)),
+	}
+	// 用户验证码较短，碰撞时重新生成
+	for i := 0; i < 5; i++ {
+		if dc.UserCode, err = usercode.New(); err != nil {
+			break
+		}
+		if err = oauth2store.(*storage.FositeStore).CreateDeviceCodeSession(deviceCode, dc); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		writeOAuthError(c, err)
+		return
+	}
+
+	verification := ucenter.Issuer() + "/device"
+	nbgin.SetNoCache(c)
+	c.JSON(http.StatusOK, gin.H{
+		"device_code":               deviceCode,
+		"user_code":                 usercode.Format(dc.UserCode),
+		"verification_uri":          verification,
+		"verification_uri_complete": verification + "?user_code=" + usercode.Format(dc.UserCode),
+		"expires_in":                ucenter.C.DeviceCodeTTL * 60,
+		"interval":                  ucenter.C.DeviceCodeInterval,
+	})
+}
+
+// pendingDeviceCode 用户输入的验证码对应的设备授权及应用
+func pendingDeviceCode(userCode string) (*storage.DeviceCode, *storage.FositeClient, error) {
+	dc, err := oauth2store.(*storage.FositeStore).GetPendingDeviceCode(usercode.Normalize(userCode))
+	if err != nil {
+		return nil, nil, errors.New("验证码不正确或已过期，请在设备上重新获取")
+	}
+	client, err := oauth2store.GetClient(nil, dc.ClientID)
+	if err != nil {
+		return nil, nil, errors.New("应用不存在")
+	}
+	return dc, client.(*storage.FositeClient), nil
+}
+
+// deviceVerification 用户在 /device 输入设备上显示的验证码，确认要授权的应用及权限
+func deviceVerification(c *gin.Context) {
+	userCode := c.Query("user_code")
+	if userCode == "" {
+		c.HTML(http.StatusOK, "page/device", nbgin.Data(c, gin.H{}))
+		return
+	}
+	dc, client, err := pendingDeviceCode(userCode)
+	if err != nil {
+		c.HTML(http.StatusOK, "page/device", nbgin.Data(c, gin.H{
+			"userCode": userCode,
+			"error":    err.Error(),
+		}))
+		return
+	}
+	check := make(map[string]bool)
+	for _, scope := range dc.Scopes {
+		check[scope] = true
+	}
+	c.HTML(http.StatusOK, "page/device", nbgin.Data(c, gin.H{
+		"userCode": usercode.Format(dc.UserCode),
+		"Client":   client,
+		"Check":    check,
+		"Scopes":   registeredScopes(),
+	}))
+}
+
+// deviceVerificationHandler 用户确认或拒绝设备授权
+func deviceVerificationHandler(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	dc, client, err := pendingDeviceCode(c.PostForm("user_code"))
+	if err != nil {
+		c.HTML(http.StatusOK, "page/device", nbgin.Data(c, gin.H{
+			"userCode": c.PostForm("user_code"),
+			"error":    err.Error(),
+		}))
+		return
+	}
+
+	dc.Subject = u.StrID()
+	dc.Status = storage.DeviceCodeDenied
+	if c.PostForm("action") == "approve" {
+		if err := checkClientActive(client); err != nil {
+			c.HTML(http.StatusForbidden, "page/info", gin.H{
+				"icon":  "ban",
+				"title": "无法授权",
+				"msg":   "该应用已被禁用或尚未通过审核",
+			})
+			return
+		}
+		perms := make(map[string]bool)
+		for _, scope := range dc.Scopes {
+			perms[scope] = c.PostForm(scope) == "on"
+			if perms[scope] {
+				dc.GrantedScope = append(dc.GrantedScope, scope)
+			}
+		}
+		ar := &fosite.AuthorizeRequest{Request: fosite.Request{Client: client, RequestedScope: fosite.Arguments(dc.Scopes)}}
+		if err := saveUserAuthorized(u, ar, perms, nil, nil); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		session := storage.NewFositeSession(u.StrID())
+		session.DefaultSession.Claims.Subject = userSubject(u, client)
+		if perms["profile"] {
+			session.DefaultSession.Claims.Extra = profileClaims(u)
+		}
+		session.DefaultSession.Claims.AuthTime = time.Now().UTC()
+		session.DefaultSession.Claims.RequestedAt = time.Now().UTC()
+		if dc.Session, err = json.Marshal(session); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		dc.Status = storage.DeviceCodeApproved
+	}
+	if err := oauth2store.(*storage.FositeStore).DecideDeviceCode(dc); err != nil {
+		c.HTML(http.StatusOK, "page/device", nbgin.Data(c, gin.H{
+			"error": "验证码已被处理，请在设备上重新获取",
+		}))
+		return
+	}
+
+	if dc.Status == storage.DeviceCodeApproved {
+		if l, ok := c.Get(ucenter.AuthLogin); ok {
+			recordLoginClient(l.(*ucenter.Login), client.ClientID)
+		}
+		c.HTML(http.StatusOK, "page/info", gin.H{
+			"icon":  "check circle",
+			"title": "授权成功",
+			"msg":   "已授权 " + client.Name + "，请回到设备上继续操作。",
+		})
+		return
+	}
+	c.HTML(http.StatusOK, "page/info", gin.H{
+		"icon":  "times circle",
+		"title": "已拒绝授权",
+		"msg":   "设备上的登录请求已被拒绝。",
+	})
+}
+
+// deviceCodeGCJob 清理过期一天以上的设备授权会话
+func deviceCodeGCJob() error {
+	return oauth2store.(*storage.FositeStore).DeleteExpiredDeviceCodes(time.Now().Add(-24 * time.Hour))
+}
@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/dpop"
+)
+
+// checkDPoP 校验请求携带的 DPoP 证明，未携带时返回 nil
+func checkDPoP(c *gin.Context, accessToken string) (*dpop.Proof, error) {
+	values := c.Request.Header[dpop.HeaderName]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if len(values) > 1 {
+		return nil, errors.New("只能携带一个 DPoP 证明")
+	}
+	proof, err := dpop.Verify(values[0], c.Request.Method, ucenter.C.WebProtocol+"://"+ucenter.C.Domain+c.Request.URL.Path, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	// 同一证明只能使用一次
+	if err := ucenter.DB.Create(&ucenter.DPoPProof{
+		JTI:       proof.JKT + ":" + proof.JTI,
+		ExpiresAt: proof.IssuedAt.Add(dpop.MaxAge*2 + dpop.Leeway),
+	}).Error; err != nil {
+		return nil, errors.New("DPoP 证明已被使用")
+	}
+	return proof, nil
+}
+
+// accessTokenFromRequest 从 Authorization 取出访问令牌，支持 Bearer 与 DPoP 两种方案
+func accessTokenFromRequest(r *http.Request) (token, scheme string) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 {
+		return r.FormValue("access_token"), "bearer"
+	}
+	return parts[1], strings.ToLower(parts[0])
+}
+
+// dpopProofGCJob 清理过期的 DPoP 证明记录
+func dpopProofGCJob() error {
+	return ucenter.DB.Delete(ucenter.DPoPProof{}, "expires_at < ?", time.Now()).Error
+}
@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+)
+
+// dryRunMaxItems 预演结果中最多列出的用户及应用数
+const dryRunMaxItems = 50
+
+// dryRunImpact 预演破坏性操作时返回的影响范围：各类记录的数量及涉及的用户、应用
+type dryRunImpact struct {
+	Counts  map[string]int `json:"counts"`
+	Users   []string       `json:"users,omitempty"`
+	Clients []string       `json:"clients,omitempty"`
+}
+
+func newDryRunImpact() *dryRunImpact {
+	return &dryRunImpact{Counts: make(map[string]int)}
+}
+
+// isDryRun 请求带有 dry_run=1 时只返回影响范围，不执行操作
+func isDryRun(c *gin.Context) bool {
+	v := c.Query("dry_run")
+	if v == "" {
+		v = c.PostForm("dry_run")
+	}
+	ok, _ := strconv.ParseBool(v)
+	return ok
+}
+
+func (d *dryRunImpact) count(name string, n int) {
+	d.Counts[name] += n
+}
+
+func (d *dryRunImpact) addUser(u *ucenter.User) {
+	if len(d.Users) < dryRunMaxItems {
+		d.Users = append(d.Users, fmt.Sprintf("%s（ID %d）", u.Username, u.ID))
+	}
+}
+
+func (d *dryRunImpact) addClient(id string) {
+	if len(d.Clients) >= dryRunMaxItems {
+		return
+	}
+	var client storage.FositeClient
+	if ucenter.DB.Select("client_id, name").Where("client_id = ?", id).First(&client).Error != nil {
+		d.Clients = append(d.Clients, id)
+		return
+	}
+	d.Clients = append(d.Clients, fmt.Sprintf("%s（%s）", client.Name, id))
+}
+
+// countRows 统计 model 中满足条件的记录数
+func (d *dryRunImpact) countRows(name string, model interface{}, where string, args ...interface{}) error {
+	var n int
+	if err := ucenter.DB.Model(model).Where(where, args...).Count(&n).Error; err != nil {
+		return err
+	}
+	d.count(name, n)
+	return nil
+}
+
+// countTokens 统计将被吊销的访问令牌及刷新令牌
+func (d *dryRunImpact) countTokens(column, value string) error {
+	access, refresh, err := oauth2store.(*storage.FositeStore).CountTokens(column, value)
+	if err != nil {
+		return err
+	}
+	d.count("access_tokens", access)
+	d.count("refresh_tokens", refresh)
+	return nil
+}
+
+// writeDryRun 返回预演结果，管理操作审计会跳过预演请求
+func writeDryRun(c *gin.Context, d *dryRunImpact) {
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run": true,
+		"impact":  d,
+	})
+}
@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/mail"
+	"github.com/naiba/ucenter/pkg/password"
+	"github.com/naiba/ucenter/pkg/pii"
+)
+
+// requestEmailChange 向新旧邮箱发送确认链接，两边都确认后才修改；原来没有邮箱时只需确认新邮箱
+func requestEmailChange(u *ucenter.User, email string) error {
+	change, err := newEmailChange(u, email)
+	if err != nil {
+		return err
+	}
+	// 重新申请时，之前的确认链接作废
+	ucenter.DB.Delete(ucenter.EmailChange{}, "user_id = ?", u.ID)
+	if err := ucenter.DB.Create(change).Error; err != nil {
+		return err
+	}
+	if err = sendEmailChange(u, change); err != nil {
+		ucenter.DB.Delete(change)
+	}
+	return err
+}
+
+// newEmailChange 生成新旧邮箱的确认链接，尚未保存
+func newEmailChange(u *ucenter.User, email string) (*ucenter.EmailChange, error) {
+	oldToken, err := password.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	newToken, err := password.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	change := ucenter.EmailChange{
+		UserID:    u.ID,
+		OldEmail:  u.Email,
+		NewEmail:  pii.String(email),
+		OldToken:  oldToken,
+		NewToken:  newToken,
+		ExpiresAt: now.Add(time.Hour * time.Duration(ucenter.C.EmailChangeTTL)),
+	}
+	if u.Email == "" {
+		change.OldConfirmedAt = &now
+	}
+	return &change, nil
+}
+
+// sendEmailChange 发送确认邮件，原来没有邮箱时只发往新邮箱
+func sendEmailChange(u *ucenter.User, change *ucenter.EmailChange) error {
+	email := string(change.NewEmail)
+	err := mail.Send(email, "确认新邮箱", fmt.Sprintf("%s 您好：\n\n您正在将账户邮箱修改为本邮箱，请打开以下链接确认：\n%s\n\n链接 %d 小时内有效。\n\n%s",
+		u.Username, mail.SiteURL("/email/confirm/"+change.NewToken), ucenter.C.EmailChangeTTL, ucenter.C.SysName))
+	if err == nil && change.OldEmail != "" {
+		err = mail.Send(string(change.OldEmail), "确认修改邮箱", fmt.Sprintf("%s 您好：\n\n您的账户申请将邮箱修改为 %s，确认是本人操作请打开以下链接：\n%s\n\n如果不是本人操作，请打开以下链接取消，并尽快修改密码：\n%s\n\n链接 %d 小时内有效。\n\n%s",
+			u.Username, email, mail.SiteURL("/email/confirm/"+change.OldToken), mail.SiteURL("/email/cancel/"+change.OldToken),
+			ucenter.C.EmailChangeTTL, ucenter.C.SysName))
+	}
+	return err
+}
+
+// resendSignupEmail 待确认邮箱的账户验证密码后，换新链接重新发送，注册邮箱不会因过期或发送失败而丢失
+func resendSignupEmail(u *ucenter.User) error {
+	var change ucenter.EmailChange
+	if err := ucenter.DB.First(&change, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+	fresh, err := newEmailChange(u, string(change.NewEmail))
+	if err != nil {
+		return err
+	}
+	if err := ucenter.DB.Model(&change).Updates(map[string]interface{}{
+		"old_token":  fresh.OldToken,
+		"new_token":  fresh.NewToken,
+		"expires_at": fresh.ExpiresAt,
+	}).Error; err != nil {
+		return err
+	}
+	return sendEmailChange(u, fresh)
+}
+
+// pendingEmailChange 用户等待确认的邮箱修改
+func pendingEmailChange(uid uint) *ucenter.EmailChange {
+	var change ucenter.EmailChange
+	if ucenter.DB.First(&change, "user_id = ? AND expires_at > ?", uid, time.Now()).Error != nil {
+		return nil
+	}
+	return &change
+}
+
+// confirmEmailChange 打开确认链接，新旧邮箱都确认后修改生效
+func confirmEmailChange(c *gin.Context) {
+	token := c.Param("token")
+	var change ucenter.EmailChange
+	if ucenter.DB.First(&change, "(old_token = ? OR new_token = ?) AND expires_at > ?", token, token, time.Now()).Error != nil {
+		c.HTML(http.StatusNotFound, "page/info", gin.H{
+			"icon":  "unlink",
+			"title": "链接无效",
+			"msg":   "确认链接已失效，请重新修改邮箱。",
+		})
+		return
+	}
+	now := time.Now()
+	column := "new_confirmed_at"
+	if token == change.OldToken {
+		column = "old_confirmed_at"
+		change.OldConfirmedAt = &now
+	} else {
+		change.NewConfirmedAt = &now
+	}
+	if err := ucenter.DB.Model(&change).UpdateColumn(column, now).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !change.Confirmed() {
+		c.HTML(http.StatusOK, "page/info", gin.H{
+			"icon":  "mail",
+			"title": "已确认",
+			"msg":   "还需打开发送到另一个邮箱的确认链接，修改才会生效。",
+		})
+		return
+	}
+
+	var u ucenter.User
+	if err := ucenter.DB.First(&u, "id = ?", change.UserID).Error; err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	if emailTaken(string(change.NewEmail), u.ID) {
+		ucenter.DB.Delete(&change)
+		c.HTML(http.StatusConflict, "page/info", gin.H{
+			"icon":  "mail",
+			"title": "邮箱已被使用",
+			"msg":   "该邮箱已被其他账户使用，邮箱未修改。",
+		})
+		return
+	}
+	if u.Status == ucenter.StatusUnconfirmed {
+		// 注册邮箱确认时按当前的注册策略重新检查域名
+		if policy := signupPolicy(); policy.EmailRequired() && !policy.EmailAllowed(string(change.NewEmail)) {
+			c.HTML(http.StatusForbidden, "page/info", gin.H{
+				"icon":  "mail",
+				"title": "邮箱域名不允许注册",
+				"msg":   "该邮箱域名已不允许注册，请联系管理员。",
+			})
+			return
+		}
+		u.Status = 0
+		if ucenter.C.SignupApproval && u.ID != 1 {
+			u.Status = ucenter.StatusPending
+		}
+	}
+	old := string(u.Email)
+	u.Email = change.NewEmail
+	tx := ucenter.DB.Begin()
+	err := tx.Save(&u).Error
+	if err == nil {
+		err = tx.Delete(&change).Error
+	}
+	if err == nil {
+		// 已发往旧邮箱的验证码作废
+		err = tx.Delete(ucenter.EmailOTP{}, "user_id = ?", u.ID).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	audit(c, u.ID, ucenter.AuditEmailChange, userTarget(u.ID), maskEmail(old)+" → "+maskEmail(string(u.Email)))
+	if u.Status == ucenter.StatusPending {
+		c.HTML(http.StatusOK, "page/info", gin.H{
+			"icon":  "hourglass half",
+			"title": "邮箱已确认",
+			"msg":   "您的账户正在等待管理员审核，审核通过后即可登录。",
+		})
+		return
+	}
+	c.HTML(http.StatusOK, "page/info", gin.H{
+		"icon":  "check",
+		"title": "邮箱已修改",
+		"msg":   "账户邮箱已修改为 " + string(u.Email) + "。",
+	})
+}
+
+// cancelEmailChange 旧邮箱的所有者取消修改
+func cancelEmailChange(c *gin.Context) {
+	db := ucenter.DB.Delete(ucenter.EmailChange{}, "old_token = ?", c.Param("token"))
+	if db.Error != nil || db.RowsAffected == 0 {
+		c.HTML(http.StatusNotFound, "page/info", gin.H{
+			"icon":  "unlink",
+			"title": "链接无效",
+			"msg":   "链接已失效或修改已完成。",
+		})
+		return
+	}
+	c.HTML(http.StatusOK, "page/info", gin.H{
+		"icon":  "shield alternate",
+		"title": "已取消修改",
+		"msg":   "邮箱不会被修改。如果不是您本人发起的修改，请尽快登录并修改密码。",
+	})
+}
+
+// emailChangeGCJob 清理过期的邮箱修改，待确认邮箱账户的注册邮箱保留，登录时重新发送
+func emailChangeGCJob() error {
+	return ucenter.DB.Delete(ucenter.EmailChange{}, "expires_at < ? AND user_id NOT IN (SELECT id FROM users WHERE status = ?)",
+		time.Now(), ucenter.StatusUnconfirmed).Error
+}
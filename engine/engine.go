@@ -2,9 +2,13 @@ package engine
 
 import (
 	"errors"
+	"fmt"
 	"html/template"
+	"log"
 	"net/http"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/ory/fosite"
 
@@ -12,53 +16,83 @@ import (
 	"github.com/gin-gonic/gin/binding"
 	"github.com/naiba/com"
 	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/captcha"
+	"github.com/naiba/ucenter/pkg/dpop"
 	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/geoip"
+	"github.com/naiba/ucenter/pkg/grant"
+	"github.com/naiba/ucenter/pkg/ids"
 	"github.com/naiba/ucenter/pkg/nbgin"
 	"github.com/naiba/ucenter/pkg/ram"
+	"github.com/naiba/ucenter/pkg/reputation"
+	"github.com/naiba/ucenter/pkg/scan"
 	"github.com/ory/fosite/compose"
 )
 
 var oauth2provider fosite.OAuth2Provider
 var oauth2store fosite.Storage
 var oauth2strategy compose.CommonStrategy
+var oauth2config *compose.Config
+var captchaProvider captcha.Captcha
+
+// minHMACSecretLength hmac_secret 的最小长度（字节）
+const minHMACSecretLength = 32
 
 func initFosite() {
 	oauth2store = storage.NewFositeStore(ucenter.DB, true)
 	oauth2store.(*storage.FositeStore).Migrate()
 
-	var config = new(compose.Config)
+	// 自定义授权类型
+	if err := grant.LoadPlugins(ucenter.C.GrantPlugins); err != nil {
+		panic(err)
+	}
+	if models := grant.Models(); len(models) > 0 {
+		if err := ucenter.DB.AutoMigrate(models...).Error; err != nil {
+			panic(err)
+		}
+	}
+
+	// 全局默认的令牌有效期，应用可单独覆盖
+	var config = &compose.Config{
+		AccessTokenLifespan:   time.Minute * time.Duration(ucenter.C.AccessTokenLifespan),
+		AuthorizeCodeLifespan: time.Minute * time.Duration(ucenter.C.AuthorizeCodeLifespan),
+		IDTokenLifespan:       time.Minute * time.Duration(ucenter.C.IDTokenLifespan),
+	}
+	oauth2config = config
+	if err := initSigningKeys(); err != nil {
+		panic(err)
+	}
 
 	// Because we are using oauth2 and open connect id, we use this little helper to combine the two in one
 	// variable.
+	// 授权码、不透明访问令牌及刷新令牌的签名密钥必须由部署方配置
+	if len(ucenter.C.HMACSecret) < minHMACSecretLength {
+		panic(fmt.Errorf("hmac_secret 未设置或不足 %d 字节", minHMACSecretLength))
+	}
+	hmacStrategy := compose.NewOAuth2HMACStrategy(config, []byte(ucenter.C.HMACSecret), nil)
+	// JWT 统一由数据库中的签名密钥签发，支持轮换
+	jwtStrategy := compose.NewOAuth2JWTStrategy(ucenter.SystemRSAKey, hmacStrategy)
+	jwtStrategy.JWTStrategy = signingKeys
+	oidcStrategy := compose.NewOpenIDConnectStrategy(config, ucenter.SystemRSAKey)
+	oidcStrategy.JWTStrategy = signingKeys
 	oauth2strategy = compose.CommonStrategy{
-		// alternatively you could use:
-		// CoreStrategy: compose.NewOAuth2JWTStrategy(ucenter.SystemRSAKey),
-		CoreStrategy: compose.NewOAuth2HMACStrategy(config,
-			[]byte("some-super-cool-secret-that-nobody-knows"),
-			[][]byte{
-				[]byte("some-super-cool-secret-that-nobody-knows")},
-		),
+		// 访问令牌按功能开关 jwt_access_token 灰度切换为 JWT
+		CoreStrategy: &flaggedCoreStrategy{HMACSHAStrategy: hmacStrategy, jwt: jwtStrategy},
 		// open id connect strategy
-		OpenIDConnectTokenStrategy: compose.NewOpenIDConnectStrategy(config, ucenter.SystemRSAKey),
-		JWTStrategy: compose.NewOAuth2JWTStrategy(ucenter.SystemRSAKey, compose.NewOAuth2HMACStrategy(config,
-			[]byte("some-super-cool-secret-that-nobody-knows"),
-			[][]byte{
-				[]byte("some-super-cool-secret-that-nobody-knows")},
-		)),
+		OpenIDConnectTokenStrategy: &clientIDTokenStrategy{DefaultStrategy: oidcStrategy},
+		JWTStrategy:                signingKeys,
 	}
 
-	oauth2provider = compose.Compose(
-		config,
-		oauth2store,
-		oauth2strategy,
-		nil,
-
+	factories := []compose.Factory{
 		// enabled handlers
 		compose.OAuth2AuthorizeExplicitFactory,
 		compose.OAuth2AuthorizeImplicitFactory,
 		compose.OAuth2ClientCredentialsGrantFactory,
 		compose.OAuth2RefreshTokenGrantFactory,
-		compose.OAuth2ResourceOwnerPasswordCredentialsFactory,
+		// 不提供密码模式：应用直接提交用户密码会绕过二次验证、登录锁定及密码有效期
+		compose.OAuth2PKCEFactory,
+		deviceCodeGrantFactory,
+		wechatMiniProgramGrantFactory,
 
 		compose.OAuth2TokenRevocationFactory,
 		compose.OAuth2TokenIntrospectionFactory,
@@ -68,12 +102,44 @@ func initFosite() {
 		compose.OpenIDConnectImplicitFactory,
 		compose.OpenIDConnectHybridFactory,
 		compose.OpenIDConnectRefreshFactory,
-	)
+	}
+	oauth2provider = compose.Compose(config, oauth2store, oauth2strategy, &storage.SecretHasher{}, append(factories, grant.Factories()...)...)
 }
 
 // ServWeb 开启Web服务
 func ServWeb() {
 	initFosite()
+	if pending, err := pendingMigrations(); err == nil && len(pending) > 0 {
+		log.Printf("有 %d 项数据迁移尚未执行，请运行 ucenter upgrade", len(pending))
+	}
+	if err := initPasswordHash(); err != nil {
+		panic(err)
+	}
+	initWebAuthn()
+	dpop.Leeway = tokenLeeway()
+	initReservedUsernames()
+	initScopes()
+	if err := initAuditChain(); err != nil {
+		panic(err)
+	}
+	if ucenter.C.GeoIPDB != "" {
+		if err := geoip.Open(ucenter.C.GeoIPDB); err != nil {
+			panic(err)
+		}
+	}
+	var err error
+	if captchaProvider, err = captcha.New(ucenter.C.CaptchaProvider, ucenter.C.CaptchaSiteKey, ucenter.C.CaptchaSecret); err != nil {
+		panic(err)
+	}
+	if uploadScanner, err = scan.New(ucenter.C.UploadScanner, ucenter.C.UploadScannerAddr, time.Duration(ucenter.C.UploadScanTimeout)*time.Second); err != nil {
+		panic(err)
+	}
+	if checker, err := reputation.New(ucenter.C.IPReputation, ucenter.C.IPReputationAddr, ucenter.C.IPReputationKey, time.Duration(ucenter.C.IPReputationTimeout)*time.Second); err != nil {
+		panic(err)
+	} else if checker != nil {
+		ipReputation = &reputation.Cache{Checker: checker, TTL: time.Duration(ucenter.C.IPReputationCacheTTL) * time.Minute}
+	}
+	startJobs()
 	binding.Validator = new(nbgin.DefaultValidator)
 	r := gin.Default()
 	r.Static("static", "static")
@@ -88,6 +154,26 @@ func ServWeb() {
 		"add": func(a, b int) int {
 			return a + b
 		},
+		"join": strings.Join,
+		"captcha": func() template.HTML {
+			return captchaProvider.Widget()
+		},
+		"invite_enabled": func() bool {
+			return ucenter.C.InviteQuota > 0
+		},
+		"identity_providers": func() map[string]ucenter.IdentityProvider {
+			return ucenter.C.IdentityProviders
+		},
+		"markdown":        renderMarkdown,
+		"legal_documents": publishedLegalDocuments,
+		"ip":              normalizeIP,
+		"feature": func(name string, user *ucenter.User) bool {
+			var uid uint
+			if user != nil {
+				uid = user.ID
+			}
+			return featureEnabled(name, uid)
+		},
 	})
 	r.LoadHTMLGlob("template/**/*")
 
@@ -95,9 +181,22 @@ func ServWeb() {
 	r.Use(func(c *gin.Context) {
 		if strings.HasPrefix(c.Request.RequestURI, "/upload/avatar/") {
 			c.Header("Content-Type", "image")
+			// 带内容哈希的头像地址不会复用，允许长期缓存
+			if strings.Contains(path.Base(c.Request.URL.Path), ".") {
+				c.Header("Cache-Control", "public, max-age=31536000, immutable")
+			}
 		}
 	})
 
+	// 图片验证码
+	if img, ok := captchaProvider.(*captcha.Image); ok {
+		r.GET(captcha.ImagePath+":file", gin.WrapH(img.Handler()))
+	}
+
+	// Prometheus
+	r.GET("/metrics", metricsAllowed, metricsHandler)
+	r.GET("/metrics/alerts", metricsAllowed, alertRules)
+
 	// Well-known handler
 	r.GET(".well-known/openid-configuration", wellknownHandler)
 	r.GET(".well-known/jwks.json", jwksHandler)
@@ -106,43 +205,151 @@ func ServWeb() {
 	r.Use(authorizeMiddleware)
 
 	// CSRF Protection
-	r.Use(func(c *gin.Context) {
-		if (c.Request.Method == http.MethodDelete ||
-			c.MustGet(ucenter.RequestRouter) == "/logout") &&
-			!strings.Contains(c.Request.Referer(), "://"+ucenter.C.Domain+"/") {
-			c.AbortWithError(http.StatusForbidden, errors.New("CSRF Protection"))
-			return
-		}
-	})
+	r.Use(csrfMiddleware)
 
 	// 登录
 	r.GET("/login", login)
-	r.POST("/login", loginHandler)
+	r.POST("/login", observeLogin("password"), loginHandler)
+	r.POST("/login/begin", beginLogin)
+	r.POST("/login/passkey/begin", requireFeature(ucenter.FlagPasskey), beginPasskeyLogin)
+	r.POST("/login/passkey/finish", requireFeature(ucenter.FlagPasskey), observeLogin("passkey"), finishPasskeyLogin)
+	r.GET("/login/mfa", loginMFA)
+	r.POST("/login/mfa", loginMFAHandler)
+	r.POST("/login/mfa/resend", resendLoginMFA)
+	r.GET("/login/idp/:provider", loginIdentity)
+	r.GET("/login/idp/:provider/callback", identityCallback)
+	r.POST("/login/qr/begin", requireFeature(ucenter.FlagQRLogin), beginQRLogin)
+	r.POST("/login/qr/poll", requireFeature(ucenter.FlagQRLogin), pollQRLogin)
+	r.POST("/login/qr/complete", requireFeature(ucenter.FlagQRLogin), completeQRLogin)
 
 	// 注册
 	r.GET("/signup", signup)
 	r.POST("/signup", signupHandler)
 
+	// 新设备提醒邮件
+	r.GET("/device/reject/:token", rejectDevice)
+
+	// 修改邮箱确认邮件
+	r.GET("/email/confirm/:token", confirmEmailChange)
+	r.GET("/email/cancel/:token", cancelEmailChange)
+
+	// 禁用申诉
+	r.POST("/appeal/:token", submitAppeal)
+
+	// 服务条款、隐私政策
+	r.GET("/legal/:kind", legalDocument)
+
+	// 对外 API：/api/v1/... 指定版本，/api/... 按请求头协商版本
+	api := r.Group("/api", apiVersionMiddleware(""))
+	registerAPI(api)
+	for _, v := range apiVersions {
+		registerAPI(r.Group("/api/"+v.name, apiVersionMiddleware(v.name)))
+	}
+
 	// 用户中心
 	mustLoginRoute := r.Group("")
-	mustLoginRoute.Use(anonymousMustLogin)
+	mustLoginRoute.Use(anonymousMustLogin, passwordMustChange, legalMustAccept)
 	{
 		mustLoginRoute.GET("/", index)
 		mustLoginRoute.GET("/logout", logout)
+		mustLoginRoute.GET("/sudo", sudo)
+		mustLoginRoute.POST("/sudo", sudoHandler)
+		mustLoginRoute.GET("/stepup", stepUp)
+		mustLoginRoute.POST("/stepup", stepUpHandler)
+		mustLoginRoute.POST("/stepup/otp", stepUpOTPHandler)
+		mustLoginRoute.POST("/stepup/passkey/begin", requireFeature(ucenter.FlagPasskey), beginStepUpPasskey)
+		mustLoginRoute.POST("/stepup/passkey/finish", requireFeature(ucenter.FlagPasskey), finishStepUpPasskey)
+		mustLoginRoute.GET("/password", requireSudo, changePassword)
+		mustLoginRoute.POST("/password", requireSudo, changePasswordHandler)
 		mustLoginRoute.PATCH("/", editProfileHandler)
-		mustLoginRoute.DELETE("/user/:id", userDelete)
+		mustLoginRoute.DELETE("/user/:id", requireSudo, userDelete)
 		mustLoginRoute.POST("/app", editOauth2App)
+		mustLoginRoute.POST("/app/:id/secret", requireSudo, resetOauth2AppSecret)
 		mustLoginRoute.DELETE("/app/:id", deleteOauth2App)
+		mustLoginRoute.GET("/devices", devices)
+		mustLoginRoute.DELETE("/devices", revokeAllDevices)
+		mustLoginRoute.DELETE("/device/:id", revokeDevice)
+		mustLoginRoute.DELETE("/trusted-device/:id", revokeTrustedDevice)
+		mustLoginRoute.GET("/invites", invites)
+		mustLoginRoute.POST("/invite", createInvite)
+		mustLoginRoute.GET("/passkeys", requireFeature(ucenter.FlagPasskey), requireSudo, passkeys)
+		mustLoginRoute.POST("/passkey/register/begin", requireFeature(ucenter.FlagPasskey), requireSudo, beginPasskeyRegistration)
+		mustLoginRoute.POST("/passkey/register/finish", requireFeature(ucenter.FlagPasskey), requireSudo, finishPasskeyRegistration)
+		mustLoginRoute.DELETE("/passkey/:id", requireSudo, deletePasskey)
+		mustLoginRoute.GET("/offline", offlineAccess)
+		mustLoginRoute.DELETE("/offline/:id", revokeOfflineAccess)
+		mustLoginRoute.GET("/users/search", searchUsers)
+		mustLoginRoute.GET("/connected", connectedApps)
+		mustLoginRoute.DELETE("/connected/:id", revokeConnectedApp)
+		mustLoginRoute.DELETE("/connected/:id/scope/:scope", revokeConnectedScope)
+		mustLoginRoute.GET("/exports", exports)
+		mustLoginRoute.POST("/export", createExport)
+		mustLoginRoute.GET("/export/:id", downloadExport)
+		mustLoginRoute.GET("/activity", activity)
+		mustLoginRoute.GET("/device", deviceVerification)
+		mustLoginRoute.POST("/device", deviceVerificationHandler)
+		mustLoginRoute.GET("/identities", requireSudo, identities)
+		mustLoginRoute.POST("/identities/link/:provider", requireSudo, linkIdentity)
+		mustLoginRoute.POST("/identity", requireSudo, addPasswordIdentity)
+		mustLoginRoute.DELETE("/identity/:id", requireSudo, deleteIdentity)
+		mustLoginRoute.GET("/mfa", requireSudo, mfaSettings)
+		mustLoginRoute.POST("/mfa/email", requireSudo, enrollEmailOTP)
+		mustLoginRoute.POST("/mfa/email/confirm", requireSudo, confirmEmailOTP)
+		mustLoginRoute.DELETE("/mfa/email", requireSudo, disableEmailOTP)
+		mustLoginRoute.POST("/mfa/recovery-codes", requireSudo, regenerateRecoveryCodes)
+		mustLoginRoute.GET("/legal", legalAccept)
+		mustLoginRoute.POST("/legal", legalAcceptHandler)
+		mustLoginRoute.GET("/qr/:id", requireFeature(ucenter.FlagQRLogin), showQRLogin)
+		mustLoginRoute.POST("/qr/:id/scan", requireFeature(ucenter.FlagQRLogin), scanQRLogin)
+		mustLoginRoute.POST("/qr/:id/approve", requireFeature(ucenter.FlagQRLogin), answerQRLogin(true))
+		mustLoginRoute.POST("/qr/:id/reject", requireFeature(ucenter.FlagQRLogin), answerQRLogin(false))
 	}
 
 	// 管理员路由
 	admin := mustLoginRoute.Group("/admin")
+	admin.Use(requireAdminSudo, auditAdmin)
 	{
 		admin.GET("/", adminIndex)
 		admin.GET("/users", adminUsers)
+		admin.GET("/users/:id", adminUser)
 		admin.GET("/apps", adminApps)
 		admin.POST("/user/status", userStatus)
+		admin.POST("/user/role", requireSudo, adminGrantRole)
+		admin.POST("/user/merge", requireSudo, adminMergeUsers)
 		admin.POST("/app/status", appStatus)
+		admin.POST("/app/first-party", appFirstParty)
+		admin.POST("/app/network", appNetwork)
+		admin.GET("/locks", adminLocks)
+		admin.POST("/unlock", unlockLogin)
+		admin.GET("/machine", adminMachine)
+		admin.POST("/machine/revoke", revokeMachineTokens)
+		admin.POST("/machine/client", markMachineClient)
+		admin.POST("/machine/scope", addMachineScope)
+		admin.POST("/machine/scope/remove", removeMachineScope)
+		admin.GET("/stale", adminStale)
+		admin.GET("/pending", adminPending)
+		admin.POST("/review", reviewUser)
+		admin.GET("/signup", adminSignup)
+		admin.POST("/signup", editSignupPolicy)
+		admin.GET("/reserved", adminReserved)
+		admin.POST("/reserved", addReserved)
+		admin.DELETE("/reserved/:id", deleteReserved)
+		admin.GET("/scopes", adminScopes)
+		admin.POST("/scope", editScope)
+		admin.DELETE("/scope/:id", deleteScope)
+		admin.GET("/invites", adminInvites)
+		admin.POST("/invite", adminCreateInvite)
+		admin.DELETE("/invite/:id", deleteInvite)
+		admin.GET("/audit", adminAudit)
+		admin.GET("/audit/verify", adminAuditVerify)
+		admin.GET("/audit/export", adminAuditExport)
+		admin.GET("/flags", adminFlags)
+		admin.POST("/flag", editFeatureFlag)
+		admin.GET("/legal", adminLegal)
+		admin.POST("/legal", publishLegalDocument)
+		admin.GET("/legal/acceptances", legalAcceptances)
+		admin.GET("/mfa", adminMFA)
+		admin.POST("/mfa", editMFAPolicy)
 	}
 
 	// Oauth2
@@ -150,13 +357,51 @@ func ServWeb() {
 	{
 		o.GET("auth", oauth2auth)
 		o.GET("info", userInfo)
+		o.POST("info", userInfo)
+		o.GET("userinfo", userInfo)
+		o.POST("userinfo", userInfo)
 		o.POST("auth", oauth2auth)
-		o.GET("token", oauth2token)
-		o.POST("token", oauth2token)
+		o.GET("token", observeToken, oauth2token)
+		o.POST("token", observeToken, oauth2token)
 		o.GET("revoke", revokeEndpoint)
 		o.POST("revoke", revokeEndpoint)
 		o.GET("introspect", introspectionEndpoint)
 		o.POST("introspect", introspectionEndpoint)
+		o.POST("introspect/aggregate", aggregateIntrospection)
+		o.POST("device_authorization", deviceAuthorization)
+		o.POST("par", pushedAuthorizeRequest)
+		o.POST("register", registerClient)
+		o.GET("logout", endSession)
+		o.POST("logout", endSession)
+		o.GET("check_session", checkSessionIframe)
+	}
+
+	// 动态注册的应用以注册访问令牌管理自身的注册信息
+	register := o.Group("register/:id")
+	register.Use(registeredClient)
+	{
+		register.GET("", readRegisteredClient)
+		register.PUT("", updateRegisteredClient)
+		register.DELETE("", deleteRegisteredClient)
+		register.POST("/secret", rotateRegisteredClientSecret)
+	}
+
+	// 外部授权界面
+	consent := o.Group("consent")
+	consent.Use(challengeAPIAuth)
+	{
+		consent.GET("", consentChallenge)
+		consent.POST("accept", acceptConsent)
+		consent.POST("reject", rejectConsent)
+	}
+
+	// 外部登录界面
+	loginUI := o.Group("login")
+	loginUI.Use(challengeAPIAuth)
+	{
+		loginUI.GET("", loginChallenge)
+		loginUI.POST("accept", acceptLogin)
+		loginUI.POST("reject", rejectLogin)
 	}
 
 	r.NoRoute(func(c *gin.Context) {
@@ -173,10 +418,16 @@ func ServWeb() {
 			"msg":   "没有这个请求方式哦",
 		})
 	})
-	r.Run("0.0.0.0:8080")
+	if err := serve(r); err != nil {
+		panic(err)
+	}
 }
 
+// genClientID serial 格式以所有者的对外 ID 加随机串作为应用 ID，uuid、ulid 格式直接生成，不含所有者信息
 func genClientID(uid string) (id string, err error) {
+	if ucenter.C.IDFormat != ids.FormatSerial {
+		return ids.New(ucenter.C.IDFormat)
+	}
 	for i := 0; i < 100; i++ {
 		id = uid + "-" + com.RandomString(6)
 		if _, err = oauth2store.GetClient(nil, id); err == nil {
@@ -186,3 +437,11 @@ func genClientID(uid string) (id string, err error) {
 	}
 	return "", errors.New("genClientID 重试次数达到限制。")
 }
+
+// verifyCaptcha 校验人机验证，本地开发环境跳过
+func verifyCaptcha(c *gin.Context) bool {
+	if strings.HasPrefix(ucenter.C.Domain, "localhost") {
+		return true
+	}
+	return captchaProvider.Verify(c.Request.Form, clientIP(c))
+}
@@ -0,0 +1,327 @@
+package engine
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/mail"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+// exportSection 导出归档中的一个 JSON 文件，新增与用户关联的数据表时在此登记
+type exportSection struct {
+	Name string
+	Data func(u *ucenter.User) (interface{}, error)
+}
+
+var exportSections = []exportSection{
+	{"profile.json", exportProfile},
+	{"logins.json", exportLogins},
+	{"devices.json", exportDevices},
+	{"authorizations.json", exportAuthorizations},
+	{"apps.json", exportApps},
+	{"passkeys.json", exportPasskeys},
+	{"invites.json", exportInvites},
+	{"legal.json", exportLegal},
+	{"identities.json", exportIdentities},
+}
+
+func exports(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var list []ucenter.DataExport
+	ucenter.DB.Where("user_id = ?", u.ID).Order("id desc").Find(&list)
+	c.HTML(http.StatusOK, "user/exports", nbgin.Data(c, gin.H{
+		"exports": list,
+	}))
+}
+
+func createExport(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var count int
+	ucenter.DB.Model(ucenter.DataExport{}).Where("user_id = ? AND status = ?", u.ID, ucenter.ExportPending).Count(&count)
+	if count > 0 {
+		c.String(http.StatusForbidden, "已有正在生成的导出，请稍后再试")
+		return
+	}
+	token, err := password.GenerateSecret()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	e := ucenter.DataExport{
+		UserID: u.ID,
+		Token:  token,
+		Status: ucenter.ExportPending,
+	}
+	if err := ucenter.DB.Create(&e).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	enqueueJob("data-export", func() error {
+		return buildExport(&e)
+	})
+}
+
+func downloadExport(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var e ucenter.DataExport
+	if ucenter.DB.Where("id = ? AND user_id = ? AND status = ?", c.Param("id"), u.ID, ucenter.ExportReady).First(&e).Error != nil || e.Expired() {
+		c.HTML(http.StatusNotFound, "page/info", gin.H{
+			"icon":  "file archive",
+			"title": "无法下载",
+			"msg":   "导出不存在或已过期，请重新申请",
+		})
+		return
+	}
+	nbgin.SetNoCache(c)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.zip"`, u.Username, e.ReadyAt.Format("20060102")))
+	c.File(e.Path())
+}
+
+// buildExport 生成导出归档，完成后邮件通知用户
+func buildExport(e *ucenter.DataExport) error {
+	var u ucenter.User
+	if err := ucenter.DB.First(&u, e.UserID).Error; err != nil {
+		return ucenter.DB.Delete(e).Error
+	}
+	if err := writeExport(e, &u); err != nil {
+		os.Remove(e.Path())
+		ucenter.DB.Model(e).Updates(map[string]interface{}{
+			"status": ucenter.ExportFailed,
+			"error":  err.Error(),
+		})
+		return err
+	}
+	now := time.Now()
+	if err := ucenter.DB.Model(e).Updates(map[string]interface{}{
+		"status":   ucenter.ExportReady,
+		"ready_at": now,
+	}).Error; err != nil {
+		return err
+	}
+	if u.Email != "" && mail.Enabled() {
+		if err := mail.Send(string(u.Email), "数据导出已完成", fmt.Sprintf(
+			"%s 您好：\n\n您申请的个人数据导出已生成，请在 %d 小时内登录下载：%s\n\n%s",
+			u.Username, ucenter.C.DataExportTTL, mail.SiteURL("/exports"), ucenter.C.SysName)); err != nil {
+			log.Printf("data export mail %s: %s", u.StrID(), err)
+		}
+	}
+	return nil
+}
+
+func writeExport(e *ucenter.DataExport, u *ucenter.User) error {
+	if err := os.MkdirAll("data/export", 0700); err != nil {
+		return err
+	}
+	f, err := os.Create(e.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, section := range exportSections {
+		data, err := section.Data(u)
+		if err != nil {
+			return fmt.Errorf("%s: %s", section.Name, err)
+		}
+		w, err := zw.Create(section.Name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(data); err != nil {
+			return err
+		}
+	}
+	// 头像
+	if u.Avatar {
+		if avatar, err := os.Open("data" + u.AvatarURL()); err == nil {
+			defer avatar.Close()
+			w, err := zw.Create("avatar")
+			if err != nil {
+				return err
+			}
+			if _, err = io.Copy(w, avatar); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+func exportProfile(u *ucenter.User) (interface{}, error) {
+	return gin.H{
+		"id":            u.ID,
+		"username":      u.Username,
+		"email":         u.Email,
+		"phone":         u.Phone,
+		"bio":           u.Bio,
+		"status":        u.Status,
+		"created_at":    u.CreatedAt,
+		"updated_at":    u.UpdatedAt,
+		"last_login_at": u.LastLoginAt,
+	}, nil
+}
+
+func exportLogins(u *ucenter.User) (interface{}, error) {
+	var list []ucenter.Login
+	if err := ucenter.DB.Where("user_id = ?", u.ID).Order("created_at").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	out := make([]gin.H, 0, len(list))
+	for _, l := range list {
+		var clients []string
+		ucenter.DB.Model(ucenter.LoginClient{}).Where("login_token = ?", l.Token).Pluck("client_id", &clients)
+		out = append(out, gin.H{
+			"name":         l.Name,
+			"ip":           l.IP,
+			"created_at":   l.CreatedAt,
+			"last_seen_at": l.LastSeenAt,
+			"expire":       l.Expire,
+			"apps":         clients,
+		})
+	}
+	return out, nil
+}
+
+func exportDevices(u *ucenter.User) (interface{}, error) {
+	var list []ucenter.KnownDevice
+	if err := ucenter.DB.Where("user_id = ?", u.ID).Order("id").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	out := make([]gin.H, 0, len(list))
+	for _, d := range list {
+		out = append(out, gin.H{
+			"fingerprint": d.Fingerprint,
+			"created_at":  d.CreatedAt,
+		})
+	}
+	return out, nil
+}
+
+func exportAuthorizations(u *ucenter.User) (interface{}, error) {
+	var list []ucenter.UserAuthorized
+	if err := ucenter.DB.Where("user_id = ?", u.ID).Find(&list).Error; err != nil {
+		return nil, err
+	}
+	out := make([]gin.H, 0, len(list))
+	for _, a := range list {
+		var client storage.FositeClient
+		ucenter.DB.Select("name, client_uri").Where("client_id = ?", a.ClientID).First(&client)
+		out = append(out, gin.H{
+			"client_id":      a.ClientID,
+			"client":         client.Name,
+			"client_uri":     client.ClientURI,
+			"scope":          a.Scope,
+			"permission":     a.Permission,
+			"remember_until": a.RememberUntil,
+			"created_at":     a.CreatedAt,
+			"updated_at":     a.UpdatedAt,
+		})
+	}
+	return out, nil
+}
+
+func exportApps(u *ucenter.User) (interface{}, error) {
+	var list []storage.FositeClient
+	if err := ucenter.DB.Where("owner = ?", u.StrID()).Find(&list).Error; err != nil {
+		return nil, err
+	}
+	out := make([]gin.H, 0, len(list))
+	for _, cli := range list {
+		out = append(out, gin.H{
+			"client_id":     cli.ClientID,
+			"name":          cli.Name,
+			"client_uri":    cli.ClientURI,
+			"redirect_uris": cli.RedirectURIs,
+			"scope":         cli.Scope,
+			"created_at":    cli.CreatedAt,
+		})
+	}
+	return out, nil
+}
+
+func exportPasskeys(u *ucenter.User) (interface{}, error) {
+	var list []ucenter.Passkey
+	if err := ucenter.DB.Where("user_id = ?", u.ID).Order("id").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	out := make([]gin.H, 0, len(list))
+	for _, p := range list {
+		out = append(out, gin.H{
+			"name":         p.Name,
+			"created_at":   p.CreatedAt,
+			"last_used_at": p.LastUsedAt,
+		})
+	}
+	return out, nil
+}
+
+func exportInvites(u *ucenter.User) (interface{}, error) {
+	var list []ucenter.Invite
+	if err := ucenter.DB.Preload("Redeemer").Where("creator_id = ?", u.ID).Order("id").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	out := make([]gin.H, 0, len(list))
+	for _, i := range list {
+		item := gin.H{
+			"code":       i.Code,
+			"created_at": i.CreatedAt,
+		}
+		if i.Redeemed() {
+			item["redeemed_by"] = i.Redeemer.Username
+			item["redeemed_at"] = i.RedeemedAt
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+// dataExportJob 生成遗留的导出（如队列已满或服务重启），并清理过期归档
+func dataExportJob() error {
+	var pending []ucenter.DataExport
+	if err := ucenter.DB.Where("status = ? AND created_at < ?", ucenter.ExportPending, time.Now().Add(-time.Minute*10)).Find(&pending).Error; err != nil {
+		return err
+	}
+	for i := 0; i < len(pending); i++ {
+		if err := buildExport(&pending[i]); err != nil {
+			log.Printf("data export %d: %s", pending[i].ID, err)
+		}
+	}
+
+	var expired []ucenter.DataExport
+	if err := ucenter.DB.Where("status <> ? AND created_at < ?", ucenter.ExportPending,
+		time.Now().Add(-time.Hour*time.Duration(ucenter.C.DataExportTTL))).Find(&expired).Error; err != nil {
+		return err
+	}
+	for i := 0; i < len(expired); i++ {
+		if !expired[i].Expired() && expired[i].Status == ucenter.ExportReady {
+			continue
+		}
+		os.Remove(expired[i].Path())
+		ucenter.DB.Delete(&expired[i])
+	}
+	return nil
+}
+
+// deleteExports 删除用户的所有导出
+func deleteExports(uid uint) {
+	var list []ucenter.DataExport
+	ucenter.DB.Where("user_id = ?", uid).Find(&list)
+	for i := 0; i < len(list); i++ {
+		os.Remove(list[i].Path())
+	}
+	ucenter.DB.Delete(ucenter.DataExport{}, "user_id = ?", uid)
+}
@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// featureFlag 功能开关的当前设置，首次使用时以配置文件初始化
+func featureFlag(name string) *ucenter.FeatureFlag {
+	f := ucenter.C.FeatureFlags[name]
+	var flag ucenter.FeatureFlag
+	ucenter.DB.Where(ucenter.FeatureFlag{Name: name}).Attrs(ucenter.FeatureFlag{
+		Enabled:    f.Enabled,
+		Percentage: f.Percentage,
+		Users:      f.Users,
+	}).FirstOrCreate(&flag)
+	return &flag
+}
+
+// featureEnabled 功能是否对用户开启，uid 为 0 时只看总开关
+func featureEnabled(name string, uid uint) bool {
+	return featureFlag(name).EnabledFor(uid)
+}
+
+// requireFeature 功能未对当前用户开启时按页面不存在处理
+func requireFeature(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var uid uint
+		if u, ok := c.Get(ucenter.AuthUser); ok {
+			uid = u.(*ucenter.User).ID
+		}
+		if featureEnabled(name, uid) {
+			return
+		}
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+func adminFlags(c *gin.Context) {
+	flags := make(map[string]*ucenter.FeatureFlag)
+	for name := range ucenter.FeatureFlags {
+		flags[name] = featureFlag(name)
+	}
+	c.HTML(http.StatusOK, "admin/flags", nbgin.Data(c, gin.H{
+		"flags": flags,
+		"names": ucenter.FeatureFlags,
+	}))
+}
+
+func editFeatureFlag(c *gin.Context) {
+	type featureFlagForm struct {
+		Name       string `form:"name" binding:"required"`
+		Enabled    bool   `form:"enabled"`
+		Percentage int    `form:"percentage" binding:"min=0,max=100"`
+		Users      string `form:"users" binding:"max=2000"`
+	}
+
+	var ff featureFlagForm
+	if err := c.ShouldBind(&ff); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	if _, ok := ucenter.FeatureFlags[ff.Name]; !ok {
+		c.String(http.StatusNotFound, "功能不存在")
+		return
+	}
+	users := pq.StringArray{}
+	for _, id := range strings.FieldsFunc(ff.Users, func(r rune) bool {
+		return r == '\n' || r == '\r' || r == ',' || r == ' '
+	}) {
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			c.String(http.StatusBadRequest, "用户 ID 不正确："+id)
+			return
+		}
+		users = append(users, id)
+	}
+	f := featureFlag(ff.Name)
+	f.Enabled = ff.Enabled
+	f.Percentage = ff.Percentage
+	f.Users = users
+	if err := ucenter.DB.Save(f).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,453 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+	"gopkg.in/go-playground/validator.v9"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/mail"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+const identityStateCookie = "nb_identity_state"
+
+// identityProviders 已完成发现的外部身份提供方
+var identityProviders sync.Map
+
+// identityProvider 外部身份提供方及其 OAuth2 配置，发现结果在进程内缓存
+func identityProvider(name string) (*oidc.Provider, *oauth2.Config, error) {
+	conf, ok := ucenter.C.IdentityProviders[name]
+	if !ok {
+		return nil, nil, errors.New("身份提供方不存在")
+	}
+	var provider *oidc.Provider
+	if p, ok := identityProviders.Load(name); ok {
+		provider = p.(*oidc.Provider)
+	} else {
+		// 公钥也通过该 context 获取，不能使用请求的 context
+		p, err := oidc.NewProvider(context.Background(), conf.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		identityProviders.Store(name, p)
+		provider = p
+	}
+	return provider, &oauth2.Config{
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  mail.SiteURL("/login/idp/" + name + "/callback"),
+		Scopes:       append([]string{oidc.ScopeOpenID}, conf.Scopes...),
+	}, nil
+}
+
+// beginIdentityAuth 跳转外部身份提供方，state、nonce 保存在 Cookie 中 10 分钟有效
+func beginIdentityAuth(c *gin.Context, name, returnURL string, opts ...oauth2.AuthCodeOption) {
+	_, conf, err := identityProvider(name)
+	if err != nil {
+		identityFailed(c, err.Error())
+		return
+	}
+	stateValue, err := password.GenerateSecret()
+	if err != nil {
+		identityFailed(c, "请稍后重试")
+		return
+	}
+	nonce, err := password.GenerateSecret()
+	if err != nil {
+		identityFailed(c, "请稍后重试")
+		return
+	}
+	state := url.Values{
+		"provider":   {name},
+		"state":      {stateValue},
+		"nonce":      {nonce},
+		"return_url": {returnURL},
+	}
+	nbgin.SetCookie(c, 60*10, identityStateCookie, state.Encode())
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, conf.AuthCodeURL(state.Get("state"), append(opts, oidc.Nonce(state.Get("nonce")))...))
+}
+
+func identityFailed(c *gin.Context, msg string) {
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusForbidden, "page/info", gin.H{
+		"icon":  "unlink",
+		"title": "外部账户验证失败",
+		"msg":   msg,
+	})
+}
+
+// loginIdentity 使用已关联的外部账户登录
+func loginIdentity(c *gin.Context) {
+	if _, ok := c.Get(ucenter.AuthUser); ok {
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, safeReturnURL(c.Query("return_url"), "/"))
+		return
+	}
+	// 标识符优先登录时把输入的邮箱传给提供方预填
+	var opts []oauth2.AuthCodeOption
+	if hint := c.Query("login_hint"); hint != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", hint))
+	}
+	beginIdentityAuth(c, c.Param("provider"), c.Query("return_url"), opts...)
+}
+
+// linkIdentity 关联外部账户到当前用户
+func linkIdentity(c *gin.Context) {
+	beginIdentityAuth(c, c.Param("provider"), "/identities")
+}
+
+// identityCallback 外部身份提供方的回调，已登录时关联账户，未登录时登录
+func identityCallback(c *gin.Context) {
+	name := c.Param("provider")
+	raw, err := c.Cookie(identityStateCookie)
+	nbgin.SetCookie(c, -1, identityStateCookie, "")
+	state, _ := url.ParseQuery(raw)
+	if err != nil || state.Get("state") == "" || state.Get("state") != c.Query("state") || state.Get("provider") != name {
+		identityFailed(c, "验证已过期，请重试")
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		identityFailed(c, "外部账户未授权："+e)
+		return
+	}
+	provider, conf, err := identityProvider(name)
+	if err != nil {
+		identityFailed(c, err.Error())
+		return
+	}
+	token, err := conf.Exchange(c.Request.Context(), c.Query("code"))
+	if err != nil {
+		identityFailed(c, "无法获取外部账户信息")
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: conf.ClientID}).Verify(c.Request.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != state.Get("nonce") {
+		identityFailed(c, "外部账户的身份令牌无效")
+		return
+	}
+	var claims struct {
+		Email             string `json:"email"`
+		PreferredUsername string `json:"preferred_username"`
+		Name              string `json:"name"`
+	}
+	idToken.Claims(&claims)
+	display := idToken.Subject
+	for _, v := range []string{claims.Email, claims.PreferredUsername, claims.Name} {
+		if v != "" {
+			display = v
+			break
+		}
+	}
+
+	if u, ok := c.Get(ucenter.AuthUser); ok {
+		finishIdentityLink(c, u.(*ucenter.User), name, idToken.Subject, display)
+		return
+	}
+	roleClaims := identityClaims(c.Request.Context(), provider, token, idToken, ucenter.C.IdentityProviders[name].RoleRules)
+	finishIdentityLogin(c, name, idToken.Subject, roleClaims, safeReturnURL(state.Get("return_url"), "/"))
+}
+
+func finishIdentityLink(c *gin.Context, u *ucenter.User, provider, subject, display string) {
+	if !sudoActive(c) {
+		identityFailed(c, "身份验证已过期，请重新验证身份后再关联")
+		return
+	}
+	var ident ucenter.Identity
+	if ucenter.DB.Where("provider = ? AND subject = ?", provider, subject).First(&ident).Error == nil {
+		if ident.UserID != u.ID {
+			identityFailed(c, "该外部账户已关联到其他用户")
+			return
+		}
+		ucenter.DB.Model(&ident).Update("name", display)
+	} else {
+		ident = ucenter.Identity{
+			UserID:   u.ID,
+			Provider: provider,
+			Subject:  subject,
+			Name:     display,
+		}
+		if err := ucenter.DB.Create(&ident).Error; err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		auditCurrent(c, ucenter.AuditIdentityLink, userTarget(u.ID), ident.ProviderTitle()+"："+display)
+	}
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, "/identities")
+}
+
+func finishIdentityLogin(c *gin.Context, provider, subject string, claims map[string]interface{}, returnURL string) {
+	if msg := countryDenied(clientIP(c), ucenter.C.LoginCountries); msg != "" {
+		identityFailed(c, msg)
+		return
+	}
+	if msg := reputationDenied(c, "登录"); msg != "" {
+		identityFailed(c, msg)
+		return
+	}
+	var ident ucenter.Identity
+	var u ucenter.User
+	if ucenter.DB.Where("provider = ? AND subject = ?", provider, subject).First(&ident).Error != nil ||
+		ucenter.DB.First(&u, "id = ?", ident.UserID).Error != nil {
+		identityFailed(c, "该外部账户尚未关联，请先使用密码登录，在「关联账户」中关联后再使用")
+		return
+	}
+	if liftExpiredSuspension(&u); u.IsSuspended() {
+		showSuspended(c, &u)
+		return
+	} else if u.Blocked() {
+		identityFailed(c, suspendedMessage(&u))
+		return
+	}
+	ucenter.DB.Model(&ident).Update("last_used_at", time.Now())
+	syncProvisionedRoles(c, u.ID, provider, claims)
+	completeLogin(c, &u, ucenter.AMRFederated, "外部账户登录："+ident.ProviderTitle(), returnURL)
+}
+
+// loginNameTaken 登录名是否已被用户名或附加登录名占用
+func loginNameTaken(name string) bool {
+	var count int
+	ucenter.DB.Model(ucenter.User{}).Where("username = ?", name).Count(&count)
+	if count > 0 {
+		return true
+	}
+	ucenter.DB.Model(ucenter.Identity{}).Where("provider = ? AND subject = ?", ucenter.IdentityPassword, name).Count(&count)
+	return count > 0
+}
+
+func identities(c *gin.Context) {
+	renderIdentities(c, nil)
+}
+
+func renderIdentities(c *gin.Context, errors map[string]string) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var list []ucenter.Identity
+	ucenter.DB.Where("user_id = ?", u.ID).Order("id").Find(&list)
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "user/identities", nbgin.Data(c, gin.H{
+		"identities": list,
+		"providers":  ucenter.C.IdentityProviders,
+		"errors":     errors,
+	}))
+}
+
+// addPasswordIdentity 添加附加登录名，使用独立的密码登录同一账户
+func addPasswordIdentity(c *gin.Context) {
+	type identityForm struct {
+		Username   string `form:"username" cfn:"登录名" binding:"required,min=1,max=20,alphanum"`
+		Password   string `form:"password" cfn:"密码" binding:"required,min=6,max=32,eqfield=RePassword"`
+		RePassword string `form:"repassword" cfn:"确认密码" binding:"required,min=6,max=32"`
+	}
+
+	var idf identityForm
+	var errors validator.ValidationErrorsTranslations
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	if err := c.ShouldBind(&idf); err != nil {
+		errors = err.(validator.ValidationErrors).Translate(ucenter.ValidatorTrans)
+	} else if loginNameTaken(idf.Username) || usernameReserved(idf.Username) {
+		errors = map[string]string{
+			"identityForm.登录名": "登录名不可用",
+		}
+	} else if err := password.CheckPolicy(idf.Password, idf.Username, string(u.Email)); err != nil {
+		errors = map[string]string{
+			"identityForm.密码": err.Error(),
+		}
+	}
+	if errors != nil {
+		renderIdentities(c, errors)
+		return
+	}
+	hash, err := password.Hash(idf.Password)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err := ucenter.DB.Create(&ucenter.Identity{
+		UserID:   u.ID,
+		Provider: ucenter.IdentityPassword,
+		Subject:  idf.Username,
+		Name:     idf.Username,
+		Secret:   hash,
+	}).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditIdentityLink, userTarget(u.ID), "附加登录名："+idf.Username)
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, "/identities")
+}
+
+func deleteIdentity(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var ident ucenter.Identity
+	if ucenter.DB.First(&ident, "id = ? AND user_id = ?", c.Param("id"), u.ID).Error != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err := ucenter.DB.Delete(&ident).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditIdentityUnlink, userTarget(u.ID), ident.ProviderTitle()+"："+ident.Name)
+}
+
+// adminMergeUsers 将重复账户合并到主账户
+func adminMergeUsers(c *gin.Context) {
+	type mergeForm struct {
+		Primary   string `form:"primary" binding:"required"` // 主账户的对外 ID，来自用户搜索
+		Duplicate uint   `form:"duplicate" binding:"required,min=1"`
+	}
+
+	var mf mergeForm
+	var primary, duplicate ucenter.User
+	err := c.ShouldBind(&mf)
+	if err == nil {
+		err = findUserBySubject(mf.Primary, &primary)
+	}
+	if err == nil {
+		err = ucenter.DB.First(&duplicate, "id = ?", mf.Duplicate).Error
+	}
+	if err == nil && primary.ID == duplicate.ID {
+		err = errors.New("不能合并到账户自身")
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	if isDryRun(c) {
+		d, err := mergeImpact(&primary, &duplicate)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		writeDryRun(c, d)
+		return
+	}
+	if err := mergeUsers(primary.ID, duplicate.ID); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditAccountMerge, userTarget(primary.ID), fmt.Sprintf("合并账户 %d（%s）", duplicate.ID, duplicate.Username))
+}
+
+// mergeUsers 将重复账户的登录终端、应用授权、应用、令牌及关联身份转到主账户，随后删除重复账户；
+// 通行密钥与重复账户的 user handle 绑定，无法转移，需在主账户重新注册
+func mergeUsers(primary, duplicate uint) error {
+	from := strconv.FormatUint(uint64(duplicate), 10)
+	to := strconv.FormatUint(uint64(primary), 10)
+	tx := ucenter.DB.Begin()
+	err := tx.Model(ucenter.Login{}).Where("user_id = ?", duplicate).UpdateColumn("user_id", primary).Error
+	if err == nil {
+		// 两个账户都授权过的应用，保留主账户的授权
+		err = tx.Exec("DELETE FROM user_authorizeds WHERE user_id = ? AND client_id IN (SELECT client_id FROM user_authorizeds WHERE user_id = ?)", duplicate, primary).Error
+	}
+	if err == nil {
+		err = tx.Model(ucenter.UserAuthorized{}).Where("user_id = ?", duplicate).UpdateColumn("user_id", primary).Error
+	}
+	if err == nil {
+		// 应用 ID 已发放给第三方，只转移所有者
+		err = tx.Model(storage.FositeClient{}).Where("owner = ?", from).UpdateColumn("owner", to).Error
+	}
+	if err == nil {
+		err = oauth2store.(*storage.FositeStore).ReassignSubject(tx, from, to, publicSubject(to))
+	}
+	for _, m := range []interface{}{ucenter.Identity{}, ucenter.KnownDevice{}, ucenter.TrustedDevice{}, ucenter.LegalAcceptance{}} {
+		if err == nil {
+			err = tx.Model(m).Where("user_id = ?", duplicate).UpdateColumn("user_id", primary).Error
+		}
+	}
+	if err == nil {
+		err = tx.Model(ucenter.Invite{}).Where("creator_id = ?", duplicate).UpdateColumn("creator_id", primary).Error
+	}
+	for _, m := range []interface{}{ucenter.Passkey{}, ucenter.PasswordHistory{}, ucenter.Appeal{}, ucenter.RecoveryCode{}, ucenter.ProvisionedRole{}} {
+		if err == nil {
+			err = tx.Delete(m, "user_id = ?", duplicate).Error
+		}
+	}
+	if err == nil {
+		// 保留墓碑，重复账户的 sub 不会被重新分配
+		err = tx.FirstOrCreate(&ucenter.UserTombstone{}, ucenter.UserTombstone{UserID: duplicate}).Error
+	}
+	if err == nil {
+		err = tx.Unscoped().Delete(ucenter.User{}, "id = ?", duplicate).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	deleteExports(duplicate)
+	return nil
+}
+
+// mergeImpact 预演 mergeUsers：转到主账户及随重复账户删除的记录
+func mergeImpact(primary, duplicate *ucenter.User) (*dryRunImpact, error) {
+	d := newDryRunImpact()
+	d.addUser(primary)
+	d.addUser(duplicate)
+	d.count("users_deleted", 1)
+	counts := []struct {
+		name  string
+		model interface{}
+		where string
+	}{
+		{"logins", ucenter.Login{}, "user_id = ?"},
+		{"authorizations", ucenter.UserAuthorized{}, "user_id = ?"},
+		{"identities", ucenter.Identity{}, "user_id = ?"},
+		{"known_devices", ucenter.KnownDevice{}, "user_id = ?"},
+		{"trusted_devices", ucenter.TrustedDevice{}, "user_id = ?"},
+		{"invites", ucenter.Invite{}, "creator_id = ?"},
+		{"passkeys_deleted", ucenter.Passkey{}, "user_id = ?"},
+		{"recovery_codes_deleted", ucenter.RecoveryCode{}, "user_id = ?"},
+	}
+	for _, m := range counts {
+		if err := d.countRows(m.name, m.model, m.where, duplicate.ID); err != nil {
+			return nil, err
+		}
+	}
+	var clients []storage.FositeClient
+	if err := ucenter.DB.Select("client_id").Where("owner = ?", duplicate.StrID()).Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	d.count("clients", len(clients))
+	for i := range clients {
+		d.addClient(clients[i].ClientID)
+	}
+	return d, d.countTokens("subject", duplicate.StrID())
+}
+
+func exportIdentities(u *ucenter.User) (interface{}, error) {
+	var list []ucenter.Identity
+	if err := ucenter.DB.Where("user_id = ?", u.ID).Order("id").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	out := make([]gin.H, 0, len(list))
+	for _, i := range list {
+		out = append(out, gin.H{
+			"provider":     i.Provider,
+			"subject":      i.Subject,
+			"name":         i.Name,
+			"created_at":   i.CreatedAt,
+			"last_used_at": i.LastUsedAt,
+		})
+	}
+	return out, nil
+}
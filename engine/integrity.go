@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+)
+
+// orphanCheck 引用了已不存在的用户、应用或登录终端的孤立记录
+type orphanCheck struct {
+	desc  string
+	model interface{}
+	where string
+}
+
+// tokenModels 授权码及令牌的数据表
+var tokenModels = []struct {
+	desc  string
+	model interface{}
+}{
+	{"授权码", storage.FositeCode{}},
+	{"PKCE 记录", storage.FositePkce{}},
+	{"OpenID 会话", storage.FositeOidc{}},
+	{"刷新令牌", storage.FositeRefresh{}},
+	{"访问令牌", storage.FositeAccess{}},
+}
+
+// orphanChecks 按清理顺序排列：先清理用户不存在的记录，再清理因此失去应用或登录终端的记录
+var orphanChecks = func() []orphanCheck {
+	checks := []orphanCheck{
+		{"所属用户不存在的登录终端", ucenter.Login{}, "user_id NOT IN (SELECT id FROM users)"},
+		{"所属用户不存在的应用授权", ucenter.UserAuthorized{}, "user_id NOT IN (SELECT id FROM users)"},
+		{"所属用户不存在的受信任设备", ucenter.TrustedDevice{}, "user_id NOT IN (SELECT id FROM users)"},
+		{"所属用户不存在的恢复码", ucenter.RecoveryCode{}, "user_id NOT IN (SELECT id FROM users)"},
+		{"所有者不存在的应用", storage.FositeClient{}, "owner NOT IN (SELECT id::text FROM users)"},
+	}
+	// 客户端凭证等令牌没有用户
+	for _, t := range tokenModels {
+		checks = append(checks, orphanCheck{"用户不存在的" + t.desc, t.model, "subject <> '' AND subject NOT IN (SELECT id::text FROM users)"})
+	}
+	for _, t := range tokenModels {
+		checks = append(checks, orphanCheck{"应用不存在的" + t.desc, t.model, "client_id NOT IN (SELECT client_id FROM fosite_clients)"})
+	}
+	return append(checks,
+		orphanCheck{"应用不存在的应用授权", ucenter.UserAuthorized{}, "client_id NOT IN (SELECT client_id FROM fosite_clients)"},
+		orphanCheck{"应用不存在的注册信息", ucenter.ClientRegistration{}, "client_id NOT IN (SELECT client_id FROM fosite_clients)"},
+		orphanCheck{"应用不存在的应用登录记录", ucenter.LoginClient{}, "client_id NOT IN (SELECT client_id FROM fosite_clients)"},
+		orphanCheck{"登录终端不存在的应用登录记录", ucenter.LoginClient{}, "login_token NOT IN (SELECT token FROM logins)"},
+	)
+}()
+
+// foreignKey 删除被引用的记录时级联删除引用它的记录
+type foreignKey struct {
+	model  interface{}
+	column string
+	ref    interface{}
+	refCol string
+}
+
+var foreignKeys = func() []foreignKey {
+	keys := []foreignKey{
+		{ucenter.Login{}, "user_id", ucenter.User{}, "id"},
+		{ucenter.LoginClient{}, "login_token", ucenter.Login{}, "token"},
+		{ucenter.LoginClient{}, "client_id", storage.FositeClient{}, "client_id"},
+		{ucenter.ClientRegistration{}, "client_id", storage.FositeClient{}, "client_id"},
+		{ucenter.UserAuthorized{}, "user_id", ucenter.User{}, "id"},
+		{ucenter.UserAuthorized{}, "client_id", storage.FositeClient{}, "client_id"},
+		{ucenter.TrustedDevice{}, "user_id", ucenter.User{}, "id"},
+		{ucenter.RecoveryCode{}, "user_id", ucenter.User{}, "id"},
+	}
+	// 令牌的 subject 可以为空，且与用户 ID 类型不同，由 deleteUser 删除
+	for _, t := range tokenModels {
+		keys = append(keys, foreignKey{t.model, "client_id", storage.FositeClient{}, "client_id"})
+	}
+	return keys
+}()
+
+func tableName(m interface{}) string {
+	return ucenter.DB.NewScope(m).TableName()
+}
+
+// checkOrphans 统计孤立记录，repair 为 true 时删除，返回剩余的孤立记录数
+func checkOrphans(w io.Writer, repair bool) (int, error) {
+	var remaining int
+	for _, check := range orphanChecks {
+		var n int
+		if err := ucenter.DB.Unscoped().Model(check.model).Where(check.where).Count(&n).Error; err != nil {
+			return 0, fmt.Errorf("完整性检查 %s 失败: %s", check.desc, err)
+		}
+		status := "通过"
+		if n > 0 && repair {
+			if err := ucenter.DB.Unscoped().Where(check.where).Delete(check.model).Error; err != nil {
+				return 0, fmt.Errorf("清理 %s 失败: %s", check.desc, err)
+			}
+			status = fmt.Sprintf("发现 %d 条，已删除", n)
+		} else if n > 0 {
+			status = fmt.Sprintf("发现 %d 条", n)
+			remaining += n
+		}
+		fmt.Fprintf(w, "完整性检查：%s %s\n", check.desc, status)
+	}
+	return remaining, nil
+}
+
+// ensureForeignKeys 建立尚不存在的外键，返回新建立的数量；存在孤立记录时建立会失败
+func ensureForeignKeys() (int, error) {
+	var created int
+	for _, fk := range foreignKeys {
+		table := tableName(fk.model)
+		name := fmt.Sprintf("fk_%s_%s", table, fk.column)
+		var exists int
+		if err := ucenter.DB.Raw("SELECT count(*) FROM pg_constraint WHERE conname = ?", name).Row().Scan(&exists); err != nil {
+			return created, err
+		}
+		if exists > 0 {
+			continue
+		}
+		if err := ucenter.DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON DELETE CASCADE",
+			table, name, fk.column, tableName(fk.ref), fk.refCol)).Error; err != nil {
+			return created, fmt.Errorf("建立外键 %s 失败: %s", name, err)
+		}
+		created++
+	}
+	return created, nil
+}
+
+// Check 检查孤立记录，repair 为 true 时删除，结果写入 w
+func Check(w io.Writer, repair bool) error {
+	remaining, err := checkOrphans(w, repair)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return fmt.Errorf("发现 %d 条孤立记录，确认删除请加 -repair", remaining)
+	}
+	fmt.Fprintln(w, "检查完成")
+	return nil
+}
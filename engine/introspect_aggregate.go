@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+)
+
+// maxAggregateAudiences 一次聚合内省最多查询的 audience 数量
+const maxAggregateAudiences = 20
+
+// aggregateIntrospection 网关持有一个访问令牌时，以一次调用内省令牌并取得它在多个 audience 下用户授权的 claims，
+// 调用方须为令牌的应用或在令牌的 aud 中
+func aggregateIntrospection(c *gin.Context) {
+	ctx := fosite.NewContext()
+	clientID := requestClientID(c)
+	if clientAuthLocked(c, clientID) {
+		return
+	}
+	if clientNetworkDenied(c, clientID) {
+		return
+	}
+	caller, err := introspectionClient(c)
+	if err != nil {
+		recordClientAuthFailure(clientID, clientIP(c))
+		c.Header("WWW-Authenticate", `Basic realm="ucenter"`)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":             fosite.ErrInvalidClient.Name,
+			"error_description": clientAuthError(err),
+		})
+		return
+	}
+
+	audiences := c.Request.PostForm["audience"]
+	if len(audiences) == 0 || len(audiences) > maxAggregateAudiences {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             fosite.ErrInvalidRequest.Name,
+			"error_description": fmt.Sprintf("Between 1 and %d audience parameters are required.", maxAggregateAudiences),
+		})
+		return
+	}
+
+	session := storage.NewFositeSession("")
+	tokenType, ar, err := oauth2provider.IntrospectToken(ctx, c.PostForm("token"), fosite.AccessToken, session)
+	if err != nil || tokenType != fosite.AccessToken || !tokenAudience(ar).Has(caller.GetID()) {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+	resp := introspectionResponse(tokenType, ar)
+	if resp["active"] != true {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	// 客户端凭证等令牌不代表用户，没有用户 claims
+	var user *ucenter.User
+	if uid, err := strconv.ParseUint(ar.GetSession().GetSubject(), 10, 64); err == nil {
+		var u ucenter.User
+		if ucenter.DB.First(&u, "id = ?", uid).Error == nil {
+			user = &u
+		}
+	}
+	result := make(map[string]gin.H, len(audiences))
+	for _, aud := range audiences {
+		result[aud] = audienceClaims(ar, user, aud)
+	}
+	resp["audiences"] = result
+	c.JSON(http.StatusOK, resp)
+}
+
+// tokenAudience 令牌可用于的 audience：授予的 aud 及令牌所属的应用
+func tokenAudience(ar fosite.AccessRequester) fosite.Arguments {
+	return append(fosite.Arguments{ar.GetClient().GetID()}, ar.GetGrantedAudience()...)
+}
+
+// audienceClaims 令牌在 audience 下的授权。audience 为用户授权过的应用时按该应用的授权计算，
+// 否则按令牌所属应用的授权计算；scope 不超过令牌授予的范围，并扣除用户拒绝提供的 claims
+func audienceClaims(ar fosite.AccessRequester, user *ucenter.User, aud string) gin.H {
+	if !tokenAudience(ar).Has(aud) {
+		return gin.H{"active": false}
+	}
+	res := gin.H{"active": true}
+	if user == nil {
+		res["scope"] = strings.Join(ar.GetGrantedScopes(), " ")
+		return res
+	}
+	var ua ucenter.UserAuthorized
+	if ucenter.DB.First(&ua, "user_id = ? AND client_id = ?", user.ID, aud).Error != nil &&
+		ucenter.DB.First(&ua, "user_id = ? AND client_id = ?", user.ID, ar.GetClient().GetID()).Error != nil {
+		res["scope"] = ""
+		res["claims"] = gin.H{}
+		return res
+	}
+	scopes := fosite.Arguments{}
+	for _, scope := range ar.GetGrantedScopes() {
+		if ua.Permission[scope] {
+			scopes = append(scopes, scope)
+		}
+	}
+	res["scope"] = strings.Join(scopes, " ")
+	res["claims"] = withholdClaims(scopeClaims(user, scopes), ua.WithheldClaims)
+	return res
+}
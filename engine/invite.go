@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/biezhi/gorm-paginator/pagination"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+func invites(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var list []ucenter.Invite
+	ucenter.DB.Preload("Redeemer").Where("creator_id = ?", u.ID).Order("id desc").Find(&list)
+	c.HTML(http.StatusOK, "user/invites", nbgin.Data(c, gin.H{
+		"invites": list,
+		"remain":  ucenter.C.InviteQuota - len(list),
+	}))
+}
+
+func createInvite(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var count int
+	ucenter.DB.Model(ucenter.Invite{}).Where("creator_id = ?", u.ID).Count(&count)
+	if count >= ucenter.C.InviteQuota {
+		c.String(http.StatusForbidden, "邀请码额度已用完")
+		return
+	}
+	if _, err := newInvite(u.ID); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+func adminInvites(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "15"))
+	var list []ucenter.Invite
+	paginator := pagination.Pagging(&pagination.Param{
+		DB:      ucenter.DB.Preload("Creator").Preload("Redeemer"),
+		Page:    page,
+		Limit:   limit,
+		OrderBy: []string{"id desc"},
+		ShowSQL: true,
+	}, &list)
+
+	c.HTML(http.StatusOK, "admin/invites", nbgin.Data(c, gin.H{
+		"invites": paginator,
+	}))
+}
+
+func adminCreateInvite(c *gin.Context) {
+	type inviteForm struct {
+		Count int `form:"count" binding:"required,min=1,max=100"`
+	}
+
+	var inf inviteForm
+	if err := c.ShouldBind(&inf); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	for i := 0; i < inf.Count; i++ {
+		if _, err := newInvite(u.ID); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+}
+
+func deleteInvite(c *gin.Context) {
+	// 已使用的邀请码保留，用于追溯注册来源
+	if err := ucenter.DB.Delete(ucenter.Invite{}, "id = ? AND redeemed_by IS NULL", c.Param("id")).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+// inviteAlphabet 邀请码字符集，输入时不区分大小写
+const inviteAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// newInvite 生成邀请码
+func newInvite(creatorID uint) (*ucenter.Invite, error) {
+	code := make([]byte, 12)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(inviteAlphabet))))
+		if err != nil {
+			return nil, err
+		}
+		code[i] = inviteAlphabet[n.Int64()]
+	}
+	invite := ucenter.Invite{
+		Code:      string(code),
+		CreatorID: creatorID,
+	}
+	return &invite, ucenter.DB.Create(&invite).Error
+}
+
+// inviteAvailable 邀请码是否可用
+func inviteAvailable(code string) bool {
+	if code == "" {
+		return false
+	}
+	var count int
+	ucenter.DB.Model(ucenter.Invite{}).Where("code = ? AND redeemed_by IS NULL", strings.ToUpper(code)).Count(&count)
+	return count > 0
+}
+
+// redeemInvite 使用邀请码，条件更新保证同一邀请码只能被使用一次
+func redeemInvite(tx *gorm.DB, code string, uid uint) error {
+	res := tx.Model(ucenter.Invite{}).Where("code = ? AND redeemed_by IS NULL", strings.ToUpper(code)).
+		Updates(map[string]interface{}{
+			"redeemed_by": uid,
+			"redeemed_at": time.Now(),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("邀请码无效或已被使用")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/iplist"
+)
+
+// clientIP 请求来源 IP 的规范形式，保存及比较 IP 时都应使用它而不是 c.ClientIP()。
+// 只采信 trusted_proxies 中的反向代理添加的 X-Forwarded-For 或 X-Real-Ip，其他来源的请求头可以伪造
+func clientIP(c *gin.Context) string {
+	forwarded := c.GetHeader("X-Forwarded-For")
+	if forwarded == "" {
+		forwarded = c.GetHeader("X-Real-Ip")
+	}
+	return normalizeIP(iplist.ClientIP(peerIP(c), forwarded, ucenter.C.TrustedProxies))
+}
+
+// peerIP 直接连接的对端 IP，不受 X-Forwarded-For 等请求头影响
+func peerIP(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		host = c.Request.RemoteAddr
+	}
+	return normalizeIP(host)
+}
+
+// fromTrustedProxy 直接连接的对端是否为 trusted_proxies 中的反向代理，只有这时才采信代理添加的请求头
+func fromTrustedProxy(c *gin.Context) bool {
+	return iplist.Contains(peerIP(c), ucenter.C.TrustedProxies)
+}
+
+// dialPublicOnly 作为 net.Dialer 的 Control，拒绝连接本机及内网地址。检查发生在域名解析之后，
+// 域名指向内网或解析结果被替换都无法绕过
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !iplist.Public(host) {
+		return fmt.Errorf("%s 不是公网地址", host)
+	}
+	return nil
+}
+
+// normalizeIP IPv4 映射的 IPv6 地址还原为 IPv4，IPv6 去掉区域并转为小写压缩形式，无法解析时原样返回
+func normalizeIP(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.String()
+}
+
+// ipKey 按 IP 限流、锁定时的计数键：IPv4 为地址本身，IPv6 为所在前缀（默认 /64），
+// 同一网段内轮换的临时地址计为同一来源
+func ipKey(s string) string {
+	s = normalizeIP(s)
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return s
+	}
+	bits := ucenter.C.IPv6PrefixLength
+	if bits <= 0 || bits > 128 {
+		bits = 64
+	}
+	mask := net.CIDRMask(bits, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/naiba/ucenter"
+)
+
+// queuedJob 异步任务
+type queuedJob struct {
+	name string
+	fn   func() error
+}
+
+// jobQueue 异步任务队列
+var jobQueue = make(chan queuedJob, 100)
+
+// jobNode 当前节点的标识，记录在 job_locks 中便于排查
+var jobNode = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}()
+
+// startJob 定时执行后台任务，多个节点同时运行时每个周期只由一个节点执行
+func startJob(name string, interval time.Duration, fn func() error) {
+	go func() {
+		for {
+			if err := runClusterJob(name, interval, fn); err != nil {
+				log.Printf("job %s: %s", name, err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// runClusterJob 在 job_locks 中以条件更新占用本周期，占用成功才执行。PostgreSQL 另在执行期间持有事务级
+// advisory lock，执行时间超过周期时其他节点也不会同时执行；其他数据库只依靠条件更新
+func runClusterJob(name string, interval time.Duration, fn func() error) error {
+	// 多个节点同时创建时只有一个成功，其余忽略错误继续争用
+	ucenter.DB.Where(ucenter.JobLock{Name: name}).FirstOrCreate(&ucenter.JobLock{})
+	if ucenter.DB.Dialect().GetName() != "postgres" {
+		if !claimJob(ucenter.DB, name, interval) {
+			return nil
+		}
+		return fn()
+	}
+
+	tx := ucenter.DB.Begin()
+	var locked bool
+	if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", jobLockKey(name)).Row().Scan(&locked); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !locked || !claimJob(tx, name, interval) {
+		tx.Rollback()
+		return nil
+	}
+	err := fn()
+	// 提交后释放 advisory lock，本周期的执行记录对其他节点可见
+	if cerr := tx.Commit().Error; err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// claimJob 距上次执行已满一个周期时记为由当前节点执行
+func claimJob(db *gorm.DB, name string, interval time.Duration) bool {
+	now := time.Now()
+	return db.Model(ucenter.JobLock{}).Where("name = ? AND run_at <= ?", name, now.Add(-interval)).
+		Updates(map[string]interface{}{"run_at": now, "node": jobNode}).RowsAffected == 1
+}
+
+// jobLockKey advisory lock 的键
+func jobLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("ucenter:job:" + name))
+	return int64(h.Sum64())
+}
+
+// enqueueJob 提交异步任务，队列已满时返回 false，由定时任务兜底
+func enqueueJob(name string, fn func() error) bool {
+	select {
+	case jobQueue <- queuedJob{name: name, fn: fn}:
+		return true
+	default:
+		return false
+	}
+}
+
+// startWorker 逐个执行队列中的异步任务
+func startWorker() {
+	go func() {
+		for job := range jobQueue {
+			if err := job.fn(); err != nil {
+				log.Printf("job %s: %s", job.name, err)
+			}
+		}
+	}()
+}
+
+func startJobs() {
+	startWorker()
+	startJob("stale-account", time.Hour, staleAccountJob)
+	startJob("login-client-gc", time.Hour, loginClientGCJob)
+	startJob("passkey-session-gc", time.Hour, passkeySessionGCJob)
+	startJob("email-otp-gc", time.Hour, emailOTPGCJob)
+	startJob("trusted-device-gc", time.Hour, trustedDeviceGCJob)
+	startJob("email-change-gc", time.Hour, emailChangeGCJob)
+	startJob("security-alert", time.Minute, securityAlertJob)
+	startJob("signup-request-gc", time.Hour, signupRequestGCJob)
+	startJob("qr-login-gc", time.Hour, qrLoginGCJob)
+	startJob("dpop-proof-gc", time.Hour, dpopProofGCJob)
+	startJob("device-code-gc", time.Hour, deviceCodeGCJob)
+	startJob("pushed-request-gc", time.Hour, pushedRequestGCJob)
+	startJob("data-export", time.Minute*10, dataExportJob)
+	startJob("pii-migrate", time.Hour, piiMigrateJob)
+	startJob("suspension-lift", time.Minute*5, suspensionLiftJob)
+	startJob("audit-anchor", time.Hour, auditAnchorJob)
+	startJob("signing-key", time.Minute*10, signingKeyJob)
+	startJob("report", time.Hour, reportJob)
+}
@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/jwe"
+)
+
+// encryptIDToken 客户端要求加密 ID Token 时返回 JWE，否则原样返回
+func encryptIDToken(client fosite.Client, idToken string) (string, error) {
+	cli, ok := client.(*storage.FositeClient)
+	if !ok || cli.IDTokenEncryptedResponseAlg == "" || idToken == "" {
+		return idToken, nil
+	}
+	return jwe.Encrypt([]byte(idToken), cli.JSONWebKeys, cli.IDTokenEncryptedResponseAlg, cli.IDTokenEncryptedResponseEnc, true)
+}
+
+// encryptAccessResponse 加密令牌端点响应中的 ID Token
+func encryptAccessResponse(ar fosite.AccessRequester, response fosite.AccessResponder) error {
+	idToken, _ := response.GetExtra("id_token").(string)
+	encrypted, err := encryptIDToken(ar.GetClient(), idToken)
+	if err != nil {
+		return err
+	}
+	if encrypted != idToken {
+		response.SetExtra("id_token", encrypted)
+	}
+	return nil
+}
+
+// encryptAuthorizeResponse 加密授权端点响应中的 ID Token
+func encryptAuthorizeResponse(ar fosite.AuthorizeRequester, response fosite.AuthorizeResponder) error {
+	fragment := response.GetFragment()
+	idToken := fragment.Get("id_token")
+	encrypted, err := encryptIDToken(ar.GetClient(), idToken)
+	if err != nil {
+		return err
+	}
+	if encrypted != idToken {
+		fragment.Set("id_token", encrypted)
+	}
+	return nil
+}
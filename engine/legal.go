@@ -0,0 +1,249 @@
+package engine
+
+import (
+	"encoding/csv"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/microcosm-cc/bluemonday"
+	"gopkg.in/russross/blackfriday.v2"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// publishedLegalDocuments 各类法律文件的最新版本
+func publishedLegalDocuments() []ucenter.LegalDocument {
+	var docs []ucenter.LegalDocument
+	ucenter.DB.Raw("SELECT DISTINCT ON (kind) * FROM legal_documents ORDER BY kind, version DESC").Scan(&docs)
+	return docs
+}
+
+// currentLegalDocuments 需要同意的法律文件的最新版本，未发布过的类型不要求同意
+func currentLegalDocuments() []ucenter.LegalDocument {
+	var docs []ucenter.LegalDocument
+	for _, d := range publishedLegalDocuments() {
+		if d.MustAccept() {
+			docs = append(docs, d)
+		}
+	}
+	return docs
+}
+
+// renderMarkdown 渲染法律文件，保留单个换行以兼容纯文本内容，并过滤脚本等不安全的 HTML
+func renderMarkdown(s string) template.HTML {
+	out := blackfriday.Run([]byte(s), blackfriday.WithExtensions(blackfriday.CommonExtensions|blackfriday.HardLineBreak))
+	return template.HTML(bluemonday.UGCPolicy().SanitizeBytes(out))
+}
+
+// pendingLegalDocuments 用户尚未同意的最新版法律文件
+func pendingLegalDocuments(uid uint) []ucenter.LegalDocument {
+	var pending []ucenter.LegalDocument
+	for _, d := range currentLegalDocuments() {
+		var count int
+		ucenter.DB.Model(ucenter.LegalAcceptance{}).Where("user_id = ? AND document_id = ?", uid, d.ID).Count(&count)
+		if count == 0 {
+			pending = append(pending, d)
+		}
+	}
+	return pending
+}
+
+// acceptLegalDocuments 记录用户同意法律文件
+func acceptLegalDocuments(db *gorm.DB, uid uint, docs []ucenter.LegalDocument, ip string) error {
+	now := time.Now()
+	for _, d := range docs {
+		if err := db.Create(&ucenter.LegalAcceptance{
+			UserID:     uid,
+			DocumentID: d.ID,
+			Kind:       d.Kind,
+			Version:    d.Version,
+			IP:         ip,
+			AcceptedAt: now,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legalMustAccept 发布新版法律文件后，用户需重新同意才能继续使用；退出、导出数据及注销账户不受限制
+func legalMustAccept(c *gin.Context) {
+	u, ok := c.Get(ucenter.AuthUser)
+	if !ok {
+		return
+	}
+	p := c.Request.URL.Path
+	if p == "/legal" || p == "/logout" || strings.HasPrefix(p, "/export") || strings.HasPrefix(p, "/user/") {
+		return
+	}
+	if len(pendingLegalDocuments(u.(*ucenter.User).ID)) == 0 {
+		return
+	}
+	if c.Request.Method == http.MethodGet {
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, "/legal?return_url="+url.QueryEscape(c.Request.RequestURI))
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"legal": "/legal"})
+}
+
+// legalDocument 查看法律文件，默认为最新版本
+func legalDocument(c *gin.Context) {
+	var doc ucenter.LegalDocument
+	db := ucenter.DB.Where("kind = ?", c.Param("kind"))
+	if v := c.Query("version"); v != "" {
+		db = db.Where("version = ?", v)
+	}
+	if _, ok := ucenter.LegalKinds[c.Param("kind")]; !ok || db.Order("version desc").First(&doc).Error != nil {
+		c.HTML(http.StatusNotFound, "page/info", gin.H{
+			"icon":  "file alternate",
+			"title": "文件不存在",
+			"msg":   "该文件尚未发布",
+		})
+		return
+	}
+	c.HTML(http.StatusOK, "page/legal", nbgin.Data(c, gin.H{
+		"doc": doc,
+	}))
+}
+
+func legalAccept(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	pending := pendingLegalDocuments(u.ID)
+	if len(pending) == 0 {
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, safeReturnURL(c.Query("return_url"), "/"))
+		return
+	}
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "page/legal_accept", nbgin.Data(c, gin.H{
+		"docs": pending,
+	}))
+}
+
+func legalAcceptHandler(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	pending := pendingLegalDocuments(u.ID)
+	if c.PostForm("agree") != "on" {
+		c.HTML(http.StatusOK, "page/legal_accept", nbgin.Data(c, gin.H{
+			"docs":  pending,
+			"error": "请阅读并勾选同意后继续",
+		}))
+		return
+	}
+	if err := acceptLegalDocuments(ucenter.DB, u.ID, pending, clientIP(c)); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, safeReturnURL(c.Query("return_url"), "/"))
+}
+
+func adminLegal(c *gin.Context) {
+	var docs []ucenter.LegalDocument
+	ucenter.DB.Order("kind, version desc").Find(&docs)
+	accepted := make(map[uint]int)
+	for _, d := range docs {
+		var count int
+		ucenter.DB.Model(ucenter.LegalAcceptance{}).Where("document_id = ?", d.ID).Count(&count)
+		accepted[d.ID] = count
+	}
+	// 编辑时以最新版本为底稿
+	latest := make(map[string]string)
+	for _, d := range publishedLegalDocuments() {
+		latest[d.Kind] = d.Content
+	}
+	c.HTML(http.StatusOK, "admin/legal", nbgin.Data(c, gin.H{
+		"docs":       docs,
+		"accepted":   accepted,
+		"kinds":      ucenter.LegalKinds,
+		"mustAccept": ucenter.LegalMustAccept,
+		"latest":     latest,
+	}))
+}
+
+// publishLegalDocument 发布法律文件的新版本，需要同意的类型所有用户需重新同意
+func publishLegalDocument(c *gin.Context) {
+	type legalForm struct {
+		Kind    string `form:"kind" binding:"required"`
+		Content string `form:"content" binding:"required,min=1,max=100000"`
+	}
+
+	var lf legalForm
+	if err := c.ShouldBind(&lf); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	if _, ok := ucenter.LegalKinds[lf.Kind]; !ok {
+		c.String(http.StatusBadRequest, "文件类型不存在")
+		return
+	}
+	var version int
+	ucenter.DB.Model(ucenter.LegalDocument{}).Where("kind = ?", lf.Kind).Select("coalesce(max(version), 0)").Row().Scan(&version)
+	if err := ucenter.DB.Create(&ucenter.LegalDocument{
+		Kind:      lf.Kind,
+		Version:   version + 1,
+		Content:   lf.Content,
+		CreatedBy: c.MustGet(ucenter.AuthUser).(*ucenter.User).ID,
+	}).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+// legalAcceptances 导出全部同意记录，供合规审计使用
+func legalAcceptances(c *gin.Context) {
+	rows, err := ucenter.DB.Table("legal_acceptances").
+		Select("legal_acceptances.user_id, users.username, legal_acceptances.kind, legal_acceptances.version, legal_acceptances.ip, legal_acceptances.accepted_at").
+		Joins("LEFT JOIN users ON users.id = legal_acceptances.user_id").
+		Order("legal_acceptances.id").Rows()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="legal-acceptances-`+time.Now().Format("20060102")+`.csv"`)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"user_id", "username", "kind", "version", "ip", "accepted_at"})
+	for rows.Next() {
+		var uid uint
+		var username *string
+		var kind, ip string
+		var version int
+		var at time.Time
+		if err := rows.Scan(&uid, &username, &kind, &version, &ip, &at); err != nil {
+			break
+		}
+		var name string
+		if username != nil {
+			name = *username
+		}
+		w.Write([]string{strconv.FormatUint(uint64(uid), 10), name, kind, strconv.Itoa(version), ip, at.Format(time.RFC3339)})
+	}
+	w.Flush()
+}
+
+func exportLegal(u *ucenter.User) (interface{}, error) {
+	var list []ucenter.LegalAcceptance
+	if err := ucenter.DB.Where("user_id = ?", u.ID).Order("id").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	out := make([]gin.H, 0, len(list))
+	for _, a := range list {
+		out = append(out, gin.H{
+			"kind":        a.Kind,
+			"version":     a.Version,
+			"ip":          a.IP,
+			"accepted_at": a.AcceptedAt,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/lockout"
+)
+
+func loginFailureWindow() time.Duration {
+	return time.Minute * time.Duration(ucenter.C.LoginFailureWindow)
+}
+
+// loginLockedFor 用户名或 IP（IPv6 按前缀）还需锁定多久，0 表示未锁定
+func loginLockedFor(username, ip string) time.Duration {
+	var locked time.Duration
+	for _, k := range lockout.Keys(ipKey(ip), username) {
+		if d := lockedFor(k.Field, k.Value); d > locked {
+			locked = d
+		}
+	}
+	return locked
+}
+
+func lockedFor(field, value string) time.Duration {
+	max := ucenter.C.LoginMaxFailures
+	if max <= 0 || value == "" {
+		return 0
+	}
+	var attempts []ucenter.LoginAttempt
+	ucenter.DB.Where(field+" = ? AND created_at > ?", value, time.Now().Add(-loginFailureWindow())).
+		Order("created_at desc").Limit(max).Find(&attempts)
+	if len(attempts) < max {
+		return 0
+	}
+	return time.Until(attempts[max-1].CreatedAt.Add(loginFailureWindow()))
+}
+
+// recordLoginFailure 记录一次登录失败
+func recordLoginFailure(username, ip string) {
+	ucenter.DB.Delete(ucenter.LoginAttempt{}, "created_at < ?", time.Now().Add(-loginFailureWindow()))
+	ucenter.DB.Create(&ucenter.LoginAttempt{
+		Username: username,
+		IP:       ipKey(ip),
+	})
+}
+
+// clearLoginFailures 建立会话后清除各登录名的失败计数。记录保留并继续计入来源 IP，随时间窗口过期
+func clearLoginFailures(names ...string) {
+	for _, k := range lockout.NameKeys(names...) {
+		ucenter.DB.Model(ucenter.LoginAttempt{}).Where(k.Field+" = ?", k.Value).UpdateColumn(k.Field, "")
+	}
+}
+
+// lockedLogin 被锁定的用户名或 IP
+type lockedLogin struct {
+	Field    string
+	Value    string
+	Failures int
+}
+
+// lockedLogins 当前被锁定的用户名及 IP
+func lockedLogins() ([]lockedLogin, error) {
+	var list []lockedLogin
+	max := ucenter.C.LoginMaxFailures
+	if max <= 0 {
+		return list, nil
+	}
+	for _, field := range []string{"username", "ip"} {
+		rows, err := ucenter.DB.Model(ucenter.LoginAttempt{}).
+			Select(field+", count(*)").
+			Where(field+" <> '' AND created_at > ?", time.Now().Add(-loginFailureWindow())).
+			Group(field).Having("count(*) >= ?", max).Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			l := lockedLogin{Field: field}
+			if err = rows.Scan(&l.Value, &l.Failures); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			list = append(list, l)
+		}
+		rows.Close()
+	}
+	return list, nil
+}
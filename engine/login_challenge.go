@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+// loginChallengeCookie 发起登录挑战的浏览器所持随机值，防止他人诱导浏览器兑换其登录结果
+const loginChallengeCookie = "nb_login_challenge"
+
+func loginChallengeHash(nonce string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(nonce)))
+}
+
+// redirectToLoginUI 创建登录挑战并跳转到外部登录界面，登录后回到 returnURL
+func redirectToLoginUI(c *gin.Context, ar fosite.AuthorizeRequester, returnURL string) {
+	nonce, err := password.GenerateSecret()
+	if err != nil {
+		oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrServerError)
+		return
+	}
+	lc, err := oauth2store.(*storage.FositeStore).CreateLoginChallenge(ar.GetClient().GetID(), returnURL, loginChallengeHash(nonce))
+	if err != nil {
+		oauth2provider.WriteAuthorizeError(c.Writer, ar, err)
+		return
+	}
+	u, err := url.Parse(ucenter.C.LoginURL)
+	if err != nil {
+		oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrServerError)
+		return
+	}
+	q := u.Query()
+	q.Set("login_challenge", lc.ID)
+	u.RawQuery = q.Encode()
+	nbgin.SetCookie(c, int(storage.ConsentChallengeLifespan.Seconds()), loginChallengeCookie, nonce)
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, u.String())
+}
+
+// handleLoginVerifier 外部登录界面确认身份后，由发起登录的浏览器完成登录，并回到原始授权请求
+func handleLoginVerifier(c *gin.Context, verifier string, ar fosite.AuthorizeRequester) {
+	nonce, _ := c.Cookie(loginChallengeCookie)
+	nbgin.SetCookie(c, -1, loginChallengeCookie, "")
+	lc, err := oauth2store.(*storage.FositeStore).ConsumeLoginVerifier(verifier)
+	if err == nil && (nonce == "" || subtle.ConstantTimeCompare([]byte(lc.BrowserHash), []byte(loginChallengeHash(nonce))) != 1) {
+		err = fosite.ErrRequestForbidden.WithHint("The login verifier was not issued to this browser.")
+	}
+	if err == nil && lc.ClientID != ar.GetClient().GetID() {
+		err = fosite.ErrRequestForbidden.WithHint("The login verifier does not belong to this request.")
+	}
+	if err == nil && lc.Status != storage.ConsentAccepted {
+		err = fosite.ErrAccessDenied
+	}
+	var u ucenter.User
+	if err == nil && ucenter.DB.First(&u, "id = ?", lc.Subject).Error != nil {
+		err = fosite.ErrAccessDenied.WithHint("The subject does not exist.")
+	}
+	if err == nil {
+		liftExpiredSuspension(&u)
+		if u.Blocked() {
+			err = fosite.ErrAccessDenied.WithHint("The subject has been suspended.")
+		}
+	}
+	if err != nil {
+		oauth2provider.WriteAuthorizeError(c.Writer, ar, err)
+		return
+	}
+
+	// 去掉 verifier 后重新进入授权流程，与其他登录方式一样先完成二次验证
+	next := *c.Request.URL
+	q := next.Query()
+	q.Del("login_verifier")
+	next.RawQuery = q.Encode()
+	completeLogin(c, &u, ucenter.AMRFederated, "外部登录界面："+lc.ClientID, next.RequestURI())
+}
+
+func loginChallenge(c *gin.Context) {
+	lc, err := oauth2store.(*storage.FositeStore).GetLoginChallenge(c.Query("challenge"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	client, err := oauth2store.GetClient(nil, lc.ClientID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	fc := client.(*storage.FositeClient)
+	c.JSON(http.StatusOK, gin.H{
+		"challenge": lc.ID,
+		"client": gin.H{
+			"client_id":   fc.ClientID,
+			"client_name": fc.Name,
+			"client_uri":  fc.ClientURI,
+			"logo_uri":    fc.LogoURI,
+		},
+		"expires_at": lc.ExpiresAt,
+	})
+}
+
+func acceptLogin(c *gin.Context) {
+	type acceptForm struct {
+		Subject string `json:"subject" binding:"required"`
+	}
+	var af acceptForm
+	if err := c.ShouldBindJSON(&af); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var u ucenter.User
+	if err := ucenter.DB.First(&u, "id = ?", af.Subject).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "subject not found"})
+		return
+	}
+	lc, err := oauth2store.(*storage.FositeStore).AcceptLoginChallenge(c.Query("challenge"), u.StrID())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"redirect_to": withQuery(lc.RequestURL, "login_verifier", lc.Verifier),
+	})
+}
+
+func rejectLogin(c *gin.Context) {
+	lc, err := oauth2store.(*storage.FositeStore).RejectLoginChallenge(c.Query("challenge"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"redirect_to": withQuery(lc.RequestURL, "login_verifier", lc.Verifier),
+	})
+}
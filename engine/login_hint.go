@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// loginHintCookie 标识符优先登录中输入的用户名或邮箱，用于返回登录页时预填
+const loginHintCookie = "nb_login_hint"
+
+// loginOptions 标识符对应的登录方式
+type loginOptions struct {
+	// Methods 可用的登录方式：password、passkey
+	Methods []string `json:"methods"`
+	// Provider 按邮箱域名推荐的外部身份提供方
+	Provider      string `json:"provider,omitempty"`
+	ProviderTitle string `json:"provider_title,omitempty"`
+	// Providers 用户已关联的外部身份提供方，隐私模式下不返回
+	Providers []string `json:"providers,omitempty"`
+}
+
+// domainProvider 按邮箱域名匹配外部身份提供方
+func domainProvider(identifier string) string {
+	i := strings.LastIndex(identifier, "@")
+	if i < 0 {
+		return ""
+	}
+	domain := strings.ToLower(identifier[i+1:])
+	names := make([]string, 0, len(ucenter.C.IdentityProviders))
+	for name := range ucenter.C.IdentityProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, pattern := range ucenter.C.IdentityProviders[name].Domains {
+			if ok, _ := path.Match(strings.ToLower(pattern), domain); ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// beginLogin 标识符优先登录：按用户名或邮箱返回可用的登录方式，登录页据此调整后续步骤
+func beginLogin(c *gin.Context) {
+	if _, ok := c.Get(ucenter.AuthUser); ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	identifier := strings.TrimSpace(c.PostForm("username"))
+	if identifier == "" || len(identifier) > 255 {
+		c.String(http.StatusBadRequest, "请输入用户名或邮箱")
+		return
+	}
+	if msg := countryDenied(clientIP(c), ucenter.C.LoginCountries); msg != "" {
+		c.String(http.StatusForbidden, msg)
+		return
+	}
+	if msg := reputationDenied(c, "登录"); msg != "" {
+		c.String(http.StatusForbidden, msg)
+		return
+	}
+	if d := loginLockedFor(identifier, clientIP(c)); d > 0 {
+		c.String(http.StatusTooManyRequests, "登录失败次数过多，请 "+humanDuration(d)+" 后再试")
+		return
+	}
+
+	opts := loginOptions{Methods: []string{"password"}}
+	if name := domainProvider(identifier); name != "" {
+		opts.Provider = name
+		opts.ProviderTitle = ucenter.C.IdentityProviders[name].Title
+		if opts.ProviderTitle == "" {
+			opts.ProviderTitle = name
+		}
+	}
+	// 隐私模式下无论用户是否存在都返回相同的选项，通行密钥使用可发现凭据，无需先确定用户
+	var u ucenter.User
+	if ucenter.C.LoginPrivacy {
+		if featureEnabled(ucenter.FlagPasskey, 0) {
+			opts.Methods = append(opts.Methods, "passkey")
+		}
+	} else if _, err := findLoginUser(identifier, &u); err == nil {
+		var count int
+		ucenter.DB.Model(ucenter.Passkey{}).Where("user_id = ?", u.ID).Count(&count)
+		if count > 0 && featureEnabled(ucenter.FlagPasskey, u.ID) {
+			opts.Methods = append(opts.Methods, "passkey")
+		}
+		var idents []ucenter.Identity
+		ucenter.DB.Where("user_id = ? AND provider <> ?", u.ID, ucenter.IdentityPassword).Find(&idents)
+		for _, ident := range idents {
+			if _, ok := ucenter.C.IdentityProviders[ident.Provider]; ok {
+				opts.Providers = append(opts.Providers, ident.Provider)
+			}
+		}
+	}
+
+	nbgin.SetCookie(c, 60*10, loginHintCookie, url.QueryEscape(identifier))
+	nbgin.SetNoCache(c)
+	c.JSON(http.StatusOK, opts)
+}
+
+// loginHint 登录页预填的用户名或邮箱
+func loginHint(c *gin.Context) string {
+	raw, _ := c.Cookie(loginHintCookie)
+	hint, _ := url.QueryUnescape(raw)
+	return hint
+}
@@ -0,0 +1,239 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	jwt2 "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/pborman/uuid"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// backchannelLogoutEvent Back-Channel Logout 令牌中的事件类型
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// logoutTokenLifespan 退出令牌的有效期，应用应在收到后立即处理
+const logoutTokenLifespan = time.Minute * 2
+
+// backchannelClient 通知应用的 HTTP 客户端，应用无响应时不阻塞后续通知；与 sectorClient 一样只连接公网地址，不跟随跳转
+var backchannelClient = &http.Client{
+	Timeout: time.Second * 5,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: time.Second * 5, Control: dialPublicOnly}).DialContext,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// loginSID 终端的会话标识，与 ID Token 中的 sid 一致
+func loginSID(token string) string {
+	return (&ucenter.Login{Token: token}).PublicID()
+}
+
+// endLogin 下线终端并通知其登录过的应用
+func endLogin(uid uint, token string) {
+	backchannelLogout(uid, token)
+	ucenter.DB.Unscoped().Delete(ucenter.Login{}, "token = ?", token)
+	ucenter.DB.Delete(ucenter.LoginClient{}, "login_token = ?", token)
+}
+
+// userLoginTokens 用户全部终端，用于下线前通知应用
+func userLoginTokens(uid uint) []string {
+	var tokens []string
+	ucenter.DB.Model(ucenter.Login{}).Where("user_id = ?", uid).Pluck("token", &tokens)
+	return tokens
+}
+
+// backchannelLogout 向终端登录过、登记了 backchannel_logout_uri 的应用发送退出令牌，须在删除 login_clients 之前调用
+func backchannelLogout(uid uint, tokens ...string) {
+	sub := publicSubject(fmt.Sprintf("%d", uid))
+	for _, token := range tokens {
+		sid := loginSID(token)
+		for _, client := range loginClients(token) {
+			if client.BackchannelLogoutURI == "" || client.Status == storage.StatusOauthClientSuspended {
+				continue
+			}
+			go func(client storage.FositeClient) {
+				if err := sendLogoutToken(&client, pairwiseSubject(&client, sub), sid); err != nil {
+					log.Printf("backchannel logout %s: %s", client.ClientID, err)
+				}
+			}(client)
+		}
+	}
+}
+
+// sendLogoutToken 签发退出令牌（OpenID Connect Back-Channel Logout 第 2.4 节）并 POST 给应用
+func sendLogoutToken(client *storage.FositeClient, sub, sid string) error {
+	now := time.Now().UTC()
+	token, _, err := signingKeys.Generate(context.Background(), jwt2.MapClaims{
+		"iss":    ucenter.Issuer(),
+		"aud":    client.ClientID,
+		"sub":    sub,
+		"sid":    sid,
+		"iat":    now.Unix(),
+		"exp":    now.Add(logoutTokenLifespan).Unix(),
+		"jti":    uuid.New(),
+		"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+	}, &jwt.Headers{Extra: map[string]interface{}{"typ": "logout+jwt"}})
+	if err != nil {
+		return err
+	}
+	resp, err := backchannelClient.PostForm(client.BackchannelLogoutURI, url.Values{"logout_token": {token}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("应用返回 %s", resp.Status)
+	}
+	return nil
+}
+
+// parseIDTokenHint 校验 id_token_hint 的签名及签发者，已过期的 ID Token 同样可以作为提示
+func parseIDTokenHint(raw string) (jwt2.MapClaims, error) {
+	t, err := (&jwt2.Parser{SkipClaimsValidation: true}).Parse(raw, signingKeys.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	claims := t.Claims.(jwt2.MapClaims)
+	if iss, _ := claims["iss"].(string); iss != ucenter.Issuer() {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	return claims, nil
+}
+
+// audiences ID Token 的 aud，可能是字符串或数组
+func audiences(claims jwt2.MapClaims) []string {
+	switch v := claims["aud"].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var aud []string
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				aud = append(aud, s)
+			}
+		}
+		return aud
+	}
+	return nil
+}
+
+// postLogoutRedirect 校验 post_logout_redirect_uri 必须与应用登记的地址完全一致，并附上 state
+func postLogoutRedirect(clientID, raw, state string) (string, error) {
+	if clientID == "" {
+		return "", errors.New("缺少 client_id 或 id_token_hint，无法校验退出后的跳转链接")
+	}
+	var client storage.FositeClient
+	if ucenter.DB.First(&client, "client_id = ?", clientID).Error != nil {
+		return "", errors.New("应用不存在")
+	}
+	var registered bool
+	for _, uri := range client.PostLogoutRedirectURIs {
+		registered = registered || uri == raw
+	}
+	if !registered {
+		return "", errors.New("退出后的跳转链接未在应用中登记")
+	}
+	if state == "" {
+		return raw, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("state", state)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// endSession RP 发起的退出登录（OpenID Connect RP-Initiated Logout），须经用户确认后才下线当前终端
+func endSession(c *gin.Context) {
+	hint := c.Request.FormValue("id_token_hint")
+	clientID := c.Request.FormValue("client_id")
+	redirect := c.Request.FormValue("post_logout_redirect_uri")
+	state := c.Request.FormValue("state")
+
+	var sub string
+	if hint != "" {
+		claims, err := parseIDTokenHint(hint)
+		if err != nil {
+			endSessionError(c, "id_token_hint 无效")
+			return
+		}
+		sub, _ = claims["sub"].(string)
+		aud := audiences(claims)
+		if clientID == "" && len(aud) == 1 {
+			clientID = aud[0]
+		} else if clientID != "" && !fosite.Arguments(aud).Has(clientID) {
+			endSessionError(c, "client_id 与 id_token_hint 不一致")
+			return
+		}
+	}
+
+	target := "/login"
+	if redirect != "" {
+		var err error
+		if target, err = postLogoutRedirect(clientID, redirect, state); err != nil {
+			endSessionError(c, err.Error())
+			return
+		}
+	}
+
+	if l, ok := c.Get(ucenter.AuthLogin); ok {
+		login := l.(*ucenter.Login)
+		if c.Query("confirm") == "" || !validCSRF(c) {
+			params := url.Values{}
+			for k, v := range map[string]string{
+				"id_token_hint":            hint,
+				"client_id":                clientID,
+				"post_logout_redirect_uri": redirect,
+				"state":                    state,
+			} {
+				if v != "" {
+					params.Set(k, v)
+				}
+			}
+			// id_token_hint 中的 sub 是应用看到的 sub
+			var client fosite.Client
+			if clientID != "" {
+				client, _ = oauth2store.GetClient(nil, clientID)
+			}
+			nbgin.SetNoCache(c)
+			c.HTML(http.StatusOK, "page/logout", nbgin.Data(c, gin.H{
+				"clients": loginClients(login.Token),
+				// 提示的用户与当前登录的不是同一人时提醒用户
+				"otherUser":  sub != "" && sub != clientSubject(fmt.Sprintf("%d", login.UserID), client),
+				"confirmURL": "/oauth2/logout?" + params.Encode(),
+			}))
+			return
+		}
+		endLogin(login.UserID, login.Token)
+		nbgin.SetCookie(c, -1, ucenter.C.AuthCookieName, "")
+		setBrowserState(c, "")
+	}
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, target)
+}
+
+func endSessionError(c *gin.Context, msg string) {
+	c.HTML(http.StatusBadRequest, "page/info", gin.H{
+		"icon":  "sign out",
+		"title": "退出登录请求无效",
+		"msg":   msg,
+	})
+}
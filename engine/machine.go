@@ -0,0 +1,236 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/ram"
+)
+
+// machineGrant 按应用及授权范围汇总的机器令牌
+type machineGrant struct {
+	Key           string
+	ClientID      string
+	ClientName    string
+	Scope         string
+	Tokens        int
+	LatestIssued  time.Time
+	LatestExpires time.Time
+	tokenIDs      []int64
+}
+
+// machineGrants 当前有效的机器令牌，按应用及授权范围分组
+func machineGrants() ([]machineGrant, error) {
+	tokens, err := oauth2store.(*storage.FositeStore).MachineTokens()
+	if err != nil {
+		return nil, err
+	}
+	var list []machineGrant
+	index := make(map[string]int)
+	names := make(map[string]string)
+	for _, t := range tokens {
+		key := t.ClientID + " " + t.Scope
+		i, ok := index[key]
+		if !ok {
+			if _, ok := names[t.ClientID]; !ok {
+				var client storage.FositeClient
+				ucenter.DB.Select("name").Where("client_id = ?", t.ClientID).First(&client)
+				names[t.ClientID] = client.Name
+			}
+			i = len(list)
+			index[key] = i
+			list = append(list, machineGrant{
+				Key:        key,
+				ClientID:   t.ClientID,
+				ClientName: names[t.ClientID],
+				Scope:      t.Scope,
+			})
+		}
+		g := &list[i]
+		g.Tokens++
+		g.tokenIDs = append(g.tokenIDs, t.ID)
+		if t.RequestedAt.After(g.LatestIssued) {
+			g.LatestIssued = t.RequestedAt
+		}
+		if t.ExpiresAt.After(g.LatestExpires) {
+			g.LatestExpires = t.ExpiresAt
+		}
+	}
+	return list, nil
+}
+
+// machineClient 机器应用及 RAM 授权的 scope
+type machineClient struct {
+	ClientID string
+	Name     string
+	Scope    string
+	Allowed  []string
+}
+
+// machineScopeAllowed RAM 策略是否允许机器应用申请该 scope，应用所属角色的策略同样生效
+func machineScopeAllowed(clientID, scope string) bool {
+	return ucenter.RAM.Enforce(ram.ClientSubject(clientID), ram.DefaultDomain, scope, ram.PolicyClientScope)
+}
+
+// machineClients 已标记为机器应用的客户端
+func machineClients() ([]machineClient, error) {
+	var clients []storage.FositeClient
+	if err := ucenter.DB.Select("client_id, name, scope").Where("machine = ?", true).Order("client_id").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	list := make([]machineClient, 0, len(clients))
+	for _, cli := range clients {
+		mc := machineClient{ClientID: cli.ClientID, Name: cli.Name, Scope: cli.Scope}
+		for _, p := range ucenter.RAM.GetFilteredPolicy(0, ram.ClientSubject(cli.ClientID), ram.DefaultDomain) {
+			if len(p) > 3 && p[3] == ram.PolicyClientScope {
+				mc.Allowed = append(mc.Allowed, p[2])
+			}
+		}
+		sort.Strings(mc.Allowed)
+		list = append(list, mc)
+	}
+	return list, nil
+}
+
+func adminMachine(c *gin.Context) {
+	grants, err := machineGrants()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	clients, err := machineClients()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.HTML(http.StatusOK, "admin/machine", nbgin.Data(c, gin.H{
+		"grants":  grants,
+		"clients": clients,
+	}))
+}
+
+// markMachineClient 标记或取消标记机器应用，取消时撤销其机器令牌
+func markMachineClient(c *gin.Context) {
+	type machineForm struct {
+		ID      string `form:"id" binding:"required,min=1,max=255"`
+		Machine bool   `form:"machine"`
+	}
+
+	var mf machineForm
+	var client storage.FositeClient
+	err := c.ShouldBind(&mf)
+	if err == nil {
+		err = ucenter.DB.Where("client_id = ?", mf.ID).First(&client).Error
+	}
+	if err == nil && mf.Machine && client.IsPublic() {
+		err = errors.New("公开客户端不能作为机器应用")
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	updates := map[string]interface{}{"machine": mf.Machine}
+	if mf.Machine && !fosite.Arguments(client.GrantTypes).Has("client_credentials") {
+		updates["grant_types"] = pq.StringArray(append(client.GetGrantTypes(), "client_credentials"))
+	}
+	if err := ucenter.DB.Model(&client).Updates(updates).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if mf.Machine {
+		return
+	}
+	grants, err := machineGrants()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	var ids []int64
+	for _, g := range grants {
+		if g.ClientID == client.ClientID {
+			ids = append(ids, g.tokenIDs...)
+		}
+	}
+	if err := oauth2store.(*storage.FositeStore).DeleteAccessTokens(ids); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+type machineScopeForm struct {
+	ID    string `form:"id" binding:"required,min=1,max=255"`
+	Scope string `form:"scope" binding:"required,min=1,max=255"`
+}
+
+// addMachineScope 允许机器应用申请 scope
+func addMachineScope(c *gin.Context) {
+	var sf machineScopeForm
+	err := c.ShouldBind(&sf)
+	if err == nil && strings.ContainsAny(sf.Scope, " \t\r\n") {
+		err = errors.New("每次只能添加一个 scope")
+	}
+	if err == nil {
+		err = ucenter.DB.Where("client_id = ? AND machine = ?", sf.ID, true).First(&storage.FositeClient{}).Error
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	ucenter.RAM.AddPolicy(ram.ClientSubject(sf.ID), ram.DefaultDomain, sf.Scope, ram.PolicyClientScope)
+}
+
+// removeMachineScope 不再允许机器应用申请 scope，已签发的令牌需在机器令牌中撤销
+func removeMachineScope(c *gin.Context) {
+	var sf machineScopeForm
+	if err := c.ShouldBind(&sf); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	ucenter.RAM.RemovePolicy(ram.ClientSubject(sf.ID), ram.DefaultDomain, sf.Scope, ram.PolicyClientScope)
+}
+
+func revokeMachineTokens(c *gin.Context) {
+	type revokeForm struct {
+		Groups []string `form:"group" binding:"required,min=1"`
+	}
+
+	var rf revokeForm
+	if err := c.ShouldBind(&rf); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	grants, err := machineGrants()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	selected := make(map[string]bool)
+	for _, key := range rf.Groups {
+		selected[key] = true
+	}
+	var ids []int64
+	d := newDryRunImpact()
+	for _, g := range grants {
+		if selected[g.Key] {
+			ids = append(ids, g.tokenIDs...)
+			d.addClient(g.ClientID)
+		}
+	}
+	if isDryRun(c) {
+		d.count("access_tokens", len(ids))
+		writeDryRun(c, d)
+		return
+	}
+	if err := oauth2store.(*storage.FositeStore).DeleteAccessTokens(ids); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
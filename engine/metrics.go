@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/iplist"
+	"github.com/naiba/ucenter/pkg/mail"
+)
+
+var (
+	staleAccountsWarned = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ucenter_stale_accounts_warned_total",
+		Help: "长期未登录提醒的账户数",
+	})
+	staleAccountsDeactivated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ucenter_stale_accounts_deactivated_total",
+		Help: "因长期未登录被停用的账户数",
+	})
+	staleAccountsPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ucenter_stale_accounts_pending",
+		Help: "已提醒、等待停用的账户数",
+	})
+	tokenRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucenter_token_requests_total",
+		Help: "令牌端点请求数，result 为 success 或 error",
+	}, []string{"grant_type", "result"})
+	loginDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ucenter_login_duration_seconds",
+		Help:    "登录请求耗时",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5},
+	}, []string{"method", "result"})
+	clientIPDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucenter_client_ip_denied_total",
+		Help: "应用凭证从限定网络之外调用令牌、内省及吊销端点的次数",
+	}, []string{"client_id"})
+)
+
+func init() {
+	prometheus.MustRegister(staleAccountsWarned, staleAccountsDeactivated, staleAccountsPending,
+		tokenRequests, loginDuration, clientIPDenied, mail.Deliveries)
+}
+
+var metricsHandler = gin.WrapH(promhttp.Handler())
+
+// metricsAllowed 只允许本机及 metrics_allow_ips 中的来源读取指标，其余返回 404。
+// 按连接的对端地址判断，不采信 X-Forwarded-For 等可伪造的请求头；反向代理部署在本机时，
+// 经代理转发的外部请求对端也是本机，因此带转发头的请求不按本机放行
+func metricsAllowed(c *gin.Context) {
+	ip := peerIP(c)
+	forwarded := c.GetHeader("X-Forwarded-For") != "" || c.GetHeader("X-Real-Ip") != "" || c.GetHeader("Forwarded") != ""
+	if addr := net.ParseIP(ip); addr != nil && addr.IsLoopback() && !forwarded {
+		return
+	}
+	if !iplist.Contains(ip, ucenter.C.MetricsAllowIPs) {
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+// observeToken 统计令牌签发的成功率
+func observeToken(c *gin.Context) {
+	c.Next()
+	grantType := c.Request.PostFormValue("grant_type")
+	if grantType == "" {
+		grantType = "unknown"
+	}
+	result := "success"
+	if c.Writer.Status() >= http.StatusBadRequest {
+		result = "error"
+	}
+	tokenRequests.WithLabelValues(grantType, result).Inc()
+}
+
+// observeLogin 统计登录耗时，写入登录 Cookie 即为成功
+func observeLogin(method string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		result := "failure"
+		for _, cookie := range c.Writer.Header()["Set-Cookie"] {
+			if strings.HasPrefix(cookie, ucenter.C.AuthCookieName+"=") {
+				result = "success"
+				break
+			}
+		}
+		loginDuration.WithLabelValues(method, result).Observe(time.Since(start).Seconds())
+	}
+}
+
+// alertRules 按 SLO 配置生成 Prometheus 告警规则
+func alertRules(c *gin.Context) {
+	c.Header("Content-Type", "text/yaml; charset=utf-8")
+	fmt.Fprintf(c.Writer, `groups:
+  - name: ucenter-slo
+    rules:
+      - alert: UcenterTokenErrorRateHigh
+        expr: |
+          sum(rate(ucenter_token_requests_total{result="error"}[5m]))
+            / sum(rate(ucenter_token_requests_total[5m])) > %g
+        for: 10m
+        labels:
+          severity: page
+        annotations:
+          summary: 令牌签发错误率超过 %g%%
+      - alert: UcenterLoginLatencyHigh
+        expr: |
+          histogram_quantile(0.95, sum(rate(ucenter_login_duration_seconds_bucket[5m])) by (le)) > %g
+        for: 10m
+        labels:
+          severity: warning
+        annotations:
+          summary: 登录 p95 耗时超过 %gs
+      - alert: UcenterMailFailureRateHigh
+        expr: |
+          sum(rate(ucenter_mail_deliveries_total{result="failure"}[15m]))
+            / sum(rate(ucenter_mail_deliveries_total[15m])) > %g
+        for: 15m
+        labels:
+          severity: warning
+        annotations:
+          summary: 邮件投递失败率超过 %g%%
+      - alert: UcenterClientIPDenied
+        expr: |
+          sum(increase(ucenter_client_ip_denied_total[15m])) by (client_id) > 0
+        labels:
+          severity: warning
+        annotations:
+          summary: 应用 {{ $labels.client_id }} 的凭证在限定网络之外被使用
+`,
+		ucenter.C.SLOTokenErrorRate, ucenter.C.SLOTokenErrorRate*100,
+		ucenter.C.SLOLoginP95, ucenter.C.SLOLoginP95,
+		ucenter.C.SLOMailFailureRate, ucenter.C.SLOMailFailureRate*100)
+}
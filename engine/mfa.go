@@ -0,0 +1,432 @@
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/mail"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+	"github.com/naiba/ucenter/pkg/ram"
+)
+
+const emailOTPCookie = "nb_email_otp"
+
+// mfaPolicy 当前二次验证策略，首次使用时以配置文件初始化
+func mfaPolicy() *ucenter.MFAPolicy {
+	var p ucenter.MFAPolicy
+	ucenter.DB.Where(ucenter.MFAPolicy{ID: 1}).Attrs(ucenter.MFAPolicy{
+		AdminStrong: ucenter.C.MFAAdminStrong,
+	}).FirstOrCreate(&p)
+	return &p
+}
+
+// passkeyRequired 策略要求管理员级用户只能使用通行密钥登录，不能使用密码、外部账户、扫码或邮箱验证码
+func passkeyRequired(u *ucenter.User) bool {
+	return mfaPolicy().AdminStrong && ucenter.RAM.Enforce(u.StrID(), ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel)
+}
+
+// hashOTP 验证码、恢复码等一次性凭据只保存哈希
+func hashOTP(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendEmailOTP 生成新的 6 位验证码并发送到用户邮箱，旧验证码随之失效
+func sendEmailOTP(u *ucenter.User, otp *ucenter.EmailOTP) error {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	otp.CodeHash = hashOTP(code)
+	otp.SentAt = time.Now()
+	otp.ExpiresAt = otp.SentAt.Add(time.Minute * time.Duration(ucenter.C.EmailOTPTTL))
+	if err := ucenter.DB.Save(otp).Error; err != nil {
+		return err
+	}
+	return mail.Send(string(u.Email), "验证码", fmt.Sprintf("%s 您好：\n\n您的验证码是 %s，%d 分钟内有效，请勿告诉他人。\n\n如果这不是您本人的操作，说明您的密码可能已经泄露，请尽快修改密码。\n\n%s",
+		u.Username, code, ucenter.C.EmailOTPTTL, ucenter.C.SysName))
+}
+
+// startEmailOTP 发送验证码，验证码 ID 保存在 Cookie 中；amr 为第一步验证身份的方式
+func startEmailOTP(c *gin.Context, u *ucenter.User, purpose, amr, detail, returnURL string) error {
+	id, err := password.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	otp := ucenter.EmailOTP{
+		ID:        id,
+		UserID:    u.ID,
+		Purpose:   purpose,
+		Detail:    detail,
+		AMR:       amr,
+		ReturnURL: returnURL,
+	}
+	if err := sendEmailOTP(u, &otp); err != nil {
+		ucenter.DB.Delete(&otp)
+		return err
+	}
+	nbgin.SetCookie(c, ucenter.C.EmailOTPTTL*60, emailOTPCookie, otp.ID)
+	return nil
+}
+
+// currentEmailOTP 当前 Cookie 对应且未过期的验证码
+func currentEmailOTP(c *gin.Context, purpose string) (*ucenter.EmailOTP, error) {
+	var otp ucenter.EmailOTP
+	id, err := c.Cookie(emailOTPCookie)
+	if err != nil || ucenter.DB.First(&otp, "id = ? AND purpose = ?", id, purpose).Error != nil || otp.Expired() {
+		return nil, errors.New("验证码已过期")
+	}
+	return &otp, nil
+}
+
+// checkEmailOTP 校验验证码，通过或超过尝试次数后作废；返回错误提示
+func checkEmailOTP(otp *ucenter.EmailOTP, code string) string {
+	// 先占用一次尝试机会，并发提交也不能超过次数限制
+	if ucenter.DB.Model(otp).Where("attempts < ?", ucenter.C.EmailOTPMaxAttempts).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1")).RowsAffected == 0 {
+		ucenter.DB.Delete(otp)
+		return "验证码错误次数过多，请重新开始"
+	}
+	otp.Attempts++
+	if subtle.ConstantTimeCompare([]byte(hashOTP(strings.TrimSpace(code))), []byte(otp.CodeHash)) == 1 {
+		ucenter.DB.Delete(otp)
+		return ""
+	}
+	if left := ucenter.C.EmailOTPMaxAttempts - otp.Attempts; left > 0 {
+		return fmt.Sprintf("验证码不正确，还可尝试 %d 次", left)
+	}
+	ucenter.DB.Delete(otp)
+	return "验证码错误次数过多，请重新开始"
+}
+
+// maskEmail 隐去邮箱的部分用户名
+func maskEmail(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i <= 0 {
+		return email
+	}
+	name := []rune(email[:i])
+	if len(name) <= 2 {
+		return string(name[:1]) + "***" + email[i:]
+	}
+	return string(name[:1]) + "***" + string(name[len(name)-1:]) + email[i:]
+}
+
+// completeLogin 第一步验证通过后登录，启用了邮箱验证码的用户还需输入验证码，建立会话后才清除登录失败计数；
+// amr 为第一步验证身份的方式
+func completeLogin(c *gin.Context, u *ucenter.User, amr, detail, returnURL string) {
+	if passkeyRequired(u) {
+		c.HTML(http.StatusForbidden, "page/info", gin.H{
+			"icon":  "shield alternate",
+			"title": "需要更强的验证方式",
+			"msg":   "管理员账户只能使用通行密钥登录。",
+		})
+		return
+	}
+	if u.MFAEmail {
+		if device := currentTrustedDevice(c, u); device != nil {
+			l, err := establishSession(c, u, amr)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			clearLoginFailures(u.Username, string(u.Email))
+			// 信任跟随该设备最新的登录终端
+			ucenter.DB.Model(device).UpdateColumns(map[string]interface{}{
+				"login_token":  l.Token,
+				"last_used_at": time.Now(),
+			})
+			audit(c, u.ID, ucenter.AuditLoginSuccess, userTarget(u.ID), detail+" + 受信任设备")
+			nbgin.SetNoCache(c)
+			c.Redirect(http.StatusFound, returnURL)
+			return
+		}
+		if err := startEmailOTP(c, u, ucenter.EmailOTPLogin, amr, detail, returnURL); err != nil {
+			c.HTML(http.StatusInternalServerError, "page/info", gin.H{
+				"icon":  "mail",
+				"title": "验证码发送失败",
+				"msg":   "请稍后重新登录。",
+			})
+			return
+		}
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, "/login/mfa")
+		return
+	}
+	if _, err := establishSession(c, u, amr); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	clearLoginFailures(u.Username, string(u.Email))
+	audit(c, u.ID, ucenter.AuditLoginSuccess, userTarget(u.ID), detail)
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, returnURL)
+}
+
+func loginMFA(c *gin.Context) {
+	if _, ok := c.Get(ucenter.AuthUser); ok {
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	otp, err := currentEmailOTP(c, ucenter.EmailOTPLogin)
+	if err != nil {
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+	renderLoginMFA(c, otp, "", "")
+}
+
+func renderLoginMFA(c *gin.Context, otp *ucenter.EmailOTP, msg, notice string) {
+	var u ucenter.User
+	ucenter.DB.First(&u, "id = ?", otp.UserID)
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "page/mfa", nbgin.Data(c, gin.H{
+		"email":     maskEmail(string(u.Email)),
+		"error":     msg,
+		"notice":    notice,
+		"trustDays": ucenter.C.MFATrustDays,
+	}))
+}
+
+func loginMFAExpired(c *gin.Context, msg string) {
+	nbgin.SetCookie(c, -1, emailOTPCookie, "")
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusForbidden, "page/info", gin.H{
+		"icon":  "hourglass end",
+		"title": "验证失败",
+		"msg":   msg + "，请重新登录。",
+	})
+}
+
+func loginMFAHandler(c *gin.Context) {
+	if _, ok := c.Get(ucenter.AuthUser); ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	var u ucenter.User
+	otp, err := currentEmailOTP(c, ucenter.EmailOTPLogin)
+	if err == nil {
+		err = ucenter.DB.First(&u, "id = ?", otp.UserID).Error
+	}
+	if err != nil {
+		loginMFAExpired(c, "验证码已过期")
+		return
+	}
+	if d := loginLockedFor(u.Username, clientIP(c)); d > 0 {
+		renderLoginMFA(c, otp, fmt.Sprintf("验证失败次数过多，请 %s 后再试", humanDuration(d)), "")
+		return
+	}
+	method := " + 邮箱验证码"
+	if code := c.PostForm("recovery_code"); code != "" {
+		// 收不到验证码时使用恢复码，验证码随之作废
+		if !useRecoveryCode(u.ID, code) {
+			recordLoginFailure(u.Username, clientIP(c))
+			audit(c, 0, ucenter.AuditLoginFailure, userTarget(u.ID), "恢复码不正确")
+			notifySecurity(&u, ucenter.AlertLoginFailure, "密码正确但恢复码不正确，IP："+clientIP(c))
+			renderLoginMFA(c, otp, "恢复码不正确或已使用", "")
+			return
+		}
+		ucenter.DB.Delete(otp)
+		method = " + 恢复码"
+		notifySecurity(&u, ucenter.AlertRecoveryCode, fmt.Sprintf("您的账户使用恢复码登录，剩余 %d 个恢复码。\nIP：%s\n如果这不是您本人的操作，请尽快修改密码并重新生成恢复码。",
+			remainingRecoveryCodes(u.ID), clientIP(c)))
+	} else if msg := checkEmailOTP(otp, c.PostForm("code")); msg != "" {
+		recordLoginFailure(u.Username, clientIP(c))
+		audit(c, 0, ucenter.AuditLoginFailure, userTarget(u.ID), "邮箱验证码不正确")
+		notifySecurity(&u, ucenter.AlertLoginFailure, "密码正确但邮箱验证码不正确，IP："+clientIP(c))
+		if otp.Attempts >= ucenter.C.EmailOTPMaxAttempts {
+			loginMFAExpired(c, msg)
+			return
+		}
+		renderLoginMFA(c, otp, msg, "")
+		return
+	}
+	nbgin.SetCookie(c, -1, emailOTPCookie, "")
+	if liftExpiredSuspension(&u); u.Blocked() {
+		loginMFAExpired(c, suspendedMessage(&u))
+		return
+	}
+	l, err := establishSession(c, &u, otp.AMR, ucenter.AMROTP)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	clearLoginFailures(u.Username, string(u.Email))
+	if c.PostForm("trust") != "" && ucenter.C.MFATrustDays > 0 {
+		if err := trustDevice(c, &u, l); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	audit(c, u.ID, ucenter.AuditLoginSuccess, userTarget(u.ID), otp.Detail+method)
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, safeReturnURL(otp.ReturnURL, "/"))
+}
+
+// resendLoginMFA 重新发送验证码，已尝试的次数不会清零
+func resendLoginMFA(c *gin.Context) {
+	var u ucenter.User
+	otp, err := currentEmailOTP(c, ucenter.EmailOTPLogin)
+	if err == nil {
+		err = ucenter.DB.First(&u, "id = ?", otp.UserID).Error
+	}
+	if err != nil {
+		loginMFAExpired(c, "验证码已过期")
+		return
+	}
+	if wait := time.Duration(ucenter.C.EmailOTPResendInterval)*time.Second - time.Since(otp.SentAt); wait > 0 {
+		renderLoginMFA(c, otp, fmt.Sprintf("请 %s 后再重新发送", humanDuration(wait)), "")
+		return
+	}
+	if err := sendEmailOTP(&u, otp); err != nil {
+		renderLoginMFA(c, otp, "验证码发送失败，请稍后再试", "")
+		return
+	}
+	nbgin.SetCookie(c, ucenter.C.EmailOTPTTL*60, emailOTPCookie, otp.ID)
+	renderLoginMFA(c, otp, "", "验证码已重新发送")
+}
+
+func mfaSettings(c *gin.Context) {
+	renderMFASettings(c, false, "")
+}
+
+func renderMFASettings(c *gin.Context, confirm bool, msg string) {
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "user/mfa", nbgin.Data(c, mfaSettingsData(c, confirm, msg)))
+}
+
+func mfaSettingsData(c *gin.Context, confirm bool, msg string) gin.H {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var trusted int
+	ucenter.DB.Model(ucenter.TrustedDevice{}).Where("user_id = ? AND expires_at > ?", u.ID, time.Now()).Count(&trusted)
+	return gin.H{
+		"denied":        passkeyRequired(u),
+		"email":         maskEmail(string(u.Email)),
+		"confirm":       confirm,
+		"error":         msg,
+		"recoveryCodes": remainingRecoveryCodes(u.ID),
+		"trusted":       trusted,
+	}
+}
+
+// enrollEmailOTP 启用邮箱验证码前，先验证能收到邮件
+func enrollEmailOTP(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	switch {
+	case u.MFAEmail:
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, "/mfa")
+	case u.Email == "":
+		renderMFASettings(c, false, "请先在个人中心填写邮箱")
+	case !mail.Enabled():
+		renderMFASettings(c, false, "系统未配置邮件发送，暂不能使用邮箱验证码")
+	case passkeyRequired(u):
+		renderMFASettings(c, false, "管理员账户不能使用邮箱验证码")
+	default:
+		if err := startEmailOTP(c, u, ucenter.EmailOTPEnroll, "", "", ""); err != nil {
+			renderMFASettings(c, false, "验证码发送失败，请稍后再试")
+			return
+		}
+		renderMFASettings(c, true, "")
+	}
+}
+
+func confirmEmailOTP(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	otp, err := currentEmailOTP(c, ucenter.EmailOTPEnroll)
+	if err != nil || otp.UserID != u.ID {
+		renderMFASettings(c, false, "验证码已过期，请重新获取")
+		return
+	}
+	if msg := checkEmailOTP(otp, c.PostForm("code")); msg != "" {
+		renderMFASettings(c, otp.Attempts < ucenter.C.EmailOTPMaxAttempts, msg)
+		return
+	}
+	nbgin.SetCookie(c, -1, emailOTPCookie, "")
+	if err := ucenter.DB.Model(u).UpdateColumn("mfa_email", true).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditMFAEnable, userTarget(u.ID), "邮箱验证码")
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, "/mfa")
+}
+
+func disableEmailOTP(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	if !u.MFAEmail {
+		return
+	}
+	if err := ucenter.DB.Model(u).UpdateColumn("mfa_email", false).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ucenter.DB.Delete(ucenter.TrustedDevice{}, "user_id = ?", u.ID)
+	ucenter.DB.Delete(ucenter.RecoveryCode{}, "user_id = ?", u.ID)
+	auditCurrent(c, ucenter.AuditMFADisable, userTarget(u.ID), "邮箱验证码")
+}
+
+// emailOTPGCJob 清理过期的邮箱验证码
+func emailOTPGCJob() error {
+	return ucenter.DB.Delete(ucenter.EmailOTP{}, "expires_at < ?", time.Now()).Error
+}
+
+func adminMFA(c *gin.Context) {
+	c.HTML(http.StatusOK, "admin/mfa", nbgin.Data(c, gin.H{
+		"policy": mfaPolicy(),
+	}))
+}
+
+func editMFAPolicy(c *gin.Context) {
+	type mfaPolicyForm struct {
+		AdminStrong bool `form:"admin_strong"`
+	}
+
+	var mf mfaPolicyForm
+	if err := c.ShouldBind(&mf); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	p := mfaPolicy()
+	if isDryRun(c) {
+		// 开启后尚未添加通行密钥的管理员将无法登录
+		d := newDryRunImpact()
+		if mf.AdminStrong && !p.AdminStrong {
+			var ids []uint
+			for id := range adminUserIDs() {
+				ids = append(ids, id)
+			}
+			var users []ucenter.User
+			if err := ucenter.DB.Where("id IN (?) AND id NOT IN (SELECT user_id FROM passkeys)", ids).Find(&users).Error; err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			d.count("users", len(users))
+			for i := range users {
+				d.addUser(&users[i])
+			}
+		}
+		writeDryRun(c, d)
+		return
+	}
+	p.AdminStrong = mf.AdminStrong
+	if err := ucenter.DB.Save(p).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+)
+
+// serve 启动 Web 服务，配置了证书时开启 HTTPS 并接受客户端证书
+func serve(r *gin.Engine) error {
+	if ucenter.C.TLSCert == "" {
+		return r.Run("0.0.0.0:8080")
+	}
+	tlsConfig := &tls.Config{ClientAuth: tls.RequestClientCert}
+	if ucenter.C.TLSClientCA != "" {
+		ca, err := ioutil.ReadFile(ucenter.C.TLSClientCA)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		tlsConfig.ClientCAs.AppendCertsFromPEM(ca)
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	srv := &http.Server{
+		Addr:      "0.0.0.0:8080",
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+	return srv.ListenAndServeTLS(ucenter.C.TLSCert, ucenter.C.TLSKey)
+}
+
+// clientCertificate 请求携带的客户端证书，verified 表示证书链已由 CA 校验
+func clientCertificate(c *gin.Context) (cert *x509.Certificate, verified bool) {
+	if c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0 {
+		return c.Request.TLS.PeerCertificates[0], len(c.Request.TLS.VerifiedChains) > 0
+	}
+	// 只采信受信任的反向代理传递的证书，代理已完成证书校验
+	if ucenter.C.MTLSCertHeader == "" || !fromTrustedProxy(c) {
+		return nil, false
+	}
+	raw, err := url.QueryUnescape(c.GetHeader(ucenter.C.MTLSCertHeader))
+	if err != nil {
+		return nil, false
+	}
+	block, _ := pem.Decode([]byte(raw))
+	if block == nil {
+		return nil, false
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, false
+	}
+	return cert, true
+}
+
+// certThumbprint 证书的 x5t#S256 指纹
+func certThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// mtlsClientAuth 校验使用 mTLS 认证的客户端证书，通过时在返回的 ctx 中记录，
+// fosite 认证客户端时由 SecretHasher 据此放行；其它客户端原样交由 fosite 认证
+func mtlsClientAuth(ctx context.Context, c *gin.Context) (context.Context, error) {
+	clientID := requestClientID(c)
+	if clientID == "" {
+		return ctx, nil
+	}
+	client, err := oauth2store.GetClient(c, clientID)
+	if err != nil {
+		return ctx, nil
+	}
+	cli, ok := client.(*storage.FositeClient)
+	if !ok || !cli.UsesMTLS() {
+		return ctx, nil
+	}
+
+	cert, verified := clientCertificate(c)
+	if cert == nil {
+		return ctx, fosite.ErrInvalidClient.WithHint("The client must authenticate with a TLS client certificate.")
+	}
+	switch cli.TokenEndpointAuthMethod {
+	case "tls_client_auth":
+		if !verified || cert.Subject.String() != cli.TLSClientAuthSubjectDN {
+			return ctx, fosite.ErrInvalidClient.WithHint("The TLS client certificate does not match the registered subject.")
+		}
+	case "self_signed_tls_client_auth":
+		if !certRegistered(cli, cert) {
+			return ctx, fosite.ErrInvalidClient.WithHint("The TLS client certificate is not registered for this client.")
+		}
+	}
+	return storage.WithCertAuthenticatedClient(ctx, cli.ClientID), nil
+}
+
+// certRegistered 证书是否在客户端 JWKS 的 x5c 中
+func certRegistered(cli *storage.FositeClient, cert *x509.Certificate) bool {
+	if cli.JSONWebKeys == nil {
+		return false
+	}
+	for _, key := range cli.JSONWebKeys.Keys {
+		for _, c := range key.Certificates {
+			if bytes.Equal(c.Raw, cert.Raw) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkCertBinding 校验绑定了证书的令牌，请求必须携带同一张证书
+func checkCertBinding(c *gin.Context, session *storage.FositeSession) error {
+	if session.CertThumbprint == "" {
+		return nil
+	}
+	if cert, _ := clientCertificate(c); cert == nil || certThumbprint(cert) != session.CertThumbprint {
+		return errors.New("The token is bound to a different TLS client certificate.")
+	}
+	return nil
+}
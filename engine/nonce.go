@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+)
+
+// checkStateNonce 按配置要求公开客户端携带 state，OpenID Connect 请求携带 nonce，防止授权响应被重放
+func checkStateNonce(ar fosite.AuthorizeRequester) error {
+	if client, ok := ar.GetClient().(*storage.FositeClient); ok && ucenter.C.AuthorizeRequireState && client.IsPublic() && ar.GetState() == "" {
+		return fosite.ErrInvalidState.WithHint("Public clients must include the state parameter.")
+	}
+	if ucenter.C.AuthorizeRequireNonce && ar.GetRequestedScopes().Has("openid") && ar.GetRequestForm().Get("nonce") == "" {
+		return fosite.ErrInvalidRequest.WithHint("OpenID Connect requests must include the nonce parameter.")
+	}
+	return nil
+}
+
+// bindNonce 将授权请求的 nonce 写入会话，授权码换取的 ID Token 沿用同一个 nonce
+func bindNonce(ar fosite.AuthorizeRequester, session *storage.FositeSession) {
+	session.DefaultSession.Claims.Nonce = ar.GetRequestForm().Get("nonce")
+}
+
+// checkCodeNonce 用授权码换取 ID Token 时，授权码必须绑定了 nonce
+func checkCodeNonce(ar fosite.AccessRequester) error {
+	if !ucenter.C.AuthorizeRequireNonce || !ar.GetGrantTypes().Exact("authorization_code") || !ar.GetGrantedScopes().Has("openid") {
+		return nil
+	}
+	if session, ok := ar.GetSession().(*storage.FositeSession); !ok || session.DefaultSession.Claims.Nonce == "" {
+		return fosite.ErrInvalidGrant.WithHint("The authorization code was issued without a nonce.")
+	}
+	return nil
+}
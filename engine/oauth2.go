@@ -1,10 +1,14 @@
 package engine
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	jwt2 "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
@@ -14,90 +18,337 @@ import (
 
 	"github.com/naiba/ucenter"
 	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/jwe"
 	"github.com/naiba/ucenter/pkg/nbgin"
 )
 
+// introspectionEndpoint RFC 7662 令牌内省，资源服务器以应用的认证方式或自己的访问令牌调用
 func introspectionEndpoint(c *gin.Context) {
 	ctx := fosite.NewContext()
-	mySessionData := storage.NewFositeSession("")
-	ir, err := oauth2provider.NewIntrospectionRequest(ctx, c.Request, mySessionData)
+	session := storage.NewFositeSession("")
+
+	clientID := requestClientID(c)
+	if clientAuthLocked(c, clientID) {
+		return
+	}
+	if clientNetworkDenied(c, clientID) {
+		return
+	}
+
+	// 以访问令牌调用时由 fosite 校验调用方的令牌
+	if bearer, _ := accessTokenFromRequest(c.Request); bearer != "" {
+		ir, err := oauth2provider.NewIntrospectionRequest(ctx, c.Request, session)
+		if err != nil {
+			oauth2provider.WriteIntrospectionError(c.Writer, err)
+			return
+		}
+		writeIntrospection(c, ir.GetTokenType(), ir.GetAccessRequester())
+		return
+	}
+
+	if _, err := introspectionClient(c); err != nil {
+		recordClientAuthFailure(clientID, clientIP(c))
+		c.Header("WWW-Authenticate", `Basic realm="ucenter"`)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":             fosite.ErrInvalidClient.Name,
+			"error_description": clientAuthError(err),
+		})
+		return
+	}
+	tokenType, ar, err := oauth2provider.IntrospectToken(ctx, c.PostForm("token"), fosite.TokenType(c.PostForm("token_type_hint")), session)
 	if err != nil {
-		oauth2provider.WriteIntrospectionError(c.Writer, err)
+		c.JSON(http.StatusOK, gin.H{"active": false})
 		return
 	}
-	oauth2provider.WriteIntrospectionResponse(c.Writer, ir)
+	writeIntrospection(c, tokenType, ar)
 }
 
+// introspectionClient 认证调用内省端点的应用，支持应用注册的全部认证方式，公开客户端不能内省
+func introspectionClient(c *gin.Context) (fosite.Client, error) {
+	if c.Request.Method != http.MethodPost {
+		return nil, fosite.ErrInvalidRequest.WithHint("The introspection endpoint only accepts POST requests.")
+	}
+	ctx, err := mtlsClientAuth(c, c)
+	if err != nil {
+		return nil, err
+	}
+	client, err := oauth2provider.(*fosite.Fosite).AuthenticateClient(ctx, c.Request, c.Request.PostForm)
+	if err != nil {
+		return nil, err
+	}
+	if cli, ok := client.(*storage.FositeClient); ok && cli.TokenEndpointAuthMethod == "none" {
+		return nil, fosite.ErrInvalidClient.WithHint("Public clients are not allowed to introspect tokens.")
+	}
+	return client, nil
+}
+
+// writeIntrospection 输出有效令牌的内省结果
+func writeIntrospection(c *gin.Context, tokenType fosite.TokenType, ar fosite.AccessRequester) {
+	c.JSON(http.StatusOK, introspectionResponse(tokenType, ar))
+}
+
+// introspectionResponse 有效令牌的内省结果，用户已删除时 active 为 false
+func introspectionResponse(tokenType fosite.TokenType, ar fosite.AccessRequester) gin.H {
+	sub := ar.GetSession().GetSubject()
+	// 用户已删除，明确告知资源服务器该 sub 已注销
+	if subjectRevoked(sub) {
+		return gin.H{
+			"active":          false,
+			"sub":             clientSubject(sub, ar.GetClient()),
+			"subject_revoked": true,
+		}
+	}
+	resp := gin.H{
+		"active":    true,
+		"client_id": ar.GetClient().GetID(),
+		"scope":     strings.Join(ar.GetGrantedScopes(), " "),
+		"iat":       ar.GetRequestedAt().Unix(),
+		"sub":       clientSubject(sub, ar.GetClient()),
+		"iss":       ucenter.Issuer(),
+	}
+	if username := ar.GetSession().GetUsername(); username != "" {
+		resp["username"] = username
+	}
+	expiresAt := ar.GetSession().GetExpiresAt(fosite.AccessToken)
+	if tokenType == fosite.RefreshToken {
+		expiresAt = ar.GetSession().GetExpiresAt(fosite.RefreshToken)
+	} else {
+		resp["token_type"] = "Bearer"
+	}
+	if !expiresAt.IsZero() {
+		resp["exp"] = expiresAt.Unix()
+	}
+	// 告知资源服务器令牌绑定的密钥
+	if cnf := tokenConfirmation(ar); cnf != nil {
+		if _, ok := cnf["jkt"]; ok && tokenType != fosite.RefreshToken {
+			resp["token_type"] = "DPoP"
+		}
+		resp["cnf"] = cnf
+	}
+	return resp
+}
+
+// tokenConfirmation 令牌的 cnf 声明，未绑定密钥时返回 nil
+func tokenConfirmation(ar fosite.Requester) map[string]string {
+	session, ok := ar.GetSession().(*storage.FositeSession)
+	if !ok || (session.DPoPJKT == "" && session.CertThumbprint == "") {
+		return nil
+	}
+	cnf := make(map[string]string)
+	if session.DPoPJKT != "" {
+		cnf["jkt"] = session.DPoPJKT
+	}
+	if session.CertThumbprint != "" {
+		cnf["x5t#S256"] = session.CertThumbprint
+	}
+	return cnf
+}
+
+// revokeEndpoint RFC 7009 令牌吊销，吊销刷新令牌时由它签发的访问令牌一并失效
 func revokeEndpoint(c *gin.Context) {
 	ctx := fosite.NewContext()
-	err := oauth2provider.NewRevocationRequest(ctx, c.Request)
+	clientID := requestClientID(c)
+	if clientAuthLocked(c, clientID) {
+		return
+	}
+	if clientNetworkDenied(c, clientID) {
+		return
+	}
+	ctx, err := mtlsClientAuth(ctx, c)
+	if err == nil {
+		err = oauth2provider.NewRevocationRequest(ctx, c.Request)
+	}
+	if err == nil {
+		audit(c, 0, ucenter.AuditTokenRevoke, clientTarget(clientID), "令牌吊销端点")
+	} else if isInvalidClient(err) {
+		recordClientAuthFailure(clientID, clientIP(c))
+	}
 	oauth2provider.WriteRevocationResponse(c.Writer, err)
 }
 
 func oauth2auth(c *gin.Context) {
 	ctx := fosite.NewContext()
+	if err := resolvePushedRequest(c); err != nil {
+		c.HTML(http.StatusBadRequest, "page/info", gin.H{
+			"icon":  "hourglass end",
+			"title": "授权请求无效",
+			"msg":   "授权请求已过期或已使用，请回到应用重新登录。",
+		})
+		return
+	}
+	// 预提交的授权请求已在 PAR 端点收窄
+	if _, pushed := c.Get(pushedRequestKey); !pushed {
+		narrowRequestScope(c)
+	}
+	// 跳转链接无效时不能跳回应用，直接展示错误页面
+	if err := checkAuthorizeRedirect(c); err != nil {
+		c.HTML(http.StatusBadRequest, "page/info", gin.H{
+			"icon":  "unlink",
+			"title": "跳转链接无效",
+			"msg":   err.Error(),
+		})
+		return
+	}
+	ctx = storage.WithRedirectURI(ctx, c.Request.FormValue("redirect_uri"))
 	// Let's create an AuthorizeRequest object!
 	// It will analyze the request and extract important information like scopes, response type and others.
 	ar, err := oauth2provider.NewAuthorizeRequest(ctx, c.Request)
+	if err == nil {
+		err = checkClientActive(ar.GetClient())
+	}
+	if err == nil {
+		err = checkClientPKCE(ar)
+	}
+	if err == nil {
+		err = checkClientPAR(c, ar)
+	}
+	if err == nil {
+		err = checkStateNonce(ar)
+	}
+	var prompt fosite.Arguments
+	if err == nil {
+		prompt, err = authorizePrompt(ar)
+	}
 	if err != nil {
 		oauth2provider.WriteAuthorizeError(c.Writer, ar, err)
 		return
 	}
 
+	// 外部登录界面已处理完毕
+	if verifier := c.Query("login_verifier"); verifier != "" {
+		handleLoginVerifier(c, verifier, ar)
+		return
+	}
+
 	// Normally, this would be the place where you would check if the user is logged in and gives his consent.
 	// We're simplifying things and just checking if the request includes a valid username and password
 	user, ok := c.Get(ucenter.AuthUser)
 	if ok {
 		user := user.(*ucenter.User)
+		// 需先同意新版服务条款、隐私政策
+		if c.Request.Method == http.MethodGet && len(pendingLegalDocuments(user.ID)) > 0 {
+			if prompt.Has("none") {
+				oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrInteractionRequired)
+				return
+			}
+			nbgin.SetNoCache(c)
+			c.Redirect(http.StatusFound, "/legal?return_url="+url.QueryEscape(c.Request.RequestURI))
+			return
+		}
+		// 应用要求用户确认账户
+		if c.Request.Method == http.MethodGet && prompt.Has("select_account") {
+			selectAccount(c, user, ar.GetClient())
+			return
+		}
+		// 应用授权策略（如组织限定的应用）不允许时终止授权
+		if clientPolicyDenied(c, user, ar) {
+			return
+		}
+		// 终端验证身份的时间或方式不满足 max_age、acr_values，或应用要求 prompt=login 时先重新验证
+		login, _ := c.Get(ucenter.AuthLogin)
+		if l, ok := login.(*ucenter.Login); ok {
+			required, mfa, err := stepUpRequired(ar, l)
+			if err != nil {
+				oauth2provider.WriteAuthorizeError(c.Writer, ar, err)
+				return
+			}
+			if required && prompt.Has("none") {
+				oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrLoginRequired)
+				return
+			}
+			if required || (c.Request.Method == http.MethodGet && prompt.Has("login")) {
+				redirectToStepUp(c, withoutPrompt(c, "login"), mfa)
+				return
+			}
+		}
 		ucenter.DB.Model(user).Where("client_id = ?", ar.GetClient().GetID()).Association("UserAuthorizeds").Find(&user.UserAuthorizeds)
+		claimsReq, err := parseClaimsRequest(ar)
+		if err == nil {
+			err = claimsReq.checkSubject(userSubject(user, ar.GetClient()))
+		}
+		if err != nil {
+			oauth2provider.WriteAuthorizeError(c.Writer, ar, err)
+			return
+		}
+		essential := claimsReq.essential()
 		if c.Request.Method == http.MethodGet {
-			if len(user.UserAuthorizeds) == 0 || !storage.IsArgEqual(ar.GetRequestedScopes(), fosite.Arguments(user.UserAuthorizeds[0].Scope)) {
+			if verifier := c.Query("consent_verifier"); verifier != "" {
+				// 外部授权界面已处理完毕
+				perms, err := consumeConsentVerifier(verifier, user, ar)
+				if err == nil {
+					err = saveUserAuthorized(user, ar, perms, nil, nil)
+				}
+				if err != nil {
+					oauth2provider.WriteAuthorizeError(c.Writer, ar, err)
+					return
+				}
+			} else if len(user.UserAuthorizeds) == 0 || !storage.IsArgEqual(ar.GetRequestedScopes(), fosite.Arguments(user.UserAuthorizeds[0].Scope)) ||
+				withholdsEssential(user.UserAuthorizeds[0].WithheldClaims, essential) || user.UserAuthorizeds[0].ConsentExpired() || prompt.Has("consent") {
 				// 需要用户授予权限
+				scopes := registeredScopes()
 				var checkPerms = make(map[string]bool)
+				var withheld []string
 				for _, scope := range ar.GetRequestedScopes() {
 					// 判断scope合法性
-					if _, has := ucenter.Scopes[scope]; !has {
+					if _, has := scopes[scope]; !has {
 						oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrInvalidRequest)
-						break
+						return
 					}
 					if len(user.UserAuthorizeds) == 1 {
 						checkPerms[scope] = user.UserAuthorizeds[0].Permission[scope]
+						withheld = user.UserAuthorizeds[0].WithheldClaims
 					} else {
 						checkPerms[scope] = true
 					}
 				}
 
-				// 权限授予界面
-				c.HTML(http.StatusOK, "page/auth", nbgin.Data(c, gin.H{
-					"User":   user,
-					"Client": ar.GetClient(),
-					"Check":  checkPerms,
-					"Scopes": ucenter.Scopes,
-				}))
-				return
+				if isFirstParty(ar.GetClient()) && !prompt.Has("consent") {
+					// 第一方应用无需用户同意，授予全部 scope，授权照常记录
+					for scope := range checkPerms {
+						checkPerms[scope] = true
+					}
+					if err := saveUserAuthorized(user, ar, checkPerms, nil, nil); err != nil {
+						oauth2provider.WriteAuthorizeError(c.Writer, ar, err)
+						return
+					}
+				} else {
+					if prompt.Has("none") {
+						oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrConsentRequired)
+						return
+					}
+					// 交由外部授权界面
+					if ucenter.C.ConsentURL != "" && featureEnabled(ucenter.FlagConsentUI, user.ID) {
+						redirectToConsentUI(c, user, ar)
+						return
+					}
+
+					// 权限授予界面
+					c.HTML(http.StatusOK, "page/auth", nbgin.Data(c, gin.H{
+						"User":            user,
+						"Client":          ar.GetClient(),
+						"Check":           checkPerms,
+						"Scopes":          scopes,
+						"Claims":          consentClaims(ar.GetRequestedScopes(), essential, withheld),
+						"RememberDays":    ucenter.C.ConsentRememberDays,
+						"RememberForever": consentRememberForeverAllowed(ar.GetRequestedScopes(), scopes),
+					}))
+					return
+				}
 			}
 		} else if c.Request.Method == http.MethodPost {
 			// 用户选择了授权的权限
+			scopes := registeredScopes()
 			var perms = make(map[string]bool)
 			for _, scope := range ar.GetRequestedScopes() {
-				if _, has := ucenter.Scopes[scope]; !has {
+				if _, has := scopes[scope]; !has {
 					oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrInvalidScope)
 					return
 				}
 				gened := c.PostForm(scope) == "on"
 				perms[scope] = gened
 			}
-			if len(user.UserAuthorizeds) == 0 {
-				user.UserAuthorizeds = make([]ucenter.UserAuthorized, 0)
-				user.UserAuthorizeds = append(user.UserAuthorizeds, ucenter.UserAuthorized{})
-			}
-
-			user.UserAuthorizeds[0].Scope = pq.StringArray(ar.GetRequestedScopes())
-			user.UserAuthorizeds[0].Permission = perms
-			user.UserAuthorizeds[0].UserID = user.ID
-			user.UserAuthorizeds[0].ClientID = ar.GetClient().GetID()
-
-			if err := ucenter.DB.Save(&user.UserAuthorizeds[0]).Error; err != nil {
+			until := consentRememberUntil(c, consentRememberForeverAllowed(ar.GetRequestedScopes(), scopes))
+			if err := saveUserAuthorized(user, ar, perms, withheldFromForm(c, perms), until); err != nil {
 				oauth2provider.WriteAuthorizeError(c.Writer, ar, err)
 				return
 			}
@@ -114,31 +365,121 @@ func oauth2auth(c *gin.Context) {
 			}
 		}
 		mySessionData := storage.NewFositeSession(user.StrID())
+		mySessionData.DefaultSession.Claims.Subject = userSubject(user, ar.GetClient())
+		mySessionData.DefaultSession.Claims.Extra = claimsReq.idTokenClaims(user, ar.GetGrantedScopes(), user.UserAuthorizeds[0].WithheldClaims)
+		bindNonce(ar, mySessionData)
+		if l, ok := login.(*ucenter.Login); ok {
+			mySessionData.DefaultSession.Claims.Extra["sid"] = loginSID(l.Token)
+			authSessionClaims(mySessionData, l)
+		}
 		response, err := oauth2provider.NewAuthorizeResponse(ctx, ar, mySessionData)
 		if err != nil {
 			oauth2provider.WriteAuthorizeError(c.Writer, ar, err)
 			return
 		}
+		if err := encryptAuthorizeResponse(ar, response); err != nil {
+			oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrServerError.WithHint(err.Error()))
+			return
+		}
+		if err := addSessionState(c, ar, response); err != nil {
+			oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrServerError.WithHint(err.Error()))
+			return
+		}
+
+		// 记录终端登录过的应用
+		if l, ok := c.Get(ucenter.AuthLogin); ok {
+			recordLoginClient(l.(*ucenter.Login), ar.GetClient().GetID())
+		}
 
 		// Last but not least, send the response!
+		finishPushedRequest(c)
 		oauth2provider.WriteAuthorizeResponse(c.Writer, ar, response)
+	} else if prompt.Has("none") {
+		// 用户未登录，且应用不允许展示登录界面
+		oauth2provider.WriteAuthorizeError(c.Writer, ar, fosite.ErrLoginRequired)
+	} else if ucenter.C.LoginURL != "" {
+		// 用户未登录，交由外部登录界面；登录后已是所选账户且刚验证过身份
+		redirectToLoginUI(c, ar, withoutPrompt(c, "login", "select_account"))
 	} else {
 		// 用户未登录，跳转登录界面
 		nbgin.SetNoCache(c)
-		c.Redirect(http.StatusFound, "/login?return_url="+url.QueryEscape(c.Request.RequestURI))
+		c.Redirect(http.StatusFound, "/login?return_url="+url.QueryEscape(withoutPrompt(c, "login", "select_account")))
+	}
+}
+
+// saveUserAuthorized 保存用户对应用的授权，withheld 为用户拒绝提供的 claims，rememberUntil 为同意记住到何时，nil 为一直记住
+func saveUserAuthorized(user *ucenter.User, ar fosite.AuthorizeRequester, perms map[string]bool, withheld []string, rememberUntil *time.Time) error {
+	if len(user.UserAuthorizeds) == 0 {
+		user.UserAuthorizeds = append(user.UserAuthorizeds, ucenter.UserAuthorized{})
+	}
+
+	user.UserAuthorizeds[0].Scope = pq.StringArray(ar.GetRequestedScopes())
+	user.UserAuthorizeds[0].Permission = perms
+	user.UserAuthorizeds[0].WithheldClaims = pq.StringArray(withheld)
+	user.UserAuthorizeds[0].RememberUntil = rememberUntil
+	user.UserAuthorizeds[0].UserID = user.ID
+	user.UserAuthorizeds[0].ClientID = ar.GetClient().GetID()
+
+	// UserAuthorized 没有主键，先删除旧记录避免重复
+	tx := ucenter.DB.Begin()
+	if err := tx.Delete(ucenter.UserAuthorized{}, "user_id = ? AND client_id = ?", user.ID, ar.GetClient().GetID()).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Create(&user.UserAuthorizeds[0]).Error; err != nil {
+		tx.Rollback()
+		return err
 	}
+	return tx.Commit().Error
 }
 
+// userInfo OpenID Connect 用户信息端点，按访问令牌授权的 scope 返回用户当前的资料，应用注册了签名算法时返回签名的 JWT
 func userInfo(c *gin.Context) {
 	session := storage.NewFositeSession("")
-	tokenType, ar, err := oauth2provider.IntrospectToken(c, fosite.AccessTokenFromRequest(c.Request), fosite.AccessToken, session)
+	token, scheme := accessTokenFromRequest(c.Request)
+	tokenType, ar, err := oauth2provider.IntrospectToken(c, token, fosite.AccessToken, session)
 	if err != nil {
-		c.AbortWithError(http.StatusUnauthorized, err)
+		userInfoUnauthorized(c, "The access token is invalid or has expired")
 		return
 	}
 
+	// 绑定证书的令牌必须通过同一张证书访问
+	if err := checkCertBinding(c, ar.GetSession().(*storage.FositeSession)); err != nil {
+		userInfoUnauthorized(c, err.Error())
+		return
+	}
+
+	// DPoP 绑定的令牌必须附带持有密钥的证明
+	if jkt := ar.GetSession().(*storage.FositeSession).DPoPJKT; jkt != "" || scheme == "dpop" {
+		proof, err := checkDPoP(c, token)
+		if err == nil && (scheme != "dpop" || proof == nil || proof.JKT != jkt) {
+			err = errors.New("DPoP proof required")
+		}
+		if err != nil {
+			c.Header("WWW-Authenticate", `DPoP error="invalid_token"`)
+			c.AbortWithError(http.StatusUnauthorized, err)
+			return
+		}
+	}
+
 	if tokenType != fosite.AccessToken {
-		c.AbortWithError(http.StatusUnauthorized, errors.New("Only access tokens are allowed in the authorization header"))
+		userInfoUnauthorized(c, "Only access tokens are allowed in the authorization header")
+		return
+	}
+
+	sub := ar.GetSession().GetSubject()
+	if subjectRevoked(sub) {
+		userInfoUnauthorized(c, "Subject has been revoked")
+		return
+	}
+	if !ar.GetGrantedScopes().Has("openid") {
+		userInfoError(c, http.StatusForbidden, "insufficient_scope", "The access token was not granted the openid scope")
+		return
+	}
+	// 客户端凭证等令牌不代表用户
+	var u ucenter.User
+	if uid, err := strconv.ParseUint(sub, 10, 64); err != nil || ucenter.DB.First(&u, "id = ?", uid).Error != nil {
+		userInfoUnauthorized(c, "The access token does not belong to a user")
 		return
 	}
 
@@ -148,44 +489,46 @@ func userInfo(c *gin.Context) {
 		return
 	}
 
-	if cli.UserinfoSignedResponseAlg == "RS256" {
-		interim := ar.GetSession().(*storage.FositeSession).IDTokenClaims().ToMap()
-
-		delete(interim, "nonce")
-		delete(interim, "at_hash")
-		delete(interim, "c_hash")
-		delete(interim, "auth_time")
-		delete(interim, "iat")
-		delete(interim, "rat")
-		delete(interim, "exp")
-		delete(interim, "jti")
+	claims := withholdClaims(scopeClaims(&u, ar.GetGrantedScopes()), authorizedWithheld(u.ID, cli.GetID()))
+	claims["sub"] = userSubject(&u, cli)
 
-		token, _, err := oauth2strategy.Generate(c, jwt2.MapClaims(interim), &jwt.Headers{
-			Extra: map[string]interface{}{
-				"kid": 1,
-			},
-		})
+	if cli.UserinfoSignedResponseAlg == signingKeys.alg() {
+		claims["iss"] = ucenter.Issuer()
+		claims["aud"] = cli.GetID()
+		token, _, err := oauth2strategy.Generate(c, jwt2.MapClaims(claims), &jwt.Headers{})
 		if err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
+		if cli.UserinfoEncryptedResponseAlg != "" {
+			if token, err = jwe.Encrypt([]byte(token), cli.JSONWebKeys, cli.UserinfoEncryptedResponseAlg, cli.UserinfoEncryptedResponseEnc, true); err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+
 		c.Header("Content-Type", "application/jwt")
 		c.Writer.Write([]byte(token))
 	} else if cli.UserinfoSignedResponseAlg == "" || cli.UserinfoSignedResponseAlg == "none" {
-		interim := ar.GetSession().(*storage.FositeSession).IDTokenClaims().ToMap()
-		delete(interim, "aud")
-		delete(interim, "iss")
-		delete(interim, "nonce")
-		delete(interim, "at_hash")
-		delete(interim, "c_hash")
-		delete(interim, "auth_time")
-		delete(interim, "iat")
-		delete(interim, "rat")
-		delete(interim, "exp")
-		delete(interim, "jti")
-
-		c.JSON(http.StatusOK, interim)
+		// 未签名但要求加密时直接加密 JSON
+		if cli.UserinfoEncryptedResponseAlg != "" {
+			payload, err := json.Marshal(claims)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			token, err := jwe.Encrypt(payload, cli.JSONWebKeys, cli.UserinfoEncryptedResponseAlg, cli.UserinfoEncryptedResponseEnc, false)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			c.Header("Content-Type", "application/jwt")
+			c.Writer.Write([]byte(token))
+			return
+		}
+
+		c.JSON(http.StatusOK, claims)
 	} else {
 		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unsupported userinfo signing algorithm \"%s\"", cli.UserinfoSignedResponseAlg))
 	}
@@ -196,22 +539,104 @@ func oauth2token(c *gin.Context) {
 
 	mySessionData := storage.NewFositeSession("")
 
+	// 认证失败过多的客户端暂时拒绝
+	clientID := requestClientID(c)
+	if clientAuthLocked(c, clientID) {
+		return
+	}
+	if clientNetworkDenied(c, clientID) {
+		return
+	}
+
+	// mTLS 认证的客户端先校验证书
+	ctx, err := mtlsClientAuth(ctx, c)
+	if err != nil {
+		recordClientAuthFailure(clientID, clientIP(c))
+		oauth2provider.WriteAccessError(c.Writer, fosite.NewAccessRequest(mySessionData), err)
+		return
+	}
+
+	if c.PostForm("grant_type") == wechatMiniProgramGrantType {
+		if msg := wechatLoginDenied(c); msg != "" {
+			oauth2provider.WriteAccessError(c.Writer, fosite.NewAccessRequest(mySessionData), fosite.ErrAccessDenied.WithHint(msg))
+			return
+		}
+		ctx = withWechatSignupCheck(ctx, c)
+	}
+
 	accessRequest, err := oauth2provider.NewAccessRequest(ctx, c.Request, mySessionData)
 
 	if err != nil {
+		if isInvalidClient(err) {
+			recordClientAuthFailure(clientID, clientIP(c))
+		}
+		oauth2provider.WriteAccessError(c.Writer, accessRequest, err)
+		return
+	}
+
+	if err := checkClientActive(accessRequest.GetClient()); err != nil {
+		oauth2provider.WriteAccessError(c.Writer, accessRequest, err)
+		return
+	}
+
+	// 已删除用户的令牌不可再刷新
+	if subjectRevoked(accessRequest.GetSession().GetSubject()) {
+		oauth2provider.WriteAccessError(c.Writer, accessRequest, fosite.ErrInvalidGrant.WithHint("The subject has been revoked."))
+		return
+	}
+	// 禁用、停用或待审核的用户不再签发令牌
+	if subjectBlocked(accessRequest.GetSession().GetSubject()) {
+		oauth2provider.WriteAccessError(c.Writer, accessRequest, fosite.ErrAccessDenied.WithHint("The subject is not allowed to sign in."))
+		return
+	}
+
+	// DPoP 绑定：刷新令牌时必须使用同一把密钥
+	proof, err := checkDPoP(c, "")
+	if err != nil {
+		oauth2provider.WriteAccessError(c.Writer, accessRequest, fosite.ErrInvalidRequest.WithHint(err.Error()))
+		return
+	}
+	session := accessRequest.GetSession().(*storage.FositeSession)
+	if session.DPoPJKT != "" && (proof == nil || proof.JKT != session.DPoPJKT) {
+		oauth2provider.WriteAccessError(c.Writer, accessRequest, fosite.ErrInvalidGrant.WithHint("The DPoP proof does not match the key the token is bound to."))
+		return
+	}
+	if proof != nil {
+		session.DPoPJKT = proof.JKT
+	}
+
+	// mTLS 证书绑定
+	if err := checkCertBinding(c, session); err != nil {
+		oauth2provider.WriteAccessError(c.Writer, accessRequest, fosite.ErrInvalidGrant.WithHint(err.Error()))
+		return
+	}
+	if err := checkCodeNonce(accessRequest); err != nil {
 		oauth2provider.WriteAccessError(c.Writer, accessRequest, err)
 		return
 	}
+	if cli, ok := accessRequest.GetClient().(*storage.FositeClient); ok && cli.TLSClientCertificateBoundAccessTokens {
+		if cert, _ := clientCertificate(c); cert != nil {
+			session.CertThumbprint = certThumbprint(cert)
+		}
+	}
 
 	// If this is a client_credentials grant, grant all scopes the client is allowed to perform.
+	// 机器应用申请的 scope 还须经 RAM 策略授权
 	if accessRequest.GetGrantTypes().Exact("client_credentials") {
 		for _, scope := range accessRequest.GetRequestedScopes() {
+			if !machineScopeAllowed(accessRequest.GetClient().GetID(), scope) {
+				oauth2provider.WriteAccessError(c.Writer, accessRequest, fosite.ErrInvalidScope.WithHint("The client is not allowed to request scope \""+scope+"\"."))
+				return
+			}
 			if fosite.HierarchicScopeStrategy(accessRequest.GetClient().GetScopes(), scope) {
 				accessRequest.GrantScope(scope)
 			}
 		}
 	}
 
+	// 按应用模板设置令牌有效期
+	applyClientLifespans(accessRequest)
+
 	// Next we create a response for the access request. Again, we iterate through the TokenEndpointHandlers
 	// and aggregate the result in response.
 	response, err := oauth2provider.NewAccessResponse(ctx, accessRequest)
@@ -220,6 +645,49 @@ func oauth2token(c *gin.Context) {
 		return
 	}
 
+	if session.DPoPJKT != "" {
+		response.SetTokenType("DPoP")
+	}
+
+	// 记录离线访问（刷新令牌）的使用情况
+	if accessRequest.GetGrantTypes().Exact("refresh_token") {
+		oauth2store.(*storage.FositeStore).TouchRefreshToken(accessRequest.GetID(), clientIP(c))
+	}
+
+	// 按客户端设置加密 ID Token
+	if err := encryptAccessResponse(accessRequest, response); err != nil {
+		oauth2provider.WriteAccessError(c.Writer, accessRequest, fosite.ErrServerError.WithHint(err.Error()))
+		return
+	}
+
+	if accessRequest.GetGrantTypes().Exact(wechatMiniProgramGrantType) {
+		auditWechatLogin(c, accessRequest)
+	}
+
 	// All done, send the response.
 	oauth2provider.WriteAccessResponse(c.Writer, accessRequest, response)
 }
+
+// subjectRevoked sub 对应的用户是否已删除
+func subjectRevoked(sub string) bool {
+	uid, err := strconv.ParseUint(sub, 10, 64)
+	if err != nil {
+		return false
+	}
+	var count int
+	ucenter.DB.Model(ucenter.UserTombstone{}).Where("user_id = ?", uid).Count(&count)
+	return count > 0
+}
+
+// subjectBlocked sub 对应的用户是否不可登录
+func subjectBlocked(sub string) bool {
+	uid, err := strconv.ParseUint(sub, 10, 64)
+	if err != nil {
+		return false
+	}
+	var u ucenter.User
+	if ucenter.DB.Select("id, status, suspended_until").First(&u, "id = ?", uid).Error != nil {
+		return false
+	}
+	return u.Blocked()
+}
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/geoip"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// offlineApp 持有刷新令牌的应用及最近使用情况
+type offlineApp struct {
+	storage.OfflineGrant
+	Client   storage.FositeClient
+	Location string
+}
+
+func offlineAccess(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	grants, err := oauth2store.(*storage.FositeStore).OfflineGrants(u.StrID())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	apps := make([]offlineApp, 0, len(grants))
+	for _, g := range grants {
+		app := offlineApp{OfflineGrant: g}
+		if ucenter.DB.Where("client_id = ?", g.ClientID).First(&app.Client).Error != nil {
+			app.Client.Name = g.ClientID
+		}
+		if g.LastUsedIP != "" {
+			if _, name, err := geoip.Country(g.LastUsedIP); err == nil {
+				app.Location = name
+			}
+		}
+		apps = append(apps, app)
+	}
+	c.HTML(http.StatusOK, "user/offline", nbgin.Data(c, gin.H{
+		"apps": apps,
+	}))
+}
+
+func revokeOfflineAccess(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	if err := oauth2store.(*storage.FositeStore).RevokeClientTokens(u.StrID(), c.Param("id")); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditTokenRevoke, clientTarget(c.Param("id")), "撤销离线访问")
+}
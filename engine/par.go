@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// pushedRequestKey 授权请求来自 PAR 时，预提交的请求在上下文中的键
+const pushedRequestKey = "pushed_request"
+
+// pushedAuthorizeRequest PAR 端点（RFC 9126），应用认证后预先提交授权请求参数，换取短期有效的 request_uri
+func pushedAuthorizeRequest(c *gin.Context) {
+	clientID := requestClientID(c)
+	if clientAuthLocked(c, clientID) {
+		return
+	}
+	if clientNetworkDenied(c, clientID) {
+		return
+	}
+	authCtx, err := mtlsClientAuth(c, c)
+	if err != nil {
+		recordClientAuthFailure(clientID, clientIP(c))
+		writeOAuthError(c, err)
+		return
+	}
+	client, err := oauth2provider.(*fosite.Fosite).AuthenticateClient(authCtx, c.Request, c.Request.PostForm)
+	if err != nil {
+		recordClientAuthFailure(clientID, clientIP(c))
+		writeOAuthError(c, err)
+		return
+	}
+
+	// 客户端认证参数不属于授权请求
+	form := url.Values{}
+	for k, v := range c.Request.PostForm {
+		switch k {
+		case "client_secret", "client_assertion", "client_assertion_type":
+		default:
+			form[k] = v
+		}
+	}
+	if form.Get("request_uri") != "" {
+		writeOAuthError(c, fosite.ErrInvalidRequest.WithHint("The request_uri parameter must not be pushed."))
+		return
+	}
+	form.Set("client_id", client.GetID())
+	if cli, ok := client.(*storage.FositeClient); ok && cli.NarrowScope {
+		form.Set("scope", strings.Join(allowedScopes(cli, strings.Fields(form.Get("scope"))), " "))
+	}
+
+	// 按授权端点的规则校验，不合法的请求在此即被拒绝
+	req, err := http.NewRequest(http.MethodGet, "/oauth2/auth?"+form.Encode(), nil)
+	if err != nil {
+		writeOAuthError(c, err)
+		return
+	}
+	ctx := storage.WithRedirectURI(fosite.NewContext(), form.Get("redirect_uri"))
+	ar, err := oauth2provider.NewAuthorizeRequest(ctx, req)
+	if err == nil {
+		err = checkClientActive(client)
+	}
+	if err == nil {
+		err = checkClientPKCE(ar)
+	}
+	if err == nil {
+		err = checkStateNonce(ar)
+	}
+	if err == nil {
+		_, err = authorizePrompt(ar)
+	}
+	if err != nil {
+		writeOAuthError(c, err)
+		return
+	}
+
+	lifespan := time.Second * time.Duration(ucenter.C.PARLifespan)
+	pr, err := oauth2store.(*storage.FositeStore).CreatePushedRequest(client.GetID(), form, lifespan)
+	if err != nil {
+		writeOAuthError(c, err)
+		return
+	}
+	nbgin.SetNoCache(c)
+	c.JSON(http.StatusCreated, gin.H{
+		"request_uri": pr.RequestURI(),
+		"expires_in":  ucenter.C.PARLifespan,
+	})
+}
+
+// resolvePushedRequest 授权请求携带 PAR 签发的 request_uri 时以预提交的参数作为授权参数，地址中的其他授权参数一律忽略。
+// 地址保持不变，登录、授权等页面处理完毕后仍以 request_uri 回到授权请求
+func resolvePushedRequest(c *gin.Context) error {
+	requestURI := c.Query("request_uri")
+	if !strings.HasPrefix(requestURI, storage.PushedRequestURIPrefix) {
+		return nil
+	}
+	pr, err := oauth2store.(*storage.FositeStore).OpenPushedRequest(requestURI)
+	if err != nil {
+		return err
+	}
+	if pr.ClientID != c.Query("client_id") {
+		return errors.WithStack(fosite.ErrInvalidRequestURI.WithHint("The request_uri was not issued to this client."))
+	}
+	form, err := pr.Values()
+	if err != nil {
+		return err
+	}
+	// 授权页提交的表单
+	if err := c.Request.ParseForm(); err != nil {
+		return err
+	}
+	for k, v := range c.Request.PostForm {
+		if _, ok := form[k]; !ok {
+			form[k] = v
+		}
+	}
+	c.Request.Form = form
+	c.Set(pushedRequestKey, pr)
+	return nil
+}
+
+// checkClientPAR 应用要求 PAR 时，授权请求必须使用 PAR 签发的 request_uri
+func checkClientPAR(c *gin.Context, ar fosite.AuthorizeRequester) error {
+	client, ok := ar.GetClient().(*storage.FositeClient)
+	if !ok || !client.RequirePushedAuthorizationRequests {
+		return nil
+	}
+	if _, pushed := c.Get(pushedRequestKey); !pushed {
+		return fosite.ErrInvalidRequest.WithHint("This client must push its authorization requests to the pushed authorization request endpoint.")
+	}
+	return nil
+}
+
+// finishPushedRequest 授权完成后作废 request_uri
+func finishPushedRequest(c *gin.Context) {
+	if pr, ok := c.Get(pushedRequestKey); ok {
+		oauth2store.(*storage.FositeStore).DeletePushedRequest(pr.(*storage.PushedRequest).ID)
+	}
+}
+
+// pushedRequestGCJob 清理过期的预提交授权请求
+func pushedRequestGCJob() error {
+	return oauth2store.(*storage.FositeStore).DeleteExpiredPushedRequests(time.Now())
+}
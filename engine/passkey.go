@@ -0,0 +1,284 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+const passkeySessionCookie = "nb_passkey_session"
+
+var webAuthn *webauthn.WebAuthn
+
+func initWebAuthn() {
+	var err error
+	webAuthn, err = webauthn.New(&webauthn.Config{
+		RPDisplayName: ucenter.C.SysName,
+		RPID:          strings.Split(ucenter.C.Domain, ":")[0],
+		RPOrigins:     []string{ucenter.C.WebProtocol + "://" + ucenter.C.Domain},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// passkeyUser 实现 webauthn.User
+type passkeyUser struct {
+	*ucenter.User
+	passkeys []ucenter.Passkey
+}
+
+func loadPasskeyUser(u *ucenter.User) *passkeyUser {
+	pu := &passkeyUser{User: u}
+	ucenter.DB.Where("user_id = ?", u.ID).Find(&pu.passkeys)
+	return pu
+}
+
+func (pu *passkeyUser) WebAuthnID() []byte {
+	return []byte(pu.PasskeyHandle)
+}
+
+func (pu *passkeyUser) WebAuthnName() string {
+	return pu.Username
+}
+
+func (pu *passkeyUser) WebAuthnDisplayName() string {
+	return pu.Username
+}
+
+func (pu *passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (pu *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(pu.passkeys))
+	for _, p := range pu.passkeys {
+		creds = append(creds, webauthn.Credential{
+			ID:              p.CredentialID,
+			PublicKey:       p.PublicKey,
+			AttestationType: p.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    p.AAGUID,
+				SignCount: p.SignCount,
+			},
+		})
+	}
+	return creds
+}
+
+// savePasskeySession 保存 WebAuthn 挑战，5 分钟内有效
+func savePasskeySession(c *gin.Context, uid uint, data *webauthn.SessionData) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	id, err := password.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	ps := ucenter.PasskeySession{
+		ID:        id,
+		UserID:    uid,
+		Data:      string(b),
+		ExpiresAt: time.Now().Add(time.Minute * 5),
+	}
+	if err := ucenter.DB.Create(&ps).Error; err != nil {
+		return err
+	}
+	nbgin.SetCookie(c, 60*5, passkeySessionCookie, ps.ID)
+	return nil
+}
+
+// takePasskeySession 取出并作废 WebAuthn 挑战
+func takePasskeySession(c *gin.Context, uid uint) (*webauthn.SessionData, error) {
+	id, err := c.Cookie(passkeySessionCookie)
+	if err != nil {
+		return nil, errors.New("验证已过期，请重试")
+	}
+	nbgin.SetCookie(c, -1, passkeySessionCookie, "")
+	var ps ucenter.PasskeySession
+	if ucenter.DB.First(&ps, "id = ? AND user_id = ? AND expires_at > ?", id, uid, time.Now()).Error != nil {
+		return nil, errors.New("验证已过期，请重试")
+	}
+	ucenter.DB.Delete(&ps)
+	var data webauthn.SessionData
+	return &data, json.Unmarshal([]byte(ps.Data), &data)
+}
+
+func passkeys(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var list []ucenter.Passkey
+	ucenter.DB.Where("user_id = ?", u.ID).Order("id desc").Find(&list)
+	c.HTML(http.StatusOK, "user/passkeys", nbgin.Data(c, gin.H{
+		"passkeys": list,
+	}))
+}
+
+func beginPasskeyRegistration(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	if u.PasskeyHandle == "" {
+		handle, err := password.GenerateSecret()
+		if err == nil {
+			u.PasskeyHandle = handle
+			err = ucenter.DB.Model(u).Update("passkey_handle", u.PasskeyHandle).Error
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	pu := loadPasskeyUser(u)
+	var exclusions []protocol.CredentialDescriptor
+	for _, cred := range pu.WebAuthnCredentials() {
+		exclusions = append(exclusions, cred.Descriptor())
+	}
+	// 要求可发现凭据，登录时无需输入用户名
+	options, session, err := webAuthn.BeginRegistration(pu,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		}),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err == nil {
+		err = savePasskeySession(c, u.ID, session)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, options)
+}
+
+func finishPasskeyRegistration(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	session, err := takePasskeySession(c, u.ID)
+	if err != nil {
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+	cred, err := webAuthn.FinishRegistration(loadPasskeyUser(u), *session, c.Request)
+	if err != nil {
+		c.String(http.StatusForbidden, "通行密钥验证失败")
+		return
+	}
+	name := c.Query("name")
+	if name == "" || len([]rune(name)) > 20 {
+		name = "通行密钥"
+	}
+	pk := ucenter.Passkey{
+		UserID:          u.ID,
+		Name:            name,
+		CredentialID:    cred.ID,
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		AAGUID:          cred.Authenticator.AAGUID,
+		SignCount:       cred.Authenticator.SignCount,
+	}
+	if err := ucenter.DB.Create(&pk).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditMFAEnable, userTarget(u.ID), "通行密钥："+name)
+}
+
+func deletePasskey(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	db := ucenter.DB.Delete(ucenter.Passkey{}, "id = ? AND user_id = ?", c.Param("id"), u.ID)
+	if db.Error != nil {
+		c.AbortWithError(http.StatusInternalServerError, db.Error)
+		return
+	}
+	if db.RowsAffected > 0 {
+		auditCurrent(c, ucenter.AuditMFADisable, userTarget(u.ID), "通行密钥")
+	}
+}
+
+func beginPasskeyLogin(c *gin.Context) {
+	if _, ok := c.Get(ucenter.AuthUser); ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	options, session, err := webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err == nil {
+		err = savePasskeySession(c, 0, session)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, options)
+}
+
+func finishPasskeyLogin(c *gin.Context) {
+	if _, ok := c.Get(ucenter.AuthUser); ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if msg := countryDenied(clientIP(c), ucenter.C.LoginCountries); msg != "" {
+		c.String(http.StatusForbidden, msg)
+		return
+	}
+	if msg := reputationDenied(c, "登录"); msg != "" {
+		c.String(http.StatusForbidden, msg)
+		return
+	}
+	session, err := takePasskeySession(c, 0)
+	if err != nil {
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+
+	// 通过 user handle 找到对应用户
+	var u ucenter.User
+	cred, err := webAuthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		if len(userHandle) == 0 || ucenter.DB.First(&u, "passkey_handle = ?", string(userHandle)).Error != nil {
+			return nil, errors.New("passkey user not found")
+		}
+		return loadPasskeyUser(&u), nil
+	}, *session, c.Request)
+	if err != nil {
+		var target string
+		if u.ID != 0 {
+			target = userTarget(u.ID)
+		}
+		audit(c, 0, ucenter.AuditLoginFailure, target, "通行密钥验证失败")
+		c.String(http.StatusForbidden, "通行密钥验证失败")
+		return
+	}
+	if liftExpiredSuspension(&u); u.Blocked() {
+		c.String(http.StatusForbidden, suspendedMessage(&u))
+		return
+	}
+	if !featureEnabled(ucenter.FlagPasskey, u.ID) {
+		c.String(http.StatusForbidden, "通行密钥登录暂未向您开放，请使用密码登录")
+		return
+	}
+	ucenter.DB.Model(ucenter.Passkey{}).Where("credential_id = ?", cred.ID).Updates(map[string]interface{}{
+		"sign_count":   cred.Authenticator.SignCount,
+		"last_used_at": time.Now(),
+	})
+
+	if _, err := establishSession(c, &u, ucenter.AMRWebAuthn); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	audit(c, u.ID, ucenter.AuditLoginSuccess, userTarget(u.ID), "通行密钥登录")
+	c.JSON(http.StatusOK, gin.H{"redirect": safeReturnURL(c.Query("return_url"), "/")})
+}
+
+// passkeySessionGCJob 清理过期的 WebAuthn 挑战
+func passkeySessionGCJob() error {
+	return ucenter.DB.Delete(ucenter.PasskeySession{}, "expires_at < ?", time.Now()).Error
+}
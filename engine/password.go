@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"gopkg.in/go-playground/validator.v9"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+// checkNewPassword 新密码需符合密码策略，且不能是最近用过的密码
+func checkNewPassword(u *ucenter.User, pw string) error {
+	if err := password.CheckPolicy(pw, u.Username, string(u.Email)); err != nil {
+		return err
+	}
+	n := ucenter.C.PasswordHistory
+	if n <= 0 || u.ID == 0 {
+		return nil
+	}
+	if ok, _ := password.Verify(u.Password, pw); ok {
+		return password.NewPolicyError(password.TransReused, n)
+	}
+	var history []ucenter.PasswordHistory
+	ucenter.DB.Where("user_id = ?", u.ID).Order("id desc").Limit(n - 1).Find(&history)
+	for _, h := range history {
+		if ok, _ := password.Verify(h.Hash, pw); ok {
+			return password.NewPolicyError(password.TransReused, n)
+		}
+	}
+	return nil
+}
+
+// setPassword 设置新密码，旧密码计入历史，调用方负责保存用户
+func setPassword(u *ucenter.User, pw string) error {
+	hash, err := password.Hash(pw)
+	if err != nil {
+		return err
+	}
+	if n := ucenter.C.PasswordHistory; n > 1 && u.ID != 0 && u.Password != "" {
+		if err := ucenter.DB.Create(&ucenter.PasswordHistory{UserID: u.ID, Hash: u.Password}).Error; err != nil {
+			return err
+		}
+		// 只保留需要比对的记录
+		ucenter.DB.Exec("DELETE FROM password_histories WHERE user_id = ? AND id NOT IN (SELECT id FROM password_histories WHERE user_id = ? ORDER BY id DESC LIMIT ?)", u.ID, u.ID, n-1)
+	}
+	now := time.Now()
+	u.Password = hash
+	u.PasswordChangedAt = &now
+	return nil
+}
+
+// passwordHashParams 生效的哈希参数。配置了 password_hash_target 时自动调优，并与同一目标下记录过的最高结果取较高者，
+// 硬件不同的多个实例使用一致的参数
+func passwordHashParams() password.Params {
+	target := ucenter.C.PasswordHashTarget
+	if target <= 0 {
+		return password.Configured()
+	}
+	p := password.Tune(time.Duration(target) * time.Millisecond)
+	var campaigns []ucenter.PasswordHashCampaign
+	ucenter.DB.Where("target = ?", target).Find(&campaigns)
+	for _, c := range campaigns {
+		q, ok := password.ParseParams(c.Params)
+		if !ok || q.Algorithm != p.Algorithm || q.Memory != p.Memory || q.Threads != p.Threads {
+			continue
+		}
+		if q.Cost > p.Cost {
+			p.Cost = q.Cost
+		}
+		if q.Time > p.Time {
+			p.Time = q.Time
+		}
+	}
+	return p
+}
+
+// initPasswordHash 确定生效的哈希参数，参数变化时开始新一轮重新哈希
+func initPasswordHash() error {
+	p := passwordHashParams()
+	password.SetCurrent(p)
+	var last ucenter.PasswordHashCampaign
+	err := ucenter.DB.Order("id desc").First(&last).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	if err == nil && last.Params == p.Prefix() {
+		return nil
+	}
+	var outdated int
+	if err := outdatedPasswords(p).Count(&outdated).Error; err != nil {
+		return err
+	}
+	log.Printf("密码哈希参数：%s，%d 个用户将在下次登录时重新哈希", p, outdated)
+	return ucenter.DB.Create(&ucenter.PasswordHashCampaign{Params: p.Prefix(), Target: ucenter.C.PasswordHashTarget, Outdated: outdated}).Error
+}
+
+// outdatedPasswords 密码哈希弱于 p 的用户，与 password.Params.Weaker 的判断一致
+func outdatedPasswords(p password.Params) *gorm.DB {
+	db := ucenter.DB.Model(ucenter.User{}).Where("password <> ''")
+	if p.Algorithm == password.AlgoArgon2id {
+		return db.Where(`NOT (password LIKE '$argon2id$%' AND substring(password from 'm=(\d+)')::bigint >= ? AND
+			substring(password from ',t=(\d+)')::bigint >= ? AND substring(password from ',p=(\d+)')::int = ?)`, p.Memory, p.Time, p.Threads)
+	}
+	// 成本为两位数字，可按字符串比较
+	return db.Where("NOT (password LIKE '$2_$__$%' AND substring(password from 5 for 2) >= ?)", fmt.Sprintf("%02d", p.Cost))
+}
+
+// passwordHashStatus 管理中心展示的哈希参数及本轮重新哈希的进度
+func passwordHashStatus() gin.H {
+	p := password.Current()
+	status := gin.H{"params": p.String(), "target": ucenter.C.PasswordHashTarget}
+	var last ucenter.PasswordHashCampaign
+	if ucenter.DB.Order("id desc").First(&last).Error != nil || last.Params != p.Prefix() {
+		return status
+	}
+	var outdated int
+	outdatedPasswords(p).Count(&outdated)
+	status["campaign"] = last
+	status["outdated"] = outdated
+	if last.Outdated > 0 {
+		done := last.Outdated - outdated
+		if done < 0 {
+			done = 0
+		}
+		status["progress"] = done * 100 / last.Outdated
+	}
+	return status
+}
+
+// passwordExpired 用户密码是否已过期
+func passwordExpired(u *ucenter.User) bool {
+	if u.PasswordChangedAt != nil {
+		return password.Expired(*u.PasswordChangedAt)
+	}
+	return password.Expired(u.CreatedAt)
+}
+
+// passwordMustChange 密码过期后只能修改密码或退出登录
+func passwordMustChange(c *gin.Context) {
+	u, ok := c.Get(ucenter.AuthUser)
+	if !ok || !passwordExpired(u.(*ucenter.User)) {
+		return
+	}
+	switch c.Request.URL.Path {
+	case "/password", "/sudo", "/logout":
+		return
+	}
+	if c.Request.Method == http.MethodGet {
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, "/password?return_url="+url.QueryEscape(c.Request.RequestURI))
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": password.NewPolicyError(password.TransExpired, ucenter.C.PasswordMaxAge).Error()})
+}
+
+func changePassword(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var notice string
+	if passwordExpired(u) {
+		notice = password.NewPolicyError(password.TransExpired, ucenter.C.PasswordMaxAge).Error()
+	}
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "user/password", nbgin.Data(c, gin.H{
+		"notice":    notice,
+		"minLength": ucenter.C.PasswordMinLength,
+		"classes":   ucenter.C.PasswordMinClasses,
+	}))
+}
+
+func changePasswordHandler(c *gin.Context) {
+	type passwordForm struct {
+		Password   string `form:"password" cfn:"密码" binding:"required,min=6,max=32,eqfield=RePassword"`
+		RePassword string `form:"repassword" cfn:"确认密码" binding:"required,min=6,max=32"`
+	}
+
+	var pf passwordForm
+	var errors validator.ValidationErrorsTranslations
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	if err := c.ShouldBind(&pf); err != nil {
+		errors = err.(validator.ValidationErrors).Translate(ucenter.ValidatorTrans)
+	} else if err := checkNewPassword(u, pf.Password); err != nil {
+		errors = map[string]string{
+			"passwordForm.密码": err.Error(),
+		}
+	} else if err := setPassword(u, pf.Password); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if errors != nil {
+		c.HTML(http.StatusOK, "user/password", nbgin.Data(c, gin.H{
+			"errors":    errors,
+			"minLength": ucenter.C.PasswordMinLength,
+			"classes":   ucenter.C.PasswordMinClasses,
+		}))
+		return
+	}
+	if err := ucenter.DB.Model(u).Select("password", "password_changed_at").Updates(map[string]interface{}{
+		"password":            u.Password,
+		"password_changed_at": u.PasswordChangedAt,
+	}).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditPasswordChange, userTarget(u.ID), "")
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, safeReturnURL(c.Query("return_url"), "/"))
+}
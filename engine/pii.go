@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/pii"
+)
+
+// piiMigrateJob 启用敏感字段加密后，加密旧的明文数据并补齐盲索引
+func piiMigrateJob() error {
+	if !pii.Enabled() {
+		return nil
+	}
+	for {
+		var users []ucenter.User
+		if err := ucenter.DB.Select("id, email").
+			Where("email <> '' AND (email NOT LIKE ? OR email_index = '' OR email_index IS NULL)", pii.Prefix+"%").
+			Limit(100).Find(&users).Error; err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			break
+		}
+		for i := 0; i < len(users); i++ {
+			if err := ucenter.DB.Model(&users[i]).UpdateColumns(map[string]interface{}{
+				"email":       users[i].Email,
+				"email_index": pii.BlindIndex(string(users[i].Email)),
+			}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		var users []ucenter.User
+		if err := ucenter.DB.Select("id, phone").Where("phone <> '' AND phone NOT LIKE ?", pii.Prefix+"%").
+			Limit(100).Find(&users).Error; err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return nil
+		}
+		for i := 0; i < len(users); i++ {
+			if err := ucenter.DB.Model(&users[i]).UpdateColumn("phone", users[i].Phone).Error; err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package engine
+
+import (
+	"net"
+	"strings"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/geoip"
+	"github.com/naiba/ucenter/pkg/iplist"
+)
+
+// countryDenied 检查 IP 所在国家是否在允许列表中，被拒绝时返回提示信息
+func countryDenied(ip string, allowed []string) string {
+	if len(allowed) == 0 || !geoip.Loaded() || iplist.Contains(ip, ucenter.C.GeoIPExemptIPs) {
+		return ""
+	}
+	if addr := net.ParseIP(ip); addr != nil && addr.IsLoopback() {
+		return ""
+	}
+	code, name, err := geoip.Country(ip)
+	if err != nil || code == "" {
+		return "无法识别您所在的地区，暂不提供服务"
+	}
+	for _, c := range allowed {
+		if strings.EqualFold(c, code) {
+			return ""
+		}
+	}
+	return "您所在的地区（" + name + "）暂不提供服务"
+}
@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// authorizePrompt 授权请求的 prompt 参数（OpenID Connect Core 第 3.1.2.1 节），none 不能与其他值同时使用
+func authorizePrompt(ar fosite.AuthorizeRequester) (fosite.Arguments, error) {
+	prompt := fosite.Arguments(strings.Fields(ar.GetRequestForm().Get("prompt")))
+	for _, p := range prompt {
+		switch p {
+		case "none", "login", "consent", "select_account":
+		default:
+			return nil, errors.WithStack(fosite.ErrInvalidRequest.WithHint("The prompt value \"" + p + "\" is not supported."))
+		}
+	}
+	if prompt.Has("none") && len(prompt) > 1 {
+		return nil, errors.WithStack(fosite.ErrInvalidRequest.WithHint("The prompt value \"none\" must not be combined with other values."))
+	}
+	return prompt, nil
+}
+
+// withoutPrompt 从授权请求地址的 prompt 中去掉已处理的值，处理完回到该地址时不会再次处理。
+// 来自 PAR 的授权请求改为修改预提交的参数，地址不变
+func withoutPrompt(c *gin.Context, values ...string) string {
+	pr, pushed := c.Get(pushedRequestKey)
+	next := *c.Request.URL
+	q := next.Query()
+	if pushed {
+		q = c.Request.Form
+	}
+	var rest []string
+	for _, p := range strings.Fields(q.Get("prompt")) {
+		if !fosite.Arguments(values).Has(p) {
+			rest = append(rest, p)
+		}
+	}
+	if pushed {
+		if len(rest) == len(strings.Fields(q.Get("prompt"))) {
+			return c.Request.RequestURI
+		}
+		form, err := pr.(*storage.PushedRequest).Values()
+		if err == nil {
+			form.Set("prompt", strings.Join(rest, " "))
+			err = oauth2store.(*storage.FositeStore).UpdatePushedRequestForm(pr.(*storage.PushedRequest), form)
+		}
+		if err != nil {
+			log.Printf("pushed request %s: %s", pr.(*storage.PushedRequest).ID, err)
+		}
+		return c.Request.RequestURI
+	}
+	if len(rest) > 0 {
+		q.Set("prompt", strings.Join(rest, " "))
+	} else {
+		q.Del("prompt")
+	}
+	next.RawQuery = q.Encode()
+	return next.RequestURI()
+}
+
+// selectAccount prompt=select_account 时请用户确认以当前账户继续，或退出后换一个账户登录
+func selectAccount(c *gin.Context, user *ucenter.User, client fosite.Client) {
+	// 换账户后重新登录，无需再处理 login；PAR 的请求两者地址相同，以后处理的 Continue 为准
+	switchURL := withoutPrompt(c, "select_account", "login")
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "page/select_account", nbgin.Data(c, gin.H{
+		"User":     user,
+		"Client":   client,
+		"Continue": withoutPrompt(c, "select_account"),
+		"Switch":   switchURL,
+	}))
+}
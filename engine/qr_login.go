@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mssola/user_agent"
+	qrcode "github.com/skip2/go-qrcode"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/geoip"
+	"github.com/naiba/ucenter/pkg/mail"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+const qrLoginCookie = "nb_qr_login"
+
+// beginQRLogin 桌面端生成扫码登录的二维码
+func beginQRLogin(c *gin.Context) {
+	if _, ok := c.Get(ucenter.AuthUser); ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	id, err := password.GenerateSecret()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	secret, err := password.GenerateSecret()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ua := user_agent.New(c.Request.UserAgent())
+	browser, _ := ua.Browser()
+	q := ucenter.QRLogin{
+		ID:        id,
+		Secret:    secret,
+		Status:    ucenter.QRLoginPending,
+		Name:      ua.OS() + " " + browser,
+		IP:        clientIP(c),
+		ReturnURL: safeReturnURL(c.Query("return_url"), "/"),
+		ExpiresAt: time.Now().Add(time.Second * time.Duration(ucenter.C.QRLoginTTL)),
+	}
+	q.Location, _ = geoip.Location(q.IP)
+	png, err := qrcode.Encode(mail.SiteURL("/qr/"+q.ID), qrcode.Medium, 256)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err := ucenter.DB.Create(&q).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	nbgin.SetCookie(c, ucenter.C.QRLoginTTL, qrLoginCookie, q.ID+"."+q.Secret)
+	c.JSON(http.StatusOK, gin.H{
+		"image":      "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		"expires_in": ucenter.C.QRLoginTTL,
+	})
+}
+
+// currentQRLogin 当前浏览器发起的扫码登录
+func currentQRLogin(c *gin.Context) *ucenter.QRLogin {
+	value, err := c.Cookie(qrLoginCookie)
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(value, ".", 2)
+	var q ucenter.QRLogin
+	if len(parts) != 2 || ucenter.DB.First(&q, "id = ?", parts[0]).Error != nil ||
+		subtle.ConstantTimeCompare([]byte(q.Secret), []byte(parts[1])) != 1 {
+		return nil
+	}
+	return &q
+}
+
+// pollQRLogin 桌面端轮询扫码结果，手机确认后由桌面端提交 completeQRLogin 完成登录
+func pollQRLogin(c *gin.Context) {
+	if _, ok := c.Get(ucenter.AuthUser); ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	q := currentQRLogin(c)
+	if q == nil || q.Expired() || q.Status == ucenter.QRLoginConsumed {
+		c.JSON(http.StatusOK, gin.H{"status": "expired"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": q.Status})
+}
+
+// completeQRLogin 手机确认后桌面端建立登录，与其他登录方式一样需要完成二次验证
+func completeQRLogin(c *gin.Context) {
+	if _, ok := c.Get(ucenter.AuthUser); ok {
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	q := currentQRLogin(c)
+	nbgin.SetCookie(c, -1, qrLoginCookie, "")
+	// 同一次确认只能换取一次登录
+	if q == nil || q.Expired() || ucenter.DB.Model(q).Where("status = ?", ucenter.QRLoginApproved).
+		UpdateColumn("status", ucenter.QRLoginConsumed).RowsAffected == 0 {
+		qrLoginExpired(c)
+		return
+	}
+	var u ucenter.User
+	if err := ucenter.DB.First(&u, "id = ?", q.UserID).Error; err != nil {
+		qrLoginExpired(c)
+		return
+	}
+	if liftExpiredSuspension(&u); u.Blocked() {
+		c.HTML(http.StatusForbidden, "page/info", gin.H{
+			"icon":  "ban",
+			"title": "无法登录",
+			"msg":   suspendedMessage(&u),
+		})
+		return
+	}
+	completeLogin(c, &u, "", "扫码登录", safeReturnURL(q.ReturnURL, "/"))
+}
+
+// qrLoginExpired 二维码失效的提示
+func qrLoginExpired(c *gin.Context) {
+	c.HTML(http.StatusNotFound, "page/info", gin.H{
+		"icon":  "qrcode",
+		"title": "二维码已失效",
+		"msg":   "请在电脑上刷新二维码后重新扫描。",
+	})
+}
+
+// showQRLogin 手机扫码后展示发起登录的设备，等待用户确认
+func showQRLogin(c *gin.Context) {
+	var q ucenter.QRLogin
+	if ucenter.DB.First(&q, "id = ?", c.Param("id")).Error != nil || q.Expired() ||
+		(q.Status != ucenter.QRLoginPending && q.Status != ucenter.QRLoginScanned) {
+		qrLoginExpired(c)
+		return
+	}
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "user/qr_login", nbgin.Data(c, gin.H{
+		"qr": q,
+	}))
+}
+
+// scanQRLogin 确认页面打开后通知桌面端已扫码
+func scanQRLogin(c *gin.Context) {
+	ucenter.DB.Model(ucenter.QRLogin{}).
+		Where("id = ? AND status = ? AND expires_at > ?", c.Param("id"), ucenter.QRLoginPending, time.Now()).
+		UpdateColumn("status", ucenter.QRLoginScanned)
+	c.Status(http.StatusNoContent)
+}
+
+// answerQRLogin 手机端确认或拒绝扫码登录
+func answerQRLogin(approve bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+		updates := map[string]interface{}{"status": ucenter.QRLoginRejected}
+		if approve {
+			updates = map[string]interface{}{"status": ucenter.QRLoginApproved, "user_id": u.ID}
+		}
+		if ucenter.DB.Model(ucenter.QRLogin{}).
+			Where("id = ? AND status IN (?) AND expires_at > ?", c.Param("id"), []string{ucenter.QRLoginPending, ucenter.QRLoginScanned}, time.Now()).
+			Updates(updates).RowsAffected == 0 {
+			qrLoginExpired(c)
+			return
+		}
+		if !approve {
+			c.HTML(http.StatusOK, "page/info", gin.H{
+				"icon":  "ban",
+				"title": "已拒绝登录",
+				"msg":   "电脑上的扫码登录已被拒绝。",
+			})
+			return
+		}
+		c.HTML(http.StatusOK, "page/info", gin.H{
+			"icon":  "check",
+			"title": "已确认登录",
+			"msg":   "电脑上将自动登录您的账户。",
+		})
+	}
+}
+
+// qrLoginGCJob 清理过期的扫码登录
+func qrLoginGCJob() error {
+	return ucenter.DB.Delete(ucenter.QRLogin{}, "expires_at < ?", time.Now()).Error
+}
@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// recoveryAlphabet 恢复码字符集，去掉了容易看错的字符
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// newRecoveryCode 生成 xxxxx-xxxxx 格式的恢复码
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = recoveryAlphabet[n.Int64()]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+// normalizeRecoveryCode 输入时忽略大小写、空格及连字符
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// generateRecoveryCodes 作废旧的恢复码并生成新的一组，明文只在生成时展示一次
+func generateRecoveryCodes(uid uint) ([]string, error) {
+	codes := make([]string, ucenter.C.MFARecoveryCodes)
+	tx := ucenter.DB.Begin()
+	if err := tx.Delete(ucenter.RecoveryCode{}, "user_id = ?", uid).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err == nil {
+			err = tx.Create(&ucenter.RecoveryCode{UserID: uid, CodeHash: hashOTP(normalizeRecoveryCode(code))}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		codes[i] = code
+	}
+	return codes, tx.Commit().Error
+}
+
+// useRecoveryCode 核销一个未使用的恢复码
+func useRecoveryCode(uid uint, code string) bool {
+	db := ucenter.DB.Model(ucenter.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", uid, hashOTP(normalizeRecoveryCode(code))).
+		UpdateColumn("used_at", time.Now())
+	return db.Error == nil && db.RowsAffected == 1
+}
+
+// remainingRecoveryCodes 未使用的恢复码个数
+func remainingRecoveryCodes(uid uint) int {
+	var count int
+	ucenter.DB.Model(ucenter.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", uid).Count(&count)
+	return count
+}
+
+func regenerateRecoveryCodes(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	if !u.MFAEmail {
+		renderMFASettings(c, false, "请先启用二次验证")
+		return
+	}
+	codes, err := generateRecoveryCodes(u.ID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditMFAEnable, userTarget(u.ID), "生成恢复码")
+	data := mfaSettingsData(c, false, "")
+	data["codes"] = codes
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "user/mfa", nbgin.Data(c, data))
+}
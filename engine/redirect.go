@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/naiba/ucenter"
+)
+
+// safeReturnURL 校验 return_url，只允许站内路径、本站及白名单域名，否则返回 fallback
+func safeReturnURL(raw, fallback string) string {
+	raw = strings.TrimSpace(raw)
+	// 反斜杠和控制字符会被部分浏览器纠正为 //，协议相对地址同样指向外站
+	if raw == "" || strings.ContainsAny(raw, "\\\r\n\t") || strings.HasPrefix(raw, "//") {
+		return fallback
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.User != nil {
+		return fallback
+	}
+	if u.Scheme == "" && u.Host == "" {
+		if !strings.HasPrefix(u.Path, "/") {
+			return fallback
+		}
+		return raw
+	}
+	if (u.Scheme == "https" || u.Scheme == "http") && allowedRedirectHost(u.Host) {
+		return u.String()
+	}
+	return fallback
+}
+
+// allowedRedirectHost 本站域名或 return_url_allow_hosts 中的域名，支持 *.example.com
+func allowedRedirectHost(host string) bool {
+	host = strings.ToLower(host)
+	if host == strings.ToLower(ucenter.C.Domain) {
+		return true
+	}
+	for _, allowed := range ucenter.C.ReturnURLAllowHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
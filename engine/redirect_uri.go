@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+)
+
+// checkRedirectURIPolicy 创建、修改应用时校验跳转链接及其匹配方式，任何匹配方式都不允许通配符域名
+func checkRedirectURIPolicy(policy string, uris []string, public bool) error {
+	switch policy {
+	case "", storage.RedirectURIPolicyExact, storage.RedirectURIPolicyPrefix, storage.RedirectURIPolicyLoopback:
+	default:
+		return fmt.Errorf("不支持的跳转链接匹配方式 %s", policy)
+	}
+	if policy == storage.RedirectURIPolicyLoopback && !public {
+		return errors.New("本机回环地址匹配只适用于公开客户端（原生应用）")
+	}
+	var loopback bool
+	for _, raw := range uris {
+		u, err := url.Parse(raw)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("%s 不是有效的跳转链接", raw)
+		}
+		if strings.Contains(u.Host, "*") {
+			return fmt.Errorf("跳转链接 %s 不能使用通配符域名", raw)
+		}
+		isLoopback := u.Scheme == "http" && storage.IsLoopback(u.Hostname())
+		loopback = loopback || isLoopback
+		if policy == storage.RedirectURIPolicyPrefix && u.Scheme != "https" && !isLoopback {
+			return fmt.Errorf("跳转链接 %s 不能使用前缀匹配，前缀匹配只支持 https 及本机回环地址", raw)
+		}
+	}
+	if policy == storage.RedirectURIPolicyLoopback && !loopback {
+		return errors.New("本机回环地址匹配需要至少登记一个 http 本机回环地址")
+	}
+	return nil
+}
+
+// checkAuthorizeRedirect 授权请求的跳转链接不符合应用的匹配方式时返回错误。
+// 此时不能把错误带回应用，由调用方展示错误页面；应用不存在等其他错误仍交给 fosite 处理
+func checkAuthorizeRedirect(c *gin.Context) error {
+	raw := c.Request.FormValue("redirect_uri")
+	if raw == "" {
+		return nil
+	}
+	x, err := oauth2store.GetClient(nil, c.Request.FormValue("client_id"))
+	if err != nil {
+		return nil
+	}
+	client := x.(*storage.FositeClient)
+	if !client.MatchRedirectURI(raw) {
+		return fmt.Errorf("跳转链接 %s 与应用 %s 登记的跳转链接不符，请联系应用开发者", raw, client.Name)
+	}
+	return nil
+}
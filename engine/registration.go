@@ -0,0 +1,573 @@
+package engine
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/ids"
+	"github.com/naiba/ucenter/pkg/jwe"
+	"github.com/naiba/ucenter/pkg/mail"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+// sectorClient 获取 sector_identifier_uri 的 HTTP 客户端，只连接公网地址且不经过代理，跟随的跳转同样受限
+var sectorClient = &http.Client{
+	Timeout: time.Second * 5,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: time.Second * 5, Control: dialPublicOnly}).DialContext,
+	},
+}
+
+// sectorMaxBytes sector_identifier_uri 内容的大小上限
+const sectorMaxBytes = 64 * 1024
+
+// registrationOwner 动态注册的应用不属于任何用户
+const registrationOwner = "0"
+
+// registeredClientKey 已通过注册访问令牌认证的应用在请求上下文中的键
+const registeredClientKey = "registered_client"
+
+// registrationMetadata 注册请求中的客户端元数据（RFC 7591 第 2 节）
+type registrationMetadata struct {
+	ClientID                     string              `json:"client_id"`
+	RedirectURIs                 []string            `json:"redirect_uris"`
+	RedirectURIPolicy            string              `json:"redirect_uri_policy"`
+	SubjectType                  string              `json:"subject_type"`
+	SectorIdentifierURI          string              `json:"sector_identifier_uri"`
+	TokenEndpointAuthMethod      string              `json:"token_endpoint_auth_method"`
+	TLSClientAuthSubjectDN       string              `json:"tls_client_auth_subject_dn"`
+	GrantTypes                   []string            `json:"grant_types"`
+	ResponseTypes                []string            `json:"response_types"`
+	ClientName                   string              `json:"client_name"`
+	ClientURI                    string              `json:"client_uri"`
+	LogoURI                      string              `json:"logo_uri"`
+	Scope                        string              `json:"scope"`
+	Contacts                     []string            `json:"contacts"`
+	TermsOfServiceURI            string              `json:"tos_uri"`
+	PolicyURI                    string              `json:"policy_uri"`
+	JSONWebKeysURI               string              `json:"jwks_uri"`
+	JSONWebKeys                  *jose.JSONWebKeySet `json:"jwks"`
+	RequestURIs                  []string            `json:"request_uris"`
+	RequestObjectSigningAlg      string              `json:"request_object_signing_alg"`
+	UserinfoSignedResponseAlg    string              `json:"userinfo_signed_response_alg"`
+	IDTokenEncryptedResponseAlg  string              `json:"id_token_encrypted_response_alg"`
+	IDTokenEncryptedResponseEnc  string              `json:"id_token_encrypted_response_enc"`
+	UserinfoEncryptedResponseAlg string              `json:"userinfo_encrypted_response_alg"`
+	UserinfoEncryptedResponseEnc string              `json:"userinfo_encrypted_response_enc"`
+	AccessTokenStrategy          string              `json:"access_token_strategy"`
+	PostLogoutRedirectURIs       []string            `json:"post_logout_redirect_uris"`
+	BackchannelLogoutURI         string              `json:"backchannel_logout_uri"`
+	BackchannelLogoutSession     bool                `json:"backchannel_logout_session_required"`
+	RequirePAR                   bool                `json:"require_pushed_authorization_requests"`
+}
+
+// registrationResponse 注册成功后返回的客户端信息，密钥与注册访问令牌只在签发时返回一次
+type registrationResponse struct {
+	*storage.FositeClient
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+}
+
+// registrationError RFC 7591 第 3.2.2 节的错误
+type registrationError struct {
+	code string
+	desc string
+}
+
+func (e *registrationError) Error() string {
+	return e.desc
+}
+
+func invalidClientMetadata(format string, a ...interface{}) error {
+	return &registrationError{"invalid_client_metadata", fmt.Sprintf(format, a...)}
+}
+
+func invalidRedirectURI(format string, a ...interface{}) error {
+	return &registrationError{"invalid_redirect_uri", fmt.Sprintf(format, a...)}
+}
+
+func writeRegistrationError(c *gin.Context, err error) {
+	if e, ok := err.(*registrationError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": e.code, "error_description": e.desc})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error", "error_description": err.Error()})
+}
+
+// registrationTemplate 按授权类型与认证方式选择应用模板，模板决定令牌有效期、PKCE 及 scope 上限
+func registrationTemplate(m *registrationMetadata) string {
+	if len(m.GrantTypes) == 1 && m.GrantTypes[0] == "client_credentials" {
+		return "service"
+	}
+	if m.TokenEndpointAuthMethod == "none" {
+		return "native"
+	}
+	return "web"
+}
+
+// checkRegistrationRedirect 跳转链接必须使用 https；公开客户端还可以使用本机回环地址及反向域名的私有 scheme
+func checkRegistrationRedirect(raw string, public bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || len(raw) > 255 {
+		return invalidRedirectURI("%s 不是有效的跳转链接", raw)
+	}
+	if u.Fragment != "" {
+		return invalidRedirectURI("跳转链接 %s 不能包含 fragment", raw)
+	}
+	switch {
+	case u.Scheme == "https":
+	case public && u.Scheme == "http" && storage.IsLoopback(u.Hostname()):
+		return nil
+	case public && u.Scheme != "http" && strings.Contains(u.Scheme, "."):
+		return nil
+	default:
+		return invalidRedirectURI("跳转链接 %s 必须使用 https", raw)
+	}
+	if len(ucenter.C.RegistrationRedirectHosts) == 0 {
+		return nil
+	}
+	for _, pattern := range ucenter.C.RegistrationRedirectHosts {
+		if ok, _ := path.Match(pattern, u.Hostname()); ok {
+			return nil
+		}
+	}
+	return invalidRedirectURI("跳转链接 %s 的域名不在允许范围内", raw)
+}
+
+// checkSubjectType 校验 sub 类型。pairwise 应用登记了 sector_identifier_uri 时，其内容须为包含全部跳转链接的
+// JSON 数组；未登记时全部跳转链接须使用同一个域名作为扇区标识（OpenID Connect Registration 第 5 节）
+func checkSubjectType(subjectType, sectorURI string, redirectURIs []string) error {
+	switch subjectType {
+	case "", storage.SubjectTypePublic:
+		if sectorURI != "" {
+			return invalidClientMetadata("sector_identifier_uri 只适用于 pairwise 应用")
+		}
+		return nil
+	case storage.SubjectTypePairwise:
+		if ucenter.C.PairwiseSalt == "" {
+			return invalidClientMetadata("服务器未开启 pairwise")
+		}
+	default:
+		return invalidClientMetadata("不支持的 subject_type %s", subjectType)
+	}
+	if sectorURI == "" {
+		sector := ids.Sector("", redirectURIs)
+		for _, uri := range redirectURIs {
+			if ids.Sector("", []string{uri}) != sector {
+				return invalidClientMetadata("跳转链接使用了多个域名，pairwise 应用须提供 sector_identifier_uri")
+			}
+		}
+		return nil
+	}
+	if u, err := url.Parse(sectorURI); err != nil || u.Scheme != "https" || len(sectorURI) > 255 {
+		return invalidClientMetadata("sector_identifier_uri 必须是 https 链接")
+	}
+	// 不论连接失败、被拒绝还是内容无效都返回同样的错误，不透露目标地址的情况
+	resp, err := sectorClient.Get(sectorURI)
+	if err != nil {
+		return invalidClientMetadata("无法获取 sector_identifier_uri 中的跳转链接")
+	}
+	defer resp.Body.Close()
+	var listed []string
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(io.LimitReader(resp.Body, sectorMaxBytes)).Decode(&listed) != nil {
+		return invalidClientMetadata("无法获取 sector_identifier_uri 中的跳转链接")
+	}
+	for _, uri := range redirectURIs {
+		var ok bool
+		for _, l := range listed {
+			ok = ok || l == uri
+		}
+		if !ok {
+			return invalidClientMetadata("跳转链接 %s 不在 sector_identifier_uri 中", uri)
+		}
+	}
+	return nil
+}
+
+// checkRegistrationURI 应用主页、图标、协议等链接必须使用 https
+func checkRegistrationURI(name, raw string) error {
+	if raw == "" {
+		return nil
+	}
+	if u, err := url.Parse(raw); err != nil || u.Scheme != "https" || len(raw) > 255 {
+		return invalidClientMetadata("%s 必须是 https 链接", name)
+	}
+	return nil
+}
+
+// applyRegistration 校验注册策略并把元数据映射到应用上，更新时整体替换原有元数据（RFC 7592 第 2.2 节）
+func applyRegistration(client *storage.FositeClient, m *registrationMetadata) error {
+	name := registrationTemplate(m)
+	tpl, ok := ucenter.C.ClientTemplates[name]
+	if !ok {
+		return invalidClientMetadata("不支持注册 %s 类型的应用", name)
+	}
+	applyClientTemplate(client, name, tpl)
+
+	if m.TokenEndpointAuthMethod != "" {
+		client.TokenEndpointAuthMethod = m.TokenEndpointAuthMethod
+	}
+	switch client.TokenEndpointAuthMethod {
+	case "client_secret_basic", "client_secret_post", "none":
+	case "private_key_jwt":
+		if m.JSONWebKeys == nil && m.JSONWebKeysURI == "" {
+			return invalidClientMetadata("private_key_jwt 需要提供 jwks 或 jwks_uri")
+		}
+	case "tls_client_auth", "self_signed_tls_client_auth":
+		if ucenter.C.TLSCert == "" && ucenter.C.MTLSCertHeader == "" {
+			return invalidClientMetadata("服务器未开启 mTLS")
+		}
+		if client.TokenEndpointAuthMethod == "tls_client_auth" && m.TLSClientAuthSubjectDN == "" {
+			return invalidClientMetadata("tls_client_auth 需要提供 tls_client_auth_subject_dn")
+		}
+	default:
+		return invalidClientMetadata("不支持的认证方式 %s", client.TokenEndpointAuthMethod)
+	}
+	client.TLSClientAuthSubjectDN = m.TLSClientAuthSubjectDN
+
+	if len(m.GrantTypes) > 0 {
+		client.GrantTypes = m.GrantTypes
+	}
+	for _, gt := range client.GrantTypes {
+		var allowed bool
+		for _, a := range ucenter.C.RegistrationGrantTypes {
+			allowed = allowed || a == gt
+		}
+		if !allowed {
+			return invalidClientMetadata("不允许注册使用 %s 授权类型的应用", gt)
+		}
+	}
+	if len(m.ResponseTypes) > 0 {
+		client.ResponseTypes = m.ResponseTypes
+		grants := client.GetGrantTypes()
+		for _, rt := range m.ResponseTypes {
+			for _, t := range strings.Fields(rt) {
+				if (t == "code" && !grants.Has("authorization_code")) || ((t == "token" || t == "id_token") && !grants.Has("implicit")) {
+					return invalidClientMetadata("response_types 与 grant_types 不一致")
+				}
+			}
+		}
+	}
+
+	grants := client.GetGrantTypes()
+	if len(m.RedirectURIs) == 0 && (grants.Has("authorization_code") || grants.Has("implicit")) {
+		return invalidRedirectURI("缺少跳转链接")
+	}
+	for _, uri := range m.RedirectURIs {
+		if err := checkRegistrationRedirect(uri, client.TokenEndpointAuthMethod == "none"); err != nil {
+			return err
+		}
+	}
+	if err := checkRedirectURIPolicy(m.RedirectURIPolicy, m.RedirectURIs, client.TokenEndpointAuthMethod == "none"); err != nil {
+		return invalidRedirectURI("%s", err)
+	}
+	client.RedirectURIs = m.RedirectURIs
+	client.RedirectURIPolicy = m.RedirectURIPolicy
+
+	if err := checkSubjectType(m.SubjectType, m.SectorIdentifierURI, m.RedirectURIs); err != nil {
+		return err
+	}
+	client.SubjectType = m.SubjectType
+	client.SectorIdentifierURI = m.SectorIdentifierURI
+
+	// 退出后的跳转链接与登录跳转链接遵循同样的规则
+	for _, uri := range m.PostLogoutRedirectURIs {
+		if err := checkRegistrationRedirect(uri, client.TokenEndpointAuthMethod == "none"); err != nil {
+			return invalidClientMetadata("post_logout_redirect_uris：%s", err)
+		}
+	}
+
+	if m.Scope != "" {
+		if err := checkTemplateScope(client, m.Scope); err != nil {
+			return &registrationError{"invalid_client_metadata", err.Error()}
+		}
+		client.Scope = strings.Join(strings.Fields(m.Scope), " ")
+	}
+
+	for name, uri := range map[string]string{
+		"client_uri": m.ClientURI,
+		"logo_uri":   m.LogoURI,
+		"tos_uri":    m.TermsOfServiceURI,
+		"policy_uri": m.PolicyURI,
+		"jwks_uri":   m.JSONWebKeysURI,
+		// 退出通知由服务端发起，只允许 https
+		"backchannel_logout_uri": m.BackchannelLogoutURI,
+	} {
+		if err := checkRegistrationURI(name, uri); err != nil {
+			return err
+		}
+	}
+	for _, uri := range m.RequestURIs {
+		if err := checkRegistrationURI("request_uris", uri); err != nil {
+			return err
+		}
+	}
+	if m.JSONWebKeys != nil && m.JSONWebKeysURI != "" {
+		return invalidClientMetadata("jwks 与 jwks_uri 不能同时使用")
+	}
+	if err := jwe.Validate(m.IDTokenEncryptedResponseAlg, m.IDTokenEncryptedResponseEnc, m.JSONWebKeys); err != nil {
+		return invalidClientMetadata("ID Token 加密：%s", err)
+	}
+	if err := jwe.Validate(m.UserinfoEncryptedResponseAlg, m.UserinfoEncryptedResponseEnc, m.JSONWebKeys); err != nil {
+		return invalidClientMetadata("用户信息加密：%s", err)
+	}
+	if alg := m.UserinfoSignedResponseAlg; alg != "" && alg != "none" && alg != signingKeys.alg() {
+		return invalidClientMetadata("不支持的用户信息签名算法 %s", alg)
+	}
+	switch m.AccessTokenStrategy {
+	case "", storage.AccessTokenStrategyOpaque, storage.AccessTokenStrategyJWT:
+	default:
+		return invalidClientMetadata("不支持的访问令牌格式 %s", m.AccessTokenStrategy)
+	}
+
+	client.Name = m.ClientName
+	client.ClientURI = m.ClientURI
+	client.LogoURI = m.LogoURI
+	client.TermsOfServiceURI = m.TermsOfServiceURI
+	client.PolicyURI = m.PolicyURI
+	client.Contacts = m.Contacts
+	client.JSONWebKeysURI = m.JSONWebKeysURI
+	client.JSONWebKeys = m.JSONWebKeys
+	client.RequestURIs = m.RequestURIs
+	client.RequestObjectSigningAlgorithm = m.RequestObjectSigningAlg
+	client.UserinfoSignedResponseAlg = m.UserinfoSignedResponseAlg
+	client.IDTokenEncryptedResponseAlg = m.IDTokenEncryptedResponseAlg
+	client.IDTokenEncryptedResponseEnc = m.IDTokenEncryptedResponseEnc
+	client.UserinfoEncryptedResponseAlg = m.UserinfoEncryptedResponseAlg
+	client.UserinfoEncryptedResponseEnc = m.UserinfoEncryptedResponseEnc
+	client.AccessTokenStrategy = m.AccessTokenStrategy
+	client.PostLogoutRedirectURIs = m.PostLogoutRedirectURIs
+	client.BackchannelLogoutURI = m.BackchannelLogoutURI
+	client.BackchannelLogoutSessionRequired = m.BackchannelLogoutSession
+	client.RequirePushedAuthorizationRequests = m.RequirePAR
+	return nil
+}
+
+// issueRegistrationSecret 需要密钥的应用没有密钥时生成一个，返回明文
+func issueRegistrationSecret(client *storage.FositeClient) (string, error) {
+	if client.IsPublic() || client.UsesMTLS() || client.TokenEndpointAuthMethod == "private_key_jwt" {
+		client.Secret = ""
+		return "", nil
+	}
+	if client.Secret != "" {
+		return "", nil
+	}
+	secret, err := password.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	client.Secret = string(b)
+	return secret, nil
+}
+
+func newRegistrationResponse(client *storage.FositeClient, secret, token string) registrationResponse {
+	cli := *client
+	cli.Secret = secret
+	return registrationResponse{
+		FositeClient:            &cli,
+		ClientIDIssuedAt:        client.CreatedAt.Unix(),
+		RegistrationAccessToken: token,
+		RegistrationClientURI:   ucenter.Issuer() + "/oauth2/register/" + client.ClientID,
+	}
+}
+
+// registrationBearer 请求头中的 Bearer 令牌
+func registrationBearer(c *gin.Context) string {
+	parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return ""
+	}
+	return parts[1]
+}
+
+func registrationUnauthorized(c *gin.Context) {
+	c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+}
+
+// registerClient 动态注册应用（RFC 7591）
+func registerClient(c *gin.Context) {
+	if !ucenter.C.Registration {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if initial := ucenter.C.RegistrationInitialToken; initial != "" &&
+		subtle.ConstantTimeCompare([]byte(registrationBearer(c)), []byte(initial)) != 1 {
+		registrationUnauthorized(c)
+		return
+	}
+
+	var m registrationMetadata
+	if err := json.NewDecoder(c.Request.Body).Decode(&m); err != nil {
+		writeRegistrationError(c, invalidClientMetadata("请求体不是有效的 JSON"))
+		return
+	}
+	client := new(storage.FositeClient)
+	if err := applyRegistration(client, &m); err != nil {
+		writeRegistrationError(c, err)
+		return
+	}
+	secret, err := issueRegistrationSecret(client)
+	if err != nil {
+		writeRegistrationError(c, err)
+		return
+	}
+	token, err := password.GenerateSecret()
+	if err != nil {
+		writeRegistrationError(c, err)
+		return
+	}
+	if client.ClientID, err = genClientID(registrationOwner); err != nil {
+		writeRegistrationError(c, err)
+		return
+	}
+	client.Owner = registrationOwner
+	if ucenter.C.RegistrationApproval {
+		client.Status = storage.StatusOauthClientSuspended
+	}
+
+	tx := ucenter.DB.Begin()
+	if err := tx.Create(client).Error; err != nil {
+		tx.Rollback()
+		writeRegistrationError(c, err)
+		return
+	}
+	if err := tx.Create(&ucenter.ClientRegistration{
+		ClientID:  client.ClientID,
+		TokenHash: hashOTP(token),
+		IP:        clientIP(c),
+	}).Error; err != nil {
+		tx.Rollback()
+		writeRegistrationError(c, err)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		writeRegistrationError(c, err)
+		return
+	}
+	audit(c, 0, ucenter.AuditClientCreate, clientTarget(client.ClientID), "动态注册")
+	if ucenter.C.RegistrationApproval {
+		mailAdmins(adminUserIDs(), "动态注册应用待审核", fmt.Sprintf("管理员您好：\n\n应用 %s（%s）通过动态注册创建，审核通过后请在管理中心启用：\n%s\n\n%s",
+			client.Name, client.ClientID, mail.SiteURL("/admin/apps"), ucenter.C.SysName))
+	}
+	c.JSON(http.StatusCreated, newRegistrationResponse(client, secret, token))
+}
+
+// registeredClient 以注册访问令牌认证并读取动态注册的应用（RFC 7592）
+func registeredClient(c *gin.Context) {
+	token := registrationBearer(c)
+	if !ucenter.C.Registration || token == "" {
+		registrationUnauthorized(c)
+		return
+	}
+	var reg ucenter.ClientRegistration
+	if ucenter.DB.Where("client_id = ? AND token_hash = ?", c.Param("id"), hashOTP(token)).First(&reg).Error != nil {
+		registrationUnauthorized(c)
+		return
+	}
+	var client storage.FositeClient
+	if ucenter.DB.Where("client_id = ?", reg.ClientID).First(&client).Error != nil {
+		registrationUnauthorized(c)
+		return
+	}
+	c.Set(registeredClientKey, &client)
+}
+
+// readRegisteredClient 读取注册信息
+func readRegisteredClient(c *gin.Context) {
+	client := c.MustGet(registeredClientKey).(*storage.FositeClient)
+	c.JSON(http.StatusOK, newRegistrationResponse(client, "", ""))
+}
+
+// updateRegisteredClient 整体替换注册信息，应用 ID、密钥及审核状态保持不变
+func updateRegisteredClient(c *gin.Context) {
+	client := c.MustGet(registeredClientKey).(*storage.FositeClient)
+	var m registrationMetadata
+	if err := json.NewDecoder(c.Request.Body).Decode(&m); err != nil {
+		writeRegistrationError(c, invalidClientMetadata("请求体不是有效的 JSON"))
+		return
+	}
+	if m.ClientID != client.ClientID {
+		writeRegistrationError(c, invalidClientMetadata("client_id 与注册信息不一致"))
+		return
+	}
+	if err := applyRegistration(client, &m); err != nil {
+		writeRegistrationError(c, err)
+		return
+	}
+	secret, err := issueRegistrationSecret(client)
+	if err != nil {
+		writeRegistrationError(c, err)
+		return
+	}
+	if err := ucenter.DB.Save(client).Error; err != nil {
+		writeRegistrationError(c, err)
+		return
+	}
+	ucenter.DB.Model(ucenter.ClientRegistration{}).Where("client_id = ?", client.ClientID).UpdateColumn("updated_at", time.Now())
+	c.JSON(http.StatusOK, newRegistrationResponse(client, secret, ""))
+}
+
+// rotateRegisteredClientSecret 重置密钥，新密钥只返回一次。rotate=1 时旧密钥在宽限期内仍然有效，
+// 到期时间见响应中的 rotated_secret_expires_at
+func rotateRegisteredClientSecret(c *gin.Context) {
+	client := c.MustGet(registeredClientKey).(*storage.FositeClient)
+	if client.IsPublic() || client.UsesMTLS() || client.TokenEndpointAuthMethod == "private_key_jwt" {
+		writeRegistrationError(c, invalidClientMetadata("该应用不使用密钥认证"))
+		return
+	}
+	var grace time.Duration
+	if c.PostForm("rotate") == "1" {
+		grace = clientSecretGrace()
+	}
+	secret, err := rotateClientSecret(client, grace)
+	if err != nil {
+		writeRegistrationError(c, err)
+		return
+	}
+	audit(c, 0, ucenter.AuditClientSecret, clientTarget(client.ClientID), "动态注册")
+	c.JSON(http.StatusOK, newRegistrationResponse(client, secret, ""))
+}
+
+// deleteRegisteredClient 注销应用，用户对其的授权一并删除
+func deleteRegisteredClient(c *gin.Context) {
+	client := c.MustGet(registeredClientKey).(*storage.FositeClient)
+	tx := ucenter.DB.Begin()
+	err := tx.Delete(ucenter.UserAuthorized{}, "client_id = ?", client.ClientID).Error
+	if err == nil {
+		err = tx.Delete(storage.FositeClient{}, "client_id = ?", client.ClientID).Error
+	}
+	if err == nil {
+		err = tx.Delete(ucenter.ClientRegistration{}, "client_id = ?", client.ClientID).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		writeRegistrationError(c, err)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		writeRegistrationError(c, err)
+		return
+	}
+	audit(c, 0, ucenter.AuditClientDelete, clientTarget(client.ClientID), "动态注册")
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,241 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/mail"
+)
+
+// reportLock 生成报告时使用的 PostgreSQL advisory lock，多实例下每个周期只生成一份
+const reportLock = 0x75637270
+
+// reportMaxItems 每项内容最多列出的条目数
+const reportMaxItems = 50
+
+// reportExpiryWindow 列入报告的即将到期时间范围
+const reportExpiryWindow = time.Hour * 24 * 30
+
+// reportSection 报告中的一项内容
+type reportSection struct {
+	Kind  string   `json:"kind"`
+	Title string   `json:"title"`
+	Count int      `json:"count"`
+	Items []string `json:"items"`
+}
+
+// reportBuilders 可在 reports 中配置的报告内容
+var reportBuilders = map[string]func(since, now time.Time) (*reportSection, error){
+	"new_users":        newUsersReport,
+	"dormant_accounts": dormantAccountsReport,
+	"idle_clients":     idleClientsReport,
+	"key_expirations":  keyExpirationsReport,
+}
+
+func reportInactiveSince(now time.Time) time.Time {
+	return now.Add(-time.Hour * 24 * time.Duration(ucenter.C.ReportInactiveDays))
+}
+
+// addItem 超过 reportMaxItems 的条目只计数
+func (s *reportSection) addItem(format string, a ...interface{}) {
+	s.Count++
+	if len(s.Items) < reportMaxItems {
+		s.Items = append(s.Items, fmt.Sprintf(format, a...))
+	}
+}
+
+func newUsersReport(since, now time.Time) (*reportSection, error) {
+	s := &reportSection{Title: "新注册用户"}
+	var users []ucenter.User
+	if err := ucenter.DB.Where("created_at >= ? AND created_at < ?", since, now).Order("id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for i := range users {
+		s.addItem("%s（ID %d）%s", users[i].Username, users[i].ID, users[i].CreatedAt.Format("2006-01-02 15:04"))
+	}
+	return s, nil
+}
+
+func dormantAccountsReport(since, now time.Time) (*reportSection, error) {
+	s := &reportSection{Title: fmt.Sprintf("超过 %d 天未登录的账户", ucenter.C.ReportInactiveDays)}
+	var users []ucenter.User
+	if err := ucenter.DB.Where("status = 0 AND COALESCE(last_login_at, created_at) < ?", reportInactiveSince(now)).
+		Order("COALESCE(last_login_at, created_at)").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for i := range users {
+		last := "从未登录"
+		if users[i].LastLoginAt != nil {
+			last = "最近登录 " + users[i].LastLoginAt.Format("2006-01-02")
+		}
+		s.addItem("%s（ID %d）%s", users[i].Username, users[i].ID, last)
+	}
+	return s, nil
+}
+
+func idleClientsReport(since, now time.Time) (*reportSection, error) {
+	s := &reportSection{Title: fmt.Sprintf("超过 %d 天未签发令牌的应用", ucenter.C.ReportInactiveDays)}
+	cutoff := reportInactiveSince(now)
+	lastUsed, err := oauth2store.(*storage.FositeStore).ClientsLastUsed()
+	if err != nil {
+		return nil, err
+	}
+	var clients []storage.FositeClient
+	if err := ucenter.DB.Where("status <> ? AND created_at < ?", storage.StatusOauthClientSuspended, cutoff).
+		Order("created_at").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	for i := range clients {
+		last, ok := lastUsed[clients[i].ClientID]
+		if ok && last.After(cutoff) {
+			continue
+		}
+		desc := "从未使用"
+		if ok {
+			desc = "最近使用 " + last.Format("2006-01-02")
+		}
+		s.addItem("%s（%s）%s", clients[i].Name, clients[i].ClientID, desc)
+	}
+	return s, nil
+}
+
+func keyExpirationsReport(since, now time.Time) (*reportSection, error) {
+	s := &reportSection{Title: fmt.Sprintf("%d 天内到期的密钥", int(reportExpiryWindow.Hours()/24))}
+	until := now.Add(reportExpiryWindow)
+	var active ucenter.SigningKey
+	if ucenter.C.SigningKeyRotationDays > 0 && ucenter.DB.Where("retired_at IS NULL").Order("id desc").First(&active).Error == nil {
+		if rotate := active.CreatedAt.Add(time.Duration(ucenter.C.SigningKeyRotationDays) * 24 * time.Hour); rotate.Before(until) {
+			s.addItem("签名密钥 %s 将于 %s 自动轮换", active.KID, rotate.Format("2006-01-02"))
+		}
+	}
+	var clients []storage.FositeClient
+	if err := ucenter.DB.Where("secret_expires_at > 0 AND secret_expires_at < ?", until.Unix()).
+		Order("secret_expires_at").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	for i := range clients {
+		expires := time.Unix(int64(clients[i].SecretExpiresAt), 0)
+		state := "将于"
+		if expires.Before(now) {
+			state = "已于"
+		}
+		s.addItem("应用 %s（%s）的密钥%s %s 过期", clients[i].Name, clients[i].ClientID, state, expires.Format("2006-01-02"))
+	}
+	return s, nil
+}
+
+// buildReport 按 reports 配置的顺序生成各项内容
+func buildReport(since, now time.Time) ([]*reportSection, error) {
+	var sections []*reportSection
+	for _, kind := range ucenter.C.Reports {
+		build, ok := reportBuilders[kind]
+		if !ok {
+			return nil, fmt.Errorf("未知的报告内容 %s", kind)
+		}
+		s, err := build(since, now)
+		if err != nil {
+			return nil, err
+		}
+		s.Kind = kind
+		sections = append(sections, s)
+	}
+	return sections, nil
+}
+
+// renderReport 邮件正文
+func renderReport(since, now time.Time, sections []*reportSection) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "管理员您好：\n\n以下是 %s 至 %s 的用户报告。\n", since.Format("2006-01-02 15:04"), now.Format("2006-01-02 15:04"))
+	for _, s := range sections {
+		fmt.Fprintf(&b, "\n%s：%d\n", s.Title, s.Count)
+		for _, item := range s.Items {
+			b.WriteString("- " + item + "\n")
+		}
+		if more := s.Count - len(s.Items); more > 0 {
+			fmt.Fprintf(&b, "……另有 %d 项\n", more)
+		}
+	}
+	fmt.Fprintf(&b, "\n管理中心：%s\n\n%s", mail.SiteURL("/admin/"), ucenter.C.SysName)
+	return b.String()
+}
+
+// reportJob 每隔 report_interval_days 天生成一份报告，发送给管理员并推送到 report_webhook
+func reportJob() error {
+	if len(ucenter.C.Reports) == 0 || ucenter.C.ReportIntervalDays <= 0 {
+		return nil
+	}
+	interval := time.Hour * 24 * time.Duration(ucenter.C.ReportIntervalDays)
+	tx := ucenter.DB.Begin()
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", reportLock).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now()
+	since := now.Add(-interval)
+	var last ucenter.Report
+	if tx.Order("id desc").First(&last).Error == nil {
+		if now.Sub(last.CreatedAt) < interval {
+			tx.Rollback()
+			return nil
+		}
+		since = last.CreatedAt
+	}
+	sections, err := buildReport(since, now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	report := ucenter.Report{Since: since, Content: renderReport(since, now, sections), CreatedAt: now}
+	if err := tx.Create(&report).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("%s 用户报告 %s", ucenter.C.SysName, now.Format("2006-01-02"))
+	if len(ucenter.C.ReportRecipients) > 0 {
+		for _, to := range ucenter.C.ReportRecipients {
+			if !mail.Enabled() {
+				break
+			}
+			if err := mail.Send(to, subject, report.Content); err != nil {
+				log.Printf("report mail %s: %s", to, err)
+			}
+		}
+	} else {
+		mailAdmins(adminUserIDs(), subject, report.Content)
+	}
+	return pushReport(&report, now, sections)
+}
+
+// pushReport 以 JSON 推送报告，失败不重试
+func pushReport(report *ucenter.Report, now time.Time, sections []*reportSection) error {
+	if ucenter.C.ReportWebhook == "" {
+		return nil
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"issuer":   ucenter.Issuer(),
+		"id":       report.ID,
+		"since":    report.Since,
+		"until":    now,
+		"sections": sections,
+	})
+	resp, err := http.Post(ucenter.C.ReportWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("报告推送失败: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/iplist"
+	"github.com/naiba/ucenter/pkg/reputation"
+)
+
+var ipReputation reputation.Checker
+
+// ipReputationScore 来源 IP 的信誉评分，未配置或查询出错时视为无记录，不影响登录
+func ipReputationScore(ip string) reputation.Result {
+	if ipReputation == nil {
+		return reputation.Result{}
+	}
+	if addr := net.ParseIP(ip); addr == nil || addr.IsLoopback() || iplist.Contains(ip, ucenter.C.IPReputationExemptIPs) {
+		return reputation.Result{}
+	}
+	r, err := ipReputation.Check(ip)
+	if err != nil {
+		log.Printf("查询 IP %s 信誉出错: %v", ip, err)
+		return reputation.Result{}
+	}
+	return r
+}
+
+// reputationDenied 来源 IP 评分达到拦截阈值时返回提示信息，达到标记阈值时记入审计日志后放行
+func reputationDenied(c *gin.Context, action string) string {
+	r := ipReputationScore(clientIP(c))
+	if r.Score == 0 {
+		return ""
+	}
+	if block := ucenter.C.IPReputationBlock; block > 0 && r.Score >= block {
+		audit(c, 0, ucenter.AuditIPFlagged, "ip:"+clientIP(c), fmt.Sprintf("拦截%s，评分 %d：%s", action, r.Score, r.Reason))
+		return "您的网络环境存在风险，暂不提供服务"
+	}
+	if flag := ucenter.C.IPReputationFlag; flag > 0 && r.Score >= flag {
+		audit(c, 0, ucenter.AuditIPFlagged, "ip:"+clientIP(c), fmt.Sprintf("%s，评分 %d：%s", action, r.Score, r.Reason))
+	}
+	return ""
+}
+
+// reputationChallenge 来源 IP 评分达到人机验证阈值
+func reputationChallenge(ip string) bool {
+	challenge := ucenter.C.IPReputationChallenge
+	return challenge > 0 && ipReputationScore(ip).Score >= challenge
+}
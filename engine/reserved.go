@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// defaultReservedUsernames 首次启动时写入的保留用户名
+var defaultReservedUsernames = []string{
+	"admin", "administrator", "root", "system", "api", "oauth", "oauth2", "openid",
+	"login", "logout", "signup", "register", "user", "users", "app", "apps",
+	"static", "upload", "support", "help", "security", "webmaster", "postmaster",
+}
+
+// initReservedUsernames 保留用户名表为空时写入默认值
+func initReservedUsernames() {
+	var count int
+	ucenter.DB.Model(ucenter.ReservedUsername{}).Count(&count)
+	if count > 0 {
+		return
+	}
+	for _, name := range defaultReservedUsernames {
+		ucenter.DB.Create(&ucenter.ReservedUsername{Pattern: name})
+	}
+}
+
+// usernameReserved 用户名是否被保留，不区分大小写
+func usernameReserved(username string) bool {
+	var list []ucenter.ReservedUsername
+	ucenter.DB.Find(&list)
+	username = strings.ToLower(username)
+	for _, r := range list {
+		if !r.IsRegex {
+			if strings.ToLower(r.Pattern) == username {
+				return true
+			}
+			continue
+		}
+		re, err := regexp.Compile("(?i)^(?:" + r.Pattern + ")$")
+		if err != nil {
+			log.Printf("reserved username pattern %q: %s", r.Pattern, err)
+			continue
+		}
+		if re.MatchString(username) {
+			return true
+		}
+	}
+	return false
+}
+
+func adminReserved(c *gin.Context) {
+	var list []ucenter.ReservedUsername
+	ucenter.DB.Order("is_regex asc, pattern asc").Find(&list)
+	c.HTML(http.StatusOK, "admin/reserved", nbgin.Data(c, gin.H{
+		"reserved": list,
+	}))
+}
+
+func addReserved(c *gin.Context) {
+	type reservedForm struct {
+		Pattern string `form:"pattern" binding:"required,min=1,max=255"`
+		IsRegex bool   `form:"is_regex"`
+	}
+
+	var rf reservedForm
+	if err := c.ShouldBind(&rf); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	if rf.IsRegex {
+		if _, err := regexp.Compile(rf.Pattern); err != nil {
+			c.String(http.StatusForbidden, "正则表达式无效："+err.Error())
+			return
+		}
+	} else {
+		rf.Pattern = strings.ToLower(rf.Pattern)
+	}
+	if err := ucenter.DB.Create(&ucenter.ReservedUsername{Pattern: rf.Pattern, IsRegex: rf.IsRegex}).Error; err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+	}
+}
+
+func deleteReserved(c *gin.Context) {
+	if err := ucenter.DB.Delete(ucenter.ReservedUsername{}, "id = ?", c.Param("id")).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
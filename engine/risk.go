@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/iplist"
+)
+
+// 人机验证模式
+const (
+	captchaAlways   = "always"
+	captchaAdaptive = "adaptive"
+)
+
+// riskScore 登录、注册请求的风险评分：近期登录失败次数，来自标记网段或 IP 信誉较差时直接达到阈值
+func riskScore(ip, username string) int {
+	threshold := ucenter.C.CaptchaFreeAttempts
+	if iplist.Contains(ip, ucenter.C.CaptchaFlaggedIPs) || reputationChallenge(ip) {
+		return threshold
+	}
+	since := time.Now().Add(-loginFailureWindow())
+	var score int
+	for field, value := range map[string]string{"ip": ipKey(ip), "username": username} {
+		if value == "" {
+			continue
+		}
+		var n int
+		ucenter.DB.Model(ucenter.LoginAttempt{}).Where(field+" = ? AND created_at > ?", value, since).Count(&n)
+		score += n
+	}
+	return score
+}
+
+// captchaRequired 是否需要人机验证，自适应模式下风险评分达到免验证次数才需要
+func captchaRequired(ip, username string) bool {
+	if ucenter.C.CaptchaMode != captchaAdaptive {
+		return true
+	}
+	return riskScore(ip, username) >= ucenter.C.CaptchaFreeAttempts
+}
+
+// passCaptcha 无需人机验证或已通过验证
+func passCaptcha(c *gin.Context, username string) bool {
+	return !captchaRequired(clientIP(c), username) || verifyCaptcha(c)
+}
@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/mail"
+	"github.com/naiba/ucenter/pkg/ram"
+)
+
+// isAdminRole 角色是否拥有管理面板权限
+func isAdminRole(role, domain string) bool {
+	return ucenter.RAM.Enforce(role, domain, ram.DefaultProject, ram.PolicyAdminPanel)
+}
+
+// adminUserIDs 拥有管理员级角色的用户
+func adminUserIDs() map[uint]bool {
+	ids := make(map[uint]bool)
+	for _, g := range ucenter.RAM.GetGroupingPolicy() {
+		if len(g) < 3 || !isAdminRole(g[1], g[2]) {
+			continue
+		}
+		if uid, err := strconv.ParseUint(g[0], 10, 64); err == nil {
+			ids[uint(uid)] = true
+		}
+	}
+	return ids
+}
+
+// grantRole 授予角色并留存记录，管理员级角色通知现有管理员
+func grantRole(uid uint, role, domain string, by uint, justification string) error {
+	justification = strings.TrimSpace(justification)
+	if justification == "" {
+		return errors.New("必须填写授权理由")
+	}
+	admin := isAdminRole(role, domain)
+	admins := adminUserIDs()
+	if err := ucenter.DB.Create(&ucenter.RoleGrant{
+		UserID:        uid,
+		Role:          role,
+		Domain:        domain,
+		GrantedBy:     by,
+		Justification: justification,
+	}).Error; err != nil {
+		return err
+	}
+	ucenter.RAM.AddRoleForUserInDomain(strconv.FormatUint(uint64(uid), 10), role, domain)
+	if admin {
+		delete(admins, uid)
+		notifyRoleGrant(admins, uid, role, by, justification)
+	}
+	return nil
+}
+
+// notifyRoleGrant 邮件通知现有管理员
+func notifyRoleGrant(admins map[uint]bool, uid uint, role string, by uint, justification string) {
+	if len(admins) == 0 || !mail.Enabled() {
+		return
+	}
+	var grantee, granter ucenter.User
+	ucenter.DB.First(&grantee, "id = ?", uid)
+	granterName := "系统"
+	if by != 0 && ucenter.DB.First(&granter, "id = ?", by).Error == nil {
+		granterName = granter.Username
+	}
+	body := fmt.Sprintf("管理员您好：\n\n%s 于 %s 将管理员级角色 %s 授予了用户 %s（ID %d）。\n\n理由：%s\n\n如果这不是预期的操作，请立即登录管理中心核查：\n%s\n\n%s",
+		granterName, time.Now().Format("2006-01-02 15:04"), role, grantee.Username, uid, justification,
+		mail.SiteURL("/admin/users"), ucenter.C.SysName)
+	mailAdmins(admins, "管理员权限授予提醒", body)
+}
+
+// mailAdmins 邮件通知管理员
+func mailAdmins(admins map[uint]bool, subject, body string) {
+	if len(admins) == 0 || !mail.Enabled() {
+		return
+	}
+	ids := make([]uint, 0, len(admins))
+	for id := range admins {
+		ids = append(ids, id)
+	}
+	var users []ucenter.User
+	ucenter.DB.Where("id IN (?)", ids).Find(&users)
+	for i := range users {
+		if users[i].Email == "" {
+			continue
+		}
+		go func(to string, id uint) {
+			if err := mail.Send(to, subject, body); err != nil {
+				log.Printf("admin mail %d: %s", id, err)
+			}
+		}(string(users[i].Email), users[i].ID)
+	}
+}
+
+// adminGrantRole 管理中心授予管理员角色
+func adminGrantRole(c *gin.Context) {
+	type grantRoleForm struct {
+		ID            uint   `form:"id" binding:"required,min=1"`
+		Justification string `form:"justification" binding:"required,max=1000"`
+	}
+
+	var gf grantRoleForm
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	err := c.ShouldBind(&gf)
+	if err == nil {
+		err = ucenter.DB.First(&ucenter.User{}, "id = ?", gf.ID).Error
+	}
+	if err == nil {
+		err = grantRole(gf.ID, ram.RoleSuperAdmin, ram.DefaultDomain, u.ID, gf.Justification)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+	}
+}
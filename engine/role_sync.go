@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"path"
+	"strconv"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/ram"
+)
+
+type provisionedKey struct {
+	role   string
+	domain string
+}
+
+// identityClaims 外部账户的 claims，ID Token 中缺少角色规则用到的 claim 时再查询 UserInfo
+func identityClaims(ctx context.Context, provider *oidc.Provider, token *oauth2.Token, idToken *oidc.IDToken, rules []ucenter.RoleRule) map[string]interface{} {
+	claims := make(map[string]interface{})
+	idToken.Claims(&claims)
+	var missing bool
+	for _, r := range rules {
+		if _, ok := claims[r.Claim]; !ok {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return claims
+	}
+	info, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return claims
+	}
+	extra := make(map[string]interface{})
+	if info.Claims(&extra) == nil && extra["sub"] == idToken.Subject {
+		for k, v := range extra {
+			if _, ok := claims[k]; !ok {
+				claims[k] = v
+			}
+		}
+	}
+	return claims
+}
+
+// claimValues claim 的字符串取值，兼容字符串及字符串数组
+func claimValues(v interface{}) []string {
+	switch x := v.(type) {
+	case string:
+		return []string{x}
+	case []interface{}:
+		values := make([]string, 0, len(x))
+		for _, item := range x {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// syncProvisionedRoles 按提供方的角色规则增删该提供方授予过的角色，手动授予的角色不受影响
+func syncProvisionedRoles(c *gin.Context, uid uint, provider string, claims map[string]interface{}) {
+	conf := ucenter.C.IdentityProviders[provider]
+	want := make(map[provisionedKey]string)
+	for _, r := range conf.RoleRules {
+		k := provisionedKey{role: r.Role, domain: r.Domain}
+		if k.domain == "" {
+			k.domain = ram.DefaultDomain
+		}
+		for _, v := range claimValues(claims[r.Claim]) {
+			if ok, _ := path.Match(r.Value, v); ok {
+				want[k] = r.Claim + "=" + v
+				break
+			}
+		}
+	}
+
+	sub := strconv.FormatUint(uint64(uid), 10)
+	var current []ucenter.ProvisionedRole
+	ucenter.DB.Where("user_id = ? AND provider = ?", uid, provider).Find(&current)
+	have := make(map[provisionedKey]bool)
+	for i := range current {
+		k := provisionedKey{role: current[i].Role, domain: current[i].Domain}
+		if _, ok := want[k]; ok {
+			have[k] = true
+			// 被手动移除的角色以外部账户为准重新加上
+			if !ucenter.RAM.HasGroupingPolicy(sub, k.role, k.domain) {
+				ucenter.RAM.AddRoleForUserInDomain(sub, k.role, k.domain)
+			}
+			continue
+		}
+		ucenter.RAM.RemoveGroupingPolicy(sub, k.role, k.domain)
+		ucenter.DB.Delete(&current[i])
+		audit(c, uid, ucenter.AuditRoleSync, userTarget(uid), "移除角色 "+k.role+"@"+k.domain)
+	}
+
+	title := conf.Title
+	if title == "" {
+		title = provider
+	}
+	for k, reason := range want {
+		// 已手动授予的角色不由外部账户接管
+		if have[k] || ucenter.RAM.HasGroupingPolicy(sub, k.role, k.domain) {
+			continue
+		}
+		if err := grantRole(uid, k.role, k.domain, 0, "外部账户 "+title+" 的 "+reason); err != nil {
+			log.Printf("role sync %d %s: %s", uid, k.role, err)
+			continue
+		}
+		ucenter.DB.Create(&ucenter.ProvisionedRole{
+			UserID:   uid,
+			Provider: provider,
+			Role:     k.role,
+			Domain:   k.domain,
+		})
+		audit(c, uid, ucenter.AuditRoleSync, userTarget(uid), "授予角色 "+k.role+"@"+k.domain+"（"+reason+"）")
+	}
+}
+
+// revokeProvisionedRoles 删除用户时收回自动授予的角色
+func revokeProvisionedRoles(uid uint) {
+	sub := strconv.FormatUint(uint64(uid), 10)
+	var current []ucenter.ProvisionedRole
+	ucenter.DB.Where("user_id = ?", uid).Find(&current)
+	for _, p := range current {
+		ucenter.RAM.RemoveGroupingPolicy(sub, p.Role, p.Domain)
+	}
+	ucenter.DB.Delete(ucenter.ProvisionedRole{}, "user_id = ?", uid)
+}
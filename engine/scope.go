@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// scopeNamePattern RFC 6749 3.3 节的 scope-token
+var scopeNamePattern = regexp.MustCompile(`^[\x21\x23-\x5b\x5d-\x7e]+$`)
+
+// scopeIconPattern Semantic UI 图标名称
+var scopeIconPattern = regexp.MustCompile(`^[a-z]+( [a-z]+)*$`)
+
+// builtinScopeMeta 内置 scope 的默认展示信息
+var builtinScopeMeta = map[string]ucenter.Scope{
+	"openid":  {DisplayName: "基本信息", Icon: "id card outline"},
+	"profile": {DisplayName: "个人资料", Icon: "user outline"},
+	"email":   {DisplayName: "邮箱地址", Icon: "envelope outline", Sensitive: true},
+	"phone":   {DisplayName: "手机号码", Icon: "phone", Sensitive: true},
+}
+
+// initScopes 写入 scope 表中尚不存在的内置及配置文件中的自定义 scope，已有的保留管理员的修改
+func initScopes() {
+	for name, desc := range ucenter.Scopes {
+		var count int
+		ucenter.DB.Model(ucenter.Scope{}).Where("name = ?", name).Count(&count)
+		if count > 0 {
+			continue
+		}
+		s := builtinScopeMeta[name]
+		s.Name = name
+		s.Description = desc
+		if s.DisplayName == "" {
+			s.DisplayName = name
+		}
+		if s.Icon == "" {
+			s.Icon = "key"
+		}
+		ucenter.DB.Create(&s)
+	}
+}
+
+// registeredScopes 已登记的 scope，授权请求只能申请其中的 scope
+func registeredScopes() map[string]ucenter.Scope {
+	var list []ucenter.Scope
+	ucenter.DB.Find(&list)
+	scopes := make(map[string]ucenter.Scope, len(list))
+	for _, s := range list {
+		scopes[s.Name] = s
+	}
+	return scopes
+}
+
+func adminScopes(c *gin.Context) {
+	var list []ucenter.Scope
+	ucenter.DB.Order("name asc").Find(&list)
+	c.HTML(http.StatusOK, "admin/scopes", nbgin.Data(c, gin.H{
+		"scopes":  list,
+		"builtin": ucenter.Scopes,
+	}))
+}
+
+// editScope 按名称新建或修改 scope
+func editScope(c *gin.Context) {
+	type scopeForm struct {
+		Name        string `form:"name" binding:"required,max=64"`
+		DisplayName string `form:"display_name" binding:"required,max=64"`
+		Description string `form:"description" binding:"max=255"`
+		Icon        string `form:"icon" binding:"max=64"`
+		Sensitive   bool   `form:"sensitive"`
+	}
+
+	var sf scopeForm
+	if err := c.ShouldBind(&sf); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	if !scopeNamePattern.MatchString(sf.Name) {
+		c.String(http.StatusForbidden, "scope 名称不能包含空格、双引号或反斜杠")
+		return
+	}
+	if sf.Icon == "" {
+		sf.Icon = "key"
+	}
+	if !scopeIconPattern.MatchString(sf.Icon) {
+		c.String(http.StatusForbidden, "图标名称只能包含小写字母和空格")
+		return
+	}
+
+	var s ucenter.Scope
+	if err := ucenter.DB.Where(ucenter.Scope{Name: sf.Name}).FirstOrInit(&s).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.DisplayName = sf.DisplayName
+	s.Description = sf.Description
+	s.Icon = sf.Icon
+	s.Sensitive = sf.Sensitive
+	if err := ucenter.DB.Save(&s).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+// deleteScope 删除 scope，已签发的令牌不受影响；内置及配置文件中的 scope 不能删除
+func deleteScope(c *gin.Context) {
+	var s ucenter.Scope
+	if err := ucenter.DB.First(&s, "id = ?", c.Param("id")).Error; err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	if _, ok := ucenter.Scopes[s.Name]; ok {
+		c.String(http.StatusForbidden, "内置及配置文件中的 scope 不能删除")
+		return
+	}
+	if isDryRun(c) {
+		d := newDryRunImpact()
+		var clients []storage.FositeClient
+		if err := ucenter.DB.Select("client_id").Where("? = ANY(string_to_array(scope, ' '))", s.Name).Find(&clients).Error; err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		d.count("clients", len(clients))
+		for i := range clients {
+			d.addClient(clients[i].ClientID)
+		}
+		if err := d.countRows("authorizations", ucenter.UserAuthorized{}, "? = ANY(scope)", s.Name); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		writeDryRun(c, d)
+		return
+	}
+	if err := ucenter.DB.Delete(&s).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/mail"
+)
+
+// 一封摘要中最多列出的事件数
+const alertDigestMaxItems = 20
+
+// alertCooldown 同类提醒的最短间隔，负数表示不发送
+func alertCooldown(event string) time.Duration {
+	minutes := ucenter.C.SecurityAlertCooldown
+	if v, ok := ucenter.C.SecurityAlertCooldowns[event]; ok {
+		minutes = v
+	}
+	return time.Minute * time.Duration(minutes)
+}
+
+// notifySecurity 记录安全事件；冷却期内已提醒过的事件留待摘要任务合并发送
+func notifySecurity(u *ucenter.User, event, detail string) {
+	cooldown := alertCooldown(event)
+	if cooldown < 0 || u.Email == "" || !mail.Enabled() {
+		return
+	}
+	if err := ucenter.DB.Create(&ucenter.SecurityAlert{UserID: u.ID, Event: event, Detail: detail}).Error; err != nil {
+		log.Printf("security alert %s: %s", u.StrID(), err)
+		return
+	}
+	if !alertCoolingDown(u.ID, event, cooldown) {
+		uid := u.ID
+		enqueueJob("security-alert", func() error {
+			return flushSecurityAlerts(uid, event)
+		})
+	}
+}
+
+// alertCoolingDown 冷却期内是否已发送过同类提醒
+func alertCoolingDown(uid uint, event string, cooldown time.Duration) bool {
+	var sent int
+	ucenter.DB.Model(ucenter.SecurityAlert{}).
+		Where("user_id = ? AND event = ? AND sent_at > ?", uid, event, time.Now().Add(-cooldown)).Count(&sent)
+	return sent > 0
+}
+
+// flushSecurityAlerts 将用户某类待发送的事件合并为一封邮件
+func flushSecurityAlerts(uid uint, event string) error {
+	var alerts []ucenter.SecurityAlert
+	if err := ucenter.DB.Where("user_id = ? AND event = ? AND sent_at IS NULL", uid, event).
+		Order("created_at").Find(&alerts).Error; err != nil {
+		return err
+	}
+	if len(alerts) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(alerts))
+	for i := range alerts {
+		ids[i] = alerts[i].ID
+	}
+	// 先占用，并发的摘要任务不会重复发送
+	db := ucenter.DB.Model(ucenter.SecurityAlert{}).Where("id IN (?) AND sent_at IS NULL", ids).
+		UpdateColumn("sent_at", time.Now())
+	if db.Error != nil || db.RowsAffected == 0 {
+		return db.Error
+	}
+	var u ucenter.User
+	if err := ucenter.DB.First(&u, "id = ?", uid).Error; err != nil || u.Email == "" {
+		return nil
+	}
+
+	title := ucenter.AlertEvents[event]
+	if len(alerts) == 1 {
+		return mail.Send(string(u.Email), title+"提醒", fmt.Sprintf("%s 您好：\n\n%s\n%s\n\n%s",
+			u.Username, alerts[0].CreatedAt.Format("2006-01-02 15:04"), alerts[0].Detail, ucenter.C.SysName))
+	}
+	var items []string
+	for i := range alerts {
+		if i == alertDigestMaxItems {
+			items = append(items, fmt.Sprintf("……另有 %d 次未列出", len(alerts)-i))
+			break
+		}
+		items = append(items, alerts[i].CreatedAt.Format("2006-01-02 15:04")+"\n"+alerts[i].Detail)
+	}
+	return mail.Send(string(u.Email), fmt.Sprintf("%s提醒（%d 次）", title, len(alerts)), fmt.Sprintf(
+		"%s 您好：\n\n自 %s 以来，您的账户共发生 %d 次%s：\n\n%s\n\n如果其中有不是您本人的操作，请尽快修改密码并在「登录设备」中下线可疑设备。\n\n%s",
+		u.Username, alerts[0].CreatedAt.Format("2006-01-02 15:04"), len(alerts), title,
+		strings.Join(items, "\n\n"), ucenter.C.SysName))
+}
+
+// securityAlertJob 冷却期结束后发送积攒的摘要，并清理旧记录
+func securityAlertJob() error {
+	var pending []ucenter.SecurityAlert
+	if err := ucenter.DB.Select("DISTINCT user_id, event").Where("sent_at IS NULL").Find(&pending).Error; err != nil {
+		return err
+	}
+	for _, p := range pending {
+		cooldown := alertCooldown(p.Event)
+		if cooldown < 0 {
+			ucenter.DB.Delete(ucenter.SecurityAlert{}, "user_id = ? AND event = ? AND sent_at IS NULL", p.UserID, p.Event)
+			continue
+		}
+		if alertCoolingDown(p.UserID, p.Event, cooldown) {
+			continue
+		}
+		if err := flushSecurityAlerts(p.UserID, p.Event); err != nil {
+			log.Printf("security alert %d %s: %s", p.UserID, p.Event, err)
+		}
+	}
+	return ucenter.DB.Delete(ucenter.SecurityAlert{}, "sent_at < ?", time.Now().AddDate(0, 0, -30)).Error
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+)
+
+// setBrowserState 写入浏览器状态 Cookie（OpenID Connect Session Management 第 3 节），登录时为终端的 sid，
+// 退出时清除。check_session_iframe 嵌在应用的页面中，需允许跨站读取
+func setBrowserState(c *gin.Context, token string) {
+	cookie := &http.Cookie{
+		Name:     ucenter.BrowserStateCookieName,
+		Path:     "/",
+		Domain:   ucenter.C.Domain,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if ucenter.C.WebProtocol == "https" {
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Value = loginSID(token)
+		cookie.MaxAge = 60 * 60 * 24 * 365 * 2
+	}
+	http.SetCookie(c.Writer, cookie)
+}
+
+// sessionState 应用据此检测登录状态的变化：sha256(client_id + " " + origin + " " + 浏览器状态 + " " + salt) + "." + salt
+func sessionState(clientID, origin, browserState string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	salt := hex.EncodeToString(b)
+	sum := sha256.Sum256([]byte(clientID + " " + origin + " " + browserState + " " + salt))
+	return hex.EncodeToString(sum[:]) + "." + salt, nil
+}
+
+// addSessionState OpenID Connect 授权响应中附上 session_state，并刷新浏览器状态 Cookie
+func addSessionState(c *gin.Context, ar fosite.AuthorizeRequester, response fosite.AuthorizeResponder) error {
+	l, ok := c.Get(ucenter.AuthLogin)
+	if !ok || !ar.GetGrantedScopes().Has("openid") {
+		return nil
+	}
+	token := l.(*ucenter.Login).Token
+	redirect := ar.GetRedirectURI()
+	state, err := sessionState(ar.GetClient().GetID(), fmt.Sprintf("%s://%s", redirect.Scheme, redirect.Host), loginSID(token))
+	if err != nil {
+		return err
+	}
+	setBrowserState(c, token)
+	if len(response.GetFragment()) > 0 {
+		response.AddFragment("session_state", state)
+	} else {
+		response.AddQuery("session_state", state)
+	}
+	return nil
+}
+
+// checkSessionIframe 应用以隐藏 iframe 嵌入，通过 postMessage 发送 "client_id session_state"，
+// 页面按来源重新计算，返回 unchanged、changed 或 error
+func checkSessionIframe(c *gin.Context) {
+	c.HTML(http.StatusOK, "page/check_session", gin.H{
+		"cookie": ucenter.BrowserStateCookieName,
+	})
+}
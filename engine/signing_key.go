@@ -0,0 +1,366 @@
+package engine
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	jwt2 "github.com/dgrijalva/jwt-go"
+	"github.com/ory/fosite/token/jwt"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/pii"
+)
+
+// legacyKID 配置文件中系统私钥导入后的 kid，升级前签发、没有 kid 的令牌也用它校验
+const legacyKID = "1"
+
+// signingKeyLock 轮换密钥时使用的 PostgreSQL advisory lock，避免多个实例同时轮换
+const signingKeyLock = 0x75636b72
+
+type signingKey struct {
+	kid     string
+	alg     string
+	method  jwt2.SigningMethod
+	private interface{}
+	public  interface{}
+	retired bool
+}
+
+// keyStore 数据库中未过期的签名密钥，实现 fosite 的 JWTStrategy：以当前密钥签名，按 kid 选择密钥校验
+type keyStore struct {
+	sync.RWMutex
+	// keys 未退役的密钥在前
+	keys     []*signingKey
+	loadedAt time.Time
+}
+
+var signingKeys = new(keyStore)
+
+var _ jwt.JWTStrategy = signingKeys
+
+func parseSigningKey(k *ucenter.SigningKey) (*signingKey, error) {
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("签名密钥 %s 格式错误", k.KID)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	sk := &signingKey{kid: k.KID, alg: k.Alg, private: priv, retired: k.RetiredAt != nil}
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		sk.method, sk.public = jwt2.SigningMethodRS256, &key.PublicKey
+	case *ecdsa.PrivateKey:
+		sk.method, sk.public = jwt2.SigningMethodES256, &key.PublicKey
+	default:
+		return nil, fmt.Errorf("签名密钥 %s 类型不支持", k.KID)
+	}
+	if sk.method.Alg() != k.Alg {
+		return nil, fmt.Errorf("签名密钥 %s 与算法 %s 不符", k.KID, k.Alg)
+	}
+	return sk, nil
+}
+
+// load 从数据库重新加载未过期的密钥
+func (s *keyStore) load() error {
+	var rows []ucenter.SigningKey
+	if err := ucenter.DB.Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Order("retired_at IS NOT NULL, id desc").Find(&rows).Error; err != nil {
+		return err
+	}
+	keys := make([]*signingKey, 0, len(rows))
+	for i := range rows {
+		k, err := parseSigningKey(&rows[i])
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 || keys[0].retired {
+		return errors.New("没有可用的签名密钥")
+	}
+	s.Lock()
+	s.keys = keys
+	s.loadedAt = time.Now()
+	s.Unlock()
+	return nil
+}
+
+func (s *keyStore) current() *signingKey {
+	s.RLock()
+	defer s.RUnlock()
+	return s.keys[0]
+}
+
+func (s *keyStore) lookup(kid string) *signingKey {
+	s.RLock()
+	defer s.RUnlock()
+	for _, k := range s.keys {
+		if k.kid == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+// find 按 kid 查找密钥，找不到时可能是其他实例刚轮换，至多每分钟重新加载一次
+func (s *keyStore) find(kid string) *signingKey {
+	if kid == "" {
+		kid = legacyKID
+	}
+	if k := s.lookup(kid); k != nil {
+		return k
+	}
+	s.RLock()
+	stale := time.Since(s.loadedAt) > time.Minute
+	s.RUnlock()
+	if stale && s.load() == nil {
+		return s.lookup(kid)
+	}
+	return nil
+}
+
+// alg 当前签名使用的算法
+func (s *keyStore) alg() string {
+	return s.current().alg
+}
+
+// jwks 公布的公钥，包括尚未过期的退役密钥
+func (s *keyStore) jwks() jose.JSONWebKeySet {
+	s.RLock()
+	defer s.RUnlock()
+	set := jose.JSONWebKeySet{Keys: make([]jose.JSONWebKey, 0, len(s.keys))}
+	for _, k := range s.keys {
+		set.Keys = append(set.Keys, jose.JSONWebKey{
+			Key:       k.public,
+			Algorithm: k.alg,
+			Use:       "sig",
+			KeyID:     k.kid,
+		})
+	}
+	return set
+}
+
+// Generate 以当前密钥签名
+func (s *keyStore) Generate(ctx context.Context, claims jwt2.Claims, header jwt.Mapper) (string, string, error) {
+	if header == nil || claims == nil {
+		return "", "", errors.New("Either claims or header is nil.")
+	}
+	k := s.current()
+	token := jwt2.NewWithClaims(k.method, claims)
+	for key, v := range header.ToMap() {
+		token.Header[key] = v
+	}
+	token.Header["alg"] = k.method.Alg()
+	token.Header["kid"] = k.kid
+	raw, err := token.SignedString(k.private)
+	if err != nil {
+		return "", "", err
+	}
+	sig, err := s.GetSignature(ctx, raw)
+	return raw, sig, err
+}
+
+// Validate 校验签名，返回签名部分
+func (s *keyStore) Validate(ctx context.Context, token string) (string, error) {
+	if _, err := s.Decode(ctx, token); err != nil {
+		return "", err
+	}
+	return s.GetSignature(ctx, token)
+}
+
+// Decode 按 kid 选择密钥解析令牌，算法必须与密钥一致，exp、iat、nbf 按 token_leeway 校验
+func (s *keyStore) Decode(ctx context.Context, token string) (*jwt2.Token, error) {
+	parser := &jwt2.Parser{SkipClaimsValidation: true}
+	t, err := parser.Parse(token, s.keyFunc)
+	if err != nil {
+		return t, err
+	}
+	return t, verifyTimeClaims(t.Claims.(jwt2.MapClaims))
+}
+
+// keyFunc 按 kid 选择校验签名的公钥
+func (s *keyStore) keyFunc(t *jwt2.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	k := s.find(kid)
+	if k == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if t.Method.Alg() != k.alg {
+		return nil, fmt.Errorf("unexpected signing method %q", t.Method.Alg())
+	}
+	return k.public, nil
+}
+
+// GetSignature 令牌的签名部分
+func (s *keyStore) GetSignature(ctx context.Context, token string) (string, error) {
+	split := strings.Split(token, ".")
+	if len(split) != 3 {
+		return "", errors.New("Header, body and signature must all be set")
+	}
+	return split[2], nil
+}
+
+// Hash RS256、ES256 均使用 SHA-256，用于 at_hash、c_hash
+func (s *keyStore) Hash(ctx context.Context, in []byte) ([]byte, error) {
+	sum := sha256.Sum256(in)
+	return sum[:], nil
+}
+
+// GetSigningMethodLength 签名哈希的长度
+func (s *keyStore) GetSigningMethodLength() int {
+	return crypto.SHA256.Size()
+}
+
+// newSigningKey 生成新密钥，kid 取公钥的 JWK 指纹
+func newSigningKey(alg string) (*ucenter.SigningKey, error) {
+	var priv crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("不支持的签名算法: %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return encodeSigningKey(priv, alg, "")
+}
+
+func encodeSigningKey(priv crypto.Signer, alg, kid string) (*ucenter.SigningKey, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if kid == "" {
+		thumbprint, err := (&jose.JSONWebKey{Key: priv.Public()}).Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		kid = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+	return &ucenter.SigningKey{
+		KID:        kid,
+		Alg:        alg,
+		PrivateKey: pii.String(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	}, nil
+}
+
+// initSigningKeys 首次启动时导入配置文件中的系统私钥，之后从数据库加载
+func initSigningKeys() error {
+	var n int
+	if err := ucenter.DB.Model(ucenter.SigningKey{}).Count(&n).Error; err != nil {
+		return err
+	}
+	if n == 0 {
+		key, err := encodeSigningKey(ucenter.SystemRSAKey, "RS256", legacyKID)
+		if err != nil {
+			return err
+		}
+		if err := ucenter.DB.Create(key).Error; err != nil {
+			return err
+		}
+	}
+	return signingKeys.load()
+}
+
+// signingKeyRetention 退役密钥继续公布的时长，覆盖最长的令牌有效期及客户端缓存 JWKS 的时间
+func signingKeyRetention() time.Duration {
+	d := oauth2config.GetAccessTokenLifespan()
+	if id := oauth2config.GetIDTokenLifespan(); id > d {
+		d = id
+	}
+	for _, tpl := range ucenter.C.ClientTemplates {
+		if l := time.Duration(tpl.AccessTokenLifespan) * time.Minute; l > d {
+			d = l
+		}
+	}
+	var max sql.NullInt64
+	if ucenter.DB.Model(storage.FositeClient{}).Select("MAX(GREATEST(access_token_lifespan, id_token_lifespan))").Row().Scan(&max) == nil {
+		if l := time.Duration(max.Int64) * time.Minute; l > d {
+			d = l
+		}
+	}
+	return d + time.Hour
+}
+
+// signingKeyDue 到达轮换周期或修改了签名算法
+func signingKeyDue(k *ucenter.SigningKey) bool {
+	if k.Alg != ucenter.C.SigningKeyAlg {
+		return true
+	}
+	return ucenter.C.SigningKeyRotationDays > 0 &&
+		time.Since(k.CreatedAt) > time.Duration(ucenter.C.SigningKeyRotationDays)*24*time.Hour
+}
+
+// rotateSigningKey 生成新密钥用于签名，旧密钥退役并在令牌全部过期后删除
+func rotateSigningKey() error {
+	key, err := newSigningKey(ucenter.C.SigningKeyAlg)
+	if err != nil {
+		return err
+	}
+	tx := ucenter.DB.Begin()
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", signingKeyLock).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	// 其他实例已经轮换过
+	var active ucenter.SigningKey
+	if tx.Where("retired_at IS NULL").Order("id desc").First(&active).Error == nil && !signingKeyDue(&active) {
+		tx.Rollback()
+		return nil
+	}
+	now := time.Now()
+	err = tx.Model(ucenter.SigningKey{}).Where("retired_at IS NULL").UpdateColumns(map[string]interface{}{
+		"retired_at": now,
+		"expires_at": now.Add(signingKeyRetention()),
+	}).Error
+	if err == nil {
+		err = tx.Create(key).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	return signingKeys.load()
+}
+
+// signingKeyJob 按周期轮换签名密钥，清理已过期的退役密钥
+func signingKeyJob() error {
+	var active ucenter.SigningKey
+	if err := ucenter.DB.Where("retired_at IS NULL").Order("id desc").First(&active).Error; err != nil {
+		return err
+	}
+	if signingKeyDue(&active) {
+		if err := rotateSigningKey(); err != nil {
+			return err
+		}
+	}
+	if err := ucenter.DB.Delete(ucenter.SigningKey{}, "expires_at < ?", time.Now()).Error; err != nil {
+		return err
+	}
+	return signingKeys.load()
+}
@@ -0,0 +1,188 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/go-playground/validator.v9"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/mail"
+)
+
+// signupAPIClient 认证调用注册 API 的第一方应用
+func signupAPIClient(c *gin.Context) (*storage.FositeClient, error) {
+	clientID := requestClientID(c)
+	var allowed bool
+	for _, id := range ucenter.C.SignupAPIClients {
+		allowed = allowed || id == clientID
+	}
+	if clientID == "" || !allowed {
+		return nil, errors.New("应用无权调用注册 API")
+	}
+	client, err := oauth2store.GetClient(c, clientID)
+	if err != nil {
+		return nil, errors.New("应用无权调用注册 API")
+	}
+	cli := client.(*storage.FositeClient)
+	if cli.Status == storage.StatusOauthClientSuspended || !cli.GetScopes().Has(ucenter.ScopeSignup) {
+		return nil, errors.New("应用无权调用注册 API")
+	}
+	if cli.UsesMTLS() {
+		if _, err := mtlsClientAuth(c, c); err != nil {
+			return nil, errors.New("应用认证失败")
+		}
+	} else if !cli.IsPublic() {
+		_, secret, ok := c.Request.BasicAuth()
+		if !ok {
+			secret = c.PostForm("client_secret")
+		}
+		if (&storage.SecretHasher{}).Compare(c, cli.GetHashedSecret(), []byte(secret)) != nil {
+			return nil, errors.New("应用认证失败")
+		}
+	}
+	return cli, nil
+}
+
+// signupAPILimited 超过限额时返回需等待的时长
+func signupAPILimited(clientID, ip string) time.Duration {
+	since := time.Now().Add(-time.Hour)
+	ip = ipKey(ip)
+	var first ucenter.SignupRequest
+	if limit := ucenter.C.SignupAPIIPLimit; limit > 0 {
+		var count int
+		ucenter.DB.Model(ucenter.SignupRequest{}).Where("ip = ? AND created_at > ?", ip, since).Count(&count)
+		if count >= limit && ucenter.DB.Where("ip = ? AND created_at > ?", ip, since).
+			Order("created_at desc").Offset(limit-1).First(&first).Error == nil {
+			return time.Until(first.CreatedAt.Add(time.Hour))
+		}
+	}
+	if limit := ucenter.C.SignupAPIClientLimit; limit > 0 {
+		var count int
+		ucenter.DB.Model(ucenter.SignupRequest{}).Where("client_id = ? AND user_id > 0 AND created_at > ?", clientID, since).Count(&count)
+		if count >= limit && ucenter.DB.Where("client_id = ? AND user_id > 0 AND created_at > ?", clientID, since).
+			Order("created_at desc").Offset(limit-1).First(&first).Error == nil {
+			return time.Until(first.CreatedAt.Add(time.Hour))
+		}
+	}
+	return 0
+}
+
+// signupRequirements 注册需满足的条件，供应用渲染注册界面
+func signupRequirements() gin.H {
+	policy := signupPolicy()
+	var legal []gin.H
+	for _, d := range currentLegalDocuments() {
+		legal = append(legal, gin.H{
+			"kind":    d.Kind,
+			"name":    d.Name(),
+			"version": d.Version,
+			"url":     mail.SiteURL("/legal/" + d.Kind),
+		})
+	}
+	return gin.H{
+		"closed":            policy.Closed,
+		"invite_required":   ucenter.C.SignupInviteOnly,
+		"email_required":    policy.EmailRequired(),
+		"approval_required": ucenter.C.SignupApproval,
+		"legal":             legal,
+	}
+}
+
+func signupAPIRequirements(c *gin.Context) {
+	if _, err := signupAPIClient(c); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, signupRequirements())
+}
+
+// signupAPI 第一方应用代用户注册，不建立登录，注册后由应用走正常的授权流程
+func signupAPI(c *gin.Context) {
+	clientID := requestClientID(c)
+	if d := clientAuthLockedFor(clientID); d > 0 {
+		c.Header("Retry-After", fmt.Sprintf("%d", int(d.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "应用认证失败次数过多"})
+		return
+	}
+	cli, err := signupAPIClient(c)
+	if err != nil {
+		recordClientAuthFailure(clientID, clientIP(c))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if d := signupAPILimited(cli.ClientID, clientIP(c)); d > 0 {
+		c.Header("Retry-After", fmt.Sprintf("%d", int(d.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "注册过于频繁，请 " + humanDuration(d) + " 后再试"})
+		return
+	}
+	req := ucenter.SignupRequest{ClientID: cli.ClientID, IP: ipKey(clientIP(c))}
+	ucenter.DB.Create(&req)
+
+	policy := signupPolicy()
+	legal := currentLegalDocuments()
+	if policy.Closed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "本站暂不开放注册"})
+		return
+	}
+	var suf signUpForm
+	var errs map[string]string
+	if err := c.ShouldBind(&suf); err != nil {
+		if ve, ok := err.(validator.ValidationErrors); ok {
+			errs = ve.Translate(ucenter.ValidatorTrans)
+		} else {
+			errs = map[string]string{"signUpForm": err.Error()}
+		}
+	} else if msg := countryDenied(clientIP(c), ucenter.C.SignupCountries); msg != "" {
+		errs = map[string]string{
+			"signUpForm.地区": msg,
+		}
+	} else if msg := reputationDenied(c, "注册"); msg != "" {
+		errs = map[string]string{
+			"signUpForm.地区": msg,
+		}
+	} else {
+		errs = checkSignup(&suf, policy, legal)
+	}
+	if errs != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"errors":       errs,
+			"requirements": signupRequirements(),
+		})
+		return
+	}
+	u, err := createSignupUser(&suf, policy, legal, clientIP(c))
+	if _, ok := err.(errInviteRedeem); ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"errors":       map[string]string{"signUpForm.邀请码": err.Error()},
+			"requirements": signupRequirements(),
+		})
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ucenter.DB.Model(&req).UpdateColumn("user_id", u.ID)
+
+	// next 为注册后还需完成的步骤：确认邮箱、等待审核，或走授权流程登录
+	status, next := "active", "authorize"
+	if u.Status == ucenter.StatusPending {
+		status, next = "pending_approval", "approval"
+	} else if u.Status == ucenter.StatusUnconfirmed {
+		status, next = "pending_email", "confirm_email"
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"sub":    userSubject(u, cli),
+		"status": status,
+		"next":   next,
+	})
+}
+
+// signupRequestGCJob 清理限流窗口之外的注册 API 请求记录
+func signupRequestGCJob() error {
+	return ucenter.DB.Delete(ucenter.SignupRequest{}, "created_at < ?", time.Now().Add(-time.Hour*24)).Error
+}
@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+)
+
+// signupPolicy 当前注册策略，首次使用时以配置文件初始化
+func signupPolicy() *ucenter.SignupPolicy {
+	var p ucenter.SignupPolicy
+	ucenter.DB.Where(ucenter.SignupPolicy{ID: 1}).Attrs(ucenter.SignupPolicy{
+		Closed:       ucenter.C.SignupClosed,
+		AllowDomains: pq.StringArray(ucenter.C.SignupAllowDomains),
+		BlockDomains: pq.StringArray(ucenter.C.SignupBlockDomains),
+	}).FirstOrCreate(&p)
+	return &p
+}
+
+func adminSignup(c *gin.Context) {
+	c.HTML(http.StatusOK, "admin/signup", nbgin.Data(c, gin.H{
+		"policy": signupPolicy(),
+	}))
+}
+
+func editSignupPolicy(c *gin.Context) {
+	type signupPolicyForm struct {
+		Closed       bool   `form:"closed"`
+		AllowDomains string `form:"allow_domains" binding:"max=2000"`
+		BlockDomains string `form:"block_domains" binding:"max=2000"`
+	}
+
+	var spf signupPolicyForm
+	if err := c.ShouldBind(&spf); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	p := signupPolicy()
+	p.Closed = spf.Closed
+	p.AllowDomains = splitDomains(spf.AllowDomains)
+	p.BlockDomains = splitDomains(spf.BlockDomains)
+	if err := ucenter.DB.Save(p).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+// splitDomains 按行或逗号拆分域名列表
+func splitDomains(s string) pq.StringArray {
+	domains := pq.StringArray{}
+	for _, d := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == '\n' || r == '\r' || r == ',' || r == ' '
+	}) {
+		domains = append(domains, strings.ToLower(strings.TrimPrefix(d, "@")))
+	}
+	return domains
+}
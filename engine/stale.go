@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/mail"
+)
+
+func staleGracePeriod() time.Duration {
+	return time.Hour * 24 * time.Duration(ucenter.C.StaleAccountGraceDays)
+}
+
+// staleAccountJob 提醒并停用长期未登录的账户
+func staleAccountJob() error {
+	if ucenter.C.StaleAccountMonths <= 0 {
+		return nil
+	}
+	now := time.Now()
+	threshold := now.AddDate(0, -ucenter.C.StaleAccountMonths, 0)
+
+	// 宽限期已过仍未登录的账户停用
+	res := ucenter.DB.Model(ucenter.User{}).
+		Where("status = 0 AND stale_warned_at < ? AND COALESCE(last_login_at, created_at) < ?", now.Add(-staleGracePeriod()), threshold).
+		Update("status", ucenter.StatusDeactivated)
+	if res.Error != nil {
+		return res.Error
+	}
+	staleAccountsDeactivated.Add(float64(res.RowsAffected))
+
+	// 新发现的长期未登录账户发送提醒
+	var users []ucenter.User
+	if err := ucenter.DB.Where("status = 0 AND stale_warned_at IS NULL AND COALESCE(last_login_at, created_at) < ?", threshold).
+		Find(&users).Error; err != nil {
+		return err
+	}
+	for i := 0; i < len(users); i++ {
+		if users[i].Email != "" && mail.Enabled() {
+			if err := mail.Send(string(users[i].Email), "账户停用提醒", fmt.Sprintf(
+				"%s 您好：\n\n您的账户已超过 %d 个月未登录，将于 %s 停用。\n如需继续使用，请在此之前登录：%s\n\n%s",
+				users[i].Username, ucenter.C.StaleAccountMonths, now.Add(staleGracePeriod()).Format("2006-01-02"),
+				mail.SiteURL("/login"), ucenter.C.SysName)); err != nil {
+				log.Printf("stale account mail %s: %s", users[i].StrID(), err)
+			}
+		}
+		if err := ucenter.DB.Model(&users[i]).Update("stale_warned_at", now).Error; err != nil {
+			return err
+		}
+		staleAccountsWarned.Inc()
+	}
+
+	var pending int
+	ucenter.DB.Model(ucenter.User{}).Where("status = 0 AND stale_warned_at IS NOT NULL").Count(&pending)
+	staleAccountsPending.Set(float64(pending))
+	return nil
+}
@@ -0,0 +1,273 @@
+package engine
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lib/pq"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+// loginAMR 整理验证身份的方式，同时使用了两种方式时加上 mfa
+func loginAMR(amr []string) pq.StringArray {
+	var list []string
+	for _, m := range amr {
+		if m != "" {
+			list = appendUnique(list, m)
+		}
+	}
+	if len(list) > 1 {
+		list = append(list, ucenter.AMRMFA)
+	}
+	return pq.StringArray(list)
+}
+
+// acrLevel 认证等级的高低，不认识的等级为 0
+func acrLevel(acr string) int {
+	switch acr {
+	case ucenter.ACRSingleFactor:
+		return 1
+	case ucenter.ACRMultiFactor:
+		return 2
+	}
+	return 0
+}
+
+// stepUpRequired 终端不满足授权请求的 max_age 或 acr_values 时需要重新验证身份，mfa 表示还须二次验证。
+// max_age 为 0 时以 token_leeway 为限，以便验证后能回到授权请求；acr_values 满足其中任一已知等级即可，都不认识时忽略
+func stepUpRequired(ar fosite.AuthorizeRequester, l *ucenter.Login) (required, mfa bool, err error) {
+	form := ar.GetRequestForm()
+	if raw := form.Get("max_age"); raw != "" {
+		maxAge, err := strconv.Atoi(raw)
+		if err != nil || maxAge < 0 {
+			return false, false, errors.WithStack(fosite.ErrInvalidRequest.WithHint("The max_age parameter must be a non-negative integer."))
+		}
+		limit := time.Second * time.Duration(maxAge)
+		if maxAge == 0 {
+			limit = time.Second * time.Duration(ucenter.C.TokenLeeway)
+		}
+		required = time.Since(l.AuthenticatedAt()) > limit
+	}
+	var level int
+	for _, acr := range strings.Fields(form.Get("acr_values")) {
+		if n := acrLevel(acr); n > 0 && (level == 0 || n < level) {
+			level = n
+		}
+	}
+	mfa = level > acrLevel(l.ACR())
+	return required || mfa, mfa, nil
+}
+
+// redirectToStepUp 跳转到重新验证身份的页面，验证后回到 returnURL
+func redirectToStepUp(c *gin.Context, returnURL string, mfa bool) {
+	target := "/stepup?return_url=" + url.QueryEscape(returnURL)
+	if mfa {
+		target += "&mfa=1"
+	}
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, target)
+}
+
+// authSessionClaims 在 ID Token 中记录终端最近一次验证身份的时间、方式及认证等级
+func authSessionClaims(session *storage.FositeSession, l *ucenter.Login) {
+	claims := session.DefaultSession.Claims
+	claims.AuthTime = l.AuthenticatedAt().UTC()
+	claims.RequestedAt = time.Now().UTC()
+	claims.AuthenticationContextClassReference = l.ACR()
+	if len(l.AMR) > 0 {
+		if claims.Extra == nil {
+			claims.Extra = make(map[string]interface{})
+		}
+		claims.Extra["amr"] = []string(l.AMR)
+	}
+}
+
+// stepUpMethods 用户可用于二次验证的方式
+func stepUpMethods(u *ucenter.User) (passkey, emailOTP bool) {
+	if featureEnabled(ucenter.FlagPasskey, u.ID) {
+		var count int
+		ucenter.DB.Model(ucenter.Passkey{}).Where("user_id = ?", u.ID).Count(&count)
+		passkey = count > 0
+	}
+	return passkey, u.MFAEmail && !passkeyRequired(u)
+}
+
+func stepUp(c *gin.Context) {
+	renderStepUp(c, "")
+}
+
+func renderStepUp(c *gin.Context, msg string) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	mfa := c.Query("mfa") != ""
+	passkey, emailOTP := stepUpMethods(u)
+	if mfa && !passkey && !emailOTP {
+		c.HTML(http.StatusForbidden, "page/info", gin.H{
+			"icon":  "shield alternate",
+			"title": "需要二次验证",
+			"msg":   "应用要求使用二次验证登录，请先在「二次验证」中启用邮箱验证码或添加通行密钥。",
+		})
+		return
+	}
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "page/stepup", nbgin.Data(c, gin.H{
+		"mfa":      mfa,
+		"password": (!mfa || emailOTP) && !passkeyRequired(u),
+		"passkey":  passkey,
+		"error":    msg,
+	}))
+}
+
+// stepUpHandler 以密码重新验证身份，要求二次验证时接着发送邮箱验证码
+func stepUpHandler(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	l, ok := c.Get(ucenter.AuthLogin)
+	if !ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if passkeyRequired(u) {
+		renderStepUp(c, "管理员账户只能使用通行密钥验证身份")
+		return
+	}
+	if d := loginLockedFor(u.Username, clientIP(c)); d > 0 {
+		renderStepUp(c, "验证失败次数过多，请 "+humanDuration(d)+" 后再试")
+		return
+	}
+	if passOK, _ := password.Verify(u.Password, c.PostForm("password")); !passOK {
+		recordLoginFailure(u.Username, clientIP(c))
+		audit(c, 0, ucenter.AuditLoginFailure, userTarget(u.ID), "授权前重新验证身份：密码不正确")
+		renderStepUp(c, "密码不正确")
+		return
+	}
+	returnURL := safeReturnURL(c.Query("return_url"), "/")
+	if c.Query("mfa") == "" {
+		if err := finishStepUp(c, l.(*ucenter.Login), u, "密码", ucenter.AMRPassword); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, returnURL)
+		return
+	}
+	if _, emailOTP := stepUpMethods(u); !emailOTP {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if err := startEmailOTP(c, u, ucenter.EmailOTPStepUp, ucenter.AMRPassword, "密码", returnURL); err != nil {
+		renderStepUp(c, "验证码发送失败，请稍后再试")
+		return
+	}
+	renderStepUpOTP(c, u, "")
+}
+
+func renderStepUpOTP(c *gin.Context, u *ucenter.User, msg string) {
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "page/stepup", nbgin.Data(c, gin.H{
+		"otp":   true,
+		"email": maskEmail(string(u.Email)),
+		"error": msg,
+	}))
+}
+
+// stepUpOTPHandler 校验授权前二次验证的邮箱验证码
+func stepUpOTPHandler(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	l, ok := c.Get(ucenter.AuthLogin)
+	otp, err := currentEmailOTP(c, ucenter.EmailOTPStepUp)
+	if !ok || err != nil || otp.UserID != u.ID {
+		loginMFAExpired(c, "验证码已过期")
+		return
+	}
+	if d := loginLockedFor(u.Username, clientIP(c)); d > 0 {
+		renderStepUpOTP(c, u, "验证失败次数过多，请 "+humanDuration(d)+" 后再试")
+		return
+	}
+	if msg := checkEmailOTP(otp, c.PostForm("code")); msg != "" {
+		recordLoginFailure(u.Username, clientIP(c))
+		audit(c, 0, ucenter.AuditLoginFailure, userTarget(u.ID), "授权前重新验证身份：邮箱验证码不正确")
+		if otp.Attempts >= ucenter.C.EmailOTPMaxAttempts {
+			loginMFAExpired(c, msg)
+			return
+		}
+		renderStepUpOTP(c, u, msg)
+		return
+	}
+	nbgin.SetCookie(c, -1, emailOTPCookie, "")
+	if err := finishStepUp(c, l.(*ucenter.Login), u, otp.Detail+" + 邮箱验证码", otp.AMR, ucenter.AMROTP); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, safeReturnURL(otp.ReturnURL, "/"))
+}
+
+func beginStepUpPasskey(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	options, session, err := webAuthn.BeginLogin(loadPasskeyUser(u), webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err == nil {
+		err = savePasskeySession(c, u.ID, session)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, options)
+}
+
+// finishStepUpPasskey 以通行密钥重新验证身份，通行密钥本身即满足二次验证
+func finishStepUpPasskey(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	l, ok := c.Get(ucenter.AuthLogin)
+	if !ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	session, err := takePasskeySession(c, u.ID)
+	if err != nil {
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+	cred, err := webAuthn.FinishLogin(loadPasskeyUser(u), *session, c.Request)
+	if err != nil {
+		audit(c, 0, ucenter.AuditLoginFailure, userTarget(u.ID), "授权前重新验证身份：通行密钥验证失败")
+		c.String(http.StatusForbidden, "通行密钥验证失败")
+		return
+	}
+	ucenter.DB.Model(ucenter.Passkey{}).Where("credential_id = ?", cred.ID).Updates(map[string]interface{}{
+		"sign_count":   cred.Authenticator.SignCount,
+		"last_used_at": time.Now(),
+	})
+	if err := finishStepUp(c, l.(*ucenter.Login), u, "通行密钥", ucenter.AMRWebAuthn); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"redirect": safeReturnURL(c.Query("return_url"), "/")})
+}
+
+// finishStepUp 记录终端重新验证身份的时间与方式
+func finishStepUp(c *gin.Context, l *ucenter.Login, u *ucenter.User, detail string, amr ...string) error {
+	now := time.Now()
+	l.AuthTime = &now
+	l.AMR = loginAMR(amr)
+	if err := ucenter.DB.Model(ucenter.Login{}).Where("token = ?", l.Token).Updates(map[string]interface{}{
+		"auth_time": now,
+		"amr":       l.AMR,
+	}).Error; err != nil {
+		return err
+	}
+	clearLoginFailures(u.Username, string(u.Email))
+	audit(c, u.ID, ucenter.AuditLoginSuccess, userTarget(u.ID), "授权前重新验证身份："+detail)
+	return nil
+}
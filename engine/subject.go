@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/ids"
+)
+
+// publicSubject 令牌中记录的是自增 ID，对外签发的 sub 换成用户的对外 ID；
+// 客户端凭证等不代表用户的主体及已删除的用户原样返回
+func publicSubject(sub string) string {
+	uid, err := strconv.ParseUint(sub, 10, 64)
+	if err != nil {
+		return sub
+	}
+	var u ucenter.User
+	if ucenter.DB.Unscoped().Select("id, public_id").First(&u, "id = ?", uid).Error != nil {
+		return sub
+	}
+	return u.Subject()
+}
+
+// findUserBySubject 按对外 ID 查找用户，回填 PublicID 之前的旧用户按自增 ID 查找
+func findUserBySubject(subject string, u *ucenter.User) error {
+	err := ucenter.DB.First(u, "public_id = ?", subject).Error
+	if err != gorm.ErrRecordNotFound {
+		return err
+	}
+	uid, perr := strconv.ParseUint(subject, 10, 64)
+	if perr != nil {
+		return err
+	}
+	return ucenter.DB.First(u, "id = ? AND (public_id = '' OR public_id IS NULL)", uid).Error
+}
+
+// clientSubject 令牌中记录的自增 ID 换成该应用看到的 sub，不代表用户的主体原样返回
+func clientSubject(sub string, client fosite.Client) string {
+	if _, err := strconv.ParseUint(sub, 10, 64); err != nil {
+		return sub
+	}
+	return pairwiseSubject(client, publicSubject(sub))
+}
+
+// userSubject 该应用看到的用户 sub
+func userSubject(u *ucenter.User, client fosite.Client) string {
+	return pairwiseSubject(client, u.Subject())
+}
+
+// pairwiseSubject pairwise 应用看到的 sub 由扇区标识、用户对外 ID 与盐派生，
+// 同一扇区的应用得到相同的 sub；public 应用直接使用对外 ID
+func pairwiseSubject(client fosite.Client, public string) string {
+	cli, ok := client.(*storage.FositeClient)
+	if !ok || cli.SubjectType != storage.SubjectTypePairwise {
+		return public
+	}
+	return ids.Pairwise(ids.Sector(cli.SectorIdentifierURI, cli.RedirectURIs), public, ucenter.C.PairwiseSalt)
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+	"github.com/naiba/ucenter/pkg/ram"
+)
+
+// sudoActive 当前终端是否在近期验证过身份
+func sudoActive(c *gin.Context) bool {
+	l, ok := c.Get(ucenter.AuthLogin)
+	return ok && l.(*ucenter.Login).Elevated()
+}
+
+// requireSudo 敏感操作前要求重新验证身份
+func requireSudo(c *gin.Context) {
+	if !sudoActive(c) {
+		abortSudo(c)
+	}
+}
+
+// requireAdminSudo 管理操作需进入管理模式，与登录会话分开计时
+func requireAdminSudo(c *gin.Context) {
+	l, ok := c.Get(ucenter.AuthLogin)
+	if !ok || !l.(*ucenter.Login).AdminElevated() {
+		abortSudo(c)
+	}
+}
+
+// abortSudo 页面请求跳转验证界面，Ajax 请求由前端根据返回的地址跳转
+func abortSudo(c *gin.Context) {
+	if c.Request.Method == http.MethodGet {
+		nbgin.SetNoCache(c)
+		c.Redirect(http.StatusFound, "/sudo?return_url="+url.QueryEscape(c.Request.RequestURI))
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"sudo": "/sudo"})
+}
+
+// elevateLogin 标记终端已重新验证身份，管理员同时进入管理模式
+func elevateLogin(l *ucenter.Login, admin bool) error {
+	until := time.Now().Add(time.Minute * time.Duration(ucenter.C.SudoTTL))
+	l.SudoUntil = &until
+	fields := map[string]interface{}{"sudo_until": until}
+	if admin {
+		adminUntil := time.Now().Add(time.Minute * time.Duration(ucenter.C.AdminSudoTTL))
+		l.AdminSudoUntil = &adminUntil
+		fields["admin_sudo_until"] = adminUntil
+	}
+	return ucenter.DB.Model(ucenter.Login{}).Where("token = ?", l.Token).Updates(fields).Error
+}
+
+func sudo(c *gin.Context) {
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusOK, "page/sudo", nbgin.Data(c, nil))
+}
+
+func sudoHandler(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	l, ok := c.Get(ucenter.AuthLogin)
+	if !ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if d := loginLockedFor(u.Username, clientIP(c)); d > 0 {
+		c.HTML(http.StatusOK, "page/sudo", nbgin.Data(c, gin.H{
+			"errors": map[string]string{
+				"sudoForm.密码": "验证失败次数过多，请 " + humanDuration(d) + " 后再试",
+			},
+		}))
+		return
+	}
+	if passOK, _ := password.Verify(u.Password, c.PostForm("password")); !passOK {
+		recordLoginFailure(u.Username, clientIP(c))
+		c.HTML(http.StatusOK, "page/sudo", nbgin.Data(c, gin.H{
+			"errors": map[string]string{
+				"sudoForm.密码": "密码不正确",
+			},
+		}))
+		return
+	}
+	admin := ucenter.RAM.Enforce(u.StrID(), ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel)
+	if err := elevateLogin(l.(*ucenter.Login), admin); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	nbgin.SetNoCache(c)
+	c.Redirect(http.StatusFound, safeReturnURL(c.Query("return_url"), "/"))
+}
@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/mail"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+// revokeUserAccess 下线用户的全部终端并吊销已签发的令牌
+func revokeUserAccess(uid uint) error {
+	backchannelLogout(uid, userLoginTokens(uid)...)
+	if err := ucenter.DB.Delete(ucenter.Login{}, "user_id = ?", uid).Error; err != nil {
+		return err
+	}
+	ucenter.DB.Delete(ucenter.TrustedDevice{}, "user_id = ?", uid)
+	return oauth2store.(*storage.FositeStore).RevokeSubjectTokens(fmt.Sprintf("%d", uid))
+}
+
+// userStatusImpact 预演修改用户状态：禁用时下线的终端、吊销的令牌及收到退出通知的应用，启用时清理的申诉
+func userStatusImpact(d *dryRunImpact, uid uint, status int) error {
+	var u ucenter.User
+	if err := ucenter.DB.First(&u, "id = ?", uid).Error; err != nil {
+		return err
+	}
+	d.addUser(&u)
+	if status != ucenter.StatusSuspended {
+		return d.countRows("appeals", ucenter.Appeal{}, "user_id = ?", uid)
+	}
+	if err := d.countRows("logins", ucenter.Login{}, "user_id = ?", uid); err != nil {
+		return err
+	}
+	if err := d.countRows("trusted_devices", ucenter.TrustedDevice{}, "user_id = ?", uid); err != nil {
+		return err
+	}
+	if err := d.countTokens("subject", u.StrID()); err != nil {
+		return err
+	}
+	grants, err := oauth2store.(*storage.FositeStore).ClientGrants(u.StrID())
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(grants))
+	for id := range grants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		d.addClient(id)
+	}
+	return nil
+}
+
+// suspensionLiftJob 解除已到期的临时禁用
+func suspensionLiftJob() error {
+	var users []ucenter.User
+	if err := ucenter.DB.Where("status = ? AND suspended_until IS NOT NULL AND suspended_until <= ?", ucenter.StatusSuspended, time.Now()).
+		Find(&users).Error; err != nil {
+		return err
+	}
+	for i := range users {
+		liftExpiredSuspension(&users[i])
+		ucenter.DB.Delete(ucenter.Appeal{}, "user_id = ?", users[i].ID)
+	}
+	return nil
+}
+
+// showSuspended 密码验证通过但账户被禁用时，展示原因及申诉入口
+func showSuspended(c *gin.Context, u *ucenter.User) {
+	var appeal ucenter.Appeal
+	if ucenter.DB.Where("user_id = ?", u.ID).Order("id desc").First(&appeal).Error != nil {
+		token, err := password.GenerateSecret()
+		if err == nil {
+			appeal = ucenter.Appeal{UserID: u.ID, Token: token}
+			err = ucenter.DB.Create(&appeal).Error
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	nbgin.SetNoCache(c)
+	c.HTML(http.StatusForbidden, "page/suspended", nbgin.Data(c, gin.H{
+		"msg":    suspendedMessage(u),
+		"appeal": appeal,
+	}))
+}
+
+// submitAppeal 提交申诉，每次禁用只能申诉一次
+func submitAppeal(c *gin.Context) {
+	type appealForm struct {
+		Message string `form:"message" cfn:"申诉理由" binding:"required,min=1,max=1000"`
+	}
+
+	var af appealForm
+	var appeal ucenter.Appeal
+	var u ucenter.User
+	if ucenter.DB.Where("token = ?", c.Param("token")).First(&appeal).Error != nil || appeal.Submitted() ||
+		ucenter.DB.First(&u, "id = ?", appeal.UserID).Error != nil || !u.IsSuspended() {
+		c.HTML(http.StatusNotFound, "page/info", gin.H{
+			"icon":  "unlink",
+			"title": "申诉无效",
+			"msg":   "申诉链接已失效或已提交过申诉。",
+		})
+		return
+	}
+	if err := c.ShouldBind(&af); err != nil {
+		c.HTML(http.StatusBadRequest, "page/info", gin.H{
+			"icon":  "edit",
+			"title": "申诉无效",
+			"msg":   "请填写 1000 字以内的申诉理由。",
+		})
+		return
+	}
+	now := time.Now()
+	if err := ucenter.DB.Model(&appeal).Updates(map[string]interface{}{
+		"message":      strings.TrimSpace(af.Message),
+		"submitted_at": now,
+	}).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	mailAdmins(adminUserIDs(), "账户禁用申诉", fmt.Sprintf("管理员您好：\n\n被禁用的用户 %s（ID %d）提交了申诉：\n\n%s\n\n请登录管理中心处理：\n%s\n\n%s",
+		u.Username, u.ID, af.Message, mail.SiteURL("/admin/users"), ucenter.C.SysName))
+	c.HTML(http.StatusOK, "page/info", gin.H{
+		"icon":  "paper plane",
+		"title": "申诉已提交",
+		"msg":   "管理员处理后账户将恢复，请耐心等待。",
+	})
+}
+
+// submittedAppeals 用户已提交的申诉
+func submittedAppeals() map[uint]string {
+	var list []ucenter.Appeal
+	ucenter.DB.Where("submitted_at IS NOT NULL").Find(&list)
+	appeals := make(map[uint]string)
+	for _, a := range list {
+		appeals[a.UserID] = a.Message
+	}
+	return appeals
+}
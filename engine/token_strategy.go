@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt2 "github.com/dgrijalva/jwt-go"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/pborman/uuid"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+)
+
+// flaggedCoreStrategy 应用选择 JWT 访问令牌或用户命中功能开关时签发 JWT，否则签发 HMAC 访问令牌；
+// 校验时按令牌格式区分，关闭开关或切回不透明令牌后已签发的 JWT 访问令牌在过期前仍然有效
+type flaggedCoreStrategy struct {
+	*oauth2.HMACSHAStrategy
+	jwt *oauth2.DefaultJWTStrategy
+}
+
+// clientIDTokenStrategy 按应用设置的有效期及 sub 类型签发 ID Token，覆盖授权端点、令牌端点及刷新时签发的全部 ID Token
+type clientIDTokenStrategy struct {
+	*openid.DefaultStrategy
+}
+
+func (s *clientIDTokenStrategy) GenerateIDToken(ctx context.Context, requester fosite.Requester) (string, error) {
+	setIDTokenExpiry(requester.GetClient(), requester.GetSession())
+	// 合并账户后保存的 sub 可能已过时，按令牌记录的用户重新计算
+	if session, ok := requester.GetSession().(*storage.FositeSession); ok && session.DefaultSession.Claims != nil {
+		session.DefaultSession.Claims.Subject = clientSubject(session.GetSubject(), requester.GetClient())
+	}
+	return s.DefaultStrategy.GenerateIDToken(ctx, requester)
+}
+
+// isJWT HMAC 令牌只有一个点，JWT 有两个
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (s *flaggedCoreStrategy) AccessTokenSignature(token string) string {
+	if isJWT(token) {
+		return s.jwt.AccessTokenSignature(token)
+	}
+	return s.HMACSHAStrategy.AccessTokenSignature(token)
+}
+
+// jwtAccessToken 是否为本次请求签发 JWT 访问令牌
+func jwtAccessToken(requester fosite.Requester) bool {
+	if client, ok := requester.GetClient().(*storage.FositeClient); ok && client.AccessTokenStrategy == storage.AccessTokenStrategyJWT {
+		return true
+	}
+	// 客户端凭证等没有用户的令牌不参与灰度
+	uid, err := strconv.ParseUint(requester.GetSession().GetSubject(), 10, 64)
+	return err == nil && uid > 0 && featureEnabled(ucenter.FlagJWTAccessToken, uint(uid))
+}
+
+func (s *flaggedCoreStrategy) GenerateAccessToken(ctx context.Context, requester fosite.Requester) (string, string, error) {
+	if !jwtAccessToken(requester) {
+		return s.HMACSHAStrategy.GenerateAccessToken(ctx, requester)
+	}
+	session, ok := requester.GetSession().(*storage.FositeSession)
+	if !ok {
+		return s.jwt.GenerateAccessToken(ctx, requester)
+	}
+	return signingKeys.Generate(ctx, accessTokenClaims(requester, session), &jwt.Headers{
+		Extra: map[string]interface{}{"typ": "at+jwt"},
+	})
+}
+
+// accessTokenClaims JWT 访问令牌的声明（RFC 9068），资源服务器以 JWKS 中的公钥即可在本地校验
+func accessTokenClaims(requester fosite.Requester, session *storage.FositeSession) jwt2.MapClaims {
+	now := time.Now().UTC()
+	clientID := requester.GetClient().GetID()
+	sub := clientSubject(session.GetSubject(), requester.GetClient())
+	// 客户端凭证令牌代表应用自身
+	if sub == "" {
+		sub = clientID
+	}
+	aud := []string(requester.GetGrantedAudience())
+	if len(aud) == 0 {
+		aud = []string{clientID}
+	}
+	claims := jwt2.MapClaims{
+		"iss":       ucenter.Issuer(),
+		"sub":       sub,
+		"aud":       aud,
+		"client_id": clientID,
+		"jti":       uuid.New(),
+		"iat":       now.Unix(),
+		"nbf":       now.Unix(),
+		"scope":     strings.Join(requester.GetGrantedScopes(), " "),
+		// 与功能开关早期签发的令牌保持一致
+		"scp": requester.GetGrantedScopes(),
+		"ext": session.Extra,
+	}
+	if exp := session.GetExpiresAt(fosite.AccessToken); !exp.IsZero() {
+		claims["exp"] = exp.Unix()
+	}
+	if cnf := tokenConfirmation(requester); cnf != nil {
+		claims["cnf"] = cnf
+	}
+	return claims
+}
+
+func (s *flaggedCoreStrategy) ValidateAccessToken(ctx context.Context, requester fosite.Requester, token string) error {
+	if isJWT(token) {
+		return s.jwt.ValidateAccessToken(ctx, requester, token)
+	}
+	return s.HMACSHAStrategy.ValidateAccessToken(ctx, requester, token)
+}
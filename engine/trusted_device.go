@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mssola/user_agent"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+)
+
+const trustedDeviceCookie = "nb_trusted_device"
+
+// signTrustedDevice 以系统私钥派生的密钥签名，Cookie 被篡改时直接拒绝
+func signTrustedDevice(payload string) string {
+	key := sha256.Sum256([]byte("trusted-device|" + ucenter.C.PrivateKeyByte))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// trustDevice 将当前浏览器标记为受信任，与刚建立的登录终端关联
+func trustDevice(c *gin.Context, u *ucenter.User, l *ucenter.Login) error {
+	ua := user_agent.New(c.Request.UserAgent())
+	browser, _ := ua.Browser()
+	now := time.Now()
+	secret, err := password.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	device := ucenter.TrustedDevice{
+		UserID:     u.ID,
+		SecretHash: hashOTP(secret),
+		LoginToken: l.Token,
+		Name:       ua.OS() + " " + browser,
+		IP:         clientIP(c),
+		ExpiresAt:  now.AddDate(0, 0, ucenter.C.MFATrustDays),
+		LastUsedAt: now,
+	}
+	if err := ucenter.DB.Create(&device).Error; err != nil {
+		return err
+	}
+	payload := fmt.Sprintf("%d.%s", device.ID, secret)
+	nbgin.SetCookie(c, ucenter.C.MFATrustDays*24*60*60, trustedDeviceCookie, payload+"."+signTrustedDevice(payload))
+	return nil
+}
+
+// currentTrustedDevice 当前浏览器对该用户有效的信任记录
+func currentTrustedDevice(c *gin.Context, u *ucenter.User) *ucenter.TrustedDevice {
+	if ucenter.C.MFATrustDays <= 0 {
+		return nil
+	}
+	value, err := c.Cookie(trustedDeviceCookie)
+	if err != nil {
+		return nil
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(signTrustedDevice(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return nil
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil
+	}
+	var device ucenter.TrustedDevice
+	if ucenter.DB.First(&device, "id = ? AND user_id = ? AND expires_at > ?", id, u.ID, time.Now()).Error != nil ||
+		!hmac.Equal([]byte(device.SecretHash), []byte(hashOTP(parts[1]))) {
+		return nil
+	}
+	return &device
+}
+
+// untrustLogins 下线终端时取消经由这些终端建立的信任
+func untrustLogins(tokens ...string) {
+	if len(tokens) > 0 {
+		ucenter.DB.Delete(ucenter.TrustedDevice{}, "login_token IN (?)", tokens)
+	}
+}
+
+func revokeTrustedDevice(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	var device ucenter.TrustedDevice
+	if ucenter.DB.First(&device, "id = ? AND user_id = ?", c.Param("id"), u.ID).Error != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err := ucenter.DB.Delete(&device).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditSessionRevoke, userTarget(u.ID), "取消信任 "+device.Name+" "+device.IP)
+}
+
+// trustedDeviceGCJob 清理已过期的受信任设备
+func trustedDeviceGCJob() error {
+	return ucenter.DB.Delete(ucenter.TrustedDevice{}, "expires_at < ?", time.Now()).Error
+}
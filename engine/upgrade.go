@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+)
+
+// dataMigration 数据迁移，按顺序执行且只执行一次
+type dataMigration struct {
+	id   string
+	desc string
+	run  func(tx *gorm.DB) (int64, error)
+}
+
+// dataMigrations 新增字段的数据回填，只能追加，不能修改已发布的迁移
+var dataMigrations = []dataMigration{
+	{
+		id:   "20261016-client-owner",
+		desc: "补齐应用的所有者",
+		run: func(tx *gorm.DB) (int64, error) {
+			db := tx.Model(storage.FositeClient{}).Where("owner = '' OR owner IS NULL").
+				UpdateColumn("owner", gorm.Expr("split_part(client_id, '-', 1)"))
+			return db.RowsAffected, db.Error
+		},
+	},
+	{
+		id:   "20261016-password-changed-at",
+		desc: "以注册时间补齐密码修改时间",
+		run: func(tx *gorm.DB) (int64, error) {
+			db := tx.Model(ucenter.User{}).Where("password_changed_at IS NULL").
+				UpdateColumn("password_changed_at", gorm.Expr("created_at"))
+			return db.RowsAffected, db.Error
+		},
+	},
+	{
+		id:   "20261016-machine-client",
+		desc: "把使用 client_credentials 的应用标记为机器应用",
+		run: func(tx *gorm.DB) (int64, error) {
+			db := tx.Model(storage.FositeClient{}).Where("? = ANY(grant_types) AND NOT machine", "client_credentials").
+				UpdateColumn("machine", true)
+			return db.RowsAffected, db.Error
+		},
+	},
+	{
+		id:   "20261016-user-public-id",
+		desc: "以自增 ID 补齐用户的对外 ID，已签发的 sub 保持不变",
+		run: func(tx *gorm.DB) (int64, error) {
+			db := tx.Unscoped().Model(ucenter.User{}).Where("public_id = '' OR public_id IS NULL").
+				UpdateColumn("public_id", gorm.Expr("id::text"))
+			return db.RowsAffected, db.Error
+		},
+	},
+}
+
+// integrityCheck 升级后的数据完整性检查，返回有问题的记录数
+type integrityCheck struct {
+	desc string
+	run  func() (int, error)
+}
+
+var integrityChecks = []integrityCheck{
+	{
+		desc: "重复的明文邮箱",
+		run: func() (n int, err error) {
+			err = ucenter.DB.Raw("SELECT count(*) FROM (SELECT lower(email) FROM users WHERE email <> '' AND email NOT LIKE 'enc:%' AND deleted_at IS NULL GROUP BY lower(email) HAVING count(*) > 1) t").Row().Scan(&n)
+			return
+		},
+	},
+	{
+		desc: "审计日志哈希链异常",
+		run: func() (int, error) {
+			_, broken, _, err := verifyAuditChain()
+			if err != nil || broken == 0 {
+				return 0, err
+			}
+			return 1, nil
+		},
+	},
+	{
+		desc: "没有管理员",
+		run: func() (int, error) {
+			var users int
+			if err := ucenter.DB.Model(ucenter.User{}).Count(&users).Error; err != nil || users == 0 {
+				return 0, err
+			}
+			if len(adminUserIDs()) == 0 {
+				return 1, nil
+			}
+			return 0, nil
+		},
+	},
+}
+
+// pendingMigrations 尚未执行的数据迁移
+func pendingMigrations() ([]dataMigration, error) {
+	var applied []ucenter.SchemaMigration
+	if err := ucenter.DB.Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool)
+	for _, m := range applied {
+		done[m.ID] = true
+	}
+	var pending []dataMigration
+	for _, m := range dataMigrations {
+		if !done[m.id] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Upgrade 升级数据表结构，执行数据迁移并检查数据完整性，结果写入 w
+func Upgrade(w io.Writer) error {
+	// 表结构在 ucenter 初始化时已同步，这里补上授权服务及插件的数据表
+	initFosite()
+	fmt.Fprintln(w, "表结构：已同步")
+
+	pending, err := pendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintln(w, "数据迁移：没有待执行的迁移")
+	}
+	for _, m := range pending {
+		tx := ucenter.DB.Begin()
+		n, err := m.run(tx)
+		if err == nil {
+			err = tx.Create(&ucenter.SchemaMigration{ID: m.id, AppliedAt: time.Now()}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("数据迁移 %s 失败: %s", m.id, err)
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "数据迁移：%s %s，更新 %d 条\n", m.id, m.desc, n)
+	}
+
+	// 敏感字段加密可随时开启，每次升级都补齐
+	if err := piiMigrateJob(); err != nil {
+		return fmt.Errorf("敏感字段加密失败: %s", err)
+	}
+
+	var failed int
+	for _, check := range integrityChecks {
+		n, err := check.run()
+		if err != nil {
+			return fmt.Errorf("完整性检查 %s 失败: %s", check.desc, err)
+		}
+		status := "通过"
+		if n > 0 {
+			status = fmt.Sprintf("发现 %d 条", n)
+			failed++
+		}
+		fmt.Fprintf(w, "完整性检查：%s %s\n", check.desc, status)
+	}
+	orphans, err := checkOrphans(w, false)
+	if err != nil {
+		return err
+	}
+	if orphans > 0 {
+		return errors.New("完整性检查未通过，孤立记录可运行 ucenter check -repair 清理，请处理后重新运行")
+	}
+	if failed > 0 {
+		return errors.New("完整性检查未通过，请处理后重新运行")
+	}
+	// 没有孤立记录后才能建立外键
+	n, err := ensureForeignKeys()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "外键：新建立 %d 个\n", n)
+	fmt.Fprintln(w, "升级完成")
+	return nil
+}
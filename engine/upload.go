@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/scan"
+)
+
+var uploadScanner scan.Scanner
+
+var uploadScans = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ucenter_upload_scans_total",
+	Help: "上传文件安全扫描次数，result 为 clean、infected 或 error",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(uploadScans)
+}
+
+// scanUpload 落盘前扫描上传文件，扫描服务不可用时按 upload_scan_fail_open 放行或拒绝
+func scanUpload(name string, f io.ReadSeeker) error {
+	if uploadScanner == nil {
+		return nil
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	err := uploadScanner.Scan(name, f)
+	if _, serr := f.Seek(0, 0); serr != nil {
+		return serr
+	}
+	if err == nil {
+		uploadScans.WithLabelValues("clean").Inc()
+		return nil
+	}
+	if infected, ok := err.(*scan.Infected); ok {
+		uploadScans.WithLabelValues("infected").Inc()
+		log.Printf("上传文件 %s 未通过安全扫描: %s", name, infected.Reason)
+		return errors.New("文件未通过安全扫描")
+	}
+	uploadScans.WithLabelValues("error").Inc()
+	log.Printf("上传文件 %s 安全扫描出错: %v", name, err)
+	if ucenter.C.UploadScanFailOpen {
+		return nil
+	}
+	return errors.New("文件安全扫描暂不可用，请稍后再试")
+}
+
+// openImageUpload 打开上传的图片，检查类型、大小并通过安全扫描后才返回，调用方负责关闭
+func openImageUpload(fh *multipart.FileHeader) (multipart.File, error) {
+	if !isImage.MatchString(fh.Filename) {
+		return nil, errors.New("头像不是图片文件")
+	}
+	if fh.Size > 1024*1024*2 {
+		return nil, errors.New("头像不能大于 2 M")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	buff := make([]byte, 512) // why 512 bytes ? see http://golang.org/pkg/net/http/#DetectContentType
+	if _, err = f.Read(buff); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(http.DetectContentType(buff), "image/") {
+		f.Close()
+		return nil, errors.New("头像不是图片文件")
+	}
+	if err = scanUpload(fh.Filename, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -1,12 +1,17 @@
 package engine
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,36 +23,85 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/mssola/user_agent"
 	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/geoip"
+	"github.com/naiba/ucenter/pkg/ids"
+	"github.com/naiba/ucenter/pkg/jwe"
+	"github.com/naiba/ucenter/pkg/mail"
 	"github.com/naiba/ucenter/pkg/nbgin"
+	"github.com/naiba/ucenter/pkg/password"
+	"github.com/naiba/ucenter/pkg/pii"
 	"github.com/naiba/ucenter/pkg/ram"
-	"github.com/naiba/ucenter/pkg/recaptcha"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/go-playground/validator.v9"
+	"gopkg.in/square/go-jose.v2"
 )
 
 var isImage = regexp.MustCompile(`^.*\.((png)|(jpeg)|(jpg)|(gif))$`)
 
+// phonePattern E.164 格式的手机号
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
 func index(c *gin.Context) {
 	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
 	c.HTML(http.StatusOK, "user/index", nbgin.Data(c, gin.H{
-		"user": u,
+		"user":            u,
+		"clientTemplates": ucenter.C.ClientTemplates,
+		"emailChange":     pendingEmailChange(u.ID),
 	}))
 }
 
 func userStatus(c *gin.Context) {
 	type userStatusForm struct {
-		ID     uint `form:"id" binding:"required,numeric,min=1"`
-		Status int  `form:"status" bindimg:"required,numeric"`
+		ID     uint   `form:"id" binding:"required,numeric,min=1"`
+		Status int    `form:"status" bindimg:"required,numeric"`
+		Until  int64  `form:"until" binding:"omitempty,min=0"` // 临时禁用的解除时间（Unix 秒），0 为永久
+		Reason string `form:"reason" binding:"max=255"`
 	}
 
 	var usf userStatusForm
+	var until *time.Time
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
 	// 验证用户输入
 	err := c.ShouldBind(&usf)
 	if usf.Status != 0 && usf.Status != ucenter.StatusSuspended {
 		err = errors.New("不支持的状态")
+	} else if usf.Status == ucenter.StatusSuspended && strings.TrimSpace(usf.Reason) == "" {
+		err = errors.New("禁用必须填写原因")
+	} else if usf.Until > 0 {
+		t := time.Unix(usf.Until, 0)
+		until = &t
+		if usf.Status != ucenter.StatusSuspended {
+			err = errors.New("只有禁用状态可以设置解除时间")
+		} else if !t.After(time.Now()) {
+			err = errors.New("解除时间必须晚于当前时间")
+		}
+	}
+	if err == nil && isDryRun(c) {
+		d := newDryRunImpact()
+		if err = userStatusImpact(d, usf.ID, usf.Status); err == nil {
+			writeDryRun(c, d)
+			return
+		}
 	}
 	if err == nil {
-		err = ucenter.DB.Model(ucenter.User{}).Where("id = ?", usf.ID).Select("status").Update(map[string]interface{}{"status": usf.Status}).Error
+		var by uint
+		if usf.Status == ucenter.StatusSuspended {
+			by = u.ID
+		}
+		// 重新启用时重置长期未登录的停用计时
+		err = ucenter.DB.Model(ucenter.User{}).Where("id = ?", usf.ID).Select("status", "suspended_until", "suspend_reason", "suspended_by", "stale_warned_at").Updates(map[string]interface{}{
+			"status":          usf.Status,
+			"suspended_until": until,
+			"suspend_reason":  strings.TrimSpace(usf.Reason),
+			"suspended_by":    by,
+			"stale_warned_at": nil,
+		}).Error
+	}
+	// 禁用后立即下线全部终端并吊销令牌，启用后清理申诉
+	if err == nil && usf.Status == ucenter.StatusSuspended {
+		err = revokeUserAccess(usf.ID)
+	} else if err == nil {
+		err = ucenter.DB.Delete(ucenter.Appeal{}, "user_id = ?", usf.ID).Error
 	}
 	if err != nil {
 		c.AbortWithError(http.StatusForbidden, err)
@@ -58,44 +112,52 @@ func editProfileHandler(c *gin.Context) {
 	type editForm struct {
 		Username   string `form:"username" cfn:"用户名" binding:"omitempty,min=1,max=20,alphanum"`
 		Bio        string `form:"bio" cfn:"简介" binding:"omitempty,min=1,max=255"`
+		Email      string `form:"email" cfn:"邮箱" binding:"omitempty,email,max=255"`
+		Phone      string `form:"phone" cfn:"手机号" binding:"omitempty,max=16"`
 		Password   string `form:"password" cfn:"密码" binding:"omitempty,min=6,max=32,eqfield=RePassword"`
 		RePassword string `form:"repassword" cfn:"确认密码" binding:"omitempty,min=6,max=32"`
 	}
 
 	var ef editForm
 	var errors = make(map[string]string)
-	var num int
 	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
 
 	// 验证用户输入
 	if err := c.ShouldBind(&ef); err != nil {
 		errors = err.(validator.ValidationErrors).Translate(ucenter.ValidatorTrans)
+	} else if (ef.Password != "" || (ef.Email != "" && ef.Email != string(u.Email))) && !sudoActive(c) {
+		// 修改密码、邮箱需近期验证过身份
+		abortSudo(c)
+		return
 	} else if ef.Username != u.Username {
-		if ucenter.DB.Model(ucenter.User{}).Where("username = ?", ef.Username).Count(&num); num != 0 {
+		if loginNameTaken(ef.Username) {
 			errors["editProfileForm.用户名"] = "用户名已被使用"
+		} else if ef.Username != "" && usernameReserved(ef.Username) {
+			errors["editProfileForm.用户名"] = "该用户名为保留用户名"
+		}
+	}
+	if ef.Email != "" && emailTaken(ef.Email, u.ID) {
+		errors["editProfileForm.邮箱"] = "邮箱已被使用"
+	} else if ef.Email != "" && ef.Email != string(u.Email) && !mail.Enabled() {
+		// 新邮箱须经新旧邮箱确认，不能直接修改
+		errors["editProfileForm.邮箱"] = "未配置邮件发送，暂不能修改邮箱"
+	}
+	if ef.Phone != "" && !phonePattern.MatchString(ef.Phone) {
+		errors["editProfileForm.手机号"] = "手机号需含国家代码，如 +8613800000000"
+	}
+	if ef.Password != "" {
+		if err := checkNewPassword(u, ef.Password); err != nil {
+			errors["editProfileForm.密码"] = err.Error()
 		}
 	}
 
 	avatar, err := c.FormFile("avatar")
 	var f multipart.File
 	if err == nil {
-		f, err = avatar.Open()
-		if err != nil {
+		if f, err = openImageUpload(avatar); err != nil {
 			errors["editProfileForm.头像"] = err.Error()
 		} else {
 			defer f.Close()
-			buff := make([]byte, 512) // why 512 bytes ? see http://golang.org/pkg/net/http/#DetectContentType
-			_, err = f.Read(buff)
-			if err != nil {
-				errors["editProfileForm.头像"] = err.Error()
-			} else if !strings.HasPrefix(http.DetectContentType(buff), "image/") {
-				errors["editProfileForm.头像"] = "头像不是图片文件"
-			}
-		}
-		if !isImage.MatchString(avatar.Filename) {
-			errors["editProfileForm.头像"] = "头像不是图片文件"
-		} else if avatar.Size > 1024*1024*2 {
-			errors["editProfileForm.头像"] = "头像不能大于 2 M"
 		}
 	}
 
@@ -110,29 +172,48 @@ func editProfileHandler(c *gin.Context) {
 	if len(ef.Bio) > 0 {
 		u.Bio = ef.Bio
 	}
+	// 表单总是携带手机号，留空表示删除
+	if _, ok := c.GetPostForm("phone"); ok {
+		u.Phone = pii.String(ef.Phone)
+	}
+	var emailPending bool
+	if ef.Email != "" && ef.Email != string(u.Email) {
+		if err := requestEmailChange(u, ef.Email); err != nil {
+			c.JSON(http.StatusForbidden, map[string]string{
+				"editProfileForm.邮箱": "确认邮件发送失败，请稍后再试",
+			})
+			return
+		}
+		emailPending = true
+	}
 	if len(ef.RePassword) > 0 {
-		bPass, err := bcrypt.GenerateFromPassword([]byte(ef.Password), bcrypt.DefaultCost)
-		if err != nil {
+		if err := setPassword(u, ef.Password); err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
-		u.Password = string(bPass)
 	}
+	var oldAvatar string
 	if f != nil {
-		f.Seek(0, 0)
-		out, err := os.Create("data/upload/avatar/" + u.StrID())
-		if err != nil {
+		if oldAvatar, err = saveUserAvatar(u, f); err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
-		defer out.Close()
-		io.Copy(out, f)
-		u.Avatar = true
 	}
 	if err := ucenter.DB.Save(&u).Error; err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
+	if len(ef.RePassword) > 0 {
+		auditCurrent(c, ucenter.AuditPasswordChange, userTarget(u.ID), "")
+	}
+	if oldAvatar != "" {
+		os.Remove(oldAvatar)
+	}
+	if emailPending {
+		c.JSON(http.StatusOK, gin.H{
+			"notice": "确认链接已发送到新旧邮箱，两边都确认后邮箱才会修改。",
+		})
+	}
 }
 
 func userDelete(c *gin.Context) {
@@ -147,39 +228,93 @@ func userDelete(c *gin.Context) {
 		return
 	}
 
-	ucenter.DB.Delete(ucenter.Login{}, "user_id = ?", id)
-	ucenter.DB.Delete(ucenter.UserAuthorized{}, "user_id = ?", id)
-	ucenter.DB.Delete(storage.FositeClient{}, "owner = ?", id)
-	ucenter.DB.Unscoped().Delete(ucenter.User{}, "id = ?", id)
+	uid, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if err := deleteUser(uint(uid)); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditAccountDelete, userTarget(uint(uid)), "")
+}
+
+// deleteUser 在同一事务中删除用户及其登录终端、授权、令牌和应用。建立外键后登录终端、授权及应用的令牌由数据库级联删除，
+// 这里仍逐一删除，兼容尚未运行 ucenter upgrade 的数据库
+func deleteUser(uid uint) error {
+	sub := strconv.FormatUint(uint64(uid), 10)
+	tx := ucenter.DB.Begin()
+	// 保留墓碑，已签发的 sub 不会被重新分配
+	err := tx.FirstOrCreate(&ucenter.UserTombstone{}, ucenter.UserTombstone{UserID: uid}).Error
+	if err == nil {
+		err = oauth2store.(*storage.FositeStore).DeleteSubjectTokens(tx, sub)
+	}
+	if err == nil {
+		err = tx.Exec("DELETE FROM login_clients WHERE login_token IN (SELECT token FROM logins WHERE user_id = ?)", uid).Error
+	}
+	for _, m := range []interface{}{ucenter.Login{}, ucenter.TrustedDevice{}, ucenter.RecoveryCode{}, ucenter.UserAuthorized{}} {
+		if err == nil {
+			err = tx.Delete(m, "user_id = ?", uid).Error
+		}
+	}
+	var owned []string
+	if err == nil {
+		err = tx.Model(storage.FositeClient{}).Where("owner = ?", sub).Pluck("client_id", &owned).Error
+	}
+	for _, id := range owned {
+		if err == nil {
+			err = deleteClient(tx, id)
+		}
+	}
+	if err == nil {
+		err = tx.Unscoped().Delete(ucenter.User{}, "id = ?", uid).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	revokeProvisionedRoles(uid)
+	deleteExports(uid)
+	return nil
 }
 
 func login(c *gin.Context) {
 	// 如果已登录，就跳转
 	if _, ok := c.Get(ucenter.AuthUser); ok {
 		nbgin.SetNoCache(c)
-		if returnURL := c.Query("return_url"); strings.HasPrefix(returnURL, "/") {
-			c.Redirect(http.StatusFound, returnURL)
-		} else {
-			c.Redirect(http.StatusFound, "/")
-		}
+		c.Redirect(http.StatusFound, safeReturnURL(c.Query("return_url"), "/"))
 		return
 	}
 
-	c.HTML(http.StatusOK, "page/login", nbgin.Data(c, gin.H{}))
+	hint := loginHint(c)
+	c.HTML(http.StatusOK, "page/login", nbgin.Data(c, gin.H{
+		"captcha":    captchaRequired(clientIP(c), hint),
+		"identifier": hint,
+	}))
 }
 
 func logout(c *gin.Context) {
 	token, err := c.Cookie(ucenter.C.AuthCookieName)
 	if err == nil {
-		ucenter.DB.Unscoped().Delete(ucenter.Login{}, "token = ?", token)
+		// 提示将一同退出的应用，未携带 CSRF Token 时（如外部链接）也需用户确认
+		if clients := loginClients(token); (len(clients) > 0 && c.Query("confirm") == "") || !validCSRF(c) {
+			nbgin.SetNoCache(c)
+			c.HTML(http.StatusOK, "page/logout", nbgin.Data(c, gin.H{
+				"clients":    clients,
+				"confirmURL": "/logout?return_url=" + url.QueryEscape(safeReturnURL(c.Query("return_url"), "")),
+			}))
+			return
+		}
+		endLogin(c.MustGet(ucenter.AuthUser).(*ucenter.User).ID, token)
 	}
 	nbgin.SetCookie(c, -1, ucenter.C.AuthCookieName, "")
+	setBrowserState(c, "")
 	nbgin.SetNoCache(c)
-	if returnURL := c.Query("return_url"); strings.HasPrefix(returnURL, "/") {
-		c.Redirect(http.StatusFound, returnURL)
-	} else {
-		c.Redirect(http.StatusFound, "/login")
-	}
+	c.Redirect(http.StatusFound, safeReturnURL(c.Query("return_url"), "/login"))
 }
 
 func loginHandler(c *gin.Context) {
@@ -190,38 +325,135 @@ func loginHandler(c *gin.Context) {
 	}
 
 	type loginForm struct {
-		ReCaptcha string `form:"g-recaptcha-response" cfn:"人机验证" binding:"required,min=10"`
-		Username  string `form:"username" cfn:"用户名" binding:"required,min=1,max=20"`
-		Password  string `form:"password" cfn:"密码" binding:"required,min=6,max=32"`
+		// Username 用户名或邮箱
+		Username string `form:"username" cfn:"用户名" binding:"required,min=1,max=255"`
+		Password string `form:"password" cfn:"密码" binding:"required,min=6,max=32"`
 	}
 	var lf loginForm
 	var u ucenter.User
 	var errors validator.ValidationErrorsTranslations
+	var ident *ucenter.Identity
+	var passOK, needRehash bool
 
 	// 验证用户输入
 	if err := c.ShouldBind(&lf); err != nil {
 		errors = err.(validator.ValidationErrors).Translate(ucenter.ValidatorTrans)
-	} else if err = ucenter.DB.Where("username = ?", lf.Username).First(&u).Error; err != nil {
+	} else if msg := countryDenied(clientIP(c), ucenter.C.LoginCountries); msg != "" {
+		errors = map[string]string{
+			"loginForm.地区": msg,
+		}
+	} else if msg := reputationDenied(c, "登录"); msg != "" {
 		errors = map[string]string{
-			"loginForm.用户名": "用户不存在",
+			"loginForm.地区": msg,
 		}
-	} else if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(lf.Password)) != nil {
+	} else if d := loginLockedFor(lf.Username, clientIP(c)); d > 0 {
 		errors = map[string]string{
-			"loginForm.密码": "密码不正确",
+			"loginForm.用户名": fmt.Sprintf("登录失败次数过多，请 %s 后再试", humanDuration(d)),
 		}
-	} else if ok, _ := recaptcha.Verify(ucenter.C.ReCaptchaSecret, lf.ReCaptcha, c.ClientIP()); !ok {
+	} else if !passCaptcha(c, lf.Username) {
 		errors = map[string]string{
 			"loginForm.人机验证": "人机验证未通过",
 		}
+	} else if ident, err = findLoginUser(lf.Username, &u); err != nil {
+		recordLoginFailure(lf.Username, clientIP(c))
+		audit(c, 0, ucenter.AuditLoginFailure, "", "用户不存在："+lf.Username)
+		if ucenter.C.LoginPrivacy {
+			password.VerifyDummy(lf.Password)
+		}
+		errors = loginFailed("loginForm.用户名", "用户不存在")
+	} else if passOK, needRehash = password.Verify(loginSecret(&u, ident), lf.Password); !passOK {
+		recordLoginFailure(lf.Username, clientIP(c))
+		audit(c, 0, ucenter.AuditLoginFailure, userTarget(u.ID), "密码不正确")
+		notifySecurity(&u, ucenter.AlertLoginFailure, "密码不正确，IP："+clientIP(c))
+		errors = loginFailed("loginForm.密码", "密码不正确")
+	} else if liftExpiredSuspension(&u); u.IsSuspended() {
+		// 已验证密码，可查看禁用原因并申诉
+		showSuspended(c, &u)
+		return
+	} else if u.Blocked() {
+		if u.Status == ucenter.StatusUnconfirmed {
+			// 已验证密码，重新发送注册邮箱的确认链接
+			if err := resendSignupEmail(&u); err != nil {
+				log.Printf("signup email %s: %s", u.StrID(), err)
+			}
+		}
+		errors = map[string]string{
+			"loginForm.用户名": suspendedMessage(&u),
+		}
 	}
 
 	if errors != nil {
 		c.HTML(http.StatusOK, "page/login", nbgin.Data(c, gin.H{
-			"errors": errors,
+			"errors":     errors,
+			"captcha":    captchaRequired(clientIP(c), lf.Username),
+			"identifier": lf.Username,
 		}))
 		return
 	}
+	// 密码哈希升级到当前配置
+	if needRehash {
+		if hash, err := password.Hash(lf.Password); err == nil && ident != nil {
+			ucenter.DB.Model(ident).Update("secret", hash)
+		} else if err == nil {
+			ucenter.DB.Model(&u).Update("password", hash)
+		}
+	}
+	detail := "密码登录"
+	if ident != nil {
+		ucenter.DB.Model(ident).Update("last_used_at", time.Now())
+		detail = "附加登录名：" + ident.Subject
+	}
+	completeLogin(c, &u, ucenter.AMRPassword, detail, safeReturnURL(c.Query("return_url"), "/"))
+}
+
+// loginFailed 登录失败的提示，隐私模式下不区分用户不存在和密码错误
+func loginFailed(field, msg string) map[string]string {
+	if ucenter.C.LoginPrivacy {
+		return map[string]string{
+			"loginForm.密码": "用户名或密码不正确",
+		}
+	}
+	return map[string]string{
+		field: msg,
+	}
+}
+
+// findLoginUser 按用户名或邮箱查找登录用户，用户名不含 @，据此区分；
+// 使用附加登录名时同时返回该身份
+func findLoginUser(name string, u *ucenter.User) (*ucenter.Identity, error) {
+	if !strings.Contains(name, "@") {
+		err := ucenter.DB.Where("username = ?", name).First(u).Error
+		if err != gorm.ErrRecordNotFound {
+			return nil, err
+		}
+		var ident ucenter.Identity
+		if ucenter.DB.Where("provider = ? AND subject = ?", ucenter.IdentityPassword, name).First(&ident).Error != nil {
+			return nil, err
+		}
+		return &ident, ucenter.DB.First(u, "id = ?", ident.UserID).Error
+	}
+	cond, arg := ucenter.EmailQuery(name)
+	return nil, ucenter.DB.Where(cond, arg).First(u).Error
+}
+
+// loginSecret 登录需比对的密码哈希，附加登录名有独立的密码
+func loginSecret(u *ucenter.User, ident *ucenter.Identity) string {
+	if ident != nil {
+		return ident.Secret
+	}
+	return u.Password
+}
 
+// emailTaken 邮箱是否已被其他用户使用
+func emailTaken(email string, except uint) bool {
+	var count int
+	cond, arg := ucenter.EmailQuery(email)
+	ucenter.DB.Model(ucenter.User{}).Where(cond, arg).Where("id <> ?", except).Count(&count)
+	return count > 0
+}
+
+// establishSession 为用户创建登录终端并写入 Cookie，amr 为本次验证身份的方式
+func establishSession(c *gin.Context, u *ucenter.User, amr ...string) (*ucenter.Login, error) {
 	rawUA := c.Request.UserAgent()
 	ua := user_agent.New(rawUA)
 	var loginClient ucenter.Login
@@ -229,34 +461,177 @@ func loginHandler(c *gin.Context) {
 	loginClient.Token = com.MD5(rawUA + time.Now().String() + u.Username)
 	browser, _ := ua.Browser()
 	loginClient.Name = ua.OS() + " " + browser
-	loginClient.IP = c.ClientIP()
+	loginClient.IP = clientIP(c)
+	loginClient.Location, _ = geoip.Location(loginClient.IP)
 	loginClient.Expire = time.Now().Add(ucenter.AuthCookieExpiretion)
+	loginClient.LastSeenAt = time.Now()
+	// 刚登录视为已验证身份
+	sudoUntil := time.Now().Add(time.Minute * time.Duration(ucenter.C.SudoTTL))
+	loginClient.SudoUntil = &sudoUntil
+	authTime := time.Now()
+	loginClient.AuthTime = &authTime
+	loginClient.AMR = loginAMR(amr)
 	if err := ucenter.DB.Save(&loginClient).Error; err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
+		return nil, err
 	}
+	touchLastLogin(u.ID)
+	checkNewDevice(u, &loginClient, rawUA)
 	nbgin.SetCookie(c, 60*60*24*365*2, ucenter.C.AuthCookieName, loginClient.Token)
-	nbgin.SetNoCache(c)
-	if returnURL := c.Query("return_url"); strings.HasPrefix(returnURL, "/") {
-		c.Redirect(http.StatusFound, returnURL)
-	} else {
-		c.Redirect(http.StatusFound, "/")
+	setBrowserState(c, loginClient.Token)
+	if _, err := newCSRFToken(c); err != nil {
+		return nil, err
 	}
+	return &loginClient, nil
+}
+
+// touchLastLogin 记录最近登录时间并清除长期未登录提醒，不经过网页的登录方式同样需要调用
+func touchLastLogin(uid uint) {
+	ucenter.DB.Model(ucenter.User{}).Where("id = ?", uid).Select("last_login_at", "stale_warned_at").Updates(map[string]interface{}{
+		"last_login_at":   time.Now(),
+		"stale_warned_at": nil,
+	})
 }
 
 func signup(c *gin.Context) {
 	// 如果已登录，就跳转
 	if _, ok := c.Get(ucenter.AuthUser); ok {
 		nbgin.SetNoCache(c)
-		if returnURL := c.Query("return_url"); strings.HasPrefix(returnURL, "/") {
-			c.Redirect(http.StatusFound, returnURL)
-		} else {
-			c.Redirect(http.StatusFound, "/")
-		}
+		c.Redirect(http.StatusFound, safeReturnURL(c.Query("return_url"), "/"))
 		return
 	}
 
-	c.HTML(http.StatusOK, "page/signup", nbgin.Data(c, gin.H{}))
+	policy := signupPolicy()
+	if policy.Closed {
+		c.HTML(http.StatusForbidden, "page/info", gin.H{
+			"icon":  "lock",
+			"title": "注册已关闭",
+			"msg":   "本站暂不开放注册",
+		})
+		return
+	}
+	c.HTML(http.StatusOK, "page/signup", nbgin.Data(c, gin.H{
+		"inviteOnly":    ucenter.C.SignupInviteOnly,
+		"invite":        c.Query("invite"),
+		"emailRequired": policy.EmailRequired(),
+		"captcha":       captchaRequired(clientIP(c), ""),
+		"legal":         currentLegalDocuments(),
+	}))
+}
+
+// signupUnavailable 用户名、邮箱不可用的提示，隐私模式下不区分已被使用和保留
+func signupUnavailable(field, msg string) map[string]string {
+	if ucenter.C.LoginPrivacy {
+		msg = "用户名或邮箱不可用"
+	}
+	return map[string]string{
+		field: msg,
+	}
+}
+
+// signUpForm 注册表单，网页与注册 API 共用
+type signUpForm struct {
+	Username   string `form:"username" json:"username" cfn:"用户名" binding:"required,min=1,max=20,alphanum"`
+	Password   string `form:"password" json:"password" cfn:"密码" binding:"required,min=6,max=32,eqfield=Password"`
+	RePassword string `form:"repassword" json:"repassword" cfn:"确认密码" binding:"required,min=6,max=32"`
+	Invite     string `form:"invite" json:"invite" cfn:"邀请码" binding:"max=32"`
+	Email      string `form:"email" json:"email" cfn:"邮箱" binding:"omitempty,email,max=255"`
+	Agree      bool   `form:"agree" json:"agree"`
+}
+
+// checkSignup 校验用户名、邮箱、密码、条款及邀请码，通过时返回 nil
+func checkSignup(suf *signUpForm, policy *ucenter.SignupPolicy, legal []ucenter.LegalDocument) map[string]string {
+	var u ucenter.User
+	if err := ucenter.DB.Where("username = ?", suf.Username).First(&u).Error; err != gorm.ErrRecordNotFound || loginNameTaken(suf.Username) {
+		return signupUnavailable("signUpForm.用户名", "用户名已存在")
+	} else if usernameReserved(suf.Username) {
+		return signupUnavailable("signUpForm.用户名", "该用户名为保留用户名")
+	} else if policy.EmailRequired() && (suf.Email == "" || !policy.EmailAllowed(suf.Email)) {
+		return map[string]string{
+			"signUpForm.邮箱": "该邮箱域名不允许注册",
+		}
+	} else if suf.Email != "" && emailTaken(suf.Email, 0) {
+		return signupUnavailable("signUpForm.邮箱", "邮箱已被使用")
+	} else if err := checkNewPassword(&ucenter.User{Username: suf.Username, Email: pii.String(suf.Email)}, suf.Password); err != nil {
+		return map[string]string{
+			"signUpForm.密码": err.Error(),
+		}
+	} else if len(legal) > 0 && !suf.Agree {
+		return map[string]string{
+			"signUpForm.条款": "请阅读并同意服务条款及隐私政策",
+		}
+	} else if ucenter.C.SignupInviteOnly && !inviteAvailable(suf.Invite) {
+		return map[string]string{
+			"signUpForm.邀请码": "邀请码无效或已被使用",
+		}
+	}
+	return nil
+}
+
+// errInviteRedeem 邀请码在提交期间已被他人使用
+type errInviteRedeem struct{ error }
+
+// createSignupUser 创建通过校验的新用户，记录条款同意并核销邀请码。
+// 注册邮箱确认后才写入账户，之前不能用于登录；限定邮箱域名时确认前账户不可登录
+func createSignupUser(suf *signUpForm, policy *ucenter.SignupPolicy, legal []ucenter.LegalDocument, ip string) (*ucenter.User, error) {
+	u := ucenter.User{
+		Username: suf.Username,
+	}
+	if err := setPassword(&u, suf.Password); err != nil {
+		return nil, err
+	}
+	// 需审核时，第一位用户以外的新用户进入审核队列，限定邮箱域名时确认邮箱后再进入
+	if policy.EmailRequired() {
+		u.Status = ucenter.StatusUnconfirmed
+	} else if ucenter.C.SignupApproval {
+		var count int
+		ucenter.DB.Model(ucenter.User{}).Count(&count)
+		if count > 0 {
+			u.Status = ucenter.StatusPending
+		}
+	}
+	tx := ucenter.DB.Begin()
+	if err := tx.Create(&u).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := acceptLegalDocuments(tx, u.ID, legal, ip); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if ucenter.C.SignupInviteOnly {
+		if err := redeemInvite(tx, suf.Invite, u.ID); err != nil {
+			tx.Rollback()
+			return nil, errInviteRedeem{err}
+		}
+	}
+	var change *ucenter.EmailChange
+	if suf.Email != "" {
+		var err error
+		if change, err = newEmailChange(&u, suf.Email); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Create(change).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	if change != nil {
+		// 发送失败时可在个人资料中重新填写邮箱，待确认邮箱的账户登录时会重新发送
+		if err := sendEmailChange(&u, change); err != nil {
+			log.Printf("signup email %s: %s", u.StrID(), err)
+		}
+	}
+	// 第一位用户授予 Root 权限
+	if u.ID == 1 {
+		if err := grantRole(u.ID, ram.RoleSuperAdmin, ram.DefaultDomain, 0, "第一位注册用户"); err != nil {
+			return nil, err
+		}
+	}
+	return &u, nil
 }
 
 func signupHandler(c *gin.Context) {
@@ -266,57 +641,100 @@ func signupHandler(c *gin.Context) {
 		return
 	}
 
-	type signUpForm struct {
-		ReCaptcha  string `form:"g-recaptcha-response" cfn:"人机验证" binding:"required,min=10"`
-		Username   string `form:"username" cfn:"用户名" binding:"required,min=1,max=20,alphanum"`
-		Password   string `form:"password" cfn:"密码" binding:"required,min=6,max=32,eqfield=Password"`
-		RePassword string `form:"repassword" cfn:"确认密码" binding:"required,min=6,max=32"`
-	}
 	var suf signUpForm
-	var u ucenter.User
 	var errors validator.ValidationErrorsTranslations
+	policy := signupPolicy()
+	legal := currentLegalDocuments()
+	if policy.Closed {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
 	if err := c.ShouldBind(&suf); err != nil {
 		errors = err.(validator.ValidationErrors).Translate(ucenter.ValidatorTrans)
-	} else if err = ucenter.DB.Where("username = ?", suf.Username).First(&u).Error; err != gorm.ErrRecordNotFound {
+	} else if msg := countryDenied(clientIP(c), ucenter.C.SignupCountries); msg != "" {
+		errors = map[string]string{
+			"signUpForm.地区": msg,
+		}
+	} else if msg := reputationDenied(c, "注册"); msg != "" {
 		errors = map[string]string{
-			"signUpForm.用户名": "用户名已存在",
+			"signUpForm.地区": msg,
 		}
-	} else if ok, _ := recaptcha.Verify(ucenter.C.ReCaptchaSecret, suf.ReCaptcha, c.ClientIP()); !ok {
+	} else if ucenter.C.LoginPrivacy && !passCaptcha(c, "") {
+		// 隐私模式下先通过人机验证，才能得知用户名、邮箱是否可用
 		errors = map[string]string{
 			"signUpForm.人机验证": "人机验证未通过",
 		}
+	} else if msgs := checkSignup(&suf, policy, legal); msgs != nil {
+		errors = msgs
+	} else if !ucenter.C.LoginPrivacy && !passCaptcha(c, "") {
+		errors = map[string]string{
+			"signUpForm.人机验证": "人机验证未通过",
+		}
+	}
+	if errors == nil {
+		u, err := createSignupUser(&suf, policy, legal, clientIP(c))
+		if _, ok := err.(errInviteRedeem); ok {
+			errors = map[string]string{
+				"signUpForm.邀请码": err.Error(),
+			}
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		} else if u.Status == ucenter.StatusPending {
+			c.HTML(http.StatusOK, "page/info", gin.H{
+				"icon":  "hourglass half",
+				"title": "注册成功",
+				"msg":   "您的账户正在等待管理员审核，审核通过后即可登录。",
+			})
+			return
+		} else if u.Status == ucenter.StatusUnconfirmed {
+			c.HTML(http.StatusOK, "page/info", gin.H{
+				"icon":  "mail",
+				"title": "注册成功",
+				"msg":   "请打开发送到 " + suf.Email + " 的确认链接，确认邮箱后即可登录。",
+			})
+			return
+		}
 	}
 	if errors != nil {
 		c.HTML(http.StatusOK, "page/signup", nbgin.Data(c, gin.H{
-			"errors": errors,
+			"errors":        errors,
+			"inviteOnly":    ucenter.C.SignupInviteOnly,
+			"invite":        suf.Invite,
+			"emailRequired": policy.EmailRequired(),
+			"captcha":       captchaRequired(clientIP(c), ""),
+			"legal":         legal,
 		}))
 		return
 	}
-	u.Username = suf.Username
-	bPass, err := bcrypt.GenerateFromPassword([]byte(suf.Password), bcrypt.DefaultCost)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
-	}
-	u.Password = string(bPass)
-	if err := ucenter.DB.Create(&u).Error; err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
-	}
-	// 第一位用户授予 Root 权限
-	if u.ID == 1 {
-		ucenter.RAM.AddRoleForUserInDomain(u.StrID(), ram.RoleSuperAdmin, ram.DefaultDomain)
-	}
 	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
 	c.Redirect(http.StatusFound, "/login?"+c.Request.URL.RawQuery)
 }
 
 func editOauth2App(c *gin.Context) {
 	type Oauth2AppForm struct {
-		ID          string `form:"id" cfn:"ID" binding:"omitempty,min=3,max=255"`
-		Name        string `form:"name" cfn:"应用名" binding:"required,min=1,max=20"`
-		URL         string `form:"url" cfn:"首页链接" binding:"required,url,min=11,max=100"`
-		RedirectURI string `form:"redirect_uri" cfn:"跳转链接" binding:"required,url,min=1,max=255"`
+		ID             string `form:"id" cfn:"ID" binding:"omitempty,min=3,max=255"`
+		Name           string `form:"name" cfn:"应用名" binding:"required,min=1,max=20"`
+		URL            string `form:"url" cfn:"首页链接" binding:"required,url,min=11,max=100"`
+		RedirectURI    string `form:"redirect_uri" cfn:"跳转链接" binding:"required,url,min=1,max=255"`
+		RedirectPolicy string `form:"redirect_uri_policy" cfn:"跳转链接" binding:"omitempty,oneof=exact prefix loopback"`
+		Secret         string `form:"secret" cfn:"密钥" binding:"omitempty,min=16,max=128"`
+		JWKS           string `form:"jwks" cfn:"加密公钥" binding:"omitempty,max=10000"`
+		IDTokenAlg     string `form:"id_token_encrypted_response_alg" cfn:"ID Token 加密" binding:"omitempty,max=20"`
+		IDTokenEnc     string `form:"id_token_encrypted_response_enc" cfn:"ID Token 加密" binding:"omitempty,max=20"`
+		UserinfoAlg    string `form:"userinfo_encrypted_response_alg" cfn:"用户信息加密" binding:"omitempty,max=20"`
+		UserinfoEnc    string `form:"userinfo_encrypted_response_enc" cfn:"用户信息加密" binding:"omitempty,max=20"`
+		Template       string `form:"template" cfn:"应用类型" binding:"omitempty,max=20"`
+		Scope          string `form:"scope" cfn:"授权范围" binding:"omitempty,max=255"`
+		TokenFormat    string `form:"access_token_strategy" cfn:"访问令牌" binding:"omitempty,oneof=opaque jwt"`
+		NarrowScope    bool   `form:"narrow_scope"`
+		LogoutURI      string `form:"post_logout_redirect_uri" cfn:"退出后跳转" binding:"omitempty,url,max=255"`
+		Backchannel    string `form:"backchannel_logout_uri" cfn:"退出通知" binding:"omitempty,url,max=255"`
+		// 令牌有效期留空保留原值，0 使用全局默认值
+		AccessLifespan  string `form:"access_token_lifespan" cfn:"令牌有效期" binding:"omitempty,numeric,max=4"`
+		RefreshLifespan string `form:"refresh_token_lifespan" cfn:"令牌有效期" binding:"omitempty,numeric,max=4"`
+		IDTokenLifespan string `form:"id_token_lifespan" cfn:"令牌有效期" binding:"omitempty,numeric,max=4"`
+		CodeLifespan    string `form:"authorize_code_lifespan" cfn:"令牌有效期" binding:"omitempty,numeric,max=2"`
 	}
 
 	var ef Oauth2AppForm
@@ -328,27 +746,14 @@ func editOauth2App(c *gin.Context) {
 		errors = err.(validator.ValidationErrors).Translate(ucenter.ValidatorTrans)
 	}
 
-	// 验证头像是否是图片文件
+	// 验证头像是否是图片文件并通过安全扫描
 	avatar, err := c.FormFile("avatar")
 	var f multipart.File
 	if err == nil {
-		f, err = avatar.Open()
-		if err != nil {
+		if f, err = openImageUpload(avatar); err != nil {
 			errors["editOauthAppForm.应用名"] = err.Error()
 		} else {
 			defer f.Close()
-			buff := make([]byte, 512) // why 512 bytes ? see http://golang.org/pkg/net/http/#DetectContentType
-			_, err = f.Read(buff)
-			if err != nil {
-				errors["editOauthAppForm.应用名"] = err.Error()
-			} else if !strings.HasPrefix(http.DetectContentType(buff), "image/") {
-				errors["editOauthAppForm.应用名"] = "头像不是图片文件"
-			}
-		}
-		if !isImage.MatchString(avatar.Filename) {
-			errors["editOauthAppForm.应用名"] = "头像不是图片文件"
-		} else if avatar.Size > 1024*1024*2 {
-			errors["editOauthAppForm.应用名"] = "头像不能大于 2 M"
 		}
 	} else if ef.ID == "" {
 		errors["editOauthAppForm.圆图标"] = "圆图标必须上传"
@@ -356,13 +761,14 @@ func editOauth2App(c *gin.Context) {
 
 	var client *storage.FositeClient
 	var newClient bool
+	var secret string
 
 	// 验证管理权
 	if len(ef.ID) > 0 {
 		x, err := oauth2store.GetClient(nil, ef.ID)
 		client = x.(*storage.FositeClient)
 		isAdmin := ucenter.RAM.Enforce(u.StrID(), ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel)
-		if err != nil || (!strings.HasPrefix(ef.ID, u.StrID()+"-") && !isAdmin) {
+		if err != nil || (!ownsClient(u, client) && !isAdmin) {
 			errors["editOauthAppForm.应用名"] = "ID错误"
 		}
 		if client.Status == storage.StatusOauthClientSuspended && !isAdmin {
@@ -371,12 +777,89 @@ func editOauth2App(c *gin.Context) {
 	} else {
 		newClient = true
 		client = new(storage.FositeClient)
-		client.Scope = "profile openid"
-		client.ClientID, err = genClientID(u.StrID())
+		if ef.Template == "" {
+			ef.Template = "web"
+		}
+		if tpl, ok := ucenter.C.ClientTemplates[ef.Template]; ok {
+			applyClientTemplate(client, ef.Template, tpl)
+		} else {
+			errors["editOauthAppForm.应用类型"] = "应用类型不存在"
+		}
+		client.ClientID, err = genClientID(u.Subject())
+		client.Owner = u.StrID()
 		if err != nil {
 			errors["editOauthAppForm.应用名"] = "生成应用ID"
+		}
+		// 未填写密钥时由服务端生成，公开客户端及 mTLS 认证的客户端没有密钥
+		if !client.IsPublic() && !client.UsesMTLS() {
+			if ef.Secret != "" {
+				if password.Entropy(ef.Secret) < float64(ucenter.C.ClientSecretMinEntropy) {
+					errors["editOauthAppForm.密钥"] = fmt.Sprintf("密钥强度不足，至少需要 %d 比特熵", ucenter.C.ClientSecretMinEntropy)
+				}
+				secret = ef.Secret
+			} else if secret, err = password.GenerateSecret(); err != nil {
+				errors["editOauthAppForm.密钥"] = "生成秘钥出错"
+			}
+		}
+	}
+
+	// 授权范围不能超出应用模板的上限，留空保留原有范围
+	if ef.Scope != "" {
+		if err := checkTemplateScope(client, ef.Scope); err != nil {
+			errors["editOauthAppForm.授权范围"] = err.Error()
+		}
+	}
+
+	// 加密 ID Token 及用户信息使用的公钥，留空保留原有公钥
+	keys := client.JSONWebKeys
+	if ef.JWKS != "" {
+		keys = new(jose.JSONWebKeySet)
+		if err := json.Unmarshal([]byte(ef.JWKS), keys); err != nil {
+			errors["editOauthAppForm.加密公钥"] = "公钥不是有效的 JWKS"
+		}
+	}
+	if err := jwe.Validate(ef.IDTokenAlg, ef.IDTokenEnc, keys); err != nil {
+		errors["editOauthAppForm.ID Token 加密"] = err.Error()
+	}
+	if err := jwe.Validate(ef.UserinfoAlg, ef.UserinfoEnc, keys); err != nil {
+		errors["editOauthAppForm.用户信息加密"] = err.Error()
+	}
+	// 退出通知由服务端发起请求，与注册 API 一样只接受 https
+	if checkRegistrationURI("backchannel_logout_uri", ef.Backchannel) != nil {
+		errors["editOauthAppForm.退出通知"] = "退出通知链接必须是 https 链接"
+	}
+
+	// 跳转链接的匹配方式，不允许通配符域名
+	if err := checkRedirectURIPolicy(ef.RedirectPolicy, []string{ef.RedirectURI}, client.IsPublic()); err != nil {
+		errors["editOauthAppForm.跳转链接"] = err.Error()
+	}
+	// pairwise 应用的扇区标识不能因修改跳转链接而改变，否则用户的 sub 随之改变
+	if client.SubjectType == storage.SubjectTypePairwise {
+		if client.SectorIdentifierURI == "" && ids.Sector("", []string{ef.RedirectURI}) != ids.Sector("", client.RedirectURIs) {
+			errors["editOauthAppForm.跳转链接"] = "pairwise 应用不能更改跳转链接的域名"
+		} else if err := checkSubjectType(client.SubjectType, client.SectorIdentifierURI, []string{ef.RedirectURI}); err != nil {
+			errors["editOauthAppForm.跳转链接"] = err.Error()
+		}
+	}
+
+	// 令牌有效期：访问令牌及 ID Token 最长 1 天，刷新令牌最长 1 年，授权码最长 10 分钟
+	for _, l := range []struct {
+		value  string
+		max    int
+		target *int
+	}{
+		{ef.AccessLifespan, 60 * 24, &client.AccessTokenLifespan},
+		{ef.RefreshLifespan, 24 * 365, &client.RefreshTokenLifespan},
+		{ef.IDTokenLifespan, 60 * 24, &client.IDTokenLifespan},
+		{ef.CodeLifespan, 10, &client.AuthorizeCodeLifespan},
+	} {
+		if l.value == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(l.value); err != nil || n < 0 || n > l.max {
+			errors["editOauthAppForm.令牌有效期"] = "有效期超出允许范围"
 		} else {
-			client.Secret = com.RandomString(16)
+			*l.target = n
 		}
 	}
 
@@ -393,10 +876,10 @@ func editOauth2App(c *gin.Context) {
 		client.LogoURI = "/upload/avatar/" + client.ClientID
 	}
 
-	if newClient {
-		b, err := bcrypt.GenerateFromPassword([]byte(time.Now().String()+ef.Name), bcrypt.DefaultCost)
+	if newClient && !client.IsPublic() && !client.UsesMTLS() && len(errors) == 0 {
+		b, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
 		if err != nil {
-			errors["editOauthAppForm.应用名"] = "生成秘钥出错"
+			errors["editOauthAppForm.密钥"] = "生成秘钥出错"
 		} else {
 			client.Secret = string(b)
 		}
@@ -407,6 +890,24 @@ func editOauth2App(c *gin.Context) {
 		client.Name = ef.Name
 		client.ClientURI = ef.URL
 		client.RedirectURIs = []string{ef.RedirectURI}
+		client.RedirectURIPolicy = ef.RedirectPolicy
+		client.JSONWebKeys = keys
+		client.IDTokenEncryptedResponseAlg = ef.IDTokenAlg
+		client.IDTokenEncryptedResponseEnc = ef.IDTokenEnc
+		client.UserinfoEncryptedResponseAlg = ef.UserinfoAlg
+		client.UserinfoEncryptedResponseEnc = ef.UserinfoEnc
+		if ef.Scope != "" {
+			client.Scope = strings.Join(strings.Fields(ef.Scope), " ")
+		}
+		if ef.TokenFormat != "" {
+			client.AccessTokenStrategy = ef.TokenFormat
+		}
+		client.NarrowScope = ef.NarrowScope
+		client.PostLogoutRedirectURIs = nil
+		if ef.LogoutURI != "" {
+			client.PostLogoutRedirectURIs = []string{ef.LogoutURI}
+		}
+		client.BackchannelLogoutURI = ef.Backchannel
 		if ucenter.DB.Save(&client).Error != nil {
 			errors["editOauthAppForm.应用名"] = "存入数据库出错"
 		}
@@ -416,12 +917,63 @@ func editOauth2App(c *gin.Context) {
 		c.JSON(http.StatusForbidden, errors)
 		return
 	}
+	// 密钥只在创建时返回一次
+	if newClient {
+		auditCurrent(c, ucenter.AuditClientCreate, clientTarget(client.ClientID), client.Name)
+		c.JSON(http.StatusOK, gin.H{
+			"client_id":     client.ClientID,
+			"client_secret": secret,
+		})
+	}
+}
+
+// ownsClient 用户是否为应用的所有者，合并账户后应用 ID 的前缀不再代表所有者
+func ownsClient(u *ucenter.User, client *storage.FositeClient) bool {
+	return client.Owner == u.StrID()
+}
+
+// resetOauth2AppSecret 重置应用密钥，密钥只保存哈希，无法找回原密钥。rotate=1 时轮换密钥，
+// 旧密钥在 client_secret_grace_hours 小时内仍然有效，便于运行中的部署平滑切换
+func resetOauth2AppSecret(c *gin.Context) {
+	id := c.Param("id")
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	x, err := oauth2store.GetClient(nil, id)
+	if err != nil || (!ownsClient(u, x.(*storage.FositeClient)) && !ucenter.RAM.Enforce(u.StrID(), ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel)) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	client := x.(*storage.FositeClient)
+	if client.IsPublic() || client.UsesMTLS() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "该应用没有密钥"})
+		return
+	}
+	var grace time.Duration
+	if c.PostForm("rotate") == "1" {
+		grace = clientSecretGrace()
+	}
+	secret, err := rotateClientSecret(client, grace)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	res := gin.H{
+		"client_id":     client.ClientID,
+		"client_secret": secret,
+	}
+	var detail string
+	if client.RotatedSecretExpiresAt != nil {
+		detail = "轮换，旧密钥有效至 " + client.RotatedSecretExpiresAt.Format("2006-01-02 15:04")
+		res["rotated_secret_expires_at"] = client.RotatedSecretExpiresAt
+	}
+	auditCurrent(c, ucenter.AuditClientSecret, clientTarget(client.ClientID), detail)
+	c.JSON(http.StatusOK, res)
 }
 
 func deleteOauth2App(c *gin.Context) {
 	id := c.Param("id")
 	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
-	if strings.HasPrefix(id, u.StrID()+"-") && !ucenter.RAM.Enforce(u.StrID(), ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel) {
+	x, err := oauth2store.GetClient(nil, id)
+	if err != nil || (!ownsClient(u, x.(*storage.FositeClient)) && !ucenter.RAM.Enforce(u.StrID(), ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel)) {
 		c.HTML(http.StatusForbidden, "page/info", gin.H{
 			"icon":  "low vision",
 			"title": "权限不足",
@@ -430,6 +982,28 @@ func deleteOauth2App(c *gin.Context) {
 		return
 	}
 
-	ucenter.DB.Delete(ucenter.UserAuthorized{}, "client_id = ?", id)
-	ucenter.DB.Delete(storage.FositeClient{}, "client_id = ?", id)
+	tx := ucenter.DB.Begin()
+	if err := deleteClient(tx, id); err != nil {
+		tx.Rollback()
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	auditCurrent(c, ucenter.AuditClientDelete, clientTarget(id), "")
+}
+
+// deleteClient 删除应用及其授权、令牌和注册信息，在调用方的事务中执行
+func deleteClient(tx *gorm.DB, id string) error {
+	if err := oauth2store.(*storage.FositeStore).DeleteClientTokens(tx, id); err != nil {
+		return err
+	}
+	for _, m := range []interface{}{ucenter.UserAuthorized{}, ucenter.LoginClient{}, ucenter.ClientRegistration{}, storage.FositeClient{}} {
+		if err := tx.Delete(m, "client_id = ?", id).Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/ram"
+)
+
+// userSearchLimit 每次搜索最多返回的用户数
+const userSearchLimit = 10
+
+// userSearchWindow 按用户计数的限流窗口
+type userSearchWindow struct {
+	start time.Time
+	count int
+}
+
+var (
+	userSearchMu      sync.Mutex
+	userSearchWindows = make(map[uint]*userSearchWindow)
+)
+
+// userSearchAllowed 每个用户每分钟最多搜索 user_search_rate_limit 次。输入框每次按键都会请求，
+// 计数只保存在本实例内存中，多实例部署时每个实例分别计数，重启后清零
+func userSearchAllowed(uid uint) bool {
+	userSearchMu.Lock()
+	defer userSearchMu.Unlock()
+	now := time.Now()
+	w, ok := userSearchWindows[uid]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		// 顺带清理过期的窗口
+		for id, w := range userSearchWindows {
+			if now.Sub(w.start) >= time.Minute {
+				delete(userSearchWindows, id)
+			}
+		}
+		w = &userSearchWindow{start: now}
+		userSearchWindows[uid] = w
+	}
+	w.count++
+	return w.count <= ucenter.C.UserSearchRateLimit
+}
+
+// canSearchUsers 拥有搜索用户或管理面板权限的用户可以搜索
+func canSearchUsers(u *ucenter.User) bool {
+	return ucenter.RAM.Enforce(u.StrID(), ram.DefaultDomain, ram.DefaultProject, ram.PolicyUserSearch) ||
+		ucenter.RAM.Enforce(u.StrID(), ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel)
+}
+
+// likeEscape 转义 LIKE 中的通配符
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// findUsers 先按对外 ID 精确匹配，再按用户名前缀匹配，不足时补充包含关键字的用户
+func findUsers(q string) []ucenter.User {
+	var users []ucenter.User
+	seen := make(map[uint]bool)
+	add := func(list []ucenter.User) {
+		for _, u := range list {
+			if !seen[u.ID] && len(users) < userSearchLimit {
+				seen[u.ID] = true
+				users = append(users, u)
+			}
+		}
+	}
+	var exact ucenter.User
+	if findUserBySubject(q, &exact) == nil {
+		add([]ucenter.User{exact})
+	}
+	pattern := likeEscape(strings.ToLower(q))
+	for _, like := range []string{pattern + "%", "%" + pattern + "%"} {
+		if len(users) >= userSearchLimit {
+			break
+		}
+		var list []ucenter.User
+		ucenter.DB.Where("lower(username) LIKE ?", like).Order("length(username), id").Limit(userSearchLimit).Find(&list)
+		add(list)
+	}
+	return users
+}
+
+// searchUsers 用户选择器的输入提示，只返回对外 ID、用户名、头像和状态
+func searchUsers(c *gin.Context) {
+	u := c.MustGet(ucenter.AuthUser).(*ucenter.User)
+	if !canSearchUsers(u) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "没有搜索用户的权限"})
+		return
+	}
+	if !userSearchAllowed(u.ID) {
+		c.Header("Retry-After", "60")
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "搜索过于频繁，请稍后再试"})
+		return
+	}
+	q := strings.TrimSpace(c.Query("q"))
+	// 用户名至少输入两个字符，ID 可以只有一位；最长为 UUID 格式的对外 ID
+	if _, err := strconv.ParseUint(q, 10, 64); (err != nil && len([]rune(q)) < 2) || len(q) > 36 {
+		c.JSON(http.StatusOK, gin.H{"users": []gin.H{}})
+		return
+	}
+	users := findUsers(q)
+	results := make([]gin.H, 0, len(users))
+	for i := range users {
+		results = append(results, gin.H{
+			"id":       users[i].Subject(),
+			"username": users[i].Username,
+			"avatar":   users[i].AvatarURL(),
+			"status":   users[i].Status,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"users": results})
+}
@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/ram"
+)
+
+// scopeClaims 按授权的 scope 返回用户当前的资料，修改后立即生效
+func scopeClaims(u *ucenter.User, scopes fosite.Arguments) map[string]interface{} {
+	claims := make(map[string]interface{})
+	if scopes.Has("profile") {
+		for k, v := range profileClaims(u) {
+			claims[k] = v
+		}
+		claims["updated_at"] = u.UpdatedAt.Unix()
+	}
+	if scopes.Has("email") && u.Email != "" {
+		claims["email"] = string(u.Email)
+	}
+	if scopes.Has("phone") && u.Phone != "" {
+		claims["phone_number"] = string(u.Phone)
+	}
+	for name, s := range ucenter.C.CustomScopes {
+		if !scopes.Has(name) {
+			continue
+		}
+		for claim, source := range s.Claims {
+			claims[claim] = customClaim(u, source)
+		}
+	}
+	return claims
+}
+
+// customClaim 自定义 claim 的取值，来源已在启动时校验
+func customClaim(u *ucenter.User, source string) interface{} {
+	switch source {
+	case "roles":
+		roles := ucenter.RAM.GetRolesForUserInDomain(u.StrID(), ram.DefaultDomain)
+		if roles == nil {
+			roles = []string{}
+		}
+		return roles
+	case "bio":
+		return u.Bio
+	case "created_at":
+		return u.CreatedAt.Unix()
+	}
+	return strings.TrimPrefix(source, "=")
+}
+
+// supportedClaims 用户信息端点可能返回的 claims，用于发现配置
+func supportedClaims() []string {
+	claims := []string{"sub", "preferred_username", "picture", "updated_at", "email", "phone_number"}
+	for _, s := range ucenter.C.CustomScopes {
+		for claim := range s.Claims {
+			claims = append(claims, claim)
+		}
+	}
+	return claims
+}
+
+// userInfoError RFC 6750 第 3 节的错误响应
+func userInfoError(c *gin.Context, status int, code, desc string) {
+	c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="%s", error_description="%s"`, code, desc))
+	c.AbortWithStatusJSON(status, gin.H{
+		"error":             code,
+		"error_description": desc,
+	})
+}
+
+// userInfoUnauthorized 访问令牌无效
+func userInfoUnauthorized(c *gin.Context, desc string) {
+	userInfoError(c, http.StatusUnauthorized, "invalid_token", desc)
+}
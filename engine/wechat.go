@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naiba/com"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/pkg/errors"
+
+	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/password"
+	"github.com/naiba/ucenter/pkg/wechat"
+)
+
+// wechatMiniProgramGrantType 微信小程序以 wx.login 取得的 js_code 换取令牌的 grant_type
+const wechatMiniProgramGrantType = "urn:ucenter:params:oauth:grant-type:wechat-mini-program"
+
+var wechatClient = &http.Client{Timeout: time.Second * 5}
+
+// wechatMiniProgramHandler 令牌端点处理微信小程序登录：经 code2session 校验 js_code，
+// 按 unionid、openid 找到关联的用户后直接签发令牌
+type wechatMiniProgramHandler struct {
+	*oauth2.HandleHelper
+	RefreshTokenStrategy oauth2.RefreshTokenStrategy
+	RefreshTokenStorage  oauth2.RefreshTokenStorage
+	IDTokenStrategy      openid.OpenIDConnectTokenStrategy
+}
+
+func wechatMiniProgramGrantFactory(config *compose.Config, store interface{}, strategy interface{}) interface{} {
+	return &wechatMiniProgramHandler{
+		HandleHelper: &oauth2.HandleHelper{
+			AccessTokenStrategy: strategy.(oauth2.AccessTokenStrategy),
+			AccessTokenStorage:  store.(oauth2.AccessTokenStorage),
+			AccessTokenLifespan: config.GetAccessTokenLifespan(),
+		},
+		RefreshTokenStrategy: strategy.(oauth2.RefreshTokenStrategy),
+		RefreshTokenStorage:  store.(oauth2.RefreshTokenStorage),
+		IDTokenStrategy:      strategy.(openid.OpenIDConnectTokenStrategy),
+	}
+}
+
+// HandleTokenEndpointRequest 校验 js_code 并确定用户。小程序由管理员在配置中登记，视同第一方应用，
+// 申请的 scope 不超过应用的授权范围即全部授予，授权照常记录
+func (h *wechatMiniProgramHandler) HandleTokenEndpointRequest(ctx context.Context, requester fosite.AccessRequester) error {
+	if !requester.GetGrantTypes().Exact(wechatMiniProgramGrantType) {
+		return errors.WithStack(fosite.ErrUnknownRequest)
+	}
+	client := requester.GetClient()
+	conf, ok := ucenter.C.WechatMiniPrograms[client.GetID()]
+	if !ok || !client.GetGrantTypes().Has(wechatMiniProgramGrantType) {
+		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHint("The client is not allowed to use the WeChat mini program grant."))
+	}
+	code := requester.GetRequestForm().Get("js_code")
+	if code == "" {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHint("The js_code parameter is missing."))
+	}
+	scopes := registeredScopes()
+	for _, scope := range requester.GetRequestedScopes() {
+		if _, has := scopes[scope]; !has || !fosite.HierarchicScopeStrategy(client.GetScopes(), scope) {
+			return errors.WithStack(fosite.ErrInvalidScope.WithHint("The client is not allowed to request scope \"" + scope + "\"."))
+		}
+	}
+
+	mp := &wechat.MiniProgram{AppID: conf.AppID, Secret: conf.AppSecret, Client: wechatClient}
+	ws, err := mp.Code2Session(code)
+	if e, ok := err.(*wechat.Error); ok && e.InvalidCode() {
+		return errors.WithStack(fosite.ErrInvalidGrant.WithHint("The js_code is invalid or has already been used."))
+	} else if err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+	u, err := wechatUser(ctx, conf, ws)
+	if err != nil {
+		return err
+	}
+	if liftExpiredSuspension(u); u.Blocked() {
+		return errors.WithStack(fosite.ErrAccessDenied.WithHint("The account is suspended, deactivated or awaiting approval."))
+	} else if passkeyRequired(u) {
+		return errors.WithStack(fosite.ErrAccessDenied.WithHint("Administrators must sign in with a passkey."))
+	}
+
+	perms := make(map[string]bool)
+	for _, scope := range requester.GetRequestedScopes() {
+		requester.GrantScope(scope)
+		perms[scope] = true
+	}
+	ucenter.DB.Model(u).Where("client_id = ?", client.GetID()).Association("UserAuthorizeds").Find(&u.UserAuthorizeds)
+	ar := &fosite.AuthorizeRequest{Request: fosite.Request{Client: client, RequestedScope: requester.GetRequestedScopes()}}
+	if err := saveUserAuthorized(u, ar, perms, nil, nil); err != nil {
+		return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+
+	session, ok := requester.GetSession().(*storage.FositeSession)
+	if !ok {
+		return errors.WithStack(fosite.ErrServerError.WithDebug("unexpected session type"))
+	}
+	*session = *storage.NewFositeSession(u.StrID())
+	session.DefaultSession.Claims.Subject = userSubject(u, client)
+	if perms["profile"] {
+		session.DefaultSession.Claims.Extra = profileClaims(u)
+	}
+	session.DefaultSession.Claims.AuthTime = time.Now().UTC()
+	session.DefaultSession.Claims.RequestedAt = time.Now().UTC()
+	session.SetExpiresAt(fosite.AccessToken, time.Now().UTC().Add(h.AccessTokenLifespan))
+	return nil
+}
+
+// PopulateTokenEndpointResponse 签发访问令牌，应用可使用 refresh_token 时签发刷新令牌，授予 openid 时签发 ID Token
+func (h *wechatMiniProgramHandler) PopulateTokenEndpointResponse(ctx context.Context, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
+	if !requester.GetGrantTypes().Exact(wechatMiniProgramGrantType) {
+		return errors.WithStack(fosite.ErrUnknownRequest)
+	}
+	if err := h.IssueAccessToken(ctx, requester, responder); err != nil {
+		return err
+	}
+	if requester.GetClient().GetGrantTypes().Has("refresh_token") {
+		refresh, signature, err := h.RefreshTokenStrategy.GenerateRefreshToken(ctx, requester)
+		if err != nil {
+			return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+		}
+		if err := h.RefreshTokenStorage.CreateRefreshTokenSession(ctx, signature, requester.Sanitize([]string{})); err != nil {
+			return errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+		}
+		responder.SetExtra("refresh_token", refresh)
+	}
+	if requester.GetGrantedScopes().Has("openid") {
+		token, err := h.IDTokenStrategy.GenerateIDToken(ctx, requester)
+		if err != nil {
+			return err
+		}
+		responder.SetExtra("id_token", token)
+	}
+	return nil
+}
+
+// wechatUser 先按 unionid、再按 openid 查找关联的用户，都未关联时按配置自动创建；
+// 找到用户后补充关联缺少的身份，小程序之后才绑定开放平台时 unionid 会关联到已有的账户
+func wechatUser(ctx context.Context, conf ucenter.WechatMiniProgram, ws *wechat.Session) (*ucenter.User, error) {
+	identities := map[string]string{ucenter.IdentityWechatMiniProgram + conf.AppID: ws.OpenID}
+	if ws.UnionID != "" {
+		identities[ucenter.IdentityWechat] = ws.UnionID
+	}
+	var ident ucenter.Identity
+	found := ws.UnionID != "" && ucenter.DB.Where("provider = ? AND subject = ?", ucenter.IdentityWechat, ws.UnionID).First(&ident).Error == nil
+	if !found {
+		found = ucenter.DB.Where("provider = ? AND subject = ?", ucenter.IdentityWechatMiniProgram+conf.AppID, ws.OpenID).First(&ident).Error == nil
+	}
+	if !found {
+		if !conf.AutoSignup {
+			return nil, errors.WithStack(fosite.ErrAccessDenied.WithHint("The WeChat account is not linked to any user."))
+		}
+		return createWechatUser(ctx, identities)
+	}
+
+	var u ucenter.User
+	if err := ucenter.DB.First(&u, "id = ?", ident.UserID).Error; err != nil {
+		return nil, errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+	now := time.Now()
+	for provider, subject := range identities {
+		var linked ucenter.Identity
+		err := ucenter.DB.Where(ucenter.Identity{Provider: provider, Subject: subject}).
+			Attrs(ucenter.Identity{UserID: u.ID, Name: subject}).FirstOrCreate(&linked).Error
+		// 已关联到其他用户的身份保持不变，以先找到的用户为准
+		if err == nil && linked.UserID == u.ID {
+			ucenter.DB.Model(&linked).Update("last_used_at", now)
+		}
+	}
+	return &u, nil
+}
+
+// createWechatUser 为未关联的微信用户创建账户及身份。用户名随机生成，密码随机且不告知用户，
+// 账户只能通过小程序登录；需要邮箱或邀请码注册时无法自动创建
+func createWechatUser(ctx context.Context, identities map[string]string) (*ucenter.User, error) {
+	policy := signupPolicy()
+	if policy.Closed || policy.EmailRequired() || ucenter.C.SignupInviteOnly {
+		return nil, errors.WithStack(fosite.ErrAccessDenied.WithHint("Automatic sign-up is not available, link the WeChat account to an existing user instead."))
+	}
+	check, ok := ctx.Value(wechatSignupKey{}).(func() string)
+	if !ok {
+		return nil, errors.WithStack(fosite.ErrServerError.WithDebug("missing sign-up check"))
+	}
+	if msg := check(); msg != "" {
+		return nil, errors.WithStack(fosite.ErrAccessDenied.WithHint(msg))
+	}
+	var u ucenter.User
+	for i := 0; i < 10 && u.Username == ""; i++ {
+		name := "wx" + strings.ToLower(com.RandomString(10))
+		if !loginNameTaken(name) && !usernameReserved(name) {
+			u.Username = name
+		}
+	}
+	if u.Username == "" {
+		return nil, errors.WithStack(fosite.ErrServerError.WithDebug("failed to generate a username"))
+	}
+	// 随机密码不告知用户，账户只能通过小程序登录
+	secret, err := password.GenerateSecret()
+	if err == nil {
+		err = setPassword(&u, secret)
+	}
+	if err != nil {
+		return nil, errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+	if ucenter.C.SignupApproval {
+		u.Status = ucenter.StatusPending
+	}
+	now := time.Now()
+	tx := ucenter.DB.Begin()
+	err = tx.Create(&u).Error
+	for provider, subject := range identities {
+		if err == nil {
+			err = tx.Create(&ucenter.Identity{
+				UserID:     u.ID,
+				Provider:   provider,
+				Subject:    subject,
+				Name:       subject,
+				LastUsedAt: &now,
+			}).Error
+		}
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		return nil, errors.WithStack(fosite.ErrServerError.WithDebug(err.Error()))
+	}
+	return &u, nil
+}
+
+// wechatLoginDenied 微信小程序登录与其他登录方式一样受地区及 IP 信誉限制
+func wechatLoginDenied(c *gin.Context) string {
+	if msg := countryDenied(clientIP(c), ucenter.C.LoginCountries); msg != "" {
+		return msg
+	}
+	return reputationDenied(c, "登录")
+}
+
+// wechatSignupKey context 中自动注册前的检查，由令牌端点放入，返回拒绝的原因
+type wechatSignupKey struct{}
+
+// withWechatSignupCheck 令牌处理中没有请求信息，自动注册时再按本次请求检查
+func withWechatSignupCheck(ctx context.Context, c *gin.Context) context.Context {
+	return context.WithValue(ctx, wechatSignupKey{}, func() string {
+		return wechatSignupDenied(c)
+	})
+}
+
+// wechatSignupDenied 自动注册与注册表单、注册 API 一样受注册地区及 IP 信誉限制；
+// 有需同意的服务条款或隐私政策时，小程序无法展示，不自动注册
+func wechatSignupDenied(c *gin.Context) string {
+	if len(currentLegalDocuments()) > 0 {
+		return "请先在网页注册并同意服务条款及隐私政策，再关联微信账户"
+	}
+	if msg := countryDenied(clientIP(c), ucenter.C.SignupCountries); msg != "" {
+		return msg
+	}
+	return reputationDenied(c, "注册")
+}
+
+// auditWechatLogin 记录微信小程序登录成功，并更新最近登录时间，避免只用小程序的账户被视为长期未登录而停用
+func auditWechatLogin(c *gin.Context, ar fosite.AccessRequester) {
+	uid, err := strconv.ParseUint(ar.GetSession().GetSubject(), 10, 64)
+	if err != nil {
+		return
+	}
+	touchLastLogin(uint(uid))
+	title := "微信小程序"
+	if conf := ucenter.C.WechatMiniPrograms[ar.GetClient().GetID()]; conf.Title != "" {
+		title = conf.Title
+	}
+	audit(c, uint(uid), ucenter.AuditLoginSuccess, userTarget(uint(uid)), "微信小程序登录："+title)
+}
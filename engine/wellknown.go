@@ -2,11 +2,18 @@ package engine
 
 import (
 	"net/http"
-
-	"gopkg.in/square/go-jose.v2"
+	"sort"
 
 	"github.com/gin-gonic/gin"
 	"github.com/naiba/ucenter"
+	"github.com/naiba/ucenter/pkg/dpop"
+	"github.com/naiba/ucenter/pkg/fosite-storage"
+	"github.com/naiba/ucenter/pkg/grant"
+	"github.com/naiba/ucenter/pkg/jwe"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/handler/pkce"
 )
 
 // WellKnown represents important OpenID Connect discovery metadata
@@ -32,6 +39,22 @@ type WellKnown struct {
 	// example: https://playground.ory.sh/ory-hydra/admin/client
 	RegistrationEndpoint string `json:"registration_endpoint,omitempty"`
 
+	// URL of the authorization server's OAuth 2.0 revocation endpoint.
+	RevocationEndpoint string `json:"revocation_endpoint,omitempty"`
+
+	// URL of the authorization server's OAuth 2.0 introspection endpoint.
+	IntrospectionEndpoint string `json:"introspection_endpoint,omitempty"`
+
+	// URL of the authorization server's device authorization endpoint (RFC 8628).
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint,omitempty"`
+
+	// URL of the authorization server's pushed authorization request endpoint (RFC 9126).
+	PushedAuthorizationRequestEndpoint string `json:"pushed_authorization_request_endpoint"`
+
+	// Boolean parameter indicating whether the authorization server accepts authorization request data only
+	// via PAR. Individual clients may still be required to use PAR.
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests"`
+
 	// URL of the OP's OAuth 2.0 Token Endpoint
 	//
 	// required: true
@@ -67,6 +90,9 @@ type WellKnown struct {
 	// values for. Note that for privacy or other reasons, this might not be an exhaustive list.
 	ClaimsSupported []string `json:"claims_supported"`
 
+	// JSON array containing a list of the Authentication Context Class References that this OP supports.
+	AcrValuesSupported []string `json:"acr_values_supported"`
+
 	// JSON array containing a list of the OAuth 2.0 Grant Type values that this OP supports.
 	GrantTypesSupported []string `json:"grant_types_supported"`
 
@@ -93,6 +119,20 @@ type WellKnown struct {
 	// required: true
 	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
 
+	// JSON array containing a list of the JWE encryption algorithms (alg values) supported by the OP for the ID Token
+	// to encode the Claims in a JWT.
+	IDTokenEncryptionAlgValuesSupported []string `json:"id_token_encryption_alg_values_supported,omitempty"`
+
+	// JSON array containing a list of the JWE encryption algorithms (enc values) supported by the OP for the ID Token
+	// to encode the Claims in a JWT.
+	IDTokenEncryptionEncValuesSupported []string `json:"id_token_encryption_enc_values_supported,omitempty"`
+
+	// JSON array containing a list of the JWE encryption algorithms (alg values) supported by the UserInfo Endpoint.
+	UserinfoEncryptionAlgValuesSupported []string `json:"userinfo_encryption_alg_values_supported,omitempty"`
+
+	// JSON array containing a list of the JWE encryption algorithms (enc values) supported by the UserInfo Endpoint.
+	UserinfoEncryptionEncValuesSupported []string `json:"userinfo_encryption_enc_values_supported,omitempty"`
+
 	// 	Boolean value specifying whether the OP supports use of the request parameter, with true indicating support.
 	RequestParameterSupported bool `json:"request_parameter_supported"`
 
@@ -105,46 +145,177 @@ type WellKnown struct {
 
 	// Boolean value specifying whether the OP supports use of the claims parameter, with true indicating support.
 	ClaimsParameterSupported bool `json:"claims_parameter_supported"`
+
+	// JSON array containing a list of PKCE code challenge methods supported by this authorization server.
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+
+	// JSON array containing a list of the JWS alg values supported by the authorization server for DPoP proof JWTs.
+	DPoPSigningAlgValuesSupported []string `json:"dpop_signing_alg_values_supported,omitempty"`
+
+	// Boolean value indicating server support for mutual-TLS client certificate-bound access tokens.
+	TLSClientCertificateBoundAccessTokens bool `json:"tls_client_certificate_bound_access_tokens"`
+
+	// URL of an OP iframe that supports cross-origin communications for session state information with the RP
+	// Client, using the HTML5 postMessage API.
+	CheckSessionIframe string `json:"check_session_iframe"`
+
+	// URL at the OP to which an RP can perform a redirect to request that the End-User be logged out at the OP.
+	EndSessionEndpoint string `json:"end_session_endpoint"`
+
+	// Boolean value specifying whether the OP supports back-channel logout, with true indicating support.
+	BackchannelLogoutSupported bool `json:"backchannel_logout_supported"`
+
+	// Boolean value specifying whether the OP can pass a sid (session ID) Claim in the Logout Token to identify
+	// the RP session with the OP.
+	BackchannelLogoutSessionSupported bool `json:"backchannel_logout_session_supported"`
 }
 
-func wellknownHandler(c *gin.Context) {
-	claimsSupported := []string{"sub"}
-	scopesSupported := []string{"profile", "openid"}
-	subjectTypes := []string{"public"}
-
-	c.JSON(http.StatusOK, &WellKnown{
-		Issuer:                            "http://" + ucenter.C.Domain,
-		AuthURL:                           "http://" + ucenter.C.Domain + "/oauth2/auth",
-		TokenURL:                          "http://" + ucenter.C.Domain + "/oauth2/token",
-		JWKsURI:                           "http://" + ucenter.C.Domain + "/.well-known/jwks.json",
-		RegistrationEndpoint:              "http://" + ucenter.C.Domain,
-		SubjectTypes:                      subjectTypes,
-		ResponseTypes:                     []string{"code", "code id_token", "id_token", "token id_token", "token", "token id_token code"},
-		ClaimsSupported:                   claimsSupported,
-		ScopesSupported:                   scopesSupported,
-		UserinfoEndpoint:                  "/oauth2/userinfo",
-		TokenEndpointAuthMethodsSupported: []string{"client_secret_post", "client_secret_basic", "private_key_jwt", "none"},
-		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
-		GrantTypesSupported:               []string{"authorization_code", "implicit", "client_credentials", "refresh_token"},
-		ResponseModesSupported:            []string{"query", "fragment"},
-		UserinfoSigningAlgValuesSupported: []string{"none", "RS256"},
-		RequestParameterSupported:         true,
-		RequestURIParameterSupported:      true,
-		RequireRequestURIRegistration:     true,
-	})
+// providerCapabilities 从已组装的 fosite 处理器推导发现文档中的授权能力，避免与实际配置脱节
+type providerCapabilities struct {
+	responseTypes        []string
+	grantTypes           []string
+	codeChallengeMethods []string
+	revocation           bool
+	introspection        bool
+	deviceAuthorization  bool
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		var found bool
+		for _, v := range list {
+			if v == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func oauth2Capabilities() providerCapabilities {
+	var pc providerCapabilities
+	f, ok := oauth2provider.(*fosite.Fosite)
+	if !ok {
+		return pc
+	}
+	for _, h := range f.AuthorizeEndpointHandlers {
+		switch h.(type) {
+		case *oauth2.AuthorizeExplicitGrantHandler:
+			pc.responseTypes = appendUnique(pc.responseTypes, "code")
+		case *oauth2.AuthorizeImplicitGrantTypeHandler:
+			pc.responseTypes = appendUnique(pc.responseTypes, "token")
+			pc.grantTypes = appendUnique(pc.grantTypes, "implicit")
+		case *openid.OpenIDConnectImplicitHandler:
+			pc.responseTypes = appendUnique(pc.responseTypes, "id_token", "token id_token")
+			pc.grantTypes = appendUnique(pc.grantTypes, "implicit")
+		case *openid.OpenIDConnectHybridHandler:
+			pc.responseTypes = appendUnique(pc.responseTypes, "code id_token", "code token", "code token id_token")
+		}
+	}
+	for _, h := range f.TokenEndpointHandlers {
+		switch v := h.(type) {
+		case *oauth2.AuthorizeExplicitGrantHandler:
+			pc.grantTypes = appendUnique(pc.grantTypes, "authorization_code")
+		case *oauth2.ClientCredentialsGrantHandler:
+			pc.grantTypes = appendUnique(pc.grantTypes, "client_credentials")
+		case *oauth2.RefreshTokenGrantHandler:
+			pc.grantTypes = appendUnique(pc.grantTypes, "refresh_token")
+		case *oauth2.ResourceOwnerPasswordCredentialsGrantHandler:
+			pc.grantTypes = appendUnique(pc.grantTypes, "password")
+		case *deviceCodeHandler:
+			pc.grantTypes = appendUnique(pc.grantTypes, deviceCodeGrantType)
+			pc.deviceAuthorization = true
+		case *wechatMiniProgramHandler:
+			pc.grantTypes = appendUnique(pc.grantTypes, wechatMiniProgramGrantType)
+		case *pkce.Handler:
+			pc.codeChallengeMethods = appendUnique(pc.codeChallengeMethods, "S256")
+			if v.EnablePlainChallengeMethod {
+				pc.codeChallengeMethods = appendUnique(pc.codeChallengeMethods, "plain")
+			}
+		}
+	}
+	pc.grantTypes = appendUnique(pc.grantTypes, grant.Types()...)
+	pc.revocation = len(f.RevocationHandlers) > 0
+	pc.introspection = len(f.TokenIntrospectionHandlers) > 0
+	return pc
 }
 
-var jwks = jose.JSONWebKeySet{
-	Keys: []jose.JSONWebKey{
-		jose.JSONWebKey{
-			Key:       &ucenter.SystemRSAKey.PublicKey,
-			Algorithm: "RS256",
-			Use:       "sig",
-			KeyID:     "1",
-		},
-	},
+func wellknownHandler(c *gin.Context) {
+	issuer := ucenter.Issuer()
+	pc := oauth2Capabilities()
+
+	// acr、amr、auth_time 只写入 ID Token
+	claimsSupported := append(supportedClaims(), "acr", "amr", "auth_time")
+	registered := registeredScopes()
+	scopesSupported := make([]string, 0, len(registered))
+	for scope := range registered {
+		scopesSupported = append(scopesSupported, scope)
+	}
+	sort.Strings(scopesSupported)
+	subjectTypes := []string{storage.SubjectTypePublic}
+	if ucenter.C.PairwiseSalt != "" {
+		subjectTypes = append(subjectTypes, storage.SubjectTypePairwise)
+	}
+
+	mtls := ucenter.C.TLSCert != "" || ucenter.C.MTLSCertHeader != ""
+	authMethods := []string{"client_secret_post", "client_secret_basic", "private_key_jwt"}
+	if mtls {
+		authMethods = append(authMethods, "tls_client_auth", "self_signed_tls_client_auth")
+	}
+	authMethods = append(authMethods, "none")
+
+	wk := &WellKnown{
+		Issuer:                                issuer,
+		AuthURL:                               issuer + "/oauth2/auth",
+		TokenURL:                              issuer + "/oauth2/token",
+		PushedAuthorizationRequestEndpoint:    issuer + "/oauth2/par",
+		JWKsURI:                               issuer + "/.well-known/jwks.json",
+		SubjectTypes:                          subjectTypes,
+		ResponseTypes:                         pc.responseTypes,
+		ClaimsSupported:                       claimsSupported,
+		AcrValuesSupported:                    []string{ucenter.ACRSingleFactor, ucenter.ACRMultiFactor},
+		ScopesSupported:                       scopesSupported,
+		UserinfoEndpoint:                      issuer + "/oauth2/userinfo",
+		TokenEndpointAuthMethodsSupported:     authMethods,
+		IDTokenSigningAlgValuesSupported:      []string{signingKeys.alg()},
+		IDTokenEncryptionAlgValuesSupported:   jwe.SupportedAlgs,
+		IDTokenEncryptionEncValuesSupported:   jwe.SupportedEncs,
+		UserinfoEncryptionAlgValuesSupported:  jwe.SupportedAlgs,
+		UserinfoEncryptionEncValuesSupported:  jwe.SupportedEncs,
+		GrantTypesSupported:                   pc.grantTypes,
+		ResponseModesSupported:                []string{"query", "fragment"},
+		UserinfoSigningAlgValuesSupported:     []string{"none", signingKeys.alg()},
+		RequestParameterSupported:             true,
+		ClaimsParameterSupported:              true,
+		RequestURIParameterSupported:          true,
+		RequireRequestURIRegistration:         true,
+		CodeChallengeMethodsSupported:         pc.codeChallengeMethods,
+		DPoPSigningAlgValuesSupported:         dpop.SupportedAlgs,
+		TLSClientCertificateBoundAccessTokens: mtls,
+		CheckSessionIframe:                    issuer + "/oauth2/check_session",
+		EndSessionEndpoint:                    issuer + "/oauth2/logout",
+		BackchannelLogoutSupported:            true,
+		BackchannelLogoutSessionSupported:     true,
+	}
+	if pc.revocation {
+		wk.RevocationEndpoint = issuer + "/oauth2/revoke"
+	}
+	if pc.introspection {
+		wk.IntrospectionEndpoint = issuer + "/oauth2/introspect"
+	}
+	if pc.deviceAuthorization {
+		wk.DeviceAuthorizationEndpoint = issuer + "/oauth2/device_authorization"
+	}
+	if ucenter.C.Registration {
+		wk.RegistrationEndpoint = issuer + "/oauth2/register"
+	}
+	c.JSON(http.StatusOK, wk)
 }
 
 func jwksHandler(c *gin.Context) {
-	c.JSON(http.StatusOK, jwks)
+	c.JSON(http.StatusOK, signingKeys.jwks())
 }
@@ -0,0 +1,80 @@
+package ucenter
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// IdentityPassword 附加的用户名密码身份
+	IdentityPassword = "password"
+	// IdentityWechat 微信 unionid，同一微信开放平台下的小程序、公众号共用
+	IdentityWechat = "wechat"
+	// IdentityWechatMiniProgram 小程序 openid 身份的前缀，后接小程序 AppID
+	IdentityWechatMiniProgram = "wechat:"
+)
+
+// Identity 关联到账户的其他登录身份
+type Identity struct {
+	ID     uint `gorm:"primary_key"`
+	UserID uint `gorm:"index"`
+	// Provider 身份来源，password 为附加的用户名密码，其余为配置的外部身份提供方
+	Provider string `gorm:"unique_index:idx_identity_subject"`
+	// Subject 身份在来源中的唯一标识：附加的登录名或外部账户的 sub
+	Subject string `gorm:"unique_index:idx_identity_subject"`
+	// Name 展示名称，如外部账户的邮箱
+	Name string
+	// Secret 附加密码的哈希，外部身份为空
+	Secret     string `json:"-"`
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// IdentityProvider 可关联的外部身份提供方（OpenID Connect）
+type IdentityProvider struct {
+	Title        string     `mapstructure:"title"`         //显示名称
+	Issuer       string     `mapstructure:"issuer"`        //Issuer 地址，用于发现配置
+	ClientID     string     `mapstructure:"client_id"`     //在提供方注册的应用 ID
+	ClientSecret string     `mapstructure:"client_secret"` //在提供方注册的应用密钥
+	Scopes       []string   `mapstructure:"scopes"`        //额外申请的 scope，openid 总是包含
+	Domains      []string   `mapstructure:"domains"`       //邮箱域名，支持 *.example.com，登录时输入这些域名的邮箱推荐使用该提供方
+	RoleRules    []RoleRule `mapstructure:"role_rules"`    //按外部账户的组信息同步 RAM 角色，每次通过该提供方登录时增删
+}
+
+// WechatMiniProgram 微信小程序，小程序以 wx.login 取得的 js_code 换取令牌
+type WechatMiniProgram struct {
+	Title      string `mapstructure:"title"`       //显示名称
+	AppID      string `mapstructure:"app_id"`      //小程序 AppID
+	AppSecret  string `mapstructure:"app_secret"`  //小程序 AppSecret
+	AutoSignup bool   `mapstructure:"auto_signup"` //未关联的微信用户自动创建账户
+}
+
+// RoleRule 外部账户 claim 取值与 RAM 角色的对应关系
+type RoleRule struct {
+	Claim  string `mapstructure:"claim"`  //组信息所在的 claim，如 groups、department，取值可为字符串或字符串数组
+	Value  string `mapstructure:"value"`  //匹配的取值，支持 * 通配
+	Role   string `mapstructure:"role"`   //授予的角色
+	Domain string `mapstructure:"domain"` //角色所在的域，默认 defaultDomain
+}
+
+// ProviderTitle 身份来源的显示名称
+func (i *Identity) ProviderTitle() string {
+	switch {
+	case i.Provider == IdentityPassword:
+		return "用户名密码"
+	case i.Provider == IdentityWechat:
+		return "微信"
+	case strings.HasPrefix(i.Provider, IdentityWechatMiniProgram):
+		appID := strings.TrimPrefix(i.Provider, IdentityWechatMiniProgram)
+		for _, m := range C.WechatMiniPrograms {
+			if m.AppID == appID && m.Title != "" {
+				return m.Title
+			}
+		}
+		return "微信小程序"
+	}
+	if p, ok := C.IdentityProviders[i.Provider]; ok && p.Title != "" {
+		return p.Title
+	}
+	return i.Provider
+}
@@ -0,0 +1,23 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// Invite 注册邀请码
+type Invite struct {
+	ID         uint   `gorm:"primary_key"`
+	Code       string `gorm:"unique_index"`
+	CreatorID  uint   `gorm:"index"`
+	RedeemedBy *uint
+	RedeemedAt *time.Time
+	CreatedAt  time.Time
+
+	Creator  User
+	Redeemer *User `gorm:"foreignkey:RedeemedBy"`
+}
+
+// Redeemed 邀请码是否已被使用
+func (i *Invite) Redeemed() bool {
+	return i.RedeemedBy != nil
+}
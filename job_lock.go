@@ -0,0 +1,14 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// JobLock 定时任务在集群中的执行记录，每个周期只由一个节点执行
+type JobLock struct {
+	Name string `gorm:"primary_key"`
+	// RunAt 最近一次开始执行的时间
+	RunAt time.Time
+	// Node 最近一次执行的节点
+	Node string
+}
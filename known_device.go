@@ -0,0 +1,17 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// KnownDevice 用户登录过的设备（UA + IP）
+type KnownDevice struct {
+	ID          uint   `gorm:"primary_key"`
+	UserID      uint   `gorm:"index"`
+	Fingerprint string `gorm:"index"`
+	// LoginToken 首次在此设备登录时的终端
+	LoginToken string
+	// RevokeToken 新设备提醒邮件中“不是我本人”链接的凭据
+	RevokeToken string `gorm:"index"`
+	CreatedAt   time.Time
+}
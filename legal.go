@@ -0,0 +1,59 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// 法律文件类型
+const (
+	LegalTerms   = "terms"
+	LegalPrivacy = "privacy"
+	LegalImprint = "imprint"
+)
+
+// LegalKinds 法律文件类型及名称
+var LegalKinds = map[string]string{
+	LegalTerms:   "服务条款",
+	LegalPrivacy: "隐私政策",
+	LegalImprint: "网站信息",
+}
+
+// LegalMustAccept 需要用户同意的文件类型，其余类型只在注册、授权页面展示链接
+var LegalMustAccept = []string{LegalTerms, LegalPrivacy}
+
+// LegalDocument 法律文件，每次修改发布为新版本，需要同意的类型用户需重新同意
+type LegalDocument struct {
+	ID      uint   `gorm:"primary_key"`
+	Kind    string `gorm:"unique_index:uix_legal_kind_version"`
+	Version int    `gorm:"unique_index:uix_legal_kind_version"`
+	// Content Markdown 格式
+	Content   string `gorm:"type:text"`
+	CreatedBy uint
+	CreatedAt time.Time
+}
+
+// Name 文件名称
+func (d *LegalDocument) Name() string {
+	return LegalKinds[d.Kind]
+}
+
+// MustAccept 是否需要用户同意
+func (d *LegalDocument) MustAccept() bool {
+	for _, k := range LegalMustAccept {
+		if k == d.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+// LegalAcceptance 用户同意法律文件的记录
+type LegalAcceptance struct {
+	ID         uint `gorm:"primary_key"`
+	UserID     uint `gorm:"index"`
+	DocumentID uint
+	Kind       string
+	Version    int
+	IP         string
+	AcceptedAt time.Time
+}
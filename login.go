@@ -1,7 +1,26 @@
 package ucenter
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"time"
+
+	"github.com/lib/pq"
+)
+
+// 验证身份的方式，即 ID Token 中的 amr（RFC 8176）
+const (
+	AMRPassword  = "pwd"
+	AMROTP       = "otp"
+	AMRWebAuthn  = "webauthn"
+	AMRFederated = "fed"
+	AMRMFA       = "mfa"
+)
+
+// 认证等级，即 ID Token 中的 acr 及授权请求的 acr_values
+const (
+	ACRSingleFactor = "urn:ucenter:acr:1fa"
+	ACRMultiFactor  = "urn:ucenter:acr:2fa"
 )
 
 // Login 登录的终端
@@ -12,6 +31,59 @@ type Login struct {
 	IP        string
 	Expire    time.Time
 	CreatedAt time.Time
+	// Location 登录时根据 IP 解析的大致位置
+	Location string
+	// LastSeenAt 最近活动时间
+	LastSeenAt time.Time
+	// SudoUntil 重新验证身份后可进行敏感操作的截止时间
+	SudoUntil *time.Time
+	// AdminSudoUntil 重新验证身份后可进行管理操作的截止时间
+	AdminSudoUntil *time.Time
+	// AuthTime 最近一次登录或授权前重新验证身份的时间，为空时为登录时间
+	AuthTime *time.Time
+	// AMR 最近一次验证身份使用的方式
+	AMR pq.StringArray `gorm:"type:varchar(32)[]"`
 
 	User User
 }
+
+// PublicID 不泄露 Token 的终端标识
+func (l *Login) PublicID() string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(l.Token)))[:16]
+}
+
+// Elevated 是否在近期验证过身份
+func (l *Login) Elevated() bool {
+	return l.SudoUntil != nil && time.Now().Before(*l.SudoUntil)
+}
+
+// AdminElevated 是否处于管理模式
+func (l *Login) AdminElevated() bool {
+	return l.AdminSudoUntil != nil && time.Now().Before(*l.AdminSudoUntil)
+}
+
+// AuthenticatedAt 最近一次验证身份的时间
+func (l *Login) AuthenticatedAt() time.Time {
+	if l.AuthTime != nil {
+		return *l.AuthTime
+	}
+	return l.CreatedAt
+}
+
+// ACR 按最近一次验证身份的方式得出的认证等级，邮箱验证码及通行密钥为多因素
+func (l *Login) ACR() string {
+	for _, m := range l.AMR {
+		if m == AMROTP || m == AMRWebAuthn {
+			return ACRMultiFactor
+		}
+	}
+	return ACRSingleFactor
+}
+
+// LoginClient 终端登录过的应用
+type LoginClient struct {
+	LoginToken string `gorm:"primary_key"`
+	ClientID   string `gorm:"primary_key"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
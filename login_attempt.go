@@ -0,0 +1,14 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// LoginAttempt 登录失败记录
+type LoginAttempt struct {
+	ID       uint   `gorm:"primary_key"`
+	Username string `gorm:"index"`
+	// IP IPv6 记为所在前缀，同一网段的临时地址一起锁定
+	IP        string    `gorm:"index"`
+	CreatedAt time.Time `gorm:"index"`
+}
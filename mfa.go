@@ -0,0 +1,52 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// 邮箱验证码的用途
+const (
+	EmailOTPLogin  = "login"
+	EmailOTPEnroll = "enroll"
+	EmailOTPStepUp = "step_up"
+)
+
+// MFAPolicy 二次验证策略，可在管理中心随时修改
+type MFAPolicy struct {
+	ID uint `gorm:"primary_key"`
+	// AdminStrong 管理员级角色只能使用通行密钥登录
+	AdminStrong bool
+	UpdatedAt   time.Time
+}
+
+// EmailOTP 发送到邮箱的一次性验证码，ID 保存在 Cookie 中
+type EmailOTP struct {
+	ID       string `gorm:"primary_key"`
+	UserID   uint   `gorm:"index"`
+	Purpose  string
+	CodeHash string
+	// Attempts 已尝试次数，重新发送不会清零
+	Attempts int
+	// ReturnURL 登录成功后的跳转地址
+	ReturnURL string
+	// Detail 第一步登录方式，记入审计日志
+	Detail string
+	// AMR 第一步登录验证身份的方式
+	AMR       string
+	SentAt    time.Time
+	ExpiresAt time.Time
+}
+
+// Expired 验证码是否已过期
+func (o *EmailOTP) Expired() bool {
+	return time.Now().After(o.ExpiresAt)
+}
+
+// RecoveryCode 二次验证的恢复码，收不到验证码时代替验证码登录，每个只能使用一次
+type RecoveryCode struct {
+	ID        uint `gorm:"primary_key"`
+	UserID    uint `gorm:"index"`
+	CodeHash  string
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,27 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// Passkey 用户注册的通行密钥（WebAuthn 可发现凭据）
+type Passkey struct {
+	ID              uint   `gorm:"primary_key"`
+	UserID          uint   `gorm:"index"`
+	Name            string `gorm:"type:varchar(20)"`
+	CredentialID    []byte `gorm:"unique_index"`
+	PublicKey       []byte
+	AttestationType string
+	AAGUID          []byte
+	SignCount       uint32
+	CreatedAt       time.Time
+	LastUsedAt      *time.Time
+}
+
+// PasskeySession WebAuthn 注册、登录过程中的挑战
+type PasskeySession struct {
+	ID        string `gorm:"primary_key"`
+	UserID    uint
+	Data      string `gorm:"type:text"`
+	ExpiresAt time.Time
+}
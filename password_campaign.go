@@ -0,0 +1,17 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// PasswordHashCampaign 哈希参数变化后的一轮重新哈希，用户下次登录时按新参数重新生成哈希
+type PasswordHashCampaign struct {
+	ID uint `gorm:"primary_key"`
+	// Params 新参数生成的哈希前缀
+	Params string
+	// Target 自动调优的目标耗时（毫秒），未调优为 0
+	Target int `gorm:"index"`
+	// Outdated 开始时仍使用旧参数的用户数
+	Outdated  int
+	CreatedAt time.Time
+}
@@ -0,0 +1,13 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// PasswordHistory 用过的密码哈希，用于禁止重复使用
+type PasswordHistory struct {
+	ID        uint `gorm:"primary_key"`
+	UserID    uint `gorm:"index"`
+	Hash      string
+	CreatedAt time.Time
+}
@@ -0,0 +1,188 @@
+// Package backup 备份文件加密
+//
+// 明文按 64 KiB 分块以 AES-256-GCM 加密，每块的 nonce 由文件头中的随机前缀、块序号及是否为最后一块组成，
+// 调换、删除或截断分块都无法通过校验。
+package backup
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	magic     = "UCBACKUP1"
+	chunkSize = 64 * 1024
+	// prefixSize nonce 中的随机前缀长度，其余为 4 字节块序号及 1 字节结束标记
+	prefixSize = 7
+)
+
+// ErrCorrupted 备份文件被篡改、截断或密钥不正确
+var ErrCorrupted = errors.New("backup: 备份文件已损坏或密钥不正确")
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Writer 加密写入，必须调用 Close 写入最后一块
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+// NewWriter 写入文件头并返回加密的 Writer，key 为 32 字节
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, magic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *Writer) flush(final bool) error {
+	if w.counter == ^uint32(0) {
+		return errors.New("backup: 文件过大")
+	}
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.counter, final), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+	header := make([]byte, 5)
+	if final {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Write 写满一块且还有后续数据时才加密输出，保证最后一块在 Close 时写入
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("backup: 写入已关闭的文件")
+	}
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == chunkSize {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// Close 写入最后一块，不关闭底层的 Writer
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+// Reader 解密读取，读到最后一块之前遇到文件结束视为截断
+type Reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+// NewReader 校验文件头并返回解密的 Reader
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	header := make([]byte, len(magic)+prefixSize)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, errors.New("backup: 不是 ucenter 备份文件")
+	}
+	return &Reader{r: br, aead: aead, prefix: header[len(magic):]}, nil
+}
+
+func (r *Reader) next() error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return ErrCorrupted
+	}
+	final := header[0] == 1
+	size := binary.BigEndian.Uint32(header[1:])
+	if header[0] > 1 || size > chunkSize+uint32(r.aead.Overhead()) {
+		return ErrCorrupted
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return ErrCorrupted
+	}
+	plain, err := r.aead.Open(nil, chunkNonce(r.prefix, r.counter, final), sealed, nil)
+	if err != nil {
+		return ErrCorrupted
+	}
+	r.counter++
+	r.buf = plain
+	if final {
+		r.done = true
+		if _, err := r.r.ReadByte(); err != io.EOF {
+			return ErrCorrupted
+		}
+	}
+	return nil
+}
+
+// Read 读取解密后的数据
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,42 @@
+package captcha
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dchest/captcha"
+)
+
+// ImagePath 图片验证码的路由前缀
+const ImagePath = "/captcha/"
+
+// Image 自建图片验证码
+type Image struct{}
+
+// Widget 验证组件
+func (i *Image) Widget() template.HTML {
+	id := captcha.New()
+	return template.HTML(`<input type="hidden" name="captcha_id" value="` + id + `" />` +
+		`<div class="ui left icon action input">` +
+		`<i class="shield alternate icon"></i>` +
+		`<input type="text" name="captcha" autocomplete="off" placeholder="验证码" />` +
+		`<img class="ui image" src="` + ImagePath + id + `.png" onclick="this.src='` + ImagePath + id + `.png?reload='+Date.now()" />` +
+		`</div>`)
+}
+
+// Verify 校验
+func (i *Image) Verify(form url.Values, ip string) bool {
+	return captcha.VerifyString(form.Get("captcha_id"), trimSpace(form.Get("captcha")))
+}
+
+// Handler 验证码图片
+func (i *Image) Handler() http.Handler {
+	return captcha.Server(120, 40)
+}
+
+// trimSpace 去除验证码中的空白
+func trimSpace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
@@ -0,0 +1,43 @@
+// Package clientpolicy 应用授权策略扩展点
+//
+// ucenter 还没有组织模型，限制用户可以授权哪些应用（例如组织管理员为成员配置的白名单、黑名单）由策略实现：
+// 在 fork 的包里于 init 中调用 clientpolicy.Register，并在 cmd/web 中匿名导入该包。
+// 授权端点在用户登录后、同意授权前依次检查已注册的策略，任一策略拒绝即终止授权。
+package clientpolicy
+
+import "sync"
+
+// Request 待检查的授权请求
+type Request struct {
+	UserID   uint
+	ClientID string
+	Scopes   []string
+}
+
+// Policy 返回非空的 reason 表示拒绝，reason 会展示给用户；返回错误时同样拒绝授权
+type Policy func(r Request) (reason string, err error)
+
+var (
+	mu       sync.Mutex
+	policies []Policy
+)
+
+// Register 注册授权策略
+func Register(p Policy) {
+	mu.Lock()
+	defer mu.Unlock()
+	policies = append(policies, p)
+}
+
+// Check 依次检查已注册的策略，返回第一个拒绝的原因，全部通过时 reason 为空
+func Check(r Request) (reason string, err error) {
+	mu.Lock()
+	list := append([]Policy(nil), policies...)
+	mu.Unlock()
+	for _, p := range list {
+		if reason, err = p(r); err != nil || reason != "" {
+			return reason, err
+		}
+	}
+	return "", nil
+}
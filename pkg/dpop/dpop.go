@@ -0,0 +1,120 @@
+package dpop
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// HeaderName 携带 DPoP 证明的请求头
+const HeaderName = "DPoP"
+
+// MaxAge 证明签发时间允许的偏差
+const MaxAge = time.Minute * 5
+
+// Leeway 在 MaxAge 之外额外允许的时钟偏差，由调用方按配置设置
+var Leeway time.Duration
+
+// SupportedAlgs 支持的证明签名算法
+var SupportedAlgs = []string{string(jose.ES256), string(jose.ES384), string(jose.RS256), string(jose.PS256)}
+
+// Proof 校验通过的 DPoP 证明
+type Proof struct {
+	JTI      string
+	JKT      string // 公钥的 JWK SHA-256 指纹
+	IssuedAt time.Time
+}
+
+type claims struct {
+	JTI string `json:"jti"`
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	IAT int64  `json:"iat"`
+	ATH string `json:"ath"`
+}
+
+// Verify 校验 DPoP 证明，accessToken 非空时同时校验 ath
+func Verify(proof, method, htu, accessToken string) (*Proof, error) {
+	sig, err := jose.ParseSigned(proof)
+	if err != nil {
+		return nil, errors.New("DPoP 证明格式错误")
+	}
+	if len(sig.Signatures) != 1 {
+		return nil, errors.New("DPoP 证明只能包含一个签名")
+	}
+	h := sig.Signatures[0].Header
+	if typ, _ := h.ExtraHeaders[jose.HeaderType].(string); typ != "dpop+jwt" {
+		return nil, errors.New("DPoP 证明 typ 必须为 dpop+jwt")
+	}
+	if !algSupported(h.Algorithm) {
+		return nil, errors.New("不支持的 DPoP 签名算法")
+	}
+	if h.JSONWebKey == nil || !h.JSONWebKey.IsPublic() {
+		return nil, errors.New("DPoP 证明必须携带公钥")
+	}
+	payload, err := sig.Verify(h.JSONWebKey)
+	if err != nil {
+		return nil, errors.New("DPoP 证明签名无效")
+	}
+
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, errors.New("DPoP 证明格式错误")
+	}
+	iat := time.Unix(c.IAT, 0)
+	switch {
+	case c.JTI == "":
+		return nil, errors.New("DPoP 证明缺少 jti")
+	case c.HTM != method:
+		return nil, errors.New("DPoP 证明 htm 不匹配")
+	case !sameURL(c.HTU, htu):
+		return nil, errors.New("DPoP 证明 htu 不匹配")
+	case time.Since(iat) > MaxAge+Leeway || time.Until(iat) > MaxAge+Leeway:
+		return nil, errors.New("DPoP 证明已过期")
+	case accessToken != "" && c.ATH != tokenHash(accessToken):
+		return nil, errors.New("DPoP 证明 ath 不匹配")
+	}
+
+	thumb, err := h.JSONWebKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &Proof{
+		JTI:      c.JTI,
+		JKT:      base64.RawURLEncoding.EncodeToString(thumb),
+		IssuedAt: iat,
+	}, nil
+}
+
+func algSupported(alg string) bool {
+	for _, a := range SupportedAlgs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// sameURL 比较时忽略查询参数与片段
+func sameURL(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host && ua.Path == ub.Path
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
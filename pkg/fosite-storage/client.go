@@ -13,6 +13,20 @@ import (
 const (
 	// StatusOauthClientSuspended 禁用应用
 	StatusOauthClientSuspended = -1
+	// AccessTokenStrategyJWT 签发自包含的 JWT 访问令牌
+	AccessTokenStrategyJWT = "jwt"
+	// AccessTokenStrategyOpaque 签发不透明访问令牌，需通过内省校验
+	AccessTokenStrategyOpaque = "opaque"
+	// RedirectURIPolicyExact 跳转链接必须与登记的完全一致
+	RedirectURIPolicyExact = "exact"
+	// RedirectURIPolicyPrefix 允许登记路径下的子路径，协议、域名、端口及查询参数必须一致
+	RedirectURIPolicyPrefix = "prefix"
+	// SubjectTypePublic 所有应用看到相同的 sub
+	SubjectTypePublic = "public"
+	// SubjectTypePairwise 每个扇区看到不同的 sub，应用之间无法据此关联用户（OpenID Connect Core 第 8 节）
+	SubjectTypePairwise = "pairwise"
+	// RedirectURIPolicyLoopback 登记的本机回环地址允许任意端口（RFC 8252 第 7.3 节），供原生应用使用
+	RedirectURIPolicyLoopback = "loopback"
 )
 
 // FositeClient represents an OAuth 2.0 FositeClient.
@@ -34,6 +48,9 @@ type FositeClient struct {
 	// RedirectURIs is an array of allowed redirect urls for the client, for example http://mydomain/oauth/callback .
 	RedirectURIs pq.StringArray `gorm:"type:varchar(255)[]" json:"redirect_uris"`
 
+	// RedirectURIPolicy 跳转链接的匹配方式，见 RedirectURIPolicyExact 等，空值为完全一致
+	RedirectURIPolicy string `json:"redirect_uri_policy,omitempty"`
+
 	// GrantTypes is an array of grant types the client is allowed to use.
 	//
 	// Pattern: client_credentials|authorization_code|implicit|refresh_token
@@ -125,9 +142,15 @@ type FositeClient struct {
 	RawJSONWebKeys string `json:"-"`
 
 	// Requested Client Authentication method for the Token Endpoint. The options are client_secret_post,
-	// client_secret_basic, private_key_jwt, and none.
+	// client_secret_basic, private_key_jwt, tls_client_auth, self_signed_tls_client_auth and none.
 	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method,omitempty"`
 
+	// The expected subject distinguished name of the certificate the client uses for tls_client_auth (RFC 8705).
+	TLSClientAuthSubjectDN string `json:"tls_client_auth_subject_dn,omitempty"`
+
+	// Indicates the client's intention to use mutual-TLS client certificate-bound access tokens (RFC 8705).
+	TLSClientCertificateBoundAccessTokens bool `json:"tls_client_certificate_bound_access_tokens,omitempty"`
+
 	// Array of request_uri values that are pre-registered by the RP for use at the OP. Servers MAY cache the
 	// contents of the files referenced by these URIs and not retrieve them at the time they are used in a request.
 	// OPs can require that request_uri values used be pre-registered with the require_request_uri_registration
@@ -143,6 +166,22 @@ type FositeClient struct {
 	// as a UTF-8 encoded JSON object using the application/json content-type.
 	UserinfoSignedResponseAlg string `json:"userinfo_signed_response_alg,omitempty"`
 
+	// JWE alg algorithm [JWA] REQUIRED for encrypting the ID Token issued to this Client. If omitted, no encryption
+	// is performed.
+	IDTokenEncryptedResponseAlg string `json:"id_token_encrypted_response_alg,omitempty"`
+
+	// JWE enc algorithm [JWA] REQUIRED for encrypting the ID Token issued to this Client. If
+	// id_token_encrypted_response_alg is specified, the default for this value is A128CBC-HS256.
+	IDTokenEncryptedResponseEnc string `json:"id_token_encrypted_response_enc,omitempty"`
+
+	// JWE alg algorithm [JWA] REQUIRED for encrypting UserInfo Responses. If both signing and encryption are
+	// requested, the response will be signed then encrypted, with the result being a Nested JWT.
+	UserinfoEncryptedResponseAlg string `json:"userinfo_encrypted_response_alg,omitempty"`
+
+	// JWE enc algorithm [JWA] REQUIRED for encrypting UserInfo Responses. If userinfo_encrypted_response_alg is
+	// specified, the default for this value is A128CBC-HS256.
+	UserinfoEncryptedResponseEnc string `json:"userinfo_encrypted_response_enc,omitempty"`
+
 	// CreatedAt returns the timestamp of the client's creation.
 	CreatedAt time.Time `json:"created_at,omitempty"`
 
@@ -151,6 +190,64 @@ type FositeClient struct {
 
 	// Status status of client.
 	Status int `json:"status,omitempty"`
+
+	// Template is the client template (web, spa, native, service) the client was created from.
+	Template string `json:"template,omitempty"`
+
+	// RequirePKCE requires the authorization code flow of this client to use PKCE with S256.
+	RequirePKCE bool `json:"require_pkce,omitempty"`
+
+	// RequirePushedAuthorizationRequests requires this client to push its authorization requests to the PAR
+	// endpoint (RFC 9126) and start the authorization with the returned request_uri.
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests,omitempty"`
+
+	// AccessTokenLifespan overrides the access token lifespan in minutes, 0 uses the server default.
+	AccessTokenLifespan int `json:"access_token_lifespan,omitempty"`
+
+	// RefreshTokenLifespan limits the refresh token lifespan in hours, 0 uses the server default.
+	RefreshTokenLifespan int `json:"refresh_token_lifespan,omitempty"`
+
+	// IDTokenLifespan overrides the ID token lifespan in minutes, 0 uses the server default.
+	IDTokenLifespan int `json:"id_token_lifespan,omitempty"`
+
+	// AuthorizeCodeLifespan overrides the authorization code lifespan in minutes, 0 uses the server default.
+	AuthorizeCodeLifespan int `json:"authorize_code_lifespan,omitempty"`
+
+	// Machine marks a confidential machine-to-machine client. Only machine clients may use the
+	// client_credentials grant, and the scopes they receive are limited by RAM policies.
+	Machine bool `json:"machine,omitempty"`
+
+	// AccessTokenStrategy is the format of access tokens issued to this client, jwt or opaque. Empty means opaque.
+	// JWT access tokens are signed with the keys published at the JWKS endpoint and can be validated locally.
+	AccessTokenStrategy string `json:"access_token_strategy,omitempty"`
+
+	// NarrowScope drops requested scopes outside Scope instead of rejecting the authorization request
+	// with invalid_scope.
+	NarrowScope bool `json:"narrow_scope,omitempty"`
+
+	// FirstParty marks an internal application trusted by the operator. Users are not asked for consent and
+	// all requested scopes are granted. Only administrators can set it.
+	FirstParty bool `json:"first_party,omitempty"`
+
+	// AllowedIPs restricts the networks (IPs or CIDRs) from which the client's credentials are accepted at the
+	// token, introspection and revocation endpoints. Empty means unrestricted. Only administrators can set it.
+	AllowedIPs pq.StringArray `gorm:"type:varchar(64)[]" json:"allowed_ips,omitempty"`
+
+	// PostLogoutRedirectURIs is an array of URLs the End-User may be redirected to after RP-initiated logout.
+	PostLogoutRedirectURIs pq.StringArray `gorm:"type:varchar(255)[]" json:"post_logout_redirect_uris,omitempty"`
+
+	// BackchannelLogoutURI is the RP URL that receives logout tokens when a session the RP participated in ends.
+	BackchannelLogoutURI string `json:"backchannel_logout_uri,omitempty"`
+
+	// BackchannelLogoutSessionRequired indicates the RP requires the sid claim in logout tokens.
+	BackchannelLogoutSessionRequired bool `json:"backchannel_logout_session_required,omitempty"`
+
+	// RotatedSecret is the BCrypt hash of the previous secret. It is still accepted until RotatedSecretExpiresAt
+	// so that running deployments can roll over to the new secret without downtime.
+	RotatedSecret string `json:"-"`
+
+	// RotatedSecretExpiresAt is the end of the grace window of the previous secret.
+	RotatedSecretExpiresAt *time.Time `json:"rotated_secret_expires_at,omitempty"`
 }
 
 // BeforeSave hook
@@ -175,8 +272,15 @@ func (c *FositeClient) GetRedirectURIs() []string {
 	return c.RedirectURIs
 }
 
-// GetHashedSecret 获取加密密钥
+// GetHashedSecret 获取加密密钥，轮换宽限期内附带旧密钥，由 SecretHasher 逐个比较。
+// mTLS 认证的客户端没有密钥，返回证书认证标记，由 SecretHasher 依据证书校验结果判断
 func (c *FositeClient) GetHashedSecret() []byte {
+	if c.UsesMTLS() {
+		return []byte(certAuthPrefix + c.ClientID)
+	}
+	if c.RotatedSecret != "" && c.RotatedSecretExpiresAt != nil && time.Now().Before(*c.RotatedSecretExpiresAt) {
+		return []byte(c.Secret + secretSeparator + c.RotatedSecret)
+	}
 	return []byte(c.Secret)
 }
 
@@ -200,6 +304,16 @@ func (c *FositeClient) GetGrantTypes() fosite.Arguments {
 	if len(c.GrantTypes) == 0 {
 		return fosite.Arguments{"authorization_code"}
 	}
+	// 未标记为机器应用的客户端不能使用 client_credentials
+	if !c.Machine {
+		grantTypes := make(fosite.Arguments, 0, len(c.GrantTypes))
+		for _, t := range c.GrantTypes {
+			if t != "client_credentials" {
+				grantTypes = append(grantTypes, t)
+			}
+		}
+		return grantTypes
+	}
 	return fosite.Arguments(c.GrantTypes)
 }
 
@@ -226,6 +340,11 @@ func (c *FositeClient) IsPublic() bool {
 	return c.TokenEndpointAuthMethod == "none"
 }
 
+// UsesMTLS 是否使用 mTLS 客户端认证
+func (c *FositeClient) UsesMTLS() bool {
+	return c.TokenEndpointAuthMethod == "tls_client_auth" || c.TokenEndpointAuthMethod == "self_signed_tls_client_auth"
+}
+
 // GetJSONWebKeysURI 获取公钥URI
 func (c *FositeClient) GetJSONWebKeysURI() string {
 	return c.JSONWebKeysURI
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ConsentPending 等待用户授权
+	ConsentPending = 0
+	// ConsentAccepted 用户已同意
+	ConsentAccepted = 1
+	// ConsentRejected 用户已拒绝
+	ConsentRejected = -1
+
+	// ConsentChallengeLifespan 授权挑战有效期
+	ConsentChallengeLifespan = time.Minute * 10
+)
+
+// ConsentChallenge 交由外部授权界面处理的授权挑战
+type ConsentChallenge struct {
+	ID              string `gorm:"primary_key"`
+	Verifier        string `gorm:"index"`
+	ClientID        string
+	Subject         string
+	RequestedScopes pq.StringArray `gorm:"type:varchar(255)[]"`
+	GrantedScopes   pq.StringArray `gorm:"type:varchar(255)[]"`
+	// RequestURL 原始授权请求，外部界面处理完毕后携带 verifier 跳转回此地址
+	RequestURL string
+	Status     int
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+}
+
+// CreateConsentChallenge 创建授权挑战
+func (s *FositeStore) CreateConsentChallenge(clientID, subject, requestURL string, scopes fosite.Arguments) (*ConsentChallenge, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	cc := &ConsentChallenge{
+		ID:              id,
+		ClientID:        clientID,
+		Subject:         subject,
+		RequestedScopes: pq.StringArray(scopes),
+		RequestURL:      requestURL,
+		ExpiresAt:       time.Now().Add(ConsentChallengeLifespan),
+	}
+	return cc, s.db.Create(cc).Error
+}
+
+// GetConsentChallenge 获取未处理的授权挑战
+func (s *FositeStore) GetConsentChallenge(id string) (*ConsentChallenge, error) {
+	var cc ConsentChallenge
+	if err := s.db.First(&cc, "id = ?", id).Error; err == gorm.ErrRecordNotFound {
+		return nil, fosite.ErrNotFound
+	} else if err != nil {
+		return nil, fosite.ErrServerError
+	}
+	if cc.Status != ConsentPending || time.Now().After(cc.ExpiresAt) {
+		return nil, errors.WithStack(fosite.ErrRequestForbidden.WithHint("The consent challenge has expired or was already handled."))
+	}
+	return &cc, nil
+}
+
+// AcceptConsentChallenge 用户同意授权，grantScopes 必须是请求 scope 的子集
+func (s *FositeStore) AcceptConsentChallenge(id string, grantScopes []string) (*ConsentChallenge, error) {
+	cc, err := s.GetConsentChallenge(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range grantScopes {
+		if !fosite.Arguments(cc.RequestedScopes).Has(scope) {
+			return nil, errors.WithStack(fosite.ErrInvalidScope.WithHint("The granted scope \"" + scope + "\" was not requested."))
+		}
+	}
+	cc.GrantedScopes = pq.StringArray(grantScopes)
+	cc.Status = ConsentAccepted
+	if cc.Verifier, err = randomToken(); err != nil {
+		return nil, err
+	}
+	return cc, s.db.Save(cc).Error
+}
+
+// RejectConsentChallenge 用户拒绝授权
+func (s *FositeStore) RejectConsentChallenge(id string) (*ConsentChallenge, error) {
+	cc, err := s.GetConsentChallenge(id)
+	if err != nil {
+		return nil, err
+	}
+	cc.Status = ConsentRejected
+	if cc.Verifier, err = randomToken(); err != nil {
+		return nil, err
+	}
+	return cc, s.db.Save(cc).Error
+}
+
+// ConsumeConsentVerifier 使用一次性的 verifier 取回已处理的授权挑战
+func (s *FositeStore) ConsumeConsentVerifier(verifier string) (*ConsentChallenge, error) {
+	var cc ConsentChallenge
+	if err := s.db.First(&cc, "verifier = ?", verifier).Error; err == gorm.ErrRecordNotFound {
+		return nil, fosite.ErrNotFound
+	} else if err != nil {
+		return nil, fosite.ErrServerError
+	}
+	if err := s.db.Delete(&cc).Error; err != nil {
+		return nil, fosite.ErrServerError
+	}
+	if time.Now().After(cc.ExpiresAt) {
+		return nil, errors.WithStack(fosite.ErrRequestForbidden.WithHint("The consent verifier has expired."))
+	}
+	return &cc, nil
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// 设备码状态
+const (
+	DeviceCodePending = iota
+	DeviceCodeApproved
+	DeviceCodeDenied
+	DeviceCodeConsumed
+)
+
+// DeviceCode 设备授权（RFC 8628）会话，设备码只保存哈希
+type DeviceCode struct {
+	ID        int64  `gorm:"primary_key"`
+	Signature string `gorm:"unique_index"`
+	// UserCode 用户在 /device 页面输入的验证码，不含分隔符
+	UserCode     string `gorm:"unique_index"`
+	RequestID    string
+	ClientID     string
+	Scopes       pq.StringArray `gorm:"type:varchar(255)[]"`
+	GrantedScope pq.StringArray `gorm:"type:varchar(255)[]"`
+	// Subject、Session 用户确认后写入，换取令牌时还原为令牌的 Session
+	Subject      string
+	Session      []byte
+	Status       int
+	LastPolledAt *time.Time
+	ExpiresAt    time.Time `gorm:"index"`
+	CreatedAt    time.Time
+}
+
+func deviceCodeSignature(code string) string {
+	return fmt.Sprintf("%x", sha512.Sum384([]byte(code)))
+}
+
+// CreateDeviceCodeSession 创建设备授权会话
+func (s *FositeStore) CreateDeviceCodeSession(deviceCode string, dc *DeviceCode) error {
+	dc.Signature = deviceCodeSignature(deviceCode)
+	return s.db.Create(dc).Error
+}
+
+// GetDeviceCodeSession 按设备码获取设备授权会话
+func (s *FositeStore) GetDeviceCodeSession(deviceCode string) (*DeviceCode, error) {
+	var dc DeviceCode
+	if err := s.db.First(&dc, "signature = ?", deviceCodeSignature(deviceCode)).Error; err == gorm.ErrRecordNotFound {
+		return nil, errors.WithStack(fosite.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	return &dc, nil
+}
+
+// GetPendingDeviceCode 按用户验证码获取等待确认的设备授权会话
+func (s *FositeStore) GetPendingDeviceCode(userCode string) (*DeviceCode, error) {
+	var dc DeviceCode
+	if err := s.db.First(&dc, "user_code = ? AND status = ? AND expires_at > ?", userCode, DeviceCodePending, time.Now()).Error; err == gorm.ErrRecordNotFound {
+		return nil, errors.WithStack(fosite.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	return &dc, nil
+}
+
+// DecideDeviceCode 用户确认或拒绝设备授权，只能处理一次
+func (s *FositeStore) DecideDeviceCode(dc *DeviceCode) error {
+	db := s.db.Model(DeviceCode{}).Where("id = ? AND status = ?", dc.ID, DeviceCodePending).Updates(map[string]interface{}{
+		"status":        dc.Status,
+		"subject":       dc.Subject,
+		"session":       dc.Session,
+		"granted_scope": dc.GrantedScope,
+	})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return errors.WithStack(fosite.ErrNotFound)
+	}
+	return nil
+}
+
+// TouchDeviceCode 记录设备轮询时间
+func (s *FositeStore) TouchDeviceCode(dc *DeviceCode) error {
+	return s.db.Model(DeviceCode{}).Where("id = ?", dc.ID).UpdateColumn("last_polled_at", time.Now()).Error
+}
+
+// ConsumeDeviceCode 换取令牌，已确认的设备码只能使用一次
+func (s *FositeStore) ConsumeDeviceCode(dc *DeviceCode) error {
+	db := s.db.Model(DeviceCode{}).Where("id = ? AND status = ?", dc.ID, DeviceCodeApproved).UpdateColumn("status", DeviceCodeConsumed)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return errors.WithStack(fosite.ErrInvalidGrant.WithHint("The device code has already been used."))
+	}
+	return nil
+}
+
+// DeleteExpiredDeviceCodes 清理过期的设备授权会话
+func (s *FositeStore) DeleteExpiredDeviceCodes(before time.Time) error {
+	return s.db.Delete(DeviceCode{}, "expires_at < ?", before).Error
+}
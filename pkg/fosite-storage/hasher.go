@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// secretSeparator 分隔新旧密钥的哈希，bcrypt 哈希与生成的密钥中都不会出现
+const secretSeparator = "\n"
+
+// certAuthPrefix mTLS 认证客户端的证书认证标记，从不与请求中的密钥比较
+const certAuthPrefix = "\x00tls_client_auth\x00"
+
+type certAuthKey struct{}
+
+// WithCertAuthenticatedClient 标记该客户端已出示与注册信息相符的 TLS 客户端证书
+func WithCertAuthenticatedClient(ctx context.Context, clientID string) context.Context {
+	return context.WithValue(ctx, certAuthKey{}, clientID)
+}
+
+// SecretHasher 客户端密钥哈希，比较过程均为常数时间
+type SecretHasher struct{}
+
+// Compare 校验客户端密钥，兼容以明文保存的旧密钥。轮换宽限期内新旧密钥都会比较，任一匹配即通过。
+// mTLS 认证的客户端只看 ctx 中的证书认证结果，请求中的密钥一律不接受
+func (h *SecretHasher) Compare(ctx context.Context, hash, data []byte) error {
+	if bytes.HasPrefix(hash, []byte(certAuthPrefix)) {
+		if id, _ := ctx.Value(certAuthKey{}).(string); id == "" || id != string(hash[len(certAuthPrefix):]) {
+			return errors.New("client certificate not verified")
+		}
+		return nil
+	}
+	err := errors.New("client secret mismatch")
+	for _, one := range bytes.Split(hash, []byte(secretSeparator)) {
+		if compareSecret(one, data) == nil {
+			err = nil
+		}
+	}
+	return err
+}
+
+func compareSecret(hash, data []byte) error {
+	if bytes.HasPrefix(hash, []byte("$2")) {
+		return bcrypt.CompareHashAndPassword(hash, data)
+	}
+	if subtle.ConstantTimeCompare(hash, data) != 1 {
+		return errors.New("client secret mismatch")
+	}
+	return nil
+}
+
+// Hash 生成客户端密钥哈希
+func (h *SecretHasher) Hash(ctx context.Context, data []byte) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(data, bcrypt.DefaultCost)
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// LoginChallenge 交由外部登录界面处理的登录挑战
+type LoginChallenge struct {
+	ID       string `gorm:"primary_key"`
+	Verifier string `gorm:"index"`
+	ClientID string
+	// BrowserHash 发起登录的浏览器所持随机值的摘要，兑换 verifier 时须由同一浏览器出示
+	BrowserHash string
+	// Subject 外部登录界面确认的用户
+	Subject string
+	// RequestURL 原始授权请求，外部界面处理完毕后携带 verifier 跳转回此地址
+	RequestURL string
+	Status     int
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+}
+
+// CreateLoginChallenge 创建绑定到浏览器的登录挑战
+func (s *FositeStore) CreateLoginChallenge(clientID, requestURL, browserHash string) (*LoginChallenge, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	lc := &LoginChallenge{
+		ID:          id,
+		ClientID:    clientID,
+		BrowserHash: browserHash,
+		RequestURL:  requestURL,
+		ExpiresAt:   time.Now().Add(ConsentChallengeLifespan),
+	}
+	return lc, s.db.Create(lc).Error
+}
+
+// GetLoginChallenge 获取未处理的登录挑战
+func (s *FositeStore) GetLoginChallenge(id string) (*LoginChallenge, error) {
+	var lc LoginChallenge
+	if err := s.db.First(&lc, "id = ?", id).Error; err == gorm.ErrRecordNotFound {
+		return nil, fosite.ErrNotFound
+	} else if err != nil {
+		return nil, fosite.ErrServerError
+	}
+	if lc.Status != ConsentPending || time.Now().After(lc.ExpiresAt) {
+		return nil, errors.WithStack(fosite.ErrRequestForbidden.WithHint("The login challenge has expired or was already handled."))
+	}
+	return &lc, nil
+}
+
+// AcceptLoginChallenge 外部登录界面确认用户身份
+func (s *FositeStore) AcceptLoginChallenge(id, subject string) (*LoginChallenge, error) {
+	lc, err := s.GetLoginChallenge(id)
+	if err != nil {
+		return nil, err
+	}
+	lc.Subject = subject
+	lc.Status = ConsentAccepted
+	if lc.Verifier, err = randomToken(); err != nil {
+		return nil, err
+	}
+	return lc, s.db.Save(lc).Error
+}
+
+// RejectLoginChallenge 外部登录界面拒绝登录
+func (s *FositeStore) RejectLoginChallenge(id string) (*LoginChallenge, error) {
+	lc, err := s.GetLoginChallenge(id)
+	if err != nil {
+		return nil, err
+	}
+	lc.Status = ConsentRejected
+	if lc.Verifier, err = randomToken(); err != nil {
+		return nil, err
+	}
+	return lc, s.db.Save(lc).Error
+}
+
+// ConsumeLoginVerifier 使用一次性的 verifier 取回已处理的登录挑战
+func (s *FositeStore) ConsumeLoginVerifier(verifier string) (*LoginChallenge, error) {
+	var lc LoginChallenge
+	if err := s.db.First(&lc, "verifier = ?", verifier).Error; err == gorm.ErrRecordNotFound {
+		return nil, fosite.ErrNotFound
+	} else if err != nil {
+		return nil, fosite.ErrServerError
+	}
+	if err := s.db.Delete(&lc).Error; err != nil {
+		return nil, fosite.ErrServerError
+	}
+	if time.Now().After(lc.ExpiresAt) {
+		return nil, errors.WithStack(fosite.ErrRequestForbidden.WithHint("The login verifier has expired."))
+	}
+	return &lc, nil
+}
@@ -81,4 +81,8 @@ type FositePkce struct {
 // FositeRefresh refresh
 type FositeRefresh struct {
 	*BaseSessionTable
+	// LastUsedAt 最近一次用于刷新的时间
+	LastUsedAt *time.Time
+	// LastUsedIP 最近一次用于刷新的 IP
+	LastUsedIP string
 }
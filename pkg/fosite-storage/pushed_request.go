@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+)
+
+// PushedRequestURIPrefix PAR 签发的 request_uri 前缀（RFC 9126 第 2.2 节）
+const PushedRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+// PushedRequest 应用通过 PAR 端点预先提交的授权请求（RFC 9126），授权端点凭 request_uri 取回参数
+type PushedRequest struct {
+	ID       string `gorm:"primary_key"`
+	ClientID string
+	// Form 预先提交的授权请求参数，URL 编码
+	Form string `gorm:"type:text"`
+	// OpenedAt 首次进入授权端点的时间，之后有效期延长到足以完成登录与授权
+	OpenedAt  *time.Time
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// RequestURI 返回给应用的 request_uri
+func (pr *PushedRequest) RequestURI() string {
+	return PushedRequestURIPrefix + pr.ID
+}
+
+// Values 预先提交的授权请求参数
+func (pr *PushedRequest) Values() (url.Values, error) {
+	return url.ParseQuery(pr.Form)
+}
+
+// CreatePushedRequest 保存预先提交的授权请求
+func (s *FositeStore) CreatePushedRequest(clientID string, form url.Values, lifespan time.Duration) (*PushedRequest, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	pr := &PushedRequest{
+		ID:        id,
+		ClientID:  clientID,
+		Form:      form.Encode(),
+		ExpiresAt: time.Now().Add(lifespan),
+	}
+	return pr, s.db.Create(pr).Error
+}
+
+// OpenPushedRequest 按 request_uri 取回未过期的授权请求，首次使用时有效期延长为 ConsentChallengeLifespan
+func (s *FositeStore) OpenPushedRequest(requestURI string) (*PushedRequest, error) {
+	if !strings.HasPrefix(requestURI, PushedRequestURIPrefix) {
+		return nil, errors.WithStack(fosite.ErrInvalidRequestURI)
+	}
+	var pr PushedRequest
+	if err := s.db.First(&pr, "id = ?", strings.TrimPrefix(requestURI, PushedRequestURIPrefix)).Error; err == gorm.ErrRecordNotFound {
+		return nil, errors.WithStack(fosite.ErrInvalidRequestURI.WithHint("The request_uri is unknown or was already used."))
+	} else if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.After(pr.ExpiresAt) {
+		return nil, errors.WithStack(fosite.ErrInvalidRequestURI.WithHint("The request_uri has expired."))
+	}
+	if pr.OpenedAt == nil {
+		pr.OpenedAt = &now
+		pr.ExpiresAt = now.Add(ConsentChallengeLifespan)
+		if err := s.db.Model(PushedRequest{}).Where("id = ?", pr.ID).Updates(map[string]interface{}{
+			"opened_at":  pr.OpenedAt,
+			"expires_at": pr.ExpiresAt,
+		}).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &pr, nil
+}
+
+// UpdatePushedRequestForm 修改授权请求参数，如去掉已处理的 prompt
+func (s *FositeStore) UpdatePushedRequestForm(pr *PushedRequest, form url.Values) error {
+	pr.Form = form.Encode()
+	return s.db.Model(PushedRequest{}).Where("id = ?", pr.ID).UpdateColumn("form", pr.Form).Error
+}
+
+// DeletePushedRequest 授权完成后作废 request_uri，只能使用一次
+func (s *FositeStore) DeletePushedRequest(id string) error {
+	return s.db.Delete(PushedRequest{}, "id = ?", id).Error
+}
+
+// DeleteExpiredPushedRequests 清理过期的预提交授权请求
+func (s *FositeStore) DeleteExpiredPushedRequests(before time.Time) error {
+	return s.db.Delete(PushedRequest{}, "expires_at < ?", before).Error
+}
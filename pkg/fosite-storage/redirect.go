@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+)
+
+type redirectURIKey struct{}
+
+// WithRedirectURI 在上下文中附上授权请求的跳转链接。fosite 只接受与登记完全一致的跳转链接，
+// GetClient 时若它符合应用的匹配方式，则临时加入应用的跳转链接
+func WithRedirectURI(ctx context.Context, uri string) context.Context {
+	return context.WithValue(ctx, redirectURIKey{}, uri)
+}
+
+func acceptRedirectURI(ctx context.Context, c *FositeClient) {
+	if ctx == nil {
+		return
+	}
+	uri, _ := ctx.Value(redirectURIKey{}).(string)
+	if uri == "" || !c.MatchRedirectURI(uri) {
+		return
+	}
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return
+		}
+	}
+	c.RedirectURIs = append(c.RedirectURIs, uri)
+}
+
+// IsLoopback 本机回环地址（RFC 8252 第 7.3 节）
+func IsLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// MatchRedirectURI 按应用的匹配方式校验授权请求的跳转链接，与登记的完全一致时总是通过
+func (c *FositeClient) MatchRedirectURI(raw string) bool {
+	for _, registered := range c.RedirectURIs {
+		if raw == registered {
+			return true
+		}
+	}
+	if c.RedirectURIPolicy != RedirectURIPolicyPrefix && c.RedirectURIPolicy != RedirectURIPolicyLoopback {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.User != nil || u.Fragment != "" {
+		return false
+	}
+	for _, registered := range c.RedirectURIs {
+		r, err := url.Parse(registered)
+		if err != nil {
+			continue
+		}
+		if c.RedirectURIPolicy == RedirectURIPolicyPrefix && matchPathPrefix(r, u) {
+			return true
+		}
+		if c.RedirectURIPolicy == RedirectURIPolicyLoopback && matchLoopback(r, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathPrefix u 位于 r 的路径之下，不允许 . 与 .. 路径段跳出登记的路径
+func matchPathPrefix(r, u *url.URL) bool {
+	if r.Scheme != u.Scheme || !strings.EqualFold(r.Host, u.Host) || r.RawQuery != u.RawQuery {
+		return false
+	}
+	for _, seg := range strings.Split(u.Path, "/") {
+		if seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return u.Path == r.Path || strings.HasPrefix(u.Path, strings.TrimSuffix(r.Path, "/")+"/")
+}
+
+// matchLoopback r 为 http 本机回环地址时忽略端口，其余部分必须一致
+func matchLoopback(r, u *url.URL) bool {
+	return r.Scheme == "http" && u.Scheme == "http" && IsLoopback(r.Hostname()) &&
+		r.Hostname() == u.Hostname() && r.Path == u.Path && r.RawQuery == u.RawQuery
+}
@@ -16,6 +16,10 @@ type FositeSession struct {
 	*openid.DefaultSession `json:"idToken"`
 	Extra                  map[string]interface{} `json:"extra"`
 	ClientID               string
+	// DPoPJKT 令牌绑定的 DPoP 公钥指纹
+	DPoPJKT string `json:"dpop_jkt,omitempty"`
+	// CertThumbprint 令牌绑定的客户端证书指纹（x5t#S256）
+	CertThumbprint string `json:"x5t_s256,omitempty"`
 }
 
 // NewFositeSession 新 Session
@@ -23,7 +27,7 @@ func NewFositeSession(subject string) *FositeSession {
 	return &FositeSession{
 		DefaultSession: &openid.DefaultSession{
 			Claims: &jwt.IDTokenClaims{
-				Issuer:  "http://" + ucenter.C.Domain,
+				Issuer:  ucenter.Issuer(),
 				Subject: subject,
 			},
 			Headers: new(jwt.Headers),
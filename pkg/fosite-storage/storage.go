@@ -5,13 +5,14 @@ import (
 	"crypto/sha512"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/lib/pq"
-	"github.com/naiba/ucenter"
 	"github.com/ory/fosite"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -38,7 +39,7 @@ func NewFositeStore(db *gorm.DB, hashSignature bool) *FositeStore {
 
 // Migrate db migrate
 func (s *FositeStore) Migrate() error {
-	return s.db.AutoMigrate(FositeAccess{}, FositeCode{}, FositeOidc{}, FositePkce{}, FositeRefresh{}, FositeClient{}).Error
+	return s.db.AutoMigrate(FositeAccess{}, FositeCode{}, FositeOidc{}, FositePkce{}, FositeRefresh{}, FositeClient{}, ConsentChallenge{}, LoginChallenge{}, DeviceCode{}, PushedRequest{}).Error
 }
 
 func (s *FositeStore) hashSignature(signature, table string) string {
@@ -90,12 +91,18 @@ func (s *FositeStore) createSession(table, signature string, req fosite.Requeste
 	case sqlTablePKCE:
 		return s.db.Save(&FositePkce{&base}).Error
 	case sqlTableRefresh:
-		return s.db.Save(&FositeRefresh{&base}).Error
+		return s.db.Save(&FositeRefresh{BaseSessionTable: &base}).Error
 	case sqlTableCode:
 		return s.db.Save(&FositeCode{&base}).Error
 	}
 
-	return fosite.ErrInvalidRequest
+	return errors.Errorf("unknown session table %s", table)
+}
+
+// expiringTables 读取时由存储层校验有效期的表
+var expiringTables = map[string]fosite.TokenType{
+	sqlTableCode:    fosite.AuthorizeCode,
+	sqlTableRefresh: fosite.RefreshToken,
 }
 
 func (s *FositeStore) findSessionBySignature(table, signature string, session fosite.Session) (fosite.Requester, error) {
@@ -112,9 +119,11 @@ func (s *FositeStore) findSessionBySignature(table, signature string, session fo
 	case sqlTableCode:
 		err = s.db.Where("signature = ?", signature).First(&FositeCode{&d}).Error
 	case sqlTableRefresh:
-		err = s.db.Where("signature = ?", signature).First(&FositeRefresh{&d}).Error
+		err = s.db.Where("signature = ?", signature).First(&FositeRefresh{BaseSessionTable: &d}).Error
 	case sqlTablePKCE:
 		err = s.db.Where("signature = ?", signature).First(&FositePkce{&d}).Error
+	default:
+		return nil, errors.Errorf("unknown session table %s", table)
 	}
 
 	if err == gorm.ErrRecordNotFound {
@@ -131,7 +140,17 @@ func (s *FositeStore) findSessionBySignature(table, signature string, session fo
 		return nil, errors.WithStack(fosite.ErrInactiveToken)
 	}
 
-	return d.toRequest(session, s)
+	r, err := d.toRequest(session, s)
+	if err != nil {
+		return nil, err
+	}
+	// 授权码及刷新令牌按签发时记录的有效期校验，过期视为不存在
+	if t, ok := expiringTables[table]; ok {
+		if exp := r.GetSession().GetExpiresAt(t); !exp.IsZero() && exp.Before(time.Now().UTC()) {
+			return nil, errors.Wrap(fosite.ErrNotFound, "token expired")
+		}
+	}
+	return r, nil
 }
 
 func (s *FositeStore) deleteSession(signature, table string) error {
@@ -149,6 +168,8 @@ func (s *FositeStore) deleteSession(signature, table string) error {
 		err = s.db.Delete(&FositePkce{}, "signature = ?", signature).Error
 	case sqlTableRefresh:
 		err = s.db.Delete(&FositeRefresh{}, "signature = ?", signature).Error
+	default:
+		err = errors.Errorf("unknown session table %s", table)
 	}
 
 	return err
@@ -169,8 +190,11 @@ func (s *FositeStore) DeleteOpenIDConnectSession(_ context.Context, signature st
 	return s.deleteSession(signature, sqlTableOpenID)
 }
 
-// CreateAuthorizeCodeSession -
+// CreateAuthorizeCodeSession 保存授权码，应用设置了授权码有效期时覆盖默认值
 func (s *FositeStore) CreateAuthorizeCodeSession(_ context.Context, signature string, req fosite.Requester) error {
+	if c, ok := req.GetClient().(*FositeClient); ok && c.AuthorizeCodeLifespan > 0 {
+		req.GetSession().SetExpiresAt(fosite.AuthorizeCode, time.Now().UTC().Add(time.Minute*time.Duration(c.AuthorizeCodeLifespan)).Round(time.Second))
+	}
 	return s.createSession(sqlTableCode, signature, req)
 }
 
@@ -181,12 +205,12 @@ func (s *FositeStore) GetAuthorizeCodeSession(_ context.Context, signature strin
 
 // InvalidateAuthorizeCodeSession 失效accessCode
 func (s *FositeStore) InvalidateAuthorizeCodeSession(_ context.Context, signature string) error {
-	return s.db.Model(&FositeCode{}).Where("signature=?", signature).Update("active", false).Error
+	return s.db.Model(&FositeCode{}).Where("signature = ?", s.hashSignature(signature, sqlTableCode)).Update("active", false).Error
 }
 
 // DeleteAuthorizeCodeSession -
 func (s *FositeStore) DeleteAuthorizeCodeSession(_ context.Context, signature string) error {
-	return s.db.Delete(&FositeCode{}, "signature=?", signature).Error
+	return s.deleteSession(signature, sqlTableCode)
 }
 
 // CreatePKCERequestSession -
@@ -201,7 +225,7 @@ func (s *FositeStore) GetPKCERequestSession(_ context.Context, signature string,
 
 // DeletePKCERequestSession -
 func (s *FositeStore) DeletePKCERequestSession(_ context.Context, signature string) error {
-	return s.db.Delete(&FositePkce{}, "signature=?", signature).Error
+	return s.deleteSession(signature, sqlTablePKCE)
 }
 
 // CreateAccessTokenSession 创建授权码
@@ -214,9 +238,9 @@ func (s *FositeStore) GetAccessTokenSession(_ context.Context, signature string,
 	return s.findSessionBySignature(sqlTableAccess, signature, session)
 }
 
-// DeleteAccessTokenSession 删除授权码
+// DeleteAccessTokenSession 删除授权码，与写入、查询一样按签名的哈希匹配
 func (s *FositeStore) DeleteAccessTokenSession(_ context.Context, signature string) error {
-	return s.db.Delete(&FositeAccess{}, "signature=?", signature).Error
+	return s.deleteSession(signature, sqlTableAccess)
 }
 
 // CreateRefreshTokenSession 创建更新令牌
@@ -231,7 +255,7 @@ func (s *FositeStore) GetRefreshTokenSession(_ context.Context, signature string
 
 // DeleteRefreshTokenSession 删除更新令牌
 func (s *FositeStore) DeleteRefreshTokenSession(_ context.Context, signature string) error {
-	return s.db.Delete(&FositeRefresh{}, "signature=?", signature).Error
+	return s.deleteSession(signature, sqlTableRefresh)
 }
 
 // CreateImplicitAccessTokenSession 创建简化授权
@@ -239,52 +263,296 @@ func (s *FositeStore) CreateImplicitAccessTokenSession(ctx context.Context, sign
 	return s.CreateAccessTokenSession(ctx, signature, req)
 }
 
-// Authenticate 用户认证
-func (s *FositeStore) Authenticate(_ context.Context, id string, secret string) error {
-	var u ucenter.User
-	if err := s.db.First(&u, "id = ?", id).Error; err == gorm.ErrRecordNotFound {
-		return fosite.ErrNotFound
-	} else if err != nil {
+// RevokeRefreshToken 吊销刷新令牌，同一授权（request_id 相同）签发的访问令牌一并失效，
+// 与 fosite 的 MemoryStore 一致，令牌不存在时不报错
+func (s *FositeStore) RevokeRefreshToken(ctx context.Context, requestID string) error {
+	if err := s.db.Delete(&FositeRefresh{}, "request_id = ?", requestID).Error; err != nil {
 		return fosite.ErrServerError
-	} else if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(secret)) != nil {
-		return errors.New("Invalid credentials")
+	}
+	return s.RevokeAccessToken(ctx, requestID)
+}
+
+// TouchRefreshToken 记录刷新令牌的最近使用时间及 IP
+func (s *FositeStore) TouchRefreshToken(requestID, ip string) error {
+	return s.db.Model(&FositeRefresh{}).Where("request_id = ? AND active", requestID).Updates(map[string]interface{}{
+		"last_used_at": time.Now(),
+		"last_used_ip": ip,
+	}).Error
+}
+
+// OfflineGrant 用户持有有效刷新令牌的应用
+type OfflineGrant struct {
+	ClientID   string
+	Tokens     int
+	IssuedAt   time.Time
+	LastUsedAt *time.Time
+	LastUsedIP string
+}
+
+// OfflineGrants 列出用户持有刷新令牌的应用，即可以在用户不在场时访问账户的应用
+func (s *FositeStore) OfflineGrants(subject string) ([]OfflineGrant, error) {
+	var rows []FositeRefresh
+	if err := s.db.Where("subject = ? AND active", subject).Order("requested_at").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	var list []OfflineGrant
+	index := make(map[string]int)
+	for _, r := range rows {
+		i, ok := index[r.ClientID]
+		if !ok {
+			i = len(list)
+			index[r.ClientID] = i
+			list = append(list, OfflineGrant{ClientID: r.ClientID, IssuedAt: r.RequestedAt})
+		}
+		g := &list[i]
+		g.Tokens++
+		if r.LastUsedAt != nil && (g.LastUsedAt == nil || r.LastUsedAt.After(*g.LastUsedAt)) {
+			g.LastUsedAt = r.LastUsedAt
+			g.LastUsedIP = r.LastUsedIP
+		}
+	}
+	return list, nil
+}
+
+// RevokeClientTokens 删除用户在某个应用的全部访问令牌及刷新令牌
+func (s *FositeStore) RevokeClientTokens(subject, clientID string) error {
+	if err := s.db.Delete(&FositeRefresh{}, "subject = ? AND client_id = ?", subject, clientID).Error; err != nil {
+		return err
+	}
+	return s.db.Delete(&FositeAccess{}, "subject = ? AND client_id = ?", subject, clientID).Error
+}
+
+// RevokeClientScopeTokens 删除用户在某个应用中授予了 scope 的访问令牌及刷新令牌
+func (s *FositeStore) RevokeClientScopeTokens(subject, clientID, scope string) error {
+	for _, m := range []interface{}{&FositeRefresh{}, &FositeAccess{}} {
+		if err := s.db.Delete(m, "subject = ? AND client_id = ? AND ? = ANY(granted_scope)", subject, clientID, scope).Error; err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// RevokeRefreshToken 置刷新令牌失效
-func (s *FositeStore) RevokeRefreshToken(ctx context.Context, requestID string) error {
-	var d FositeRefresh
+// ClientGrant 用户在某个应用的有效令牌汇总
+type ClientGrant struct {
+	ClientID    string
+	Scopes      []string
+	FirstUsedAt time.Time
+	LastUsedAt  time.Time
+}
 
-	if err := s.db.First(&d, "request_id=?", requestID).Error; err == gorm.ErrRecordNotFound {
-		return fosite.ErrNotFound
-	} else if err != nil {
-		return fosite.ErrServerError
+// ClientGrants 按应用汇总用户有效的访问令牌及刷新令牌，LastUsedAt 取最近签发或刷新的时间
+func (s *FositeStore) ClientGrants(subject string) (map[string]*ClientGrant, error) {
+	var access []FositeAccess
+	if err := s.db.Where("subject = ? AND active", subject).Find(&access).Error; err != nil {
+		return nil, err
+	}
+	var refresh []FositeRefresh
+	if err := s.db.Where("subject = ? AND active", subject).Find(&refresh).Error; err != nil {
+		return nil, err
+	}
+	grants := make(map[string]*ClientGrant)
+	add := func(t *BaseSessionTable, used *time.Time) {
+		g, ok := grants[t.ClientID]
+		if !ok {
+			g = &ClientGrant{ClientID: t.ClientID, FirstUsedAt: t.RequestedAt}
+			grants[t.ClientID] = g
+		}
+		for _, scope := range t.GrantedScope {
+			if !fosite.Arguments(g.Scopes).Has(scope) {
+				g.Scopes = append(g.Scopes, scope)
+			}
+		}
+		if t.RequestedAt.Before(g.FirstUsedAt) {
+			g.FirstUsedAt = t.RequestedAt
+		}
+		last := t.RequestedAt
+		if used != nil && used.After(last) {
+			last = *used
+		}
+		if last.After(g.LastUsedAt) {
+			g.LastUsedAt = last
+		}
+	}
+	for _, t := range access {
+		add(t.BaseSessionTable, nil)
+	}
+	for _, t := range refresh {
+		add(t.BaseSessionTable, t.LastUsedAt)
+	}
+	return grants, nil
+}
+
+// ClientsLastUsed 各应用最近签发访问令牌或刷新令牌的时间，没有令牌的应用不在结果中
+func (s *FositeStore) ClientsLastUsed() (map[string]time.Time, error) {
+	last := make(map[string]time.Time)
+	for m, column := range map[interface{}]string{
+		&FositeAccess{}:  "MAX(requested_at)",
+		&FositeRefresh{}: "MAX(COALESCE(last_used_at, requested_at))",
+	} {
+		rows, err := s.db.Table(s.db.NewScope(m).TableName()).Select("client_id, " + column).Group("client_id").Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var clientID string
+			var t time.Time
+			if err := rows.Scan(&clientID, &t); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if t.After(last[clientID]) {
+				last[clientID] = t
+			}
+		}
+		rows.Close()
+	}
+	return last, nil
+}
+
+// RevokeSubjectTokens 删除用户的全部授权码及令牌
+func (s *FositeStore) RevokeSubjectTokens(subject string) error {
+	return s.DeleteSubjectTokens(s.db, subject)
+}
+
+// DeleteSubjectTokens 删除用户的全部授权码及令牌，在调用方的事务中执行
+func (s *FositeStore) DeleteSubjectTokens(tx *gorm.DB, subject string) error {
+	for _, m := range []interface{}{&FositeCode{}, &FositePkce{}, &FositeOidc{}, &FositeRefresh{}, &FositeAccess{}} {
+		if err := tx.Delete(m, "subject = ?", subject).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteClientTokens 删除签发给应用的全部授权码及令牌，在调用方的事务中执行
+func (s *FositeStore) DeleteClientTokens(tx *gorm.DB, clientID string) error {
+	for _, m := range []interface{}{&FositeCode{}, &FositePkce{}, &FositeOidc{}, &FositeRefresh{}, &FositeAccess{}} {
+		if err := tx.Delete(m, "client_id = ?", clientID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReassignSubject 将用户的授权码和令牌转给另一个用户（合并账户），在调用方的事务中执行；
+// publicTo 为新用户对外的 sub，写入会话中的 ID Token claims
+func (s *FositeStore) ReassignSubject(tx *gorm.DB, from, to, publicTo string) error {
+	for _, m := range []interface{}{&FositeCode{}, &FositePkce{}, &FositeOidc{}, &FositeRefresh{}, &FositeAccess{}} {
+		table := tx.NewScope(m).TableName()
+		rows, err := tx.Table(table).Select("id, session").Where("subject = ?", from).Rows()
+		if err != nil {
+			return err
+		}
+		sessions := make(map[int64][]byte)
+		for rows.Next() {
+			var id int64
+			var raw []byte
+			if err := rows.Scan(&id, &raw); err != nil {
+				rows.Close()
+				return err
+			}
+			sessions[id] = raw
+		}
+		rows.Close()
+		for id, raw := range sessions {
+			// 会话中也记录了 sub，刷新令牌、签发 ID Token 时以会话为准
+			var session FositeSession
+			if err := json.Unmarshal(raw, &session); err != nil {
+				return errors.WithStack(err)
+			}
+			if session.DefaultSession != nil {
+				session.DefaultSession.Subject = to
+				if session.DefaultSession.Claims != nil {
+					session.DefaultSession.Claims.Subject = publicTo
+				}
+			}
+			b, err := json.Marshal(&session)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if err := tx.Table(table).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+				"subject": to,
+				"session": b,
+			}).Error; err != nil {
+				return err
+			}
+		}
 	}
-	s.DeleteRefreshTokenSession(ctx, d.Signature)
-	s.DeleteAccessTokenSession(ctx, d.Signature)
 	return nil
 }
 
-// RevokeAccessToken 删除授权码
+// MachineToken 不代表任何用户的访问令牌（client_credentials 等）
+type MachineToken struct {
+	ID          int64
+	ClientID    string
+	Scope       string
+	RequestedAt time.Time
+	ExpiresAt   time.Time
+}
+
+// MachineTokens 列出当前有效的机器令牌
+func (s *FositeStore) MachineTokens() ([]MachineToken, error) {
+	var rows []FositeAccess
+	if err := s.db.Where("subject = '' AND active").Order("requested_at desc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	var list []MachineToken
+	now := time.Now()
+	for _, r := range rows {
+		session := NewFositeSession("")
+		if err := json.Unmarshal(r.Session, session); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		expiresAt := session.GetExpiresAt(fosite.AccessToken)
+		if !expiresAt.IsZero() && expiresAt.Before(now) {
+			continue
+		}
+		scopes := append([]string{}, r.GrantedScope...)
+		sort.Strings(scopes)
+		list = append(list, MachineToken{
+			ID:          r.ID,
+			ClientID:    r.ClientID,
+			Scope:       strings.Join(scopes, " "),
+			RequestedAt: r.RequestedAt,
+			ExpiresAt:   expiresAt,
+		})
+	}
+	return list, nil
+}
+
+// CountTokens 统计 column（subject 或 client_id）等于 value 的有效访问令牌及刷新令牌数量，预演吊销时使用
+func (s *FositeStore) CountTokens(column, value string) (access, refresh int, err error) {
+	if err = s.db.Model(&FositeAccess{}).Where(column+" = ? AND active", value).Count(&access).Error; err != nil {
+		return
+	}
+	err = s.db.Model(&FositeRefresh{}).Where(column+" = ? AND active", value).Count(&refresh).Error
+	return
+}
+
+// DeleteAccessTokens 按 ID 删除访问令牌
+func (s *FositeStore) DeleteAccessTokens(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.db.Delete(&FositeAccess{}, "id IN (?)", ids).Error
+}
+
+// RevokeAccessToken 吊销同一授权签发的访问令牌，令牌不存在时不报错
 func (s *FositeStore) RevokeAccessToken(ctx context.Context, requestID string) error {
-	var d FositeAccess
-	if err := s.db.First(&d, "request_id=?", requestID).Error; err == gorm.ErrRecordNotFound {
-		return fosite.ErrNotFound
-	} else if err != nil {
+	if err := s.db.Delete(&FositeAccess{}, "request_id = ?", requestID).Error; err != nil {
 		return fosite.ErrServerError
 	}
-	s.DeleteAccessTokenSession(ctx, d.Signature)
 	return nil
 }
 
 // GetClient 查找客户端
-func (s *FositeStore) GetClient(_ context.Context, id string) (fosite.Client, error) {
+func (s *FositeStore) GetClient(ctx context.Context, id string) (fosite.Client, error) {
 	var c FositeClient
 	if err := s.db.First(&c, "client_id = ?", id).Error; err == gorm.ErrRecordNotFound {
 		return nil, fosite.ErrNotFound
 	} else if err != nil {
 		return nil, fosite.ErrServerError
 	}
+	acceptRedirectURI(ctx, &c)
 	return &c, nil
 }
@@ -0,0 +1,274 @@
+//go:build integration
+// +build integration
+
+// 存储测试需要真实的 Postgres：ucenter 包初始化时按 data/config.yaml 连接数据库，
+// 在本目录下放置指向测试库的 data/config.yaml 后运行 go test -tags integration .
+
+package storage
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/naiba/com"
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+
+	"github.com/naiba/ucenter"
+)
+
+var testClient *FositeClient
+
+func TestMain(m *testing.M) {
+	if err := NewFositeStore(ucenter.DB, false).Migrate(); err != nil {
+		panic(err)
+	}
+	testClient = &FositeClient{
+		ClientID: "storage-test-" + com.RandomString(8),
+		Name:     "storage test",
+	}
+	if err := ucenter.DB.Create(testClient).Error; err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	for _, model := range []interface{}{&FositeOidc{}, &FositeAccess{}, &FositeCode{}, &FositePkce{}, &FositeRefresh{}} {
+		ucenter.DB.Delete(model, "client_id = ?", testClient.ClientID)
+	}
+	ucenter.DB.Delete(&FositeClient{}, "client_id = ?", testClient.ClientID)
+	os.Exit(code)
+}
+
+func newTestRequest() *fosite.Request {
+	r := fosite.NewRequest()
+	r.Client = testClient
+	r.RequestedScope = fosite.Arguments{"openid", "profile"}
+	r.GrantedScope = fosite.Arguments{"openid"}
+	r.Form = url.Values{"state": {"storage-test"}}
+	r.Session = NewFositeSession("storage-test-subject")
+	return r
+}
+
+func newSignature() string {
+	return com.RandomString(32)
+}
+
+// sessionTable 一张会话表对应的 fosite 存储接口
+type sessionTable struct {
+	name   string
+	table  string
+	model  interface{}
+	create func(s *FositeStore, ctx context.Context, signature string, req fosite.Requester) error
+	get    func(s *FositeStore, ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error)
+	delete func(s *FositeStore, ctx context.Context, signature string) error
+}
+
+var sessionTables = []sessionTable{
+	{
+		name:   "openid",
+		table:  sqlTableOpenID,
+		model:  &FositeOidc{},
+		create: (*FositeStore).CreateOpenIDConnectSession,
+		get: func(s *FositeStore, ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+			return s.GetOpenIDConnectSession(ctx, signature, &fosite.Request{Session: session})
+		},
+		delete: (*FositeStore).DeleteOpenIDConnectSession,
+	},
+	{
+		name:   "access",
+		table:  sqlTableAccess,
+		model:  &FositeAccess{},
+		create: (*FositeStore).CreateAccessTokenSession,
+		get:    (*FositeStore).GetAccessTokenSession,
+		delete: (*FositeStore).DeleteAccessTokenSession,
+	},
+	{
+		name:   "refresh",
+		table:  sqlTableRefresh,
+		model:  &FositeRefresh{},
+		create: (*FositeStore).CreateRefreshTokenSession,
+		get:    (*FositeStore).GetRefreshTokenSession,
+		delete: (*FositeStore).DeleteRefreshTokenSession,
+	},
+	{
+		name:   "code",
+		table:  sqlTableCode,
+		model:  &FositeCode{},
+		create: (*FositeStore).CreateAuthorizeCodeSession,
+		get:    (*FositeStore).GetAuthorizeCodeSession,
+		delete: (*FositeStore).DeleteAuthorizeCodeSession,
+	},
+	{
+		name:   "pkce",
+		table:  sqlTablePKCE,
+		model:  &FositePkce{},
+		create: (*FositeStore).CreatePKCERequestSession,
+		get:    (*FositeStore).GetPKCERequestSession,
+		delete: (*FositeStore).DeletePKCERequestSession,
+	},
+}
+
+func TestSessionCreateGetDelete(t *testing.T) {
+	ctx := context.Background()
+	for _, hash := range []bool{false, true} {
+		s := NewFositeStore(ucenter.DB, hash)
+		for _, st := range sessionTables {
+			signature := newSignature()
+			req := newTestRequest()
+			if err := st.create(s, ctx, signature, req); err != nil {
+				t.Fatalf("%s (hash=%v): create: %+v", st.name, hash, err)
+			}
+			got, err := st.get(s, ctx, signature, NewFositeSession(""))
+			if err != nil {
+				t.Fatalf("%s (hash=%v): get: %+v", st.name, hash, err)
+			}
+			if got.GetID() != req.GetID() {
+				t.Errorf("%s (hash=%v): request id = %s, want %s", st.name, hash, got.GetID(), req.GetID())
+			}
+			if got.GetClient().GetID() != testClient.ClientID {
+				t.Errorf("%s (hash=%v): client = %s, want %s", st.name, hash, got.GetClient().GetID(), testClient.ClientID)
+			}
+			if got.GetSession().GetSubject() != "storage-test-subject" {
+				t.Errorf("%s (hash=%v): subject = %s", st.name, hash, got.GetSession().GetSubject())
+			}
+			if !got.GetGrantedScopes().Exact("openid") || got.GetRequestForm().Get("state") != "storage-test" {
+				t.Errorf("%s (hash=%v): scopes or form not restored: %v %v", st.name, hash, got.GetGrantedScopes(), got.GetRequestForm())
+			}
+			if err := st.delete(s, ctx, signature); err != nil {
+				t.Fatalf("%s (hash=%v): delete: %+v", st.name, hash, err)
+			}
+			if _, err := st.get(s, ctx, signature, NewFositeSession("")); errors.Cause(err) != fosite.ErrNotFound {
+				t.Errorf("%s (hash=%v): get after delete = %v, want not found", st.name, hash, err)
+			}
+		}
+	}
+}
+
+func TestSessionInactive(t *testing.T) {
+	ctx := context.Background()
+	s := NewFositeStore(ucenter.DB, false)
+	for _, st := range sessionTables {
+		signature := newSignature()
+		if err := st.create(s, ctx, signature, newTestRequest()); err != nil {
+			t.Fatalf("%s: create: %+v", st.name, err)
+		}
+		if err := s.db.Model(st.model).Where("signature = ?", signature).Update("active", false).Error; err != nil {
+			t.Fatalf("%s: deactivate: %+v", st.name, err)
+		}
+		want := fosite.ErrInactiveToken
+		if st.table == sqlTableCode {
+			want = fosite.ErrInvalidatedAuthorizeCode
+		}
+		if _, err := st.get(s, ctx, signature, NewFositeSession("")); errors.Cause(err) != want {
+			t.Errorf("%s: get inactive = %v, want %v", st.name, err, want)
+		}
+	}
+}
+
+func TestInvalidateAuthorizeCodeSession(t *testing.T) {
+	ctx := context.Background()
+	s := NewFositeStore(ucenter.DB, false)
+	signature := newSignature()
+	req := newTestRequest()
+	if err := s.CreateAuthorizeCodeSession(ctx, signature, req); err != nil {
+		t.Fatalf("create: %+v", err)
+	}
+	if err := s.InvalidateAuthorizeCodeSession(ctx, signature); err != nil {
+		t.Fatalf("invalidate: %+v", err)
+	}
+	// 已失效的授权码仍返回原请求，供 fosite 吊销由它签发的令牌
+	got, err := s.GetAuthorizeCodeSession(ctx, signature, NewFositeSession(""))
+	if errors.Cause(err) != fosite.ErrInvalidatedAuthorizeCode {
+		t.Fatalf("get invalidated = %v, want %v", err, fosite.ErrInvalidatedAuthorizeCode)
+	}
+	if got == nil || got.GetID() != req.GetID() {
+		t.Errorf("invalidated code did not return the original request")
+	}
+}
+
+func TestRevokeTokens(t *testing.T) {
+	ctx := context.Background()
+	s := NewFositeStore(ucenter.DB, true)
+	req := newTestRequest()
+	access, refresh := newSignature(), newSignature()
+	if err := s.CreateAccessTokenSession(ctx, access, req); err != nil {
+		t.Fatalf("create access: %+v", err)
+	}
+	if err := s.CreateRefreshTokenSession(ctx, refresh, req); err != nil {
+		t.Fatalf("create refresh: %+v", err)
+	}
+	if err := s.RevokeRefreshToken(ctx, req.GetID()); err != nil {
+		t.Fatalf("revoke refresh: %+v", err)
+	}
+	if _, err := s.GetRefreshTokenSession(ctx, refresh, NewFositeSession("")); errors.Cause(err) != fosite.ErrNotFound {
+		t.Errorf("refresh after revoke = %v, want not found", err)
+	}
+	if _, err := s.GetAccessTokenSession(ctx, access, NewFositeSession("")); errors.Cause(err) != fosite.ErrNotFound {
+		t.Errorf("access after refresh revoke = %v, want not found", err)
+	}
+
+	access = newSignature()
+	if err := s.CreateAccessTokenSession(ctx, access, req); err != nil {
+		t.Fatalf("create access: %+v", err)
+	}
+	if err := s.RevokeAccessToken(ctx, req.GetID()); err != nil {
+		t.Fatalf("revoke access: %+v", err)
+	}
+	if _, err := s.GetAccessTokenSession(ctx, access, NewFositeSession("")); errors.Cause(err) != fosite.ErrNotFound {
+		t.Errorf("access after revoke = %v, want not found", err)
+	}
+	// 令牌不存在时不报错
+	if err := s.RevokeAccessToken(ctx, req.GetID()); err != nil {
+		t.Errorf("revoke missing access token: %+v", err)
+	}
+}
+
+func TestHashedAccessSignature(t *testing.T) {
+	ctx := context.Background()
+	s := NewFositeStore(ucenter.DB, true)
+	signature := newSignature()
+	hashed := s.hashSignature(signature, sqlTableAccess)
+	if hashed == signature {
+		t.Fatal("access signature is not hashed")
+	}
+	if err := s.CreateAccessTokenSession(ctx, signature, newTestRequest()); err != nil {
+		t.Fatalf("create: %+v", err)
+	}
+	count := func(sig string) int {
+		var n int
+		s.db.Model(&FositeAccess{}).Where("signature = ?", sig).Count(&n)
+		return n
+	}
+	if count(signature) != 0 || count(hashed) != 1 {
+		t.Fatalf("stored signature: raw %d, hashed %d", count(signature), count(hashed))
+	}
+	if _, err := s.GetAccessTokenSession(ctx, signature, NewFositeSession("")); err != nil {
+		t.Fatalf("get: %+v", err)
+	}
+	if err := s.DeleteAccessTokenSession(ctx, signature); err != nil {
+		t.Fatalf("delete: %+v", err)
+	}
+	if n := count(hashed); n != 0 {
+		t.Errorf("hashed access token still stored after delete: %d", n)
+	}
+	// 只有访问令牌按哈希保存
+	if s.hashSignature(signature, sqlTableRefresh) != signature {
+		t.Error("refresh signature should not be hashed")
+	}
+}
+
+func TestUnknownSessionTable(t *testing.T) {
+	s := NewFositeStore(ucenter.DB, false)
+	const table = "sqlTableUnknown"
+	check := func(op string, err error) {
+		if err == nil || !strings.Contains(err.Error(), "unknown session table "+table) {
+			t.Errorf("%s: err = %v, want unknown session table", op, err)
+		}
+	}
+	check("create", s.createSession(table, newSignature(), newTestRequest()))
+	_, err := s.findSessionBySignature(table, newSignature(), NewFositeSession(""))
+	check("find", err)
+	check("delete", s.deleteSession(newSignature(), table))
+}
@@ -1,7 +1,11 @@
 package storage
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+
 	"github.com/ory/fosite"
+	"github.com/pkg/errors"
 )
 
 // IsArgEqual 判断fosite参数是否相同
@@ -24,3 +28,12 @@ func IsArgEqual(a, b fosite.Arguments) bool {
 
 	return true
 }
+
+// randomToken 生成不可预测的挑战 ID、verifier 等一次性凭据
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(fosite.ErrServerError)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,81 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+// ErrNotLoaded 未加载 GeoIP 数据库
+var ErrNotLoaded = errors.New("GeoIP 数据库未加载")
+
+var db *geoip2.Reader
+
+// Open 打开 MaxMind/GeoLite 数据库
+func Open(path string) (err error) {
+	db, err = geoip2.Open(path)
+	return
+}
+
+// Loaded 是否已加载数据库
+func Loaded() bool {
+	return db != nil
+}
+
+// Country 查询 IP 所属国家，返回 ISO 代码与中文名称
+func Country(ip string) (code, name string, err error) {
+	if db == nil {
+		return "", "", ErrNotLoaded
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", "", errors.New("IP 格式错误")
+	}
+	record, err := db.Country(addr)
+	if err != nil {
+		return "", "", err
+	}
+	return record.Country.IsoCode, localName(record.Country.Names), nil
+}
+
+// Location 查询 IP 的大致位置：城市库精确到城市，国家库只到国家
+func Location(ip string) (string, error) {
+	if db == nil {
+		return "", ErrNotLoaded
+	}
+	if !strings.Contains(db.Metadata().DatabaseType, "City") {
+		_, name, err := Country(ip)
+		return name, err
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", errors.New("IP 格式错误")
+	}
+	record, err := db.City(addr)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, names := range []map[string]string{record.Country.Names, subdivisionNames(record), record.City.Names} {
+		if name := localName(names); name != "" && (len(parts) == 0 || parts[len(parts)-1] != name) {
+			parts = append(parts, name)
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+func subdivisionNames(record *geoip2.City) map[string]string {
+	if len(record.Subdivisions) == 0 {
+		return nil
+	}
+	return record.Subdivisions[0].Names
+}
+
+func localName(names map[string]string) string {
+	if name := names["zh-CN"]; name != "" {
+		return name
+	}
+	return names["en"]
+}
@@ -0,0 +1,90 @@
+// Package grant 自定义 grant type 扩展点
+//
+// 编译期注册：在 fork 的包里于 init 中调用 grant.Register，并在 cmd/web 中匿名导入该包。
+// 运行期注册：将实现编译为 Go plugin（go build -buildmode=plugin），导出 `func RegisterGrants()`，
+// 并在配置文件 grant_plugins 中填写 .so 路径。
+package grant
+
+import (
+	"fmt"
+	"plugin"
+	"sync"
+
+	"github.com/ory/fosite/compose"
+)
+
+// Grant 自定义授权类型
+type Grant struct {
+	// Type grant_type 的取值，例如 urn:example:params:oauth:grant-type:sms-otp
+	Type string
+	// Factory 创建 fosite TokenEndpointHandler，参数中的 storage 为 *storage.FositeStore
+	Factory compose.Factory
+	// Models 需要自动迁移的数据表
+	Models []interface{}
+}
+
+var (
+	mu     sync.Mutex
+	grants []Grant
+)
+
+// Register 注册自定义授权类型
+func Register(g Grant) {
+	mu.Lock()
+	defer mu.Unlock()
+	grants = append(grants, g)
+}
+
+// Grants 已注册的自定义授权类型
+func Grants() []Grant {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Grant(nil), grants...)
+}
+
+// Factories 已注册授权类型的 handler 工厂
+func Factories() []compose.Factory {
+	var fs []compose.Factory
+	for _, g := range Grants() {
+		fs = append(fs, g.Factory)
+	}
+	return fs
+}
+
+// Types 已注册的 grant_type
+func Types() []string {
+	var ts []string
+	for _, g := range Grants() {
+		ts = append(ts, g.Type)
+	}
+	return ts
+}
+
+// Models 已注册授权类型需要的数据表
+func Models() []interface{} {
+	var ms []interface{}
+	for _, g := range Grants() {
+		ms = append(ms, g.Models...)
+	}
+	return ms
+}
+
+// LoadPlugins 加载 Go plugin，插件需导出 RegisterGrants 函数并在其中调用 Register
+func LoadPlugins(paths []string) error {
+	for _, path := range paths {
+		p, err := plugin.Open(path)
+		if err != nil {
+			return fmt.Errorf("加载 grant 插件 %s 失败：%s", path, err)
+		}
+		sym, err := p.Lookup("RegisterGrants")
+		if err != nil {
+			return fmt.Errorf("grant 插件 %s 未导出 RegisterGrants：%s", path, err)
+		}
+		register, ok := sym.(func())
+		if !ok {
+			return fmt.Errorf("grant 插件 %s 的 RegisterGrants 签名应为 func()", path)
+		}
+		register()
+	}
+	return nil
+}
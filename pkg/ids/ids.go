@@ -0,0 +1,92 @@
+// Package ids 生成对外使用的用户及应用 ID，避免自增 ID 泄露注册顺序
+package ids
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	// FormatSerial 沿用数据库自增 ID
+	FormatSerial = "serial"
+	// FormatUUID 随机 UUID（版本 4）
+	FormatUUID = "uuid"
+	// FormatULID 按时间排序的 ULID，26 位 Crockford Base32
+	FormatULID = "ulid"
+)
+
+// crockford ULID 使用的 Base32 字母表，不含 I、L、O、U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Valid 是否为支持的格式
+func Valid(format string) bool {
+	return format == FormatSerial || format == FormatUUID || format == FormatULID
+}
+
+// New 按格式生成 ID，serial 返回空字符串，由调用方使用自增 ID
+func New(format string) (string, error) {
+	switch format {
+	case FormatUUID:
+		return uuid.New(), nil
+	case FormatULID:
+		return newULID(time.Now())
+	case FormatSerial:
+		return "", nil
+	}
+	return "", fmt.Errorf("不支持的 ID 格式 %s", format)
+}
+
+// newULID 48 位毫秒时间戳加 80 位随机数
+func newULID(t time.Time) (string, error) {
+	var b [16]byte
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	copy(b[:6], ms[2:])
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	// 128 位按 5 位一组编码，首字符只含最高 3 位
+	out := make([]byte, 26)
+	var acc uint32
+	var bits uint
+	i := len(out) - 1
+	for j := len(b) - 1; j >= 0; j-- {
+		acc |= uint32(b[j]) << bits
+		bits += 8
+		for bits >= 5 {
+			out[i] = crockford[acc&31]
+			acc >>= 5
+			bits -= 5
+			i--
+		}
+	}
+	out[0] = crockford[acc&31]
+	return string(out), nil
+}
+
+// Pairwise pairwise 主体标识，为扇区标识、用户对外 ID 与盐的 SHA-256（OpenID Connect Core 第 8.1 节），
+// 同一扇区的应用得到相同的值，不同扇区之间无法关联
+func Pairwise(sector, subject, salt string) string {
+	sum := sha256.Sum256([]byte(sector + subject + salt))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Sector 扇区标识：登记了 sector_identifier_uri 时为其域名，否则为第一个跳转链接的域名
+func Sector(sectorURI string, redirectURIs []string) string {
+	raw := sectorURI
+	if raw == "" && len(redirectURIs) > 0 {
+		raw = redirectURIs[0]
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
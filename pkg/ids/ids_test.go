@@ -0,0 +1,53 @@
+package ids
+
+import "testing"
+
+func TestPairwise(t *testing.T) {
+	a := Pairwise("a.example.com", "42", "salt")
+	if a != Pairwise("a.example.com", "42", "salt") {
+		t.Fatal("同一扇区、同一用户应得到相同的 sub")
+	}
+	if a == Pairwise("b.example.com", "42", "salt") {
+		t.Fatal("不同扇区不应得到相同的 sub")
+	}
+	if a == Pairwise("a.example.com", "43", "salt") {
+		t.Fatal("不同用户不应得到相同的 sub")
+	}
+	if a == Pairwise("a.example.com", "42", "other") {
+		t.Fatal("更换盐后 sub 应改变")
+	}
+	if len(a) != 43 || a == "42" {
+		t.Fatalf("sub 应为 SHA-256 的 base64url 编码：%q", a)
+	}
+}
+
+func TestSector(t *testing.T) {
+	for _, c := range []struct {
+		sectorURI    string
+		redirectURIs []string
+		want         string
+	}{
+		{"https://sector.example.com/redirects.json", []string{"https://app.example.com/cb"}, "sector.example.com"},
+		{"", []string{"https://app.example.com:8443/cb", "https://other.example.com/cb"}, "app.example.com"},
+		{"", []string{"http://127.0.0.1:9000/cb"}, "127.0.0.1"},
+		{"", nil, ""},
+		{"://bad", nil, ""},
+	} {
+		if got := Sector(c.sectorURI, c.redirectURIs); got != c.want {
+			t.Errorf("Sector(%q, %q) = %q，应为 %q", c.sectorURI, c.redirectURIs, got, c.want)
+		}
+	}
+}
+
+func TestNewULID(t *testing.T) {
+	id, err := New(FormatULID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 26 {
+		t.Fatalf("ULID 应为 26 位：%q", id)
+	}
+	if id[0] > '7' {
+		t.Fatalf("ULID 首字符只含最高 3 位：%q", id)
+	}
+}
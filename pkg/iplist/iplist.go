@@ -0,0 +1,82 @@
+// Package iplist 由单个 IP 及 CIDR 网段组成的地址列表
+package iplist
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// reserved 非公网地址：本机、私有网络、CGNAT、链路本地、组播、文档示例及其他保留地址
+var reserved = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+	"224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "100::/64", "2001:db8::/32", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+// Public 是否为公网地址，服务端代为访问外部链接前用它拒绝本机及内网地址
+func Public(ip string) bool {
+	return net.ParseIP(ip) != nil && !Contains(ip, reserved)
+}
+
+// Contains IP 是否在列表中，列表项可以是单个 IP 或 CIDR，无法解析的 IP 不在任何列表中
+func Contains(ip string, list []string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, item := range list {
+		if strings.Contains(item, "/") {
+			if _, network, err := net.ParseCIDR(item); err == nil && network.Contains(addr) {
+				return true
+			}
+		} else if other := net.ParseIP(item); other != nil && other.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP 请求的来源 IP。直接连接的对端 peer 不在 trusted 中时就是来源，不采信 X-Forwarded-For；
+// 否则从右向左跳过 trusted 中的代理，取第一个不受信任的地址。请求头中的地址全部受信任时取最左侧的，
+// 遇到无法解析的项时停在它右侧最近的一跳
+func ClientIP(peer, forwardedFor string, trusted []string) string {
+	if !Contains(peer, trusted) || forwardedFor == "" {
+		return peer
+	}
+	hops := strings.Split(forwardedFor, ",")
+	ip := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !Contains(hop, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// Parse 解析以空白或逗号分隔的 IP、CIDR 列表，网段统一为网络地址的形式
+func Parse(raw string) ([]string, error) {
+	items := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if strings.Contains(item, "/") {
+			_, network, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, errors.New("无效的网段：" + item)
+			}
+			item = network.String()
+		} else if net.ParseIP(item) == nil {
+			return nil, errors.New("无效的 IP：" + item)
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
@@ -0,0 +1,97 @@
+package iplist
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContains(t *testing.T) {
+	list := []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "::1", "not-an-ip"}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":         true,
+		"11.0.0.1":         false,
+		"192.168.1.10":     true,
+		"192.168.1.11":     false,
+		"2001:db8::1":      true,
+		"2001:db9::1":      false,
+		"::1":              true,
+		"::ffff:10.0.0.1":  true,
+		"":                 false,
+		"not-an-ip":        false,
+		"192.168.1.10:443": false,
+	} {
+		if got := Contains(ip, list); got != want {
+			t.Errorf("Contains(%q) = %v，应为 %v", ip, got, want)
+		}
+	}
+	if Contains("10.0.0.1", nil) {
+		t.Error("空列表不应包含任何 IP")
+	}
+}
+
+func TestParse(t *testing.T) {
+	list, err := Parse(" 10.1.2.3/8,192.168.1.10\n2001:db8::1/32\t::1 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "::1"}
+	if !reflect.DeepEqual(list, want) {
+		t.Fatalf("Parse = %q，应为 %q", list, want)
+	}
+	if list, err = Parse(""); err != nil || len(list) != 0 {
+		t.Fatalf("空字符串应得到空列表：%q %v", list, err)
+	}
+	for _, raw := range []string{"10.0.0.0/33", "example.com", "10.0.0.1, 300.0.0.1"} {
+		if _, err := Parse(raw); err == nil {
+			t.Errorf("Parse(%q) 应返回错误", raw)
+		}
+	}
+}
+
+func TestPublic(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"8.8.8.8":           true,
+		"2606:4700::1111":   true,
+		"127.0.0.1":         false,
+		"10.0.0.1":          false,
+		"172.16.5.4":        false,
+		"192.168.1.1":       false,
+		"169.254.169.254":   false,
+		"100.64.0.1":        false,
+		"0.0.0.0":           false,
+		"::1":               false,
+		"::":                false,
+		"fd00::1":           false,
+		"fe80::1":           false,
+		"::ffff:127.0.0.1":  false,
+		"::ffff:8.8.8.8":    true,
+		"64:ff9b::a00:1":    false,
+		"":                  false,
+		"metadata.internal": false,
+	} {
+		if got := Public(ip); got != want {
+			t.Errorf("Public(%q) = %v，应为 %v", ip, got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "::1"}
+	for _, c := range []struct {
+		peer, xff, want string
+	}{
+		// 不受信任的对端伪造的请求头不采信
+		{"203.0.113.7", "198.51.100.1", "203.0.113.7"},
+		{"10.0.0.2", "", "10.0.0.2"},
+		{"10.0.0.2", "198.51.100.1", "198.51.100.1"},
+		// 客户端自己添加的左侧地址不采信
+		{"10.0.0.2", "1.1.1.1, 198.51.100.1, 10.0.0.3", "198.51.100.1"},
+		{"::1", "10.0.0.5, 10.0.0.3", "10.0.0.5"},
+		{"10.0.0.2", "garbage, 10.0.0.3", "10.0.0.3"},
+		{"10.0.0.2", "198.51.100.1:443", "10.0.0.2"},
+	} {
+		if got := ClientIP(c.peer, c.xff, trusted); got != c.want {
+			t.Errorf("ClientIP(%q, %q) = %q，应为 %q", c.peer, c.xff, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package jwe
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// DefaultEnc 客户端只设置了 alg 时使用的内容加密算法
+const DefaultEnc = string(jose.A128CBC_HS256)
+
+// SupportedAlgs 支持的密钥管理算法
+var SupportedAlgs = []string{
+	string(jose.RSA_OAEP),
+	string(jose.RSA_OAEP_256),
+	string(jose.ECDH_ES),
+	string(jose.ECDH_ES_A128KW),
+	string(jose.ECDH_ES_A256KW),
+}
+
+// SupportedEncs 支持的内容加密算法
+var SupportedEncs = []string{
+	string(jose.A128CBC_HS256),
+	string(jose.A256CBC_HS512),
+	string(jose.A128GCM),
+	string(jose.A256GCM),
+}
+
+// Validate 校验客户端的加密设置，alg 为空表示不加密
+func Validate(alg, enc string, keys *jose.JSONWebKeySet) error {
+	if alg == "" {
+		if enc != "" {
+			return errors.New("设置了内容加密算法但未设置密钥管理算法")
+		}
+		return nil
+	}
+	if !supported(SupportedAlgs, alg) {
+		return fmt.Errorf("不支持的密钥管理算法 %s", alg)
+	}
+	if enc != "" && !supported(SupportedEncs, enc) {
+		return fmt.Errorf("不支持的内容加密算法 %s", enc)
+	}
+	if _, err := encryptionKey(keys, alg); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encrypt 使用客户端的公钥加密 payload，nested 表示 payload 是已签名的 JWT
+func Encrypt(payload []byte, keys *jose.JSONWebKeySet, alg, enc string, nested bool) (string, error) {
+	if enc == "" {
+		enc = DefaultEnc
+	}
+	key, err := encryptionKey(keys, alg)
+	if err != nil {
+		return "", err
+	}
+	opts := new(jose.EncrypterOptions)
+	if nested {
+		opts = opts.WithContentType("JWT")
+	}
+	encrypter, err := jose.NewEncrypter(jose.ContentEncryption(enc), jose.Recipient{
+		Algorithm: jose.KeyAlgorithm(alg),
+		Key:       key.Key,
+		KeyID:     key.KeyID,
+	}, opts)
+	if err != nil {
+		return "", err
+	}
+	obj, err := encrypter.Encrypt(payload)
+	if err != nil {
+		return "", err
+	}
+	return obj.CompactSerialize()
+}
+
+// encryptionKey 在客户端 JWKS 中挑选可用于该算法的加密公钥
+func encryptionKey(keys *jose.JSONWebKeySet, alg string) (*jose.JSONWebKey, error) {
+	if keys == nil {
+		return nil, errors.New("客户端未登记加密公钥")
+	}
+	for i := range keys.Keys {
+		key := &keys.Keys[i]
+		if key.Use != "" && key.Use != "enc" {
+			continue
+		}
+		if key.Algorithm != "" && key.Algorithm != alg {
+			continue
+		}
+		switch key.Key.(type) {
+		case *rsa.PublicKey:
+			if alg == string(jose.RSA_OAEP) || alg == string(jose.RSA_OAEP_256) {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if alg == string(jose.ECDH_ES) || alg == string(jose.ECDH_ES_A128KW) || alg == string(jose.ECDH_ES_A256KW) {
+				return key, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("客户端未登记可用于 %s 的加密公钥", alg)
+}
+
+func supported(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
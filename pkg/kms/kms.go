@@ -0,0 +1,84 @@
+// Package kms 密钥管理服务接口
+//
+// 内置 local 实现，从配置的主密钥派生数据密钥。接入云 KMS 时在 init 中调用 kms.Register
+// 注册新的实现，并在配置文件 kms_provider 中填写其名称。
+package kms
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeySize 数据密钥长度
+const KeySize = 32
+
+// Provider 密钥管理服务，按用途提供数据密钥
+type Provider interface {
+	// DataKey 返回指定用途的数据密钥，同一用途每次返回相同的密钥
+	DataKey(purpose string) ([]byte, error)
+}
+
+// Factory 使用配置中的主密钥（或凭据）创建 Provider
+type Factory func(masterKey string) (Provider, error)
+
+var (
+	mu        sync.Mutex
+	factories = map[string]Factory{
+		"local": func(masterKey string) (Provider, error) {
+			return NewLocal(masterKey)
+		},
+	}
+)
+
+// Register 注册密钥管理服务实现
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[name] = f
+}
+
+// New 按名称创建密钥管理服务，名称为空时使用 local
+func New(name, masterKey string) (Provider, error) {
+	if name == "" {
+		name = "local"
+	}
+	mu.Lock()
+	f, ok := factories[name]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("kms: unknown provider %q", name)
+	}
+	return f(masterKey)
+}
+
+// Local 使用本地主密钥通过 HKDF 派生数据密钥
+type Local struct {
+	master []byte
+}
+
+// NewLocal 主密钥为 base64 编码，至少 32 字节
+func NewLocal(masterKey string) (*Local, error) {
+	master, err := base64.StdEncoding.DecodeString(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("kms: master key is not valid base64: %s", err)
+	}
+	if len(master) < KeySize {
+		return nil, errors.New("kms: master key must be at least 32 bytes")
+	}
+	return &Local{master: master}, nil
+}
+
+// DataKey 派生指定用途的数据密钥
+func (l *Local) DataKey(purpose string) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, l.master, nil, []byte(purpose)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,38 @@
+// Package lockout 登录失败锁定的计数键
+package lockout
+
+// 计数键对应 login_attempts 表中的列
+const (
+	FieldUsername = "username"
+	FieldIP       = "ip"
+)
+
+// Key 一个计数键，同一键下的失败次数达到上限即锁定
+type Key struct {
+	Field string
+	Value string
+}
+
+// Keys 检查锁定时的全部计数键：每个不同的登录名（用户名、邮箱或附加登录名）及来源 IP 的计数键，忽略空值
+func Keys(ipKey string, names ...string) []Key {
+	keys := NameKeys(names...)
+	if ipKey != "" {
+		keys = append(keys, Key{Field: FieldIP, Value: ipKey})
+	}
+	return keys
+}
+
+// NameKeys 登录成功后可以清除的计数键，只有登录名。来源 IP 的计数不随登录成功清除，只随时间窗口过期，
+// 否则在同一 IP 上交替猜测他人密码与登录自己的账户即可绕过按 IP 的锁定
+func NameKeys(names ...string) []Key {
+	keys := make([]Key, 0, len(names)+1)
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		keys = append(keys, Key{Field: FieldUsername, Value: name})
+	}
+	return keys
+}
@@ -0,0 +1,55 @@
+package lockout
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+	for _, c := range []struct {
+		ip    string
+		names []string
+		want  []Key
+	}{
+		{"203.0.113.7", []string{"alice"}, []Key{
+			{FieldUsername, "alice"},
+			{FieldIP, "203.0.113.7"},
+		}},
+		{"2001:db8::/64", []string{"alice@example.com", "alice", "alice@example.com"}, []Key{
+			{FieldUsername, "alice@example.com"},
+			{FieldUsername, "alice"},
+			{FieldIP, "2001:db8::/64"},
+		}},
+		{"", []string{"", "alice"}, []Key{
+			{FieldUsername, "alice"},
+		}},
+		{"203.0.113.7", nil, []Key{
+			{FieldIP, "203.0.113.7"},
+		}},
+	} {
+		if got := Keys(c.ip, c.names...); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Keys(%q, %q) = %v，应为 %v", c.ip, c.names, got, c.want)
+		}
+	}
+}
+
+// 在同一 IP 上猜测他人密码后登录自己的账户，不能清除该 IP 的失败计数
+func TestNameKeysKeepIP(t *testing.T) {
+	const ip = "203.0.113.7"
+	failures := map[Key]int{
+		{FieldUsername, "victim"}: 4,
+		{FieldIP, ip}:             4,
+	}
+	for _, k := range NameKeys("attacker", "attacker@example.com") {
+		if k.Field != FieldUsername {
+			t.Fatalf("登录成功后不应清除 %v", k)
+		}
+		delete(failures, k)
+	}
+	if failures[Key{FieldIP, ip}] != 4 || failures[Key{FieldUsername, "victim"}] != 4 {
+		t.Errorf("登录自己的账户后其他计数不应变化：%v", failures)
+	}
+	if got := NameKeys("", "alice", "alice"); !reflect.DeepEqual(got, []Key{{FieldUsername, "alice"}}) {
+		t.Errorf("NameKeys 应去重并忽略空值：%v", got)
+	}
+}
@@ -0,0 +1,98 @@
+package mail
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/naiba/ucenter"
+)
+
+// ErrNotConfigured 未配置 SMTP
+var ErrNotConfigured = errors.New("未配置邮件服务")
+
+// Enabled 是否已配置邮件服务
+func Enabled() bool {
+	return ucenter.C.SMTPHost != "" && ucenter.C.MailFrom != ""
+}
+
+// Deliveries 邮件投递结果计数，由 engine 注册到 Prometheus
+var Deliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ucenter_mail_deliveries_total",
+	Help: "邮件投递次数，result 为 success 或 failure",
+}, []string{"result"})
+
+// Send 发送纯文本邮件
+func Send(to, subject, body string) error {
+	if !Enabled() {
+		return ErrNotConfigured
+	}
+	err := send(to, subject, body)
+	if err != nil {
+		Deliveries.WithLabelValues("failure").Inc()
+	} else {
+		Deliveries.WithLabelValues("success").Inc()
+	}
+	return err
+}
+
+func send(to, subject, body string) error {
+	msg := "From: " + ucenter.C.MailFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.BEncoding.Encode("UTF-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+	addr := net.JoinHostPort(ucenter.C.SMTPHost, fmt.Sprintf("%d", ucenter.C.SMTPPort))
+	var auth smtp.Auth
+	if ucenter.C.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", ucenter.C.SMTPUsername, ucenter.C.SMTPPassword, ucenter.C.SMTPHost)
+	}
+	// 非 465 端口走 STARTTLS
+	if ucenter.C.SMTPPort != 465 {
+		return smtp.SendMail(addr, auth, ucenter.C.MailFrom, []string{to}, []byte(msg))
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: ucenter.C.SMTPHost})
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, ucenter.C.SMTPHost)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(ucenter.C.MailFrom); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// SiteURL 站点链接
+func SiteURL(path string) string {
+	return ucenter.C.WebProtocol + "://" + ucenter.C.Domain + "/" + strings.TrimPrefix(path, "/")
+}
@@ -1,6 +1,8 @@
 package nbgin
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 	"github.com/naiba/ucenter"
 )
@@ -8,19 +10,28 @@ import (
 // Data 写入数据
 func Data(c *gin.Context, data map[string]interface{}) gin.H {
 	u, _ := c.Get(ucenter.AuthUser)
+	csrf, _ := c.Get(ucenter.CSRFToken)
 	path := c.MustGet(ucenter.RequestRouter).(string)
 	return gin.H{
 		"title":   ucenter.RouteTitle[path],
 		"user":    u,
 		"path":    path,
 		"sysname": ucenter.C.SysName,
+		"csrf":    csrf,
 		"data":    data,
 	}
 }
 
-// SetCookie 设置Cookie
+// SetCookie 设置Cookie，SameSite=Lax 阻止跨站的非导航请求携带
 func SetCookie(c *gin.Context, second int, k, v string) {
-	c.SetCookie(k, v, second, "/", ucenter.C.Domain, false, false)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     k,
+		Value:    v,
+		MaxAge:   second,
+		Path:     "/",
+		Domain:   ucenter.C.Domain,
+		SameSite: http.SameSiteLaxMode,
+	})
 }
 
 // SetNoCache 此页面不准缓存
@@ -0,0 +1,196 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/naiba/ucenter"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// AlgoBcrypt bcrypt
+	AlgoBcrypt = "bcrypt"
+	// AlgoArgon2id Argon2id
+	AlgoArgon2id = "argon2id"
+
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// Params 哈希算法及参数
+type Params struct {
+	Algorithm string
+	// Cost bcrypt 成本
+	Cost int
+	// Time、Memory（KiB）、Threads Argon2id 的迭代次数、内存及并行度
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// Prefix 以该参数生成的哈希的公共前缀
+func (p Params) Prefix() string {
+	if p.Algorithm == AlgoArgon2id {
+		return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$", AlgoArgon2id, argon2.Version, p.Memory, p.Time, p.Threads)
+	}
+	return fmt.Sprintf("$2a$%02d$", p.Cost)
+}
+
+func (p Params) String() string {
+	if p.Algorithm == AlgoArgon2id {
+		return fmt.Sprintf("Argon2id 迭代 %d 次，内存 %d KiB，并行度 %d", p.Time, p.Memory, p.Threads)
+	}
+	return fmt.Sprintf("bcrypt 成本 %d", p.Cost)
+}
+
+// Weaker 是否弱于 q：算法不同，或成本、迭代次数、内存低于 q。参数降低不要求重新哈希，
+// 硬件不同的实例调优结果不一致时不会来回重新哈希
+func (p Params) Weaker(q Params) bool {
+	if p.Algorithm != q.Algorithm {
+		return true
+	}
+	if p.Algorithm == AlgoArgon2id {
+		return p.Time < q.Time || p.Memory < q.Memory || p.Threads != q.Threads
+	}
+	return p.Cost < q.Cost
+}
+
+func (p Params) hash(password string) (string, error) {
+	if p.Algorithm == AlgoArgon2id {
+		return hashArgon2id(password, p.Time, p.Memory, p.Threads)
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(password), p.Cost)
+	return string(b), err
+}
+
+// ParseParams 从哈希或哈希前缀中解析参数
+func ParseParams(hash string) (Params, bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) < 4 || parts[0] != "" {
+		return Params{}, false
+	}
+	if parts[1] == AlgoArgon2id {
+		p := Params{Algorithm: AlgoArgon2id}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+			return Params{}, false
+		}
+		return p, true
+	}
+	cost, err := strconv.Atoi(parts[2])
+	if !strings.HasPrefix(parts[1], "2") || err != nil {
+		return Params{}, false
+	}
+	return Params{Algorithm: AlgoBcrypt, Cost: cost}, true
+}
+
+var (
+	current   *Params
+	currentMu sync.RWMutex
+)
+
+// Configured 配置文件中的哈希参数
+func Configured() Params {
+	if ucenter.C.PasswordHasher == AlgoArgon2id {
+		return Params{Algorithm: AlgoArgon2id, Time: ucenter.C.Argon2Time, Memory: ucenter.C.Argon2Memory, Threads: ucenter.C.Argon2Threads}
+	}
+	return Params{Algorithm: AlgoBcrypt, Cost: bcryptCost()}
+}
+
+// Current 生成哈希使用的参数，未调用 SetCurrent 时为配置的参数
+func Current() Params {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	if current != nil {
+		return *current
+	}
+	return Configured()
+}
+
+// SetCurrent 设置生成哈希使用的参数，如自动调优的结果
+func SetCurrent(p Params) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = &p
+}
+
+// Hash 按当前参数生成密码哈希
+func Hash(password string) (string, error) {
+	return Current().hash(password)
+}
+
+// Verify 校验密码，needRehash 表示哈希算法已更换或参数低于当前参数，应在登录成功后重新生成
+func Verify(hash, password string) (ok, needRehash bool) {
+	if strings.HasPrefix(hash, "$"+AlgoArgon2id+"$") {
+		ok = verifyArgon2id(hash, password)
+	} else {
+		ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	if !ok {
+		return false, false
+	}
+	p, parsed := ParseParams(hash)
+	return true, !parsed || p.Weaker(Current())
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// VerifyDummy 与不存在的用户比对密码，耗时与 Verify 相当，避免通过响应时间判断用户是否存在
+func VerifyDummy(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = Hash("ucenter-dummy-password")
+	})
+	Verify(dummyHash, password)
+}
+
+func bcryptCost() int {
+	if ucenter.C.BcryptCost < bcrypt.MinCost || ucenter.C.BcryptCost > bcrypt.MaxCost {
+		return bcrypt.DefaultCost
+	}
+	return ucenter.C.BcryptCost
+}
+
+func hashArgon2id(password string, time, memory uint32, threads uint8) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, argon2KeyLen)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", AlgoArgon2id, argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyArgon2id 校验 PHC 格式的 Argon2id 哈希
+func verifyArgon2id(hash, password string) bool {
+	var p Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
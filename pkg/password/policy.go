@@ -0,0 +1,117 @@
+package password
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	ut "github.com/go-playground/universal-translator"
+
+	"github.com/naiba/ucenter"
+)
+
+// 密码策略的错误信息，注册到 ucenter.ValidatorTrans
+const (
+	TransMinLength = "password_min_length"
+	TransClasses   = "password_classes"
+	TransIdentity  = "password_identity"
+	TransReused    = "password_reused"
+	TransExpired   = "password_expired"
+)
+
+var policyTranslations = map[string]string{
+	TransMinLength: "密码长度至少为 {0} 位",
+	TransClasses:   "密码需包含大写字母、小写字母、数字、符号中的至少 {0} 类",
+	TransIdentity:  "密码不能包含用户名或邮箱",
+	TransReused:    "不能使用最近 {0} 次用过的密码",
+	TransExpired:   "密码已超过 {0} 天未修改，请设置新密码",
+}
+
+func init() {
+	if err := RegisterTranslations(ucenter.ValidatorTrans); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterTranslations 注册密码策略的错误信息
+func RegisterTranslations(trans ut.Translator) error {
+	for k, v := range policyTranslations {
+		if err := trans.Add(k, v, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PolicyError 密码不符合策略
+type PolicyError struct {
+	Key    string
+	Params []string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Translate(ucenter.ValidatorTrans)
+}
+
+// Translate 翻译错误信息
+func (e *PolicyError) Translate(trans ut.Translator) string {
+	s, err := trans.T(e.Key, e.Params...)
+	if err != nil {
+		return e.Key
+	}
+	return s
+}
+
+// NewPolicyError 新建密码策略错误
+func NewPolicyError(key string, params ...int) *PolicyError {
+	e := &PolicyError{Key: key}
+	for _, p := range params {
+		e.Params = append(e.Params, strconv.Itoa(p))
+	}
+	return e
+}
+
+// CheckPolicy 检查密码长度、字符类别及是否包含用户名、邮箱
+func CheckPolicy(password, username, email string) error {
+	if n := ucenter.C.PasswordMinLength; len([]rune(password)) < n {
+		return NewPolicyError(TransMinLength, n)
+	}
+	if n := ucenter.C.PasswordMinClasses; n > 0 && charClasses(password) < n {
+		return NewPolicyError(TransClasses, n)
+	}
+	if ucenter.C.PasswordDisallowIdentity {
+		lower := strings.ToLower(password)
+		if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+			return NewPolicyError(TransIdentity)
+		}
+		// 邮箱只比较 @ 前的部分，整串出现在密码中的可能很小
+		if local := strings.SplitN(email, "@", 2)[0]; len(local) >= 3 && strings.Contains(lower, strings.ToLower(local)) {
+			return NewPolicyError(TransIdentity)
+		}
+	}
+	return nil
+}
+
+// Expired 密码是否超过有效期
+func Expired(changedAt time.Time) bool {
+	days := ucenter.C.PasswordMaxAge
+	return days > 0 && time.Since(changedAt) > time.Hour*24*time.Duration(days)
+}
+
+func charClasses(s string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
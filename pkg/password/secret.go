@@ -0,0 +1,55 @@
+package password
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"math"
+	"unicode"
+	"unicode/utf8"
+)
+
+// clientSecretBytes 自动生成的客户端密钥长度（字节）
+const clientSecretBytes = 32
+
+// Entropy 按出现的字符类别估算字符串的熵（比特）
+func Entropy(s string) float64 {
+	var lower, upper, digit, other bool
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	var pool int
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if other {
+		pool += 33
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(utf8.RuneCountInString(s)) * math.Log2(float64(pool))
+}
+
+// GenerateSecret 生成高强度的随机密钥，用于客户端密钥及各类一次性链接、令牌
+func GenerateSecret() (string, error) {
+	b := make([]byte, clientSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
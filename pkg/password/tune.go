@@ -0,0 +1,50 @@
+package password
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxArgon2Time 自动调优时 Argon2id 迭代次数的上限
+const maxArgon2Time = 64
+
+// benchmark 以 p 生成一次哈希的耗时，取三次中最短的一次以减少抖动
+func (p Params) benchmark() time.Duration {
+	var best time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		p.hash("ucenter-benchmark-password")
+		if d := time.Since(start); i == 0 || d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// Tune 以配置的参数为下限做基准测试，提高 bcrypt 成本或 Argon2id 迭代次数，
+// 使一次哈希的耗时尽量接近但不超过 target；内存与并行度按配置不变
+func Tune(target time.Duration) Params {
+	p := Configured()
+	d := p.benchmark()
+	if d <= 0 || d >= target {
+		return p
+	}
+	if p.Algorithm == AlgoArgon2id {
+		// 耗时与迭代次数近似成正比
+		t := uint32(int64(p.Time) * int64(target) / int64(d))
+		if t > maxArgon2Time {
+			t = maxArgon2Time
+		}
+		if t > p.Time {
+			p.Time = t
+		}
+		return p
+	}
+	// bcrypt 成本每加一，耗时翻倍
+	for p.Cost < bcrypt.MaxCost && d*2 <= target {
+		p.Cost++
+		d *= 2
+	}
+	return p
+}
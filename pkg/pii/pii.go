@@ -0,0 +1,128 @@
+// Package pii 敏感字段的应用层加密
+//
+// 未调用 Init 时字段以明文保存；启用后新写入的值使用 AES-GCM 加密，读取时兼容旧的明文数据。
+// 需要按值查找的字段另存一列盲索引（HMAC-SHA256），查询时使用 BlindIndex 计算。
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/naiba/ucenter/pkg/kms"
+)
+
+// Prefix 密文前缀，用于区分旧的明文数据
+const Prefix = "enc:v1:"
+
+var (
+	aead     cipher.AEAD
+	indexKey []byte
+)
+
+// Init 从密钥管理服务获取数据密钥并启用加密
+func Init(provider kms.Provider) error {
+	key, err := provider.DataKey("pii-encryption")
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	indexKey, err = provider.DataKey("pii-blind-index")
+	return err
+}
+
+// Enabled 是否已启用加密
+func Enabled() bool {
+	return aead != nil
+}
+
+// Encrypt 加密字符串，未启用或值为空时原样返回
+func Encrypt(plain string) (string, error) {
+	if aead == nil || plain == "" {
+		return plain, nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return Prefix + base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(plain), nil)), nil
+}
+
+// Decrypt 解密字符串，非密文（旧的明文数据）原样返回
+func Decrypt(s string) (string, error) {
+	if !strings.HasPrefix(s, Prefix) {
+		return s, nil
+	}
+	if aead == nil {
+		return "", errors.New("pii: encrypted value found but encryption is not configured")
+	}
+	data, err := base64.RawStdEncoding.DecodeString(s[len(Prefix):])
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", errors.New("pii: ciphertext too short")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// Encrypted 是否为密文
+func Encrypted(s string) bool {
+	return strings.HasPrefix(s, Prefix)
+}
+
+// BlindIndex 计算用于查找的盲索引，值先统一为小写
+func BlindIndex(value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(value))))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// String 加密保存的字符串字段
+type String string
+
+// Value 写入数据库时加密
+func (s String) Value() (driver.Value, error) {
+	return Encrypt(string(s))
+}
+
+// Scan 读取数据库时解密
+func (s *String) Scan(src interface{}) error {
+	var raw string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		raw = v
+	case []byte:
+		raw = string(v)
+	default:
+		return fmt.Errorf("pii: cannot scan %T", src)
+	}
+	plain, err := Decrypt(raw)
+	if err != nil {
+		return err
+	}
+	*s = String(plain)
+	return nil
+}
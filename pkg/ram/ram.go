@@ -12,6 +12,10 @@ const (
 	RoleSuperAdmin = "root"
 	// PolicyAdminPanel 管理面板权限
 	PolicyAdminPanel = "pAdminPanel"
+	// PolicyClientScope 机器应用可申请的 scope，obj 为 scope
+	PolicyClientScope = "pClientScope"
+	// PolicyUserSearch 按用户名搜索用户，供选择用户的输入框使用
+	PolicyUserSearch = "pUserSearch"
 	// DefaultDomain 默认域
 	DefaultDomain = "defaultDomain"
 	// DefaultProject 默认项目
@@ -44,4 +48,10 @@ m = g(r.sub, p.sub, r.dom) && r.dom == p.dom && r.obj == p.obj && r.act == p.act
 // InitSuperAdminPermission 初始化超级管理员权限
 func InitSuperAdminPermission(m *casbin.Enforcer) {
 	m.AddPolicy(RoleSuperAdmin, DefaultDomain, DefaultProject, PolicyAdminPanel)
+	m.AddPolicy(RoleSuperAdmin, DefaultDomain, DefaultProject, PolicyUserSearch)
+}
+
+// ClientSubject 应用在 RAM 中的主体
+func ClientSubject(clientID string) string {
+	return "client:" + clientID
 }
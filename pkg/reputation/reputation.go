@@ -0,0 +1,260 @@
+// Package reputation 登录、注册来源 IP 的信誉查询
+package reputation
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result 查询结果
+type Result struct {
+	// Score 风险评分 0-100，0 表示无记录
+	Score int
+	// Reason 命中的原因，如黑名单备注、滥用类别
+	Reason string
+}
+
+// Checker IP 信誉查询
+type Checker interface {
+	Check(ip string) (Result, error)
+}
+
+// New 按名称创建查询，provider 为空时返回 nil 表示不查询
+func New(provider, addr, key string, timeout time.Duration) (Checker, error) {
+	switch provider {
+	case "":
+		return nil, nil
+	case "file":
+		return &Blocklist{Path: addr}, nil
+	case "abuseipdb":
+		if addr == "" {
+			addr = "https://api.abuseipdb.com/api/v2/check"
+		}
+		return &AbuseIPDB{URL: addr, Key: key, Client: &http.Client{Timeout: timeout}}, nil
+	case "http":
+		if !strings.Contains(addr, "{ip}") {
+			return nil, fmt.Errorf("IP 信誉服务地址需包含 {ip}: %s", addr)
+		}
+		return &HTTP{URL: addr, Key: key, Client: &http.Client{Timeout: timeout}}, nil
+	}
+	return nil, fmt.Errorf("不支持的 IP 信誉服务: %s", provider)
+}
+
+// Blocklist 本地黑名单文件，每行一个 IP 或 CIDR，# 之后为备注；文件修改后自动重新加载
+type Blocklist struct {
+	Path string
+
+	mu       sync.Mutex
+	loadedAt time.Time
+	modTime  time.Time
+	ips      map[string]string
+	networks []blockedNetwork
+}
+
+type blockedNetwork struct {
+	network *net.IPNet
+	reason  string
+}
+
+func (b *Blocklist) reload() error {
+	if time.Since(b.loadedAt) < time.Minute && b.ips != nil {
+		return nil
+	}
+	b.loadedAt = time.Now()
+	info, err := os.Stat(b.Path)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(b.modTime) && b.ips != nil {
+		return nil
+	}
+	f, err := os.Open(b.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ips := make(map[string]string)
+	var networks []blockedNetwork
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var reason string
+		if i := strings.Index(line, "#"); i >= 0 {
+			line, reason = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(line); err == nil {
+			networks = append(networks, blockedNetwork{network, reason})
+		} else if ip := net.ParseIP(line); ip != nil {
+			ips[ip.String()] = reason
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	b.ips, b.networks, b.modTime = ips, networks, info.ModTime()
+	return nil
+}
+
+// Check 命中黑名单的评分为 100
+func (b *Blocklist) Check(ip string) (Result, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return Result{}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.reload(); err != nil && b.ips == nil {
+		return Result{}, err
+	}
+	if reason, ok := b.ips[addr.String()]; ok {
+		return Result{Score: 100, Reason: blocklistReason(reason)}, nil
+	}
+	for _, n := range b.networks {
+		if n.network.Contains(addr) {
+			return Result{Score: 100, Reason: blocklistReason(n.reason)}, nil
+		}
+	}
+	return Result{}, nil
+}
+
+func blocklistReason(reason string) string {
+	if reason == "" {
+		return "黑名单"
+	}
+	return "黑名单：" + reason
+}
+
+// AbuseIPDB 使用 AbuseIPDB 的置信度作为评分
+type AbuseIPDB struct {
+	URL    string
+	Key    string
+	Client *http.Client
+}
+
+// Check 查询近 90 天的举报
+func (a *AbuseIPDB) Check(ip string) (Result, error) {
+	req, err := http.NewRequest(http.MethodGet, a.URL+"?maxAgeInDays=90&ipAddress="+url.QueryEscape(ip), nil)
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Key", a.Key)
+	req.Header.Set("Accept", "application/json")
+	var body struct {
+		Data struct {
+			AbuseConfidenceScore int    `json:"abuseConfidenceScore"`
+			TotalReports         int    `json:"totalReports"`
+			UsageType            string `json:"usageType"`
+		} `json:"data"`
+	}
+	if err := getJSON(a.Client, req, &body); err != nil {
+		return Result{}, err
+	}
+	r := Result{Score: body.Data.AbuseConfidenceScore}
+	if r.Score > 0 {
+		r.Reason = fmt.Sprintf("AbuseIPDB 近 90 天被举报 %d 次", body.Data.TotalReports)
+		if body.Data.UsageType != "" {
+			r.Reason += "（" + body.Data.UsageType + "）"
+		}
+	}
+	return r, nil
+}
+
+// HTTP 自建的信誉服务，GET 地址中的 {ip} 替换为查询的 IP，返回 {"score": 0-100, "reason": "..."}
+type HTTP struct {
+	URL    string
+	Key    string
+	Client *http.Client
+}
+
+// Check 查询自建服务
+func (h *HTTP) Check(ip string) (Result, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.Replace(h.URL, "{ip}", url.PathEscape(ip), -1), nil)
+	if err != nil {
+		return Result{}, err
+	}
+	if h.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Key)
+	}
+	var body struct {
+		Score  int    `json:"score"`
+		Reason string `json:"reason"`
+	}
+	if err := getJSON(h.Client, req, &body); err != nil {
+		return Result{}, err
+	}
+	return Result{Score: body.Score, Reason: body.Reason}, nil
+}
+
+func getJSON(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("IP 信誉服务返回 %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// maxCacheEntries 缓存条目上限，超过时先清理过期条目，仍超过则清空
+const maxCacheEntries = 100000
+
+// Cache 缓存查询结果，同一 IP 在 TTL 内不再重复查询；查询出错的结果不缓存
+type Cache struct {
+	Checker Checker
+	TTL     time.Duration
+
+	mu    sync.Mutex
+	items map[string]cacheItem
+}
+
+type cacheItem struct {
+	result    Result
+	expiresAt time.Time
+}
+
+// Check 优先返回缓存的结果
+func (c *Cache) Check(ip string) (Result, error) {
+	c.mu.Lock()
+	if item, ok := c.items[ip]; ok && time.Now().Before(item.expiresAt) {
+		c.mu.Unlock()
+		return item.result, nil
+	}
+	c.mu.Unlock()
+
+	r, err := c.Checker.Check(ip)
+	if err != nil {
+		return r, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		c.items = make(map[string]cacheItem)
+	}
+	if len(c.items) >= maxCacheEntries {
+		now := time.Now()
+		for k, item := range c.items {
+			if now.After(item.expiresAt) {
+				delete(c.items, k)
+			}
+		}
+		if len(c.items) >= maxCacheEntries {
+			c.items = make(map[string]cacheItem)
+		}
+	}
+	c.items[ip] = cacheItem{r, time.Now().Add(c.TTL)}
+	return r, nil
+}
@@ -0,0 +1,227 @@
+package scan
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scanner 上传文件安全扫描
+type Scanner interface {
+	// Scan 扫描文件内容，发现威胁时返回 *Infected，扫描服务出错时返回其它错误
+	Scan(name string, r io.Reader) error
+}
+
+// Infected 文件未通过扫描
+type Infected struct {
+	Reason string
+}
+
+func (e *Infected) Error() string {
+	if e.Reason == "" {
+		return "文件未通过安全扫描"
+	}
+	return "文件未通过安全扫描：" + e.Reason
+}
+
+// New 按名称创建扫描器，provider 为空时返回 nil 表示不扫描
+func New(provider, addr string, timeout time.Duration) (Scanner, error) {
+	switch provider {
+	case "":
+		return nil, nil
+	case "clamd":
+		return &Clamd{Addr: addr, Timeout: timeout}, nil
+	case "icap":
+		u, err := url.Parse(addr)
+		if err != nil || u.Scheme != "icap" {
+			return nil, fmt.Errorf("ICAP 地址无效: %s", addr)
+		}
+		return &ICAP{URL: u, Timeout: timeout}, nil
+	case "http":
+		return &HTTP{URL: addr, Client: &http.Client{Timeout: timeout}}, nil
+	}
+	return nil, fmt.Errorf("不支持的上传扫描: %s", provider)
+}
+
+const chunkSize = 32 * 1024
+
+// Clamd ClamAV 守护进程，使用 INSTREAM 命令
+type Clamd struct {
+	// Addr tcp://host:3310、unix:///path/clamd.sock 或 host:3310
+	Addr    string
+	Timeout time.Duration
+}
+
+func (s *Clamd) dial() (net.Conn, error) {
+	network, addr := "tcp", s.Addr
+	if strings.HasPrefix(addr, "unix://") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	} else {
+		addr = strings.TrimPrefix(addr, "tcp://")
+	}
+	return net.DialTimeout(network, addr, s.Timeout)
+}
+
+// Scan 扫描
+func (s *Clamd) Scan(name string, r io.Reader) error {
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(size); werr != nil {
+				return werr
+			}
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &Infected{Reason: strings.TrimSuffix(reply, " FOUND")}
+	}
+	return fmt.Errorf("clamd: %s", reply)
+}
+
+// ICAP ICAP 服务（RFC 3507），以 RESPMOD 提交文件
+type ICAP struct {
+	// URL icap://host:1344/service
+	URL     *url.URL
+	Timeout time.Duration
+}
+
+// Scan 扫描
+func (s *ICAP) Scan(name string, r io.Reader) error {
+	host := s.URL.Host
+	if s.URL.Port() == "" {
+		host += ":1344"
+	}
+	conn, err := net.DialTimeout("tcp", host, s.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	resHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=" + strconv.Quote(name) + "\r\n\r\n"
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", s.URL.String())
+	fmt.Fprintf(w, "Host: %s\r\n", s.URL.Hostname())
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(resHdr))
+	w.WriteString(resHdr)
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "ICAP/") {
+		return fmt.Errorf("icap: 无效的响应 %q", line)
+	}
+	header, _ := tp.ReadMIMEHeader()
+	switch parts[1] {
+	case "204":
+		return nil
+	case "200":
+		// 服务修改了响应（通常替换为拦截页面），视为发现威胁
+		reason := header.Get("X-Infection-Found")
+		if reason == "" {
+			reason = header.Get("X-Virus-ID")
+		}
+		return &Infected{Reason: reason}
+	}
+	return fmt.Errorf("icap: %s", line)
+}
+
+// HTTP 外部 HTTP 扫描服务：以请求体提交文件，
+// 200/204 表示安全，403/406/422 表示发现威胁（响应体为原因），其余视为扫描出错
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+// Scan 扫描
+func (s *HTTP) Scan(name string, r io.Reader) error {
+	req, err := http.NewRequest(http.MethodPost, s.URL, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Disposition", "attachment; filename="+strconv.Quote(name))
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusForbidden, http.StatusNotAcceptable, http.StatusUnprocessableEntity:
+		return &Infected{Reason: strings.TrimSpace(string(body))}
+	}
+	return fmt.Errorf("扫描服务返回 %s", resp.Status)
+}
@@ -0,0 +1,45 @@
+// Package usercode 设备授权（RFC 8628）中由用户在浏览器输入的验证码
+package usercode
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+)
+
+// Alphabet 验证码的字符集，去掉元音及易混淆的字符（RFC 8628 第 6.1 节）
+const Alphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// length 验证码位数
+const length = 8
+
+// New 生成 8 位验证码
+func New() (string, error) {
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(Alphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = Alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// Normalize 忽略大小写及分隔符
+func Normalize(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+// Format 显示时每 4 位加分隔符
+func Format(code string) string {
+	if len(code) != length {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
@@ -0,0 +1,54 @@
+package usercode
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code, err := New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != length {
+			t.Fatalf("验证码长度应为 %d：%q", length, code)
+		}
+		for _, r := range code {
+			if !strings.ContainsRune(Alphabet, r) {
+				t.Fatalf("验证码含有字符集之外的字符：%q", code)
+			}
+		}
+		seen[code] = true
+	}
+	if len(seen) < 99 {
+		t.Fatalf("100 个验证码中只有 %d 个不同", len(seen))
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for in, want := range map[string]string{
+		"BCDF-GHJK":   "BCDFGHJK",
+		"bcdf-ghjk":   "BCDFGHJK",
+		" bcdf ghjk ": "BCDFGHJK",
+		"BC-DF-GH-JK": "BCDFGHJK",
+		"":            "",
+	} {
+		if got := Normalize(in); got != want {
+			t.Errorf("Normalize(%q) = %q，应为 %q", in, got, want)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	if got := Format("BCDFGHJK"); got != "BCDF-GHJK" {
+		t.Fatalf("Format = %q", got)
+	}
+	if got := Format("BCD"); got != "BCD" {
+		t.Fatalf("长度不对时应原样返回：%q", got)
+	}
+	if got := Normalize(Format("BCDFGHJK")); got != "BCDFGHJK" {
+		t.Fatalf("格式化后应能还原：%q", got)
+	}
+}
@@ -0,0 +1,83 @@
+// Package wechat 微信小程序登录凭证校验（code2session）
+package wechat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Code2SessionURL 微信 code2session 接口
+const Code2SessionURL = "https://api.weixin.qq.com/sns/jscode2session"
+
+// Session code2session 的结果。SessionKey 用于解密小程序上报的加密数据，不能下发给小程序
+type Session struct {
+	OpenID     string `json:"openid"`
+	UnionID    string `json:"unionid"`
+	SessionKey string `json:"session_key"`
+}
+
+// Error 微信接口返回的错误
+type Error struct {
+	Code int    `json:"errcode"`
+	Msg  string `json:"errmsg"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("微信接口返回错误 %d：%s", e.Code, e.Msg)
+}
+
+// InvalidCode js_code 无效或已被使用，由小程序重新调用 wx.login 获取
+func (e *Error) InvalidCode() bool {
+	return e.Code == 40029 || e.Code == 40163
+}
+
+// MiniProgram 小程序的 AppID 与 AppSecret
+type MiniProgram struct {
+	AppID  string
+	Secret string
+	// URL 为空时使用 Code2SessionURL
+	URL    string
+	Client *http.Client
+}
+
+// Code2Session 以小程序 wx.login 取得的 js_code 换取 openid、unionid 及 session_key
+func (m *MiniProgram) Code2Session(code string) (*Session, error) {
+	endpoint := m.URL
+	if endpoint == "" {
+		endpoint = Code2SessionURL
+	}
+	q := url.Values{
+		"appid":      {m.AppID},
+		"secret":     {m.Secret},
+		"js_code":    {code},
+		"grant_type": {"authorization_code"},
+	}
+	client := m.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(endpoint + "?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("微信接口返回 %s", resp.Status)
+	}
+	var body struct {
+		Session
+		Error
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Code != 0 {
+		return nil, &body.Error
+	}
+	if body.OpenID == "" {
+		return nil, fmt.Errorf("微信接口未返回 openid")
+	}
+	return &body.Session, nil
+}
@@ -0,0 +1,35 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// 扫码登录的状态
+const (
+	QRLoginPending  = "pending"
+	QRLoginScanned  = "scanned"
+	QRLoginApproved = "approved"
+	QRLoginRejected = "rejected"
+	QRLoginConsumed = "consumed"
+)
+
+// QRLogin 等待手机确认的扫码登录，ID 写在二维码中，Secret 只保存在发起登录的浏览器
+type QRLogin struct {
+	ID     string `gorm:"primary_key"`
+	Secret string `json:"-"`
+	Status string
+	// UserID 确认登录的用户
+	UserID uint
+	// Name、IP、Location 发起登录的设备，展示给扫码的用户核对
+	Name      string
+	IP        string
+	Location  string
+	ReturnURL string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// Expired 二维码是否已过期
+func (q *QRLogin) Expired() bool {
+	return time.Now().After(q.ExpiresAt)
+}
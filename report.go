@@ -0,0 +1,12 @@
+package ucenter
+
+import "time"
+
+// Report 定期发送给管理员的报告，最近一次的生成时间决定下一次何时生成
+type Report struct {
+	ID uint `gorm:"primary_key"`
+	// Since 报告统计的起始时间
+	Since     time.Time
+	Content   string `gorm:"type:text"`
+	CreatedAt time.Time
+}
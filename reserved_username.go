@@ -0,0 +1,13 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// ReservedUsername 保留或禁止注册的用户名
+type ReservedUsername struct {
+	ID        uint   `gorm:"primary_key"`
+	Pattern   string `gorm:"type:varchar(255);unique_index"`
+	IsRegex   bool   // 是否为正则表达式
+	CreatedAt time.Time
+}
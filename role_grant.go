@@ -0,0 +1,27 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// RoleGrant 角色授予记录，授予管理员级角色必须填写理由
+type RoleGrant struct {
+	ID     uint `gorm:"primary_key"`
+	UserID uint `gorm:"index"`
+	Role   string
+	Domain string
+	// GrantedBy 授予人，0 为系统（第一位用户）
+	GrantedBy     uint
+	Justification string `gorm:"type:text"`
+	CreatedAt     time.Time
+}
+
+// ProvisionedRole 按外部账户的组信息自动授予的角色，每次通过该提供方登录时同步，手动授予的角色不在其中
+type ProvisionedRole struct {
+	ID        uint `gorm:"primary_key"`
+	UserID    uint `gorm:"index"`
+	Provider  string
+	Role      string
+	Domain    string
+	CreatedAt time.Time
+}
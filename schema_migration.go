@@ -0,0 +1,11 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// SchemaMigration 已执行的数据迁移
+type SchemaMigration struct {
+	ID        string `gorm:"primary_key"`
+	AppliedAt time.Time
+}
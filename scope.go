@@ -0,0 +1,17 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// Scope 授权范围，在授权页展示给用户
+type Scope struct {
+	ID          uint   `gorm:"primary_key"`
+	Name        string `gorm:"type:varchar(64);unique_index"`
+	DisplayName string `gorm:"type:varchar(64)"`  // 授权页展示的名称
+	Description string `gorm:"type:varchar(255)"` // 授权页展示的说明
+	Icon        string `gorm:"type:varchar(64)"`  // Semantic UI 图标名称
+	Sensitive   bool   // 涉及敏感信息，授权页着重提示
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
@@ -0,0 +1,31 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// 安全提醒事件
+const (
+	AlertLoginFailure = "login_failure"
+	AlertNewDevice    = "new_device"
+	AlertRecoveryCode = "recovery_code"
+)
+
+// AlertEvents 安全提醒事件的显示名称
+var AlertEvents = map[string]string{
+	AlertLoginFailure: "登录失败",
+	AlertNewDevice:    "新设备登录",
+	AlertRecoveryCode: "使用恢复码登录",
+}
+
+// SecurityAlert 待发送或已发送给用户的安全提醒，冷却期内的同类事件合并为一封摘要
+type SecurityAlert struct {
+	ID     uint   `gorm:"primary_key"`
+	UserID uint   `gorm:"index"`
+	Event  string `gorm:"index"`
+	// Detail 邮件正文中该事件的说明
+	Detail    string
+	CreatedAt time.Time
+	// SentAt 发送时间，为空表示尚未发送
+	SentAt *time.Time
+}
@@ -0,0 +1,23 @@
+package ucenter
+
+import (
+	"time"
+
+	"github.com/naiba/ucenter/pkg/pii"
+)
+
+// SigningKey ID Token、JWT 访问令牌等的签名密钥
+//
+// 同一时间只有一把未退役的密钥用于签名；轮换后旧密钥停止签名，但在 ExpiresAt 之前仍在 JWKS 中公布，
+// 以便已签发的令牌在过期前可以继续校验。
+type SigningKey struct {
+	ID  uint   `gorm:"primary_key"`
+	KID string `gorm:"unique_index"`
+	// Alg RS256 或 ES256
+	Alg string
+	// PrivateKey PKCS#8 PEM，开启敏感字段加密时加密保存
+	PrivateKey pii.String `gorm:"type:text"`
+	CreatedAt  time.Time
+	RetiredAt  *time.Time
+	ExpiresAt  *time.Time `gorm:"index"`
+}
@@ -0,0 +1,50 @@
+package ucenter
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SignupPolicy 注册策略，可在管理中心随时修改
+type SignupPolicy struct {
+	ID           uint           `gorm:"primary_key"`
+	Closed       bool           // 关闭注册
+	AllowDomains pq.StringArray `gorm:"type:varchar(255)[]"` // 允许注册的邮箱域名，为空不限制
+	BlockDomains pq.StringArray `gorm:"type:varchar(255)[]"` // 禁止注册的邮箱域名
+	UpdatedAt    time.Time
+}
+
+// EmailRequired 是否需要填写邮箱才能注册
+func (p *SignupPolicy) EmailRequired() bool {
+	return len(p.AllowDomains) > 0 || len(p.BlockDomains) > 0
+}
+
+// EmailAllowed 邮箱域名是否允许注册，子域名与上级域名同等对待
+func (p *SignupPolicy) EmailAllowed(email string) bool {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[i+1:])
+	for _, d := range p.BlockDomains {
+		if matchDomain(domain, d) {
+			return false
+		}
+	}
+	if len(p.AllowDomains) == 0 {
+		return true
+	}
+	for _, d := range p.AllowDomains {
+		if matchDomain(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(domain, rule string) bool {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	return rule != "" && (domain == rule || strings.HasSuffix(domain, "."+rule))
+}
@@ -0,0 +1,19 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// ScopeSignup 第一方应用通过 API 代用户注册所需的 scope
+const ScopeSignup = "signup"
+
+// SignupRequest 注册 API 的请求记录，用于按 IP 及应用限流
+type SignupRequest struct {
+	ID       uint   `gorm:"primary_key"`
+	ClientID string `gorm:"index"`
+	// IP IPv6 记为所在前缀
+	IP string `gorm:"index"`
+	// UserID 注册成功的用户，失败为 0
+	UserID    uint
+	CreatedAt time.Time `gorm:"index"`
+}
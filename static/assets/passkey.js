@@ -0,0 +1,68 @@
+// WebAuthn 选项中的二进制字段使用 base64url 编码传输
+function b64urlToBuf(s) {
+  s = s.replace(/-/g, '+').replace(/_/g, '/')
+  while (s.length % 4) {
+    s += '='
+  }
+  return Uint8Array.from(atob(s), c => c.charCodeAt(0)).buffer
+}
+
+function bufToB64url(buf) {
+  return btoa(String.fromCharCode.apply(null, new Uint8Array(buf)))
+    .replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+}
+
+function passkeyRegister(name) {
+  return $.post('/passkey/register/begin').then((opts) => {
+    opts.publicKey.challenge = b64urlToBuf(opts.publicKey.challenge)
+    opts.publicKey.user.id = b64urlToBuf(opts.publicKey.user.id)
+    if (opts.publicKey.excludeCredentials) {
+      opts.publicKey.excludeCredentials.forEach(c => c.id = b64urlToBuf(c.id))
+    }
+    return navigator.credentials.create(opts)
+  }).then((cred) => {
+    return $.ajax({
+      url: '/passkey/register/finish?name=' + encodeURIComponent(name),
+      type: 'POST',
+      contentType: 'application/json',
+      data: JSON.stringify({
+        id: cred.id,
+        rawId: bufToB64url(cred.rawId),
+        type: cred.type,
+        response: {
+          attestationObject: bufToB64url(cred.response.attestationObject),
+          clientDataJSON: bufToB64url(cred.response.clientDataJSON),
+        },
+      }),
+    })
+  })
+}
+
+// passkeyLogin 使用通行密钥登录，base 为重新验证身份等其他验证接口的前缀
+function passkeyLogin(search, base) {
+  base = base || '/login/passkey'
+  return $.post(base + '/begin').then((opts) => {
+    opts.publicKey.challenge = b64urlToBuf(opts.publicKey.challenge)
+    if (opts.publicKey.allowCredentials) {
+      opts.publicKey.allowCredentials.forEach(c => c.id = b64urlToBuf(c.id))
+    }
+    return navigator.credentials.get(opts)
+  }).then((cred) => {
+    return $.ajax({
+      url: base + '/finish' + search,
+      type: 'POST',
+      contentType: 'application/json',
+      data: JSON.stringify({
+        id: cred.id,
+        rawId: bufToB64url(cred.rawId),
+        type: cred.type,
+        response: {
+          authenticatorData: bufToB64url(cred.response.authenticatorData),
+          clientDataJSON: bufToB64url(cred.response.clientDataJSON),
+          signature: bufToB64url(cred.response.signature),
+          userHandle: cred.response.userHandle ? bufToB64url(cred.response.userHandle) : null,
+        },
+      }),
+    })
+  })
+}
@@ -0,0 +1,20 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// TrustedDevice 通过二次验证后被标记为受信任的浏览器，有效期内登录不再需要验证码
+type TrustedDevice struct {
+	ID     uint `gorm:"primary_key"`
+	UserID uint `gorm:"index"`
+	// SecretHash Cookie 中设备令牌的哈希，数据库泄露也无法伪造受信任设备
+	SecretHash string `json:"-"`
+	// LoginToken 最近一次通过该设备登录的终端，下线该终端时一并取消信任
+	LoginToken string `gorm:"index" json:"-"`
+	Name       string
+	IP         string
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
@@ -5,11 +5,16 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/casbin/casbin"
+	"github.com/naiba/ucenter/pkg/ids"
+	"github.com/naiba/ucenter/pkg/kms"
+	"github.com/naiba/ucenter/pkg/pii"
 	"github.com/naiba/ucenter/pkg/ram"
 
 	"github.com/go-playground/locales/en"
@@ -33,36 +38,153 @@ const (
 	RequestRouter = "ctx_request_router"
 	// AuthUser 通过验证的用户
 	AuthUser = "ctx_auth_user"
+	// AuthLogin 当前请求所属的登录终端
+	AuthLogin = "ctx_auth_login"
 	// AuthCookieExpiretion Web验证用的Cookie过期时间
 	AuthCookieExpiretion = time.Hour * 24 * 60
+	// CSRFToken 当前会话的 CSRF Token
+	CSRFToken = "ctx_csrf_token"
+	// CSRFCookieName 保存 CSRF Token 的 Cookie 名称
+	CSRFCookieName = "nb_csrf"
+	// BrowserStateCookieName OpenID Connect 会话管理的浏览器状态 Cookie 名称
+	BrowserStateCookieName = "nb_bs"
 )
 
 var (
 	// RouteNeedAuthorize 需要认证的路由
 	RouteNeedAuthorize = map[string]interface{}{
-		"/":                  nil,
-		"/login":             nil,
-		"/signup":            nil,
-		"/logout":            nil,
-		"/app":               nil,
-		"/oauth2/auth":       nil,
-		"/app/:id":           nil,
-		"/user/:id":          nil,
-		"/admin/":            []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
-		"/admin/users":       []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
-		"/admin/apps":        []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
-		"/admin/user/status": []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
-		"/admin/app/status":  []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/":                             nil,
+		"/login":                        nil,
+		"/signup":                       nil,
+		"/logout":                       nil,
+		"/app":                          nil,
+		"/oauth2/auth":                  nil,
+		"/oauth2/logout":                nil,
+		"/app/:id":                      nil,
+		"/app/:id/secret":               nil,
+		"/sudo":                         nil,
+		"/stepup":                       nil,
+		"/stepup/otp":                   nil,
+		"/stepup/passkey/begin":         nil,
+		"/stepup/passkey/finish":        nil,
+		"/password":                     nil,
+		"/user/:id":                     nil,
+		"/devices":                      nil,
+		"/device/:id":                   nil,
+		"/trusted-device/:id":           nil,
+		"/invites":                      nil,
+		"/invite":                       nil,
+		"/passkeys":                     nil,
+		"/passkey/:id":                  nil,
+		"/passkey/register/begin":       nil,
+		"/passkey/register/finish":      nil,
+		"/login/passkey/begin":          nil,
+		"/login/passkey/finish":         nil,
+		"/offline":                      nil,
+		"/offline/:id":                  nil,
+		"/connected":                    nil,
+		"/users/search":                 nil,
+		"/connected/:id":                nil,
+		"/connected/:id/scope/:scope":   nil,
+		"/exports":                      nil,
+		"/export":                       nil,
+		"/export/:id":                   nil,
+		"/activity":                     nil,
+		"/device":                       nil,
+		"/identities":                   nil,
+		"/qr/:id":                       nil,
+		"/qr/:id/scan":                  nil,
+		"/qr/:id/approve":               nil,
+		"/qr/:id/reject":                nil,
+		"/identities/link/:provider":    nil,
+		"/identity":                     nil,
+		"/identity/:id":                 nil,
+		"/login/idp/:provider":          nil,
+		"/login/idp/:provider/callback": nil,
+		"/login/mfa":                    nil,
+		"/login/mfa/resend":             nil,
+		"/mfa":                          nil,
+		"/mfa/email":                    nil,
+		"/mfa/recovery-codes":           nil,
+		"/mfa/email/confirm":            nil,
+		"/legal":                        nil,
+		"/legal/:kind":                  nil,
+		"/admin/":                       []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/users":                  []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/users/:id":              []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/apps":                   []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/user/status":            []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/user/role":              []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/user/merge":             []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/app/status":             []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/app/first-party":        []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/app/network":            []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/locks":                  []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/unlock":                 []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/machine":                []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/machine/revoke":         []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/machine/client":         []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/machine/scope":          []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/machine/scope/remove":   []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/stale":                  []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/pending":                []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/review":                 []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/signup":                 []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/reserved":               []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/reserved/:id":           []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/scopes":                 []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/scope":                  []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/scope/:id":              []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/invites":                []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/invite":                 []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/invite/:id":             []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/audit":                  []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/audit/verify":           []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/audit/export":           []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/flags":                  []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/flag":                   []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/legal":                  []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/legal/acceptances":      []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
+		"/admin/mfa":                    []interface{}{ram.DefaultDomain, ram.DefaultProject, ram.PolicyAdminPanel},
 	}
 	// RouteTitle 页面标题
 	RouteTitle = map[string]string{
-		"/":            "个人中心",
-		"/admin/":      "管理中心",
-		"/admin/users": "用户管理",
-		"/admin/apps":  "应用管理",
-		"/login":       "用户登录",
-		"/signup":      "用户注册",
-		"/oauth2/auth": "用户授权",
+		"/":                "个人中心",
+		"/admin/":          "管理中心",
+		"/admin/users":     "用户管理",
+		"/admin/users/:id": "用户详情",
+		"/admin/apps":      "应用管理",
+		"/admin/locks":     "登录锁定",
+		"/admin/machine":   "机器令牌",
+		"/admin/stale":     "停用预告",
+		"/admin/pending":   "注册审核",
+		"/admin/signup":    "注册设置",
+		"/admin/reserved":  "保留用户名",
+		"/admin/scopes":    "授权范围",
+		"/admin/invites":   "邀请码",
+		"/admin/audit":     "审计日志",
+		"/admin/flags":     "功能开关",
+		"/admin/legal":     "法律文件",
+		"/legal":           "服务条款",
+		"/invites":         "邀请码",
+		"/passkeys":        "通行密钥",
+		"/offline":         "离线访问",
+		"/connected":       "已授权应用",
+		"/exports":         "数据导出",
+		"/activity":        "最近活动",
+		"/device":          "设备登录",
+		"/identities":      "关联账户",
+		"/qr/:id":          "扫码登录",
+		"/mfa":             "二次验证",
+		"/login/mfa":       "二次验证",
+		"/admin/mfa":       "二次验证",
+		"/devices":         "登录设备",
+		"/login":           "用户登录",
+		"/sudo":            "验证身份",
+		"/password":        "修改密码",
+		"/signup":          "用户注册",
+		"/oauth2/auth":     "用户授权",
+		"/oauth2/logout":   "退出登录",
 	}
 	// RAM 权限系统
 	RAM *casbin.Enforcer
@@ -70,10 +192,12 @@ var (
 	DB *gorm.DB
 	// ValidatorTrans 翻译工具
 	ValidatorTrans ut.Translator
-	// Scopes 可以使用的 scope 列表
+	// Scopes 内置的 scope 及默认说明，启动时写入 scope 表
 	Scopes = map[string]string{
 		"openid":  "获取必要信息(必选)",
 		"profile": "获取个人资料(用户名、简介等)",
+		"email":   "获取邮箱地址",
+		"phone":   "获取手机号码",
 	}
 	// SystemRSAKey 系统RSA私钥
 	SystemRSAKey *rsa.PrivateKey
@@ -82,6 +206,69 @@ var (
 )
 
 func init() {
+	viper.SetDefault("id_format", ids.FormatSerial)
+	viper.SetDefault("captcha_provider", "recaptcha")
+	viper.SetDefault("captcha_site_key", "6Lf1o4wUAAAAACxndMJn--Nghjw0jMWm8JLEKjbF")
+	viper.SetDefault("captcha_mode", "always")
+	viper.SetDefault("captcha_free_attempts", 3)
+	viper.SetDefault("password_hasher", "bcrypt")
+	viper.SetDefault("bcrypt_cost", 10)
+	viper.SetDefault("argon2_time", 1)
+	viper.SetDefault("argon2_memory", 64*1024)
+	viper.SetDefault("argon2_threads", 4)
+	viper.SetDefault("password_min_length", 6)
+	viper.SetDefault("password_disallow_identity", true)
+	viper.SetDefault("authorize_require_state", true)
+	viper.SetDefault("authorize_require_nonce", true)
+	viper.SetDefault("login_max_failures", 5)
+	viper.SetDefault("login_failure_window", 15)
+	viper.SetDefault("email_change_ttl", 24)
+	viper.SetDefault("security_alert_cooldown", 30)
+	viper.SetDefault("email_otp_ttl", 10)
+	viper.SetDefault("email_otp_max_attempts", 5)
+	viper.SetDefault("email_otp_resend_interval", 60)
+	viper.SetDefault("mfa_trust_days", 30)
+	viper.SetDefault("mfa_recovery_codes", 10)
+	viper.SetDefault("qr_login_ttl", 120)
+	viper.SetDefault("sudo_ttl", 10)
+	viper.SetDefault("admin_sudo_ttl", 15)
+	viper.SetDefault("client_secret_min_entropy", 128)
+	viper.SetDefault("client_auth_max_failures", 10)
+	viper.SetDefault("client_auth_failure_window", 15)
+	viper.SetDefault("access_token_lifespan", 60)
+	viper.SetDefault("id_token_lifespan", 60)
+	viper.SetDefault("authorize_code_lifespan", 10)
+	viper.SetDefault("smtp_port", 465)
+	viper.SetDefault("stale_account_grace_days", 30)
+	viper.SetDefault("data_export_ttl", 72)
+	viper.SetDefault("slo_token_error_rate", 0.01)
+	viper.SetDefault("slo_login_p95", 1.0)
+	viper.SetDefault("slo_mail_failure_rate", 0.05)
+	viper.SetDefault("kms_provider", "local")
+	viper.SetDefault("signup_api_ip_limit", 10)
+	viper.SetDefault("signup_api_client_limit", 100)
+	viper.SetDefault("upload_scan_timeout", 10)
+	viper.SetDefault("audit_anchor_interval", 24)
+	viper.SetDefault("signing_key_alg", "RS256")
+	viper.SetDefault("signing_key_rotation_days", 90)
+	viper.SetDefault("client_secret_grace_hours", 24)
+	viper.SetDefault("consent_remember_days", 30)
+	viper.SetDefault("consent_remember_forever", true)
+	viper.SetDefault("token_leeway", 30)
+	viper.SetDefault("registration_grant_types", []string{"authorization_code", "refresh_token"})
+	viper.SetDefault("registration_approval", true)
+	viper.SetDefault("device_code_ttl", 10)
+	viper.SetDefault("device_code_interval", 5)
+	viper.SetDefault("par_lifespan", 90)
+	viper.SetDefault("ip_reputation_timeout", 2)
+	viper.SetDefault("ip_reputation_cache_ttl", 60)
+	viper.SetDefault("ip_reputation_block", 90)
+	viper.SetDefault("ip_reputation_challenge", 25)
+	viper.SetDefault("ip_reputation_flag", 50)
+	viper.SetDefault("ipv6_prefix_length", 64)
+	viper.SetDefault("user_search_rate_limit", 30)
+	viper.SetDefault("report_interval_days", 7)
+	viper.SetDefault("report_inactive_days", 90)
 	viper.SetConfigName("config") // name of config file (without extension)
 	viper.AddConfigPath("data")   // optionally look for config in the working directory
 	err := viper.ReadInConfig()   // Find and read the config file
@@ -92,13 +279,68 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	if !ids.Valid(C.IDFormat) {
+		panic(fmt.Errorf("不支持的 ID 格式 %s", C.IDFormat))
+	}
+	if C.ConsentRememberDays < 1 {
+		panic(fmt.Errorf("consent_remember_days 至少为 1 天"))
+	}
+	if len(C.ClientTemplates) == 0 {
+		C.ClientTemplates = DefaultClientTemplates
+	}
+	for name, tpl := range C.ClientTemplates {
+		if tpl.Machine && tpl.AuthMethod == "none" {
+			panic(fmt.Errorf("应用模板 %s 为机器应用，不能使用公开客户端", name))
+		}
+	}
+	for name := range C.IdentityProviders {
+		if name == IdentityPassword || name == IdentityWechat || strings.HasPrefix(name, IdentityWechatMiniProgram) {
+			panic(fmt.Errorf("身份提供方标识 %s 为保留名称", name))
+		}
+	}
+	for clientID, m := range C.WechatMiniPrograms {
+		if m.AppID == "" || m.AppSecret == "" {
+			panic(fmt.Errorf("应用 %s 的微信小程序缺少 app_id 或 app_secret", clientID))
+		}
+	}
+	registerCustomScopes()
+	if C.FeatureFlags == nil {
+		C.FeatureFlags = make(map[string]FeatureFlag)
+	}
+	for name, f := range DefaultFeatureFlags {
+		if _, ok := C.FeatureFlags[name]; !ok {
+			C.FeatureFlags[name] = f
+		}
+	}
+
+	// 敏感字段加密，需在读写数据库之前初始化
+	if C.PIIEncryption {
+		provider, err := kms.New(C.KMSProvider, C.KMSMasterKey)
+		if err != nil {
+			panic(err)
+		}
+		if err = pii.Init(provider); err != nil {
+			panic(err)
+		}
+	}
 
 	DB, err = gorm.Open("postgres", C.DBDSN)
 	if err != nil {
 		panic(err)
 	}
 	// 创建数据表
-	DB.AutoMigrate(&User{}, &Login{}, &UserAuthorized{})
+	DB.AutoMigrate(&User{}, &Login{}, &UserAuthorized{}, &LoginAttempt{}, &UserTombstone{}, &KnownDevice{}, &LoginClient{}, &Invite{}, &Passkey{}, &PasskeySession{}, &DPoPProof{}, &SignupPolicy{}, &ReservedUsername{}, &ClientAuthFailure{}, &DataExport{}, &RoleGrant{}, &PasswordHistory{}, &Appeal{}, &AuditLog{}, &SchemaMigration{}, &FeatureFlag{}, &LegalDocument{}, &LegalAcceptance{}, &Identity{}, &MFAPolicy{}, &EmailOTP{}, &EmailChange{}, &TrustedDevice{}, &SecurityAlert{}, &SignupRequest{}, &QRLogin{}, &RecoveryCode{}, &AuditAnchor{}, &SigningKey{}, &ProvisionedRole{}, &ClientRegistration{}, &PasswordHashCampaign{}, &Scope{}, &Report{}, &JobLock{})
+	// 加密后的邮箱超出 varchar(255)
+	DB.Model(&User{}).ModifyColumn("email", "text")
+	// 邮箱可用于登录，必须唯一：明文按小写比较，加密后按盲索引比较
+	for _, idx := range []string{
+		"CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email ON users (lower(email)) WHERE email <> '' AND email NOT LIKE 'enc:%' AND deleted_at IS NULL",
+		"CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email_index ON users (email_index) WHERE email_index <> '' AND deleted_at IS NULL",
+	} {
+		if err := DB.Exec(idx).Error; err != nil {
+			log.Printf("邮箱唯一索引创建失败，请先处理重复邮箱: %s", err)
+		}
+	}
 	if C.DebugAble {
 		DB = DB.Debug()
 		RAM.EnableLog(true)
@@ -2,23 +2,58 @@ package ucenter
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/jinzhu/gorm"
+
+	"github.com/naiba/ucenter/pkg/ids"
+	"github.com/naiba/ucenter/pkg/pii"
 )
 
 const (
 	// StatusSuspended 账户已被禁用
 	StatusSuspended = -1
+	// StatusDeactivated 账户长期未登录已停用
+	StatusDeactivated = -2
+	// StatusPending 新注册账户等待管理员审核
+	StatusPending = -3
+	// StatusUnconfirmed 限定邮箱域名注册的新账户等待确认邮箱
+	StatusUnconfirmed = -4
 )
 
 // User 用户表
 type User struct {
 	gorm.Model
+	// PublicID 对外的用户 ID，用作 sub、头像地址及应用 ID 前缀；按 id_format 生成，serial 与自增 ID 相同
+	PublicID string `gorm:"index" json:"public_id,omitempty"`
 	Username string `gorm:"type:varchar(20);unique_index;notnull" json:"username,omitempty"`
 	Password string `json:"-,omitempty"`
-	Avatar   bool   `json:"avatar,omitempty"`
-	Bio      string `json:"bio,omitempty"`
-	Status   int    `json:"status,omitempty"`
+	// PasswordChangedAt 最近修改密码的时间，为空时以注册时间计算有效期
+	PasswordChangedAt *time.Time `json:"-"`
+	Avatar            bool       `json:"avatar,omitempty"`
+	// AvatarHash 头像内容哈希，头像更新后地址随之变化
+	AvatarHash string     `json:"-"`
+	Bio        string     `json:"bio,omitempty"`
+	Email      pii.String `gorm:"type:text" json:"email,omitempty"`
+	// EmailIndex 邮箱的盲索引，启用敏感字段加密后按邮箱查找使用
+	EmailIndex string `gorm:"index" json:"-"`
+	// Phone 手机号码，E.164 格式，通过 phone scope 提供给应用
+	Phone  pii.String `gorm:"type:text" json:"phone,omitempty"`
+	Status int        `json:"status,omitempty"`
+	// SuspendedUntil 临时禁用的解除时间，为空表示永久禁用
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
+	// SuspendReason 禁用原因，会展示给被禁用的用户
+	SuspendReason string `json:"suspend_reason,omitempty"`
+	// SuspendedBy 执行禁用的管理员
+	SuspendedBy uint `json:"suspended_by,omitempty"`
+	// LastLoginAt 最近登录时间
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	// StaleWarnedAt 长期未登录提醒的发送时间
+	StaleWarnedAt *time.Time `json:"stale_warned_at,omitempty"`
+	// PasskeyHandle 通行密钥的 user handle，与用户 ID 解耦避免泄露
+	PasskeyHandle string `gorm:"index" json:"-"`
+	// MFAEmail 登录时需输入发送到邮箱的验证码
+	MFAEmail bool `json:"mfa_email,omitempty"`
 
 	UserAuthorizeds []UserAuthorized `json:"user_authorizeds,omitempty"`
 	Logins          []Login          `json:"logins,omitempty"`
@@ -28,3 +63,78 @@ type User struct {
 func (u *User) StrID() string {
 	return fmt.Sprintf("%d", u.ID)
 }
+
+// Subject 对外的 sub，回填 PublicID 之前的旧用户使用自增 ID
+func (u *User) Subject() string {
+	if u.PublicID != "" {
+		return u.PublicID
+	}
+	return u.StrID()
+}
+
+// AvatarURL 头像地址，内容不变地址就不变，可长期缓存
+func (u *User) AvatarURL() string {
+	if !u.Avatar {
+		return "/static/assets/favicon.png"
+	}
+	if u.AvatarHash == "" {
+		return "/upload/avatar/" + u.Subject()
+	}
+	return "/upload/avatar/" + u.Subject() + "." + u.AvatarHash
+}
+
+// BeforeCreate 按 id_format 生成对外 ID
+func (u *User) BeforeCreate() (err error) {
+	if u.PublicID == "" {
+		u.PublicID, err = ids.New(C.IDFormat)
+	}
+	return
+}
+
+// BeforeSave 更新邮箱的盲索引
+func (u *User) BeforeSave() error {
+	u.EmailIndex = ""
+	if pii.Enabled() {
+		u.EmailIndex = pii.BlindIndex(string(u.Email))
+	}
+	return nil
+}
+
+// EmailQuery 按邮箱查找用户的查询条件，启用敏感字段加密时使用盲索引
+func EmailQuery(email string) (string, string) {
+	if pii.Enabled() {
+		return "email_index = ?", pii.BlindIndex(email)
+	}
+	return "lower(email) = lower(?)", email
+}
+
+// AfterCreate 已删除用户的 ID 不可再分配；serial 格式的对外 ID 即自增 ID
+func (u *User) AfterCreate(tx *gorm.DB) error {
+	var count int
+	if err := tx.Model(UserTombstone{}).Where("user_id = ?", u.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("用户 ID %d 已被删除，不可重新分配", u.ID)
+	}
+	if u.PublicID == "" {
+		u.PublicID = u.StrID()
+		return tx.Model(u).UpdateColumn("public_id", u.PublicID).Error
+	}
+	return nil
+}
+
+// IsSuspended 账户是否处于禁用中
+func (u *User) IsSuspended() bool {
+	return u.Status == StatusSuspended && (u.SuspendedUntil == nil || time.Now().Before(*u.SuspendedUntil))
+}
+
+// Blocked 账户当前是否不可登录（禁用、停用、待审核或待确认邮箱）
+func (u *User) Blocked() bool {
+	return u.IsSuspended() || u.Status == StatusDeactivated || u.Status == StatusPending || u.Status == StatusUnconfirmed
+}
+
+// SuspensionExpired 临时禁用是否已到期
+func (u *User) SuspensionExpired() bool {
+	return u.Status == StatusSuspended && u.SuspendedUntil != nil && !time.Now().Before(*u.SuspendedUntil)
+}
@@ -14,12 +14,21 @@ type UserAuthorized struct {
 	Scope         pq.StringArray `gorm:"type:varchar(255)[]"`
 	PermissionRaw string
 	Permission    map[string]bool `gorm:"-"`
+	// WithheldClaims 用户在已授权的 scope 中拒绝提供的 claims
+	WithheldClaims pq.StringArray `gorm:"type:varchar(255)[]"`
+	// RememberUntil 用户的同意记住到何时，之后再次授权需要重新同意；为空时一直记住
+	RememberUntil *time.Time
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 
 	User User
 }
 
+// ConsentExpired 用户的同意是否已过了记住的期限
+func (ua *UserAuthorized) ConsentExpired() bool {
+	return ua.RememberUntil != nil && !ua.RememberUntil.After(time.Now())
+}
+
 // AfterFind 解码用户授权
 func (ua *UserAuthorized) AfterFind() error {
 	json.Unmarshal([]byte(ua.PermissionRaw), &ua.Permission)
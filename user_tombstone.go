@@ -0,0 +1,11 @@
+package ucenter
+
+import (
+	"time"
+)
+
+// UserTombstone 已删除用户的墓碑，保证签发过的 sub 不会被重新分配
+type UserTombstone struct {
+	UserID    uint `gorm:"primary_key;auto_increment:false"`
+	CreatedAt time.Time
+}